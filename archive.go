@@ -0,0 +1,634 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+// The store archives written by Export are gzipped tar files holding
+// the following members, in order:
+//
+//	manifest.json       - Format version, and size and SHA256 of the other members
+//	charms.bson         - Charm documents
+//	bundles.bson        - Bundle documents
+//	events.bson         - Charm events
+//	channels.bson       - Revisions released in each channel
+//	promulgations.bson  - Promulgated charm names
+//	counters.bson       - Statistics counters, if exported
+//	blobs/<sha256>      - Charm and bundle archives, named after their SHA256
+//
+// The .bson members hold a sequence of BSON documents.
+
+// archiveFormat holds the version of the store archive format.
+const archiveFormat = 1
+
+const archiveManifest = "manifest.json"
+
+const archiveBlobPrefix = "blobs/"
+
+// archiveManifestDoc is the content of the manifest.json member
+// of a store archive.
+type archiveManifestDoc struct {
+	Format  int           `json:"format"`
+	Created time.Time     `json:"created"`
+	Files   []archiveFile `json:"files"`
+}
+
+type archiveFile struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	Sha256 string `json:"sha256"`
+}
+
+// archiveCounterDoc represents a statistics counter in a store
+// archive. The key is held as words, since the token ids used in
+// the keys stored in MongoDB are specific to each store.
+type archiveCounterDoc struct {
+	Key   []string
+	Time  int32
+	Count int64
+}
+
+// ExportOptions holds options for exporting a store.
+type ExportOptions struct {
+	// Stats specifies that the statistics counters are exported.
+	Stats bool
+}
+
+// ArchiveReport holds the number of entries of each kind
+// exported to or imported from a store archive.
+type ArchiveReport struct {
+	Charms        int
+	Bundles       int
+	Events        int
+	Channels      int
+	Promulgations int
+	Counters      int
+
+	// Existing holds the number of charms and bundles which were
+	// not imported because they are present in the store already.
+	Existing int
+
+	// Conflicts holds the URLs, with revision, of the charms and
+	// bundles which were not imported because a different entry
+	// is stored at the same URL and revision.
+	Conflicts []string
+}
+
+// String returns a one line summary of the report.
+func (r *ArchiveReport) String() string {
+	return fmt.Sprintf("%d charms, %d bundles, %d events, %d channel releases, %d promulgations, %d counters",
+		r.Charms, r.Bundles, r.Events, r.Channels, r.Promulgations, r.Counters)
+}
+
+// Export writes to w an archive of the charms and bundles in the
+// store, including their archives, along with the charm events, the
+// channel releases, the promulgations and, if opts.Stats is set, the
+// statistics counters. The archive may be loaded into another store
+// with Import. opts may be nil to use the defaults.
+func (s *Store) Export(w io.Writer, opts *ExportOptions) (*ArchiveReport, error) {
+	if opts == nil {
+		opts = &ExportOptions{}
+	}
+	session := s.session.Copy()
+	defer session.Close()
+
+	report := &ArchiveReport{}
+	manifest := &archiveManifestDoc{
+		Format:  archiveFormat,
+		Created: time.Now().UTC(),
+	}
+	members := make(map[string][]byte)
+	addMember := func(name string, data []byte) {
+		sum := sha256.Sum256(data)
+		manifest.Files = append(manifest.Files, archiveFile{name, int64(len(data)), hex.EncodeToString(sum[:])})
+		members[name] = data
+	}
+
+	// Blobs are recorded in the order the documents referring to them are found.
+	var blobs []archiveFile
+	blobIds := make(map[string]bson.ObjectId)
+	collections := []struct {
+		name  string
+		c     *mgo.Collection
+		count *int
+		blobs bool
+	}{
+		{"charms.bson", session.Charms(), &report.Charms, true},
+		{"bundles.bson", session.Bundles(), &report.Bundles, true},
+		{"events.bson", session.Events(), &report.Events, false},
+		{"channels.bson", session.Channels(), &report.Channels, false},
+		{"promulgations.bson", session.Promulgations(), &report.Promulgations, false},
+	}
+	for _, coll := range collections {
+		var buf bytes.Buffer
+		iter := coll.c.Find(nil).Sort("_id").Iter()
+		var doc bson.Raw
+		for iter.Next(&doc) {
+			buf.Write(doc.Data)
+			*coll.count++
+			if !coll.blobs {
+				continue
+			}
+			var blob struct {
+				Sha256 string
+				Size   int64
+				FileId bson.ObjectId
+			}
+			if err := doc.Unmarshal(&blob); err != nil {
+				return nil, err
+			}
+			if _, ok := blobIds[blob.Sha256]; !ok {
+				blobIds[blob.Sha256] = blob.FileId
+				blobs = append(blobs, archiveFile{archiveBlobPrefix + blob.Sha256, blob.Size, blob.Sha256})
+			}
+		}
+		if err := iter.Close(); err != nil {
+			return nil, err
+		}
+		addMember(coll.name, buf.Bytes())
+	}
+	if opts.Stats {
+		data, n, err := s.exportCounters(session)
+		if err != nil {
+			return nil, err
+		}
+		report.Counters = n
+		addMember("counters.bson", data)
+	}
+	manifest.Files = append(manifest.Files, blobs...)
+
+	gzw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gzw)
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := writeArchiveMember(tw, archiveManifest, int64(len(data)), bytes.NewReader(data)); err != nil {
+		return nil, err
+	}
+	for _, f := range manifest.Files {
+		if !strings.HasPrefix(f.Name, archiveBlobPrefix) {
+			data := members[f.Name]
+			if err := writeArchiveMember(tw, f.Name, f.Size, bytes.NewReader(data)); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		file, err := session.CharmFS().OpenId(blobIds[f.Sha256])
+		if err != nil {
+			return nil, fmt.Errorf("cannot open archive with SHA256 %s: %v", f.Sha256, err)
+		}
+		err = writeArchiveMember(tw, f.Name, f.Size, file)
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gzw.Close(); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+func writeArchiveMember(tw *tar.Writer, name string, size int64, r io.Reader) error {
+	hdr := &tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    size,
+		ModTime: time.Now(),
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	n, err := io.Copy(tw, r)
+	if err != nil {
+		return fmt.Errorf("cannot write %s to archive: %v", name, err)
+	}
+	if n != size {
+		return fmt.Errorf("cannot write %s to archive: got %d bytes, expected %d", name, n, size)
+	}
+	return nil
+}
+
+// exportCounters returns the statistics counters in the
+// store as a sequence of BSON archiveCounterDoc documents.
+func (s *Store) exportCounters(session *storeSession) ([]byte, int, error) {
+	tokens := make(map[int]string)
+	var t tokenId
+	iter := session.StatTokens().Find(nil).Iter()
+	for iter.Next(&t) {
+		tokens[t.Id] = t.Token
+	}
+	if err := iter.Close(); err != nil {
+		return nil, 0, err
+	}
+	var buf bytes.Buffer
+	var counter struct {
+		Key   string `bson:"k"`
+		Time  int32  `bson:"t"`
+		Count int64  `bson:"c"`
+	}
+	n := 0
+	iter = session.StatCounters().Find(nil).Sort("k", "t").Iter()
+	for iter.Next(&counter) {
+		doc := archiveCounterDoc{Time: counter.Time, Count: counter.Count}
+		for _, id := range strings.Split(strings.TrimSuffix(counter.Key, ":"), ":") {
+			v, err := strconv.ParseInt(id, 32, 64)
+			token, ok := tokens[int(v)]
+			if err != nil || !ok {
+				return nil, 0, fmt.Errorf("internal error: bad counter key: %q", counter.Key)
+			}
+			doc.Key = append(doc.Key, token)
+		}
+		data, err := bson.Marshal(&doc)
+		if err != nil {
+			return nil, 0, err
+		}
+		buf.Write(data)
+		n++
+	}
+	if err := iter.Close(); err != nil {
+		return nil, 0, err
+	}
+	return buf.Bytes(), n, nil
+}
+
+// ConflictPolicy specifies how Import handles charms and bundles
+// stored at the same URL and revision as a different archived one.
+type ConflictPolicy string
+
+const (
+	// ConflictFail makes the import fail before changing
+	// the store if any conflict is found.
+	ConflictFail ConflictPolicy = "fail"
+
+	// ConflictSkip keeps the entries in the store, skipping
+	// the conflicting ones in the archive.
+	ConflictSkip ConflictPolicy = "skip"
+)
+
+// ParseConflictPolicy returns the conflict policy with the given name.
+func ParseConflictPolicy(name string) (ConflictPolicy, error) {
+	switch policy := ConflictPolicy(name); policy {
+	case ConflictFail, ConflictSkip:
+		return policy, nil
+	}
+	return "", fmt.Errorf("unknown conflict policy %q", name)
+}
+
+// ImportOptions holds options for importing a store archive.
+type ImportOptions struct {
+	// OnConflict specifies how conflicting charms and bundles
+	// are handled. If empty, ConflictFail is used.
+	OnConflict ConflictPolicy
+}
+
+// archiveEntryDoc holds the fields of the charm and bundle documents
+// in a store archive needed to import them.
+type archiveEntryDoc struct {
+	URLs     []string
+	Revision int
+	Sha256   string
+}
+
+// importEntry holds a charm or bundle document to be imported.
+type importEntry struct {
+	coll *mgo.Collection
+	doc  bson.M
+	urls []string
+}
+
+// Import loads into the store an archive written by Export. The
+// archive is verified against the checksums in its manifest while
+// being read. Charms and bundles already in the store are left
+// untouched, and when only some of the URLs of an archived entry are
+// in the store, the entry is imported at the remaining URLs. Entries
+// whose URL and revision are associated with a different archive in
+// the store are handled according to opts.OnConflict. Events, channel
+// releases and promulgations already in the store are kept, while
+// archived statistics counters are added to the existing ones.
+// opts may be nil to use the defaults.
+//
+// An import that fails part way through may be run again: the entries
+// already imported are then reported as existing, and the counters
+// already added from the archive are skipped. The archives of the
+// charms and bundles imported before the failure are kept.
+func (s *Store) Import(r io.Reader, opts *ImportOptions) (report *ArchiveReport, err error) {
+	if opts == nil {
+		opts = &ImportOptions{}
+	}
+	if opts.OnConflict == "" {
+		opts.OnConflict = ConflictFail
+	}
+	session := s.session.Copy()
+	defer session.Close()
+
+	gzr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read store archive: %v", err)
+	}
+	tr := tar.NewReader(gzr)
+	hdr, err := tr.Next()
+	if err != nil || hdr.Name != archiveManifest {
+		return nil, fmt.Errorf("cannot read store archive: missing %s", archiveManifest)
+	}
+	var manifest archiveManifestDoc
+	if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("cannot read store archive manifest: %v", err)
+	}
+	if manifest.Format != archiveFormat {
+		return nil, fmt.Errorf("unsupported store archive format %d", manifest.Format)
+	}
+	files := make(map[string]archiveFile)
+	for _, f := range manifest.Files {
+		files[f.Name] = f
+	}
+
+	// The documents are read first, so that the needed archives are known
+	// and conflicts can be found before the store is changed.
+	members := make(map[string][]byte)
+	for hdr, err = tr.Next(); err == nil && !strings.HasPrefix(hdr.Name, archiveBlobPrefix); hdr, err = tr.Next() {
+		f, ok := files[hdr.Name]
+		if !ok {
+			return nil, fmt.Errorf("cannot read store archive: unexpected member %s", hdr.Name)
+		}
+		data, readErr := ioutil.ReadAll(tr)
+		if readErr != nil {
+			return nil, fmt.Errorf("cannot read %s from store archive: %v", hdr.Name, readErr)
+		}
+		if verifyErr := f.verify(data); verifyErr != nil {
+			return nil, verifyErr
+		}
+		members[hdr.Name] = data
+	}
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("cannot read store archive: %v", err)
+	}
+	for _, f := range manifest.Files {
+		if _, ok := members[f.Name]; !ok && !strings.HasPrefix(f.Name, archiveBlobPrefix) {
+			return nil, fmt.Errorf("cannot read store archive: missing %s", f.Name)
+		}
+	}
+
+	report = &ArchiveReport{}
+	var entries []importEntry
+	needed := make(map[string]bool)
+	for _, coll := range []struct {
+		name  string
+		c     *mgo.Collection
+		count *int
+	}{
+		{"charms.bson", session.Charms(), &report.Charms},
+		{"bundles.bson", session.Bundles(), &report.Bundles},
+	} {
+		err := eachArchiveDoc(members[coll.name], func(raw bson.Raw) error {
+			entry, err := planImport(coll.c, raw, report)
+			if entry == nil || err != nil {
+				return err
+			}
+			entries = append(entries, *entry)
+			needed[entry.doc["sha256"].(string)] = true
+			*coll.count++
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(report.Conflicts) > 0 && opts.OnConflict == ConflictFail {
+		return nil, fmt.Errorf("cannot import store archive: %d conflicting entries, including %s", len(report.Conflicts), report.Conflicts[0])
+	}
+
+	// Store the needed archives. If the import fails, the ones not
+	// referred to by any imported charm or bundle are removed again.
+	fileIds := make(map[string]interface{})
+	referenced := make(map[string]bool)
+	defer func() {
+		if err != nil {
+			for sha256, id := range fileIds {
+				if !referenced[sha256] {
+					session.CharmFS().RemoveId(id)
+				}
+			}
+		}
+	}()
+	for ; err == nil; hdr, err = tr.Next() {
+		f, ok := files[hdr.Name]
+		if !ok || !strings.HasPrefix(hdr.Name, archiveBlobPrefix) {
+			return nil, fmt.Errorf("cannot read store archive: unexpected member %s", hdr.Name)
+		}
+		if needed[f.Sha256] && fileIds[f.Sha256] == nil {
+			id, blobErr := importBlob(session, f, tr)
+			if blobErr != nil {
+				return nil, blobErr
+			}
+			fileIds[f.Sha256] = id
+		}
+	}
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("cannot read store archive: %v", err)
+	}
+	for sha256 := range needed {
+		if fileIds[sha256] == nil {
+			return nil, fmt.Errorf("cannot read store archive: missing archive with SHA256 %s", sha256)
+		}
+	}
+
+	for _, entry := range entries {
+		sha256 := entry.doc["sha256"].(string)
+		entry.doc["fileid"] = fileIds[sha256]
+		if err := entry.coll.Insert(entry.doc); err != nil {
+			return nil, maybeConflict(err)
+		}
+		referenced[sha256] = true
+	}
+	// Imported events keep their time but get new sequence numbers, so
+	// that clients polling for new events see them.
+	events := session.Events()
+	err = eachArchiveDoc(members["events.bson"], func(raw bson.Raw) error {
+		var doc bson.D
+		if err := raw.Unmarshal(&doc); err != nil {
+			return err
+		}
+		for i, elem := range doc {
+			if elem.Name == "seq" {
+				doc = append(doc[:i], doc[i+1:]...)
+				break
+			}
+		}
+		err := insertEvent(events, func(seq int64) error {
+			return events.Insert(append(doc, bson.DocElem{"seq", seq}))
+		})
+		if mgo.IsDup(err) {
+			return nil
+		}
+		if err == nil {
+			report.Events++
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, coll := range []struct {
+		name  string
+		c     *mgo.Collection
+		count *int
+	}{
+		{"channels.bson", session.Channels(), &report.Channels},
+		{"promulgations.bson", session.Promulgations(), &report.Promulgations},
+	} {
+		err := eachArchiveDoc(members[coll.name], func(raw bson.Raw) error {
+			err := coll.c.Insert(raw)
+			if mgo.IsDup(err) {
+				return nil
+			}
+			if err == nil {
+				*coll.count++
+			}
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	// Each counter records the archives its count was imported from,
+	// identified by their creation time, so that importing an archive
+	// again doesn't add the same counts twice. The upsert fails with
+	// a duplicate key error when the counter exists and the archive
+	// was already imported.
+	importId := manifest.Created.UTC().Format(time.RFC3339Nano)
+	err = eachArchiveDoc(members["counters.bson"], func(raw bson.Raw) error {
+		var doc archiveCounterDoc
+		if err := raw.Unmarshal(&doc); err != nil {
+			return err
+		}
+		skey, err := s.statsKey(session, doc.Key, true)
+		if err != nil {
+			return err
+		}
+		_, err = session.StatCounters().Upsert(
+			bson.D{{"k", skey}, {"t", doc.Time}, {"imports", bson.D{{"$ne", importId}}}},
+			bson.D{{"$inc", bson.D{{"c", doc.Count}}}, {"$push", bson.D{{"imports", importId}}}},
+		)
+		if mgo.IsDup(err) {
+			return nil
+		}
+		if err == nil {
+			report.Counters++
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// planImport returns the entry for importing the charm or bundle
+// document raw into coll, or nil if it must not be imported, in which
+// case report is updated accordingly.
+func planImport(coll *mgo.Collection, raw bson.Raw, report *ArchiveReport) (*importEntry, error) {
+	var adoc archiveEntryDoc
+	if err := raw.Unmarshal(&adoc); err != nil {
+		return nil, err
+	}
+	var missing []string
+	for _, url := range adoc.URLs {
+		var existing archiveEntryDoc
+		err := coll.Find(bson.D{{"urls", url}, {"revision", adoc.Revision}}).One(&existing)
+		if err == mgo.ErrNotFound {
+			missing = append(missing, url)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if existing.Sha256 != adoc.Sha256 {
+			report.Conflicts = append(report.Conflicts, fmt.Sprintf("%s-%d", url, adoc.Revision))
+			return nil, nil
+		}
+	}
+	if len(missing) == 0 {
+		report.Existing++
+		return nil, nil
+	}
+	var doc bson.M
+	if err := raw.Unmarshal(&doc); err != nil {
+		return nil, err
+	}
+	delete(doc, "_id")
+	doc["urls"] = missing
+	return &importEntry{coll, doc, missing}, nil
+}
+
+// importBlob stores in the charms GridFS the archive
+// described by f, read from r.
+func importBlob(session *storeSession, f archiveFile, r io.Reader) (interface{}, error) {
+	file, err := session.CharmFS().Create("")
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(file, h), r)
+	if err == nil && (n != f.Size || hex.EncodeToString(h.Sum(nil)) != f.Sha256) {
+		err = fmt.Errorf("cannot read store archive: checksum mismatch for %s", f.Name)
+	}
+	if err != nil {
+		file.Close()
+		session.CharmFS().RemoveId(file.Id())
+		return nil, err
+	}
+	if err := file.Close(); err != nil {
+		return nil, err
+	}
+	return file.Id(), nil
+}
+
+// verify returns an error if data doesn't match
+// the size and checksum of f.
+func (f archiveFile) verify(data []byte) error {
+	sum := sha256.Sum256(data)
+	if int64(len(data)) != f.Size || hex.EncodeToString(sum[:]) != f.Sha256 {
+		return fmt.Errorf("cannot read store archive: checksum mismatch for %s", f.Name)
+	}
+	return nil
+}
+
+// eachArchiveDoc calls f for each of the BSON documents in data.
+func eachArchiveDoc(data []byte, f func(bson.Raw) error) error {
+	for len(data) > 0 {
+		if len(data) < 4 {
+			return fmt.Errorf("cannot read store archive: truncated document")
+		}
+		size := int(data[0]) | int(data[1])<<8 | int(data[2])<<16 | int(data[3])<<24
+		if size < 5 || size > len(data) {
+			return fmt.Errorf("cannot read store archive: invalid document size %d", size)
+		}
+		if err := f(bson.Raw{Kind: 3, Data: data[:size]}); err != nil {
+			return err
+		}
+		data = data[size:]
+	}
+	return nil
+}
@@ -0,0 +1,276 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/juju/charm"
+	gitjujutesting "github.com/juju/testing"
+	"labix.org/v2/mgo/bson"
+	gc "launchpad.net/gocheck"
+
+	"github.com/juju/charmstore"
+)
+
+// openImportStore returns an empty store held in a separate database.
+func openImportStore(c *gc.C) *charmstore.Store {
+	store, err := charmstore.OpenDB(gitjujutesting.MgoServer.Addr(), "juju-import")
+	c.Assert(err, gc.IsNil)
+	return store
+}
+
+// readCharm returns the information on the charm at url
+// in store and its archive.
+func readCharm(c *gc.C, store *charmstore.Store, url string) (*charmstore.CharmInfo, []byte) {
+	info, rc, err := store.OpenCharm(charm.MustParseURL(url))
+	c.Assert(err, gc.IsNil)
+	defer rc.Close()
+	data, err := ioutil.ReadAll(rc)
+	c.Assert(err, gc.IsNil)
+	return info, data
+}
+
+func (s *StoreSuite) TestExportImport(c *gc.C) {
+	publishDummy(c, s.store, "digest-0", "cs:precise/dummy", "cs:~joe/precise/dummy")
+	publishDummy(c, s.store, "digest-1", "cs:precise/dummy")
+	err := s.store.IncCounter([]string{"a", "b"})
+	c.Assert(err, gc.IsNil)
+
+	var buf bytes.Buffer
+	report, err := s.store.Export(&buf, &charmstore.ExportOptions{Stats: true})
+	c.Assert(err, gc.IsNil)
+	c.Assert(report.String(), gc.Equals, "2 charms, 0 bundles, 2 events, 0 channel releases, 0 promulgations, 1 counters")
+
+	store := openImportStore(c)
+	defer store.Close()
+	report, err = store.Import(bytes.NewReader(buf.Bytes()), nil)
+	c.Assert(err, gc.IsNil)
+	c.Assert(report.String(), gc.Equals, "2 charms, 0 bundles, 2 events, 0 channel releases, 0 promulgations, 1 counters")
+
+	for _, url := range []string{"cs:precise/dummy-0", "cs:~joe/precise/dummy-0", "cs:precise/dummy-1"} {
+		info, data := readCharm(c, s.store, url)
+		imported, importedData := readCharm(c, store, url)
+		c.Assert(imported.Revision(), gc.Equals, info.Revision())
+		c.Assert(imported.Digest(), gc.Equals, info.Digest())
+		c.Assert(imported.BundleSha256(), gc.Equals, info.BundleSha256())
+		c.Assert(imported.Meta(), gc.DeepEquals, info.Meta())
+		c.Assert(importedData, gc.DeepEquals, data)
+	}
+
+	event, err := store.CharmEvent(charm.MustParseURL("cs:precise/dummy"), "digest-1")
+	c.Assert(err, gc.IsNil)
+	c.Assert(event.Revision, gc.Equals, 1)
+
+	if !*noTestMongoJs {
+		counters, err := store.Counters(&charmstore.CounterRequest{Key: []string{"a", "b"}})
+		c.Assert(err, gc.IsNil)
+		c.Assert(counters[0].Count, gc.Equals, int64(1))
+	}
+
+	// Importing the archive again leaves the store unchanged.
+	report, err = store.Import(bytes.NewReader(buf.Bytes()), nil)
+	c.Assert(err, gc.IsNil)
+	c.Assert(report.Charms, gc.Equals, 0)
+	c.Assert(report.Events, gc.Equals, 0)
+	c.Assert(report.Counters, gc.Equals, 0)
+	c.Assert(report.Existing, gc.Equals, 2)
+	if !*noTestMongoJs {
+		counters, err := store.Counters(&charmstore.CounterRequest{Key: []string{"a", "b"}})
+		c.Assert(err, gc.IsNil)
+		c.Assert(counters[0].Count, gc.Equals, int64(1))
+	}
+}
+
+func (s *StoreSuite) TestImportedEventsFollowPolledEvents(c *gc.C) {
+	publishDummy(c, s.store, "digest-0", "cs:precise/dummy")
+	var buf bytes.Buffer
+	_, err := s.store.Export(&buf, nil)
+	c.Assert(err, gc.IsNil)
+
+	store := openImportStore(c)
+	defer store.Close()
+	publishDummy(c, store, "digest-1", "cs:precise/other")
+	polled, err := store.Events(&charmstore.EventsRequest{})
+	c.Assert(err, gc.IsNil)
+	c.Assert(polled, gc.HasLen, 1)
+
+	// The imported event is older than the polled one, but
+	// clients polling for new events see it.
+	_, err = store.Import(bytes.NewReader(buf.Bytes()), nil)
+	c.Assert(err, gc.IsNil)
+	events, err := store.Events(&charmstore.EventsRequest{AfterId: polled[0].Id})
+	c.Assert(err, gc.IsNil)
+	c.Assert(eventDigests(events), gc.DeepEquals, []string{"published digest-0"})
+}
+
+func (s *StoreSuite) TestImportAfterPartialFailure(c *gc.C) {
+	publishDummy(c, s.store, "digest-0", "cs:precise/dummy")
+	err := s.store.IncCounter([]string{"a", "b"})
+	c.Assert(err, gc.IsNil)
+	var buf bytes.Buffer
+	_, err = s.store.Export(&buf, &charmstore.ExportOptions{Stats: true})
+	c.Assert(err, gc.IsNil)
+
+	// Make the import fail after the charm and the first counter
+	// are imported, by adding an invalid counter to the archive.
+	var counters []byte
+	rewriteArchive(c, buf.Bytes(), func(name string, data []byte) []byte {
+		if name == "counters.bson" {
+			counters = data
+		}
+		return data
+	})
+	bad, err := bson.Marshal(bson.D{{"key", []string{}}, {"time", 0}, {"count", 1}})
+	c.Assert(err, gc.IsNil)
+	counters = append(counters, bad...)
+	corrupt := rewriteArchive(c, buf.Bytes(), func(name string, data []byte) []byte {
+		switch name {
+		case "manifest.json":
+			var manifest struct {
+				Format  int       `json:"format"`
+				Created time.Time `json:"created"`
+				Files   []struct {
+					Name   string `json:"name"`
+					Size   int64  `json:"size"`
+					Sha256 string `json:"sha256"`
+				} `json:"files"`
+			}
+			err := json.Unmarshal(data, &manifest)
+			c.Assert(err, gc.IsNil)
+			for i, f := range manifest.Files {
+				if f.Name == "counters.bson" {
+					sum := sha256.Sum256(counters)
+					manifest.Files[i].Size = int64(len(counters))
+					manifest.Files[i].Sha256 = hex.EncodeToString(sum[:])
+				}
+			}
+			data, err = json.Marshal(&manifest)
+			c.Assert(err, gc.IsNil)
+		case "counters.bson":
+			data = counters
+		}
+		return data
+	})
+
+	store := openImportStore(c)
+	defer store.Close()
+	_, err = store.Import(bytes.NewReader(corrupt), nil)
+	c.Assert(err, gc.ErrorMatches, "store: empty statistics key")
+
+	// The archive of the imported charm is kept.
+	info, data := readCharm(c, store, "cs:precise/dummy-0")
+	c.Assert(info.Digest(), gc.Equals, "digest-0")
+	c.Assert(data, gc.HasLen, int(info.BundleSize()))
+
+	// Running the import again doesn't count the statistics twice.
+	report, err := store.Import(bytes.NewReader(buf.Bytes()), nil)
+	c.Assert(err, gc.IsNil)
+	c.Assert(report.Existing, gc.Equals, 1)
+	c.Assert(report.Counters, gc.Equals, 0)
+	if !*noTestMongoJs {
+		counters, err := store.Counters(&charmstore.CounterRequest{Key: []string{"a", "b"}})
+		c.Assert(err, gc.IsNil)
+		c.Assert(counters[0].Count, gc.Equals, int64(1))
+	}
+}
+
+func (s *StoreSuite) TestImportConflicts(c *gc.C) {
+	publishDummy(c, s.store, "digest-0", "cs:precise/dummy")
+	publishDummy(c, s.store, "digest-0", "cs:precise/other")
+	var buf bytes.Buffer
+	_, err := s.store.Export(&buf, nil)
+	c.Assert(err, gc.IsNil)
+
+	store := openImportStore(c)
+	defer store.Close()
+	pub, err := store.CharmPublisher([]*charm.URL{charm.MustParseURL("cs:precise/dummy")}, "local-digest")
+	c.Assert(err, gc.IsNil)
+	err = pub.Publish(&FakeCharmDir{})
+	c.Assert(err, gc.IsNil)
+
+	_, err = store.Import(bytes.NewReader(buf.Bytes()), nil)
+	c.Assert(err, gc.ErrorMatches, "cannot import store archive: 1 conflicting entries, including cs:precise/dummy-0")
+	_, err = store.CharmInfo(charm.MustParseURL("cs:precise/other"))
+	c.Assert(err, gc.Equals, charmstore.ErrNotFound)
+
+	report, err := store.Import(bytes.NewReader(buf.Bytes()), &charmstore.ImportOptions{OnConflict: charmstore.ConflictSkip})
+	c.Assert(err, gc.IsNil)
+	c.Assert(report.Charms, gc.Equals, 1)
+	c.Assert(report.Conflicts, gc.DeepEquals, []string{"cs:precise/dummy-0"})
+	info, err := store.CharmInfo(charm.MustParseURL("cs:precise/dummy"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(info.Digest(), gc.Equals, "local-digest")
+	info, err = store.CharmInfo(charm.MustParseURL("cs:precise/other"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(info.Digest(), gc.Equals, "digest-0")
+}
+
+// rewriteArchive returns the store archive data with the
+// members changed by f.
+func rewriteArchive(c *gc.C, data []byte, f func(name string, data []byte) []byte) []byte {
+	gzr, err := gzip.NewReader(bytes.NewReader(data))
+	c.Assert(err, gc.IsNil)
+	tr := tar.NewReader(gzr)
+	var buf bytes.Buffer
+	gzw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gzw)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		c.Assert(err, gc.IsNil)
+		data, err := ioutil.ReadAll(tr)
+		c.Assert(err, gc.IsNil)
+		data = f(hdr.Name, data)
+		hdr.Size = int64(len(data))
+		err = tw.WriteHeader(hdr)
+		c.Assert(err, gc.IsNil)
+		_, err = tw.Write(data)
+		c.Assert(err, gc.IsNil)
+	}
+	c.Assert(tw.Close(), gc.IsNil)
+	c.Assert(gzw.Close(), gc.IsNil)
+	return buf.Bytes()
+}
+
+func (s *StoreSuite) TestImportVerifiesChecksums(c *gc.C) {
+	publishDummy(c, s.store, "digest-0", "cs:precise/dummy")
+	var buf bytes.Buffer
+	_, err := s.store.Export(&buf, nil)
+	c.Assert(err, gc.IsNil)
+
+	store := openImportStore(c)
+	defer store.Close()
+
+	corrupt := rewriteArchive(c, buf.Bytes(), func(name string, data []byte) []byte {
+		if strings.HasPrefix(name, "blobs/") {
+			data[len(data)/2] ^= 0xff
+		}
+		return data
+	})
+	_, err = store.Import(bytes.NewReader(corrupt), nil)
+	c.Assert(err, gc.ErrorMatches, "cannot read store archive: checksum mismatch for blobs/[0-9a-f]+")
+	_, err = store.CharmInfo(charm.MustParseURL("cs:precise/dummy"))
+	c.Assert(err, gc.Equals, charmstore.ErrNotFound)
+
+	corrupt = rewriteArchive(c, buf.Bytes(), func(name string, data []byte) []byte {
+		if name == "events.bson" {
+			return data[:len(data)-1]
+		}
+		return data
+	})
+	_, err = store.Import(bytes.NewReader(corrupt), nil)
+	c.Assert(err, gc.ErrorMatches, "cannot read store archive: checksum mismatch for events.bson")
+}
@@ -0,0 +1,676 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore_test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"time"
+
+	"github.com/juju/charm"
+	charmtesting "github.com/juju/charm/testing"
+	gitjujutesting "github.com/juju/testing"
+	gc "launchpad.net/gocheck"
+
+	"github.com/juju/charmstore"
+)
+
+// BackendSuite holds the conformance tests that every
+// charmstore.Backend implementation must pass. It's embedded
+// in a suite for each implementation, which sets open.
+type BackendSuite struct {
+	open    func(c *gc.C) charmstore.Backend
+	backend charmstore.Backend
+
+	// needsJs reports whether the counter
+	// queries require MongoDB Javascript.
+	needsJs bool
+}
+
+func (s *BackendSuite) SetUpTest(c *gc.C) {
+	s.backend = s.open(c)
+}
+
+func (s *BackendSuite) TearDownTest(c *gc.C) {
+	if s.backend != nil {
+		s.backend.Close()
+	}
+}
+
+var _ = gc.Suite(&MongoBackendSuite{})
+
+type MongoBackendSuite struct {
+	gitjujutesting.MgoSuite
+	BackendSuite
+}
+
+func (s *MongoBackendSuite) SetUpSuite(c *gc.C) {
+	s.MgoSuite.SetUpSuite(c)
+	if os.Getenv("JUJU_NOTEST_MONGOJS") == "1" || gitjujutesting.MgoServer.WithoutV8 {
+		*noTestMongoJs = true
+	}
+	s.needsJs = true
+	s.open = func(c *gc.C) charmstore.Backend {
+		store, err := charmstore.Open(gitjujutesting.MgoServer.Addr())
+		c.Assert(err, gc.IsNil)
+		return store
+	}
+}
+
+func (s *MongoBackendSuite) SetUpTest(c *gc.C) {
+	s.MgoSuite.SetUpTest(c)
+	s.BackendSuite.SetUpTest(c)
+}
+
+func (s *MongoBackendSuite) TearDownTest(c *gc.C) {
+	s.BackendSuite.TearDownTest(c)
+	s.MgoSuite.TearDownTest(c)
+}
+
+var _ = gc.Suite(&MemBackendSuite{})
+
+type MemBackendSuite struct {
+	BackendSuite
+}
+
+func (s *MemBackendSuite) SetUpSuite(c *gc.C) {
+	s.open = func(c *gc.C) charmstore.Backend {
+		return charmstore.NewMemStore()
+	}
+}
+
+// publish publishes ch at urls in the backend with the
+// given digest, and returns the published revision.
+func (s *BackendSuite) publish(c *gc.C, ch charmstore.CharmDir, digest string, urls ...*charm.URL) int {
+	pub, err := s.backend.CharmPublisher(urls, digest)
+	c.Assert(err, gc.IsNil)
+	err = pub.Publish(ch)
+	c.Assert(err, gc.IsNil)
+	return pub.Revision()
+}
+
+func (s *BackendSuite) TestCharmPublisher(c *gc.C) {
+	urls := []*charm.URL{
+		charm.MustParseURL("cs:oneiric/wordpress-a"),
+		charm.MustParseURL("cs:oneiric/wordpress-b"),
+	}
+	rev := s.publish(c, charmtesting.Charms.ClonedDir(c.MkDir(), "dummy"), "some-digest", urls...)
+	c.Assert(rev, gc.Equals, 0)
+
+	for _, url := range urls {
+		info, rc, err := s.backend.OpenCharm(url)
+		c.Assert(err, gc.IsNil)
+		data, err := ioutil.ReadAll(rc)
+		c.Assert(err, gc.IsNil)
+		c.Assert(rc.Close(), gc.IsNil)
+		bundle, err := charm.ReadBundleBytes(data)
+		c.Assert(err, gc.IsNil)
+		c.Assert(bundle.Meta().Name, gc.Equals, "dummy")
+
+		hash := sha256.Sum256(data)
+		c.Assert(info.Revision(), gc.Equals, 0)
+		c.Assert(info.Digest(), gc.Equals, "some-digest")
+		c.Assert(info.BundleSha256(), gc.Equals, hex.EncodeToString(hash[:]))
+		c.Assert(info.BundleSize(), gc.Equals, int64(len(data)))
+		c.Assert(info.Meta().Name, gc.Equals, "dummy")
+		c.Assert(info.Config().Options["title"].Default, gc.Equals, "My Title")
+
+		info2, err := s.backend.CharmInfo(url)
+		c.Assert(err, gc.IsNil)
+		c.Assert(info2, gc.DeepEquals, info)
+	}
+}
+
+func (s *BackendSuite) TestCharmPublisherWithRevisionedURL(c *gc.C) {
+	urls := []*charm.URL{charm.MustParseURL("cs:oneiric/wordpress-0")}
+	pub, err := s.backend.CharmPublisher(urls, "some-digest")
+	c.Assert(err, gc.ErrorMatches, "CharmPublisher: got charm URL with revision: cs:oneiric/wordpress-0")
+	c.Assert(pub, gc.IsNil)
+}
+
+func (s *BackendSuite) TestCharmPublishError(c *gc.C) {
+	url := charm.MustParseURL("cs:oneiric/wordpress")
+	s.publish(c, &FakeCharmDir{}, "one-digest", url)
+
+	for _, when := range []string{"beforeWrite", "afterWrite"} {
+		pub, err := s.backend.CharmPublisher([]*charm.URL{url}, "another-digest")
+		c.Assert(err, gc.IsNil)
+		c.Assert(pub.Revision(), gc.Equals, 1)
+		err = pub.Publish(&FakeCharmDir{error: when})
+		c.Assert(err, gc.ErrorMatches, when)
+	}
+
+	info, err := s.backend.CharmInfo(url)
+	c.Assert(err, gc.IsNil)
+	c.Assert(info.Revision(), gc.Equals, 0)
+	c.Assert(info.Digest(), gc.Equals, "one-digest")
+	c.Assert(info.BundleSha256(), gc.Equals, fakeRevZeroSha)
+}
+
+func (s *BackendSuite) TestCharmPublishEmptyArchive(c *gc.C) {
+	url := charm.MustParseURL("cs:oneiric/wordpress")
+	pub, err := s.backend.CharmPublisher([]*charm.URL{url}, "some-digest")
+	c.Assert(err, gc.IsNil)
+	err = pub.Publish(&FakeCharmDir{error: "noWrite"})
+	c.Assert(err, gc.ErrorMatches, "cannot publish empty archive")
+	_, err = s.backend.CharmInfo(url)
+	c.Assert(err, gc.Equals, charmstore.ErrNotFound)
+}
+
+func (s *BackendSuite) TestCharmPublisherLintPolicies(c *gc.C) {
+	incomplete := &charm.Meta{Name: "fakecharm", Summary: "Fake charm."}
+	s.backend.SetLintPolicy("", charmstore.LintStrict)
+	s.backend.SetLintPolicy("joe", charmstore.LintLenient)
+
+	// Lenient policies publish the charm with warnings.
+	curl := charm.MustParseURL("cs:~joe/oneiric/fakecharm")
+	pub, err := s.backend.CharmPublisher([]*charm.URL{curl}, "some-digest")
+	c.Assert(err, gc.IsNil)
+	err = pub.Publish(&FakeCharmDir{meta: incomplete})
+	c.Assert(err, gc.IsNil)
+	c.Assert(pub.Warnings(), gc.DeepEquals, []string{"metadata: missing description"})
+	_, err = s.backend.CharmInfo(curl)
+	c.Assert(err, gc.IsNil)
+
+	// The strict policy applies if it applies to any of the URLs.
+	urls := []*charm.URL{curl, charm.MustParseURL("cs:oneiric/fakecharm")}
+	pub, err = s.backend.CharmPublisher(urls, "another-digest")
+	c.Assert(err, gc.IsNil)
+	err = pub.Publish(&FakeCharmDir{meta: incomplete})
+	c.Assert(err, gc.ErrorMatches, "charm failed lint checks: metadata: missing description")
+	lintErr, ok := err.(*charmstore.LintError)
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(lintErr.Problems, gc.DeepEquals, []string{"metadata: missing description"})
+	_, err = s.backend.CharmInfo(urls[1])
+	c.Assert(err, gc.Equals, charmstore.ErrNotFound)
+}
+
+func (s *BackendSuite) TestRevisioning(c *gc.C) {
+	urlA := charm.MustParseURL("cs:oneiric/wordpress-a")
+	urlB := charm.MustParseURL("cs:oneiric/wordpress-b")
+	tests := [][]*charm.URL{{urlA, urlB}, {urlB}, {urlA, urlB}}
+	for i, urls := range tests {
+		rev := s.publish(c, &FakeCharmDir{}, fmt.Sprintf("digest-%d", i), urls...)
+		c.Assert(rev, gc.Equals, i)
+	}
+	for i, urls := range tests {
+		for _, url := range urls {
+			info, rc, err := s.backend.OpenCharm(url.WithRevision(i))
+			c.Assert(err, gc.IsNil)
+			data, err := ioutil.ReadAll(rc)
+			c.Assert(err, gc.IsNil)
+			c.Assert(rc.Close(), gc.IsNil)
+			c.Assert(info.Revision(), gc.Equals, i)
+			c.Assert(string(data), gc.Equals, fmt.Sprintf("charm-revision-%d", i))
+		}
+	}
+	info, rc, err := s.backend.OpenCharm(urlA.WithRevision(1))
+	c.Assert(err, gc.Equals, charmstore.ErrNotFound)
+	c.Assert(info, gc.IsNil)
+	c.Assert(rc, gc.IsNil)
+
+	info, err = s.backend.CharmInfo(urlA)
+	c.Assert(err, gc.IsNil)
+	c.Assert(info.Revision(), gc.Equals, 2)
+}
+
+func (s *BackendSuite) TestRedundantUpdate(c *gc.C) {
+	urls := []*charm.URL{
+		charm.MustParseURL("cs:oneiric/wordpress-a"),
+		charm.MustParseURL("cs:oneiric/wordpress-b"),
+	}
+	s.publish(c, &FakeCharmDir{}, "digest-0", urls...)
+
+	pub, err := s.backend.CharmPublisher(urls, "digest-0")
+	c.Assert(err, gc.Equals, charmstore.ErrRedundantUpdate)
+	c.Assert(pub, gc.IsNil)
+
+	rev := s.publish(c, &FakeCharmDir{}, "digest-1", urls[1])
+	c.Assert(rev, gc.Equals, 1)
+
+	// Same digest bumps revision because one of them was old.
+	rev = s.publish(c, &FakeCharmDir{}, "digest-1", urls...)
+	c.Assert(rev, gc.Equals, 2)
+}
+
+func (s *BackendSuite) TestConflictingUpdate(c *gc.C) {
+	urls := []*charm.URL{charm.MustParseURL("cs:oneiric/wordpress")}
+	pub1, err := s.backend.CharmPublisher(urls, "some-digest")
+	c.Assert(err, gc.IsNil)
+	pub2, err := s.backend.CharmPublisher(urls, "some-digest")
+	c.Assert(err, gc.IsNil)
+
+	err = pub2.Publish(&FakeCharmDir{})
+	c.Assert(err, gc.IsNil)
+	err = pub1.Publish(&FakeCharmDir{})
+	c.Assert(err, gc.Equals, charmstore.ErrUpdateConflict)
+}
+
+func (s *BackendSuite) TestCharmInfoNotFound(c *gc.C) {
+	info, err := s.backend.CharmInfo(charm.MustParseURL("cs:oneiric/wordpress"))
+	c.Assert(err, gc.Equals, charmstore.ErrNotFound)
+	c.Assert(info, gc.IsNil)
+}
+
+func (s *BackendSuite) TestSeries(c *gc.C) {
+	for _, url := range []string{"cs:oneiric/wordpress", "cs:precise/wordpress", "cs:trusty/wordpress", "cs:~joe/quantal/wordpress", "cs:saucy/mysql"} {
+		s.publish(c, &FakeCharmDir{}, "digest", charm.MustParseURL(url))
+	}
+	series, err := s.backend.Series(charm.MustParseURL("cs:precise/wordpress").Reference)
+	c.Assert(err, gc.IsNil)
+	c.Assert(series, gc.DeepEquals, []string{"trusty", "precise", "oneiric"})
+
+	series, err = s.backend.Series(charm.MustParseURL("cs:~joe/precise/wordpress").Reference)
+	c.Assert(err, gc.IsNil)
+	c.Assert(series, gc.DeepEquals, []string{"quantal"})
+
+	series, err = s.backend.Series(charm.MustParseURL("cs:precise/missing").Reference)
+	c.Assert(err, gc.IsNil)
+	c.Assert(series, gc.HasLen, 0)
+}
+
+func (s *BackendSuite) TestDeleteCharm(c *gc.C) {
+	url := charm.MustParseURL("cs:oneiric/wordpress")
+	for i := 0; i < 4; i++ {
+		s.publish(c, &FakeCharmDir{}, fmt.Sprintf("digest-%d", i), url)
+	}
+
+	infos, err := s.backend.DeleteCharm(url.WithRevision(1), charmstore.Origin{"joe", "broken"})
+	c.Assert(err, gc.IsNil)
+	c.Assert(infos, gc.HasLen, 1)
+	c.Assert(infos[0].Revision(), gc.Equals, 1)
+	_, err = s.backend.CharmInfo(url.WithRevision(1))
+	c.Assert(err, gc.Equals, charmstore.ErrNotFound)
+	info, err := s.backend.CharmInfo(url)
+	c.Assert(err, gc.IsNil)
+	c.Assert(info.Revision(), gc.Equals, 3)
+
+	event, err := s.backend.CharmEvent(url, "digest-1")
+	c.Assert(err, gc.IsNil)
+	c.Assert(event.Kind, gc.Equals, charmstore.EventDeleted)
+	c.Assert(event.Revision, gc.Equals, 1)
+	c.Assert(event.Actor, gc.Equals, "joe")
+	c.Assert(event.Reason, gc.Equals, "broken")
+
+	infos, err = s.backend.DeleteCharm(url, charmstore.Origin{})
+	c.Assert(err, gc.IsNil)
+	var revs []int
+	for _, info := range infos {
+		revs = append(revs, info.Revision())
+	}
+	c.Assert(revs, gc.DeepEquals, []int{3, 2, 0})
+	_, err = s.backend.CharmInfo(url)
+	c.Assert(err, gc.Equals, charmstore.ErrNotFound)
+
+	_, err = s.backend.DeleteCharm(url, charmstore.Origin{})
+	c.Assert(err, gc.Equals, charmstore.ErrNotFound)
+}
+
+func (s *BackendSuite) TestLogCharmEvent(c *gc.C) {
+	url1 := charm.MustParseURL("cs:oneiric/wordpress")
+	url2 := charm.MustParseURL("cs:oneiric/mysql")
+	event1 := &charmstore.CharmEvent{
+		Kind:     charmstore.EventPublished,
+		Revision: 42,
+		Digest:   "revKey1",
+		URLs:     []*charm.URL{url1, url2},
+		Warnings: []string{"A warning."},
+		Time:     time.Unix(1, 0),
+	}
+	event2 := &charmstore.CharmEvent{
+		Kind:   charmstore.EventPublishError,
+		Digest: "revKey2",
+		Errors: []string{"An error."},
+		URLs:   []*charm.URL{url1},
+		Time:   time.Unix(2, 0),
+	}
+	for _, event := range []*charmstore.CharmEvent{event1, event2} {
+		err := s.backend.LogCharmEvent(event)
+		c.Assert(err, gc.IsNil)
+	}
+
+	event, err := s.backend.CharmEvent(url1, "")
+	c.Assert(err, gc.IsNil)
+	c.Assert(event, gc.DeepEquals, event2)
+
+	event, err = s.backend.CharmEvent(url1, "revKey1")
+	c.Assert(err, gc.IsNil)
+	c.Assert(event, gc.DeepEquals, event1)
+
+	event, err = s.backend.CharmEvent(url2, "revKey2")
+	c.Assert(err, gc.Equals, charmstore.ErrNotFound)
+	c.Assert(event, gc.IsNil)
+
+	err = s.backend.LogCharmEvent(&charmstore.CharmEvent{Kind: charmstore.EventPublished, URLs: []*charm.URL{url1}})
+	c.Assert(err, gc.ErrorMatches, "LogCharmEvent: need valid Digest for published events")
+	err = s.backend.LogCharmEvent(&charmstore.CharmEvent{Kind: charmstore.EventPublished, Digest: "x", URLs: []*charm.URL{url1.WithRevision(1)}})
+	c.Assert(err, gc.ErrorMatches, "LogCharmEvent: got charm URL with revision: cs:oneiric/wordpress-1")
+}
+
+func (s *BackendSuite) TestEvents(c *gc.C) {
+	url := charm.MustParseURL("cs:oneiric/wordpress")
+	var logged []*charmstore.CharmEvent
+	for i, kind := range []charmstore.CharmEventKind{
+		charmstore.EventPublished,
+		charmstore.EventDeleted,
+		charmstore.EventPublished,
+	} {
+		event := &charmstore.CharmEvent{
+			Kind:   kind,
+			Digest: fmt.Sprintf("digest-%d", i),
+			URLs:   []*charm.URL{url},
+			Actor:  fmt.Sprintf("actor-%d", i%2),
+			Time:   time.Unix(int64(10*i), 0),
+		}
+		err := s.backend.LogCharmEvent(event)
+		c.Assert(err, gc.IsNil)
+		logged = append(logged, event)
+	}
+
+	for i, test := range []struct {
+		req    charmstore.EventsRequest
+		expect []int
+	}{
+		{charmstore.EventsRequest{}, []int{0, 1, 2}},
+		{charmstore.EventsRequest{Since: time.Unix(10, 0)}, []int{1, 2}},
+		{charmstore.EventsRequest{AfterId: logged[0].Id}, []int{1, 2}},
+		{charmstore.EventsRequest{Kinds: []charmstore.CharmEventKind{charmstore.EventPublished}}, []int{0, 2}},
+		{charmstore.EventsRequest{Actor: "actor-1"}, []int{1}},
+		{charmstore.EventsRequest{Limit: 2}, []int{0, 1}},
+	} {
+		c.Logf("test %d: %#v", i, test.req)
+		events, err := s.backend.Events(&test.req)
+		c.Assert(err, gc.IsNil)
+		var expect []*charmstore.CharmEvent
+		for _, j := range test.expect {
+			expect = append(expect, logged[j])
+		}
+		c.Assert(events, gc.DeepEquals, expect)
+	}
+
+	_, err := s.backend.Events(&charmstore.EventsRequest{AfterId: logged[0].Id[:6] + "xxxxxx"})
+	c.Assert(err, gc.Equals, charmstore.ErrNotFound)
+}
+
+func (s *BackendSuite) TestEventsLoggedOutOfOrder(c *gc.C) {
+	url := charm.MustParseURL("cs:oneiric/wordpress")
+	logEvent := func(digest string, t time.Time) *charmstore.CharmEvent {
+		event := &charmstore.CharmEvent{
+			Kind:   charmstore.EventPublished,
+			Digest: digest,
+			URLs:   []*charm.URL{url},
+			Time:   t,
+		}
+		err := s.backend.LogCharmEvent(event)
+		c.Assert(err, gc.IsNil)
+		return event
+	}
+	first := logEvent("digest-0", time.Unix(20, 0))
+
+	// An event logged after a client polled for new events is
+	// returned to the client, even if it happened earlier.
+	late := logEvent("digest-1", time.Unix(10, 0))
+	events, err := s.backend.Events(&charmstore.EventsRequest{AfterId: first.Id})
+	c.Assert(err, gc.IsNil)
+	c.Assert(events, gc.DeepEquals, []*charmstore.CharmEvent{late})
+
+	events, err = s.backend.Events(&charmstore.EventsRequest{})
+	c.Assert(err, gc.IsNil)
+	c.Assert(events, gc.DeepEquals, []*charmstore.CharmEvent{first, late})
+	c.Assert(late.Seq > first.Seq, gc.Equals, true)
+}
+
+func (s *BackendSuite) TestPublishAttempts(c *gc.C) {
+	url := charm.MustParseURL("cs:oneiric/wordpress")
+	urls := []*charm.URL{url}
+	logEvent := func(event *charmstore.CharmEvent) {
+		event.Digest = "some-digest"
+		event.URLs = urls
+		err := s.backend.LogCharmEvent(event)
+		c.Assert(err, gc.IsNil)
+	}
+	attempts, err := charmstore.PublishAttempts(s.backend, urls, "some-digest")
+	c.Assert(err, gc.IsNil)
+	c.Assert(attempts, gc.Equals, 1)
+
+	// Transient failures are retried after a delay.
+	logEvent(&charmstore.CharmEvent{
+		Kind:       charmstore.EventPublishError,
+		Errors:     []string{"Connection reset"},
+		Transient:  true,
+		Attempts:   2,
+		RetryAfter: time.Now().Add(time.Hour),
+		Time:       time.Unix(1, 0),
+	})
+	_, err = charmstore.PublishAttempts(s.backend, urls, "some-digest")
+	c.Assert(err, gc.Equals, charmstore.ErrPublishDeferred)
+	logEvent(&charmstore.CharmEvent{
+		Kind:       charmstore.EventPublishError,
+		Errors:     []string{"Connection reset"},
+		Transient:  true,
+		Attempts:   2,
+		RetryAfter: time.Now().Add(-time.Hour),
+		Time:       time.Unix(2, 0),
+	})
+	attempts, err = charmstore.PublishAttempts(s.backend, urls, "some-digest")
+	c.Assert(err, gc.IsNil)
+	c.Assert(attempts, gc.Equals, 3)
+
+	// Permanent failures are only retried on request, and
+	// events unrelated to publishing are disregarded.
+	logEvent(&charmstore.CharmEvent{
+		Kind:   charmstore.EventPublishError,
+		Errors: []string{"boom"},
+		Time:   time.Unix(3, 0),
+	})
+	logEvent(&charmstore.CharmEvent{
+		Kind: charmstore.EventDeleted,
+		Time: time.Unix(4, 0),
+	})
+	_, err = charmstore.PublishAttempts(s.backend, urls, "some-digest")
+	c.Assert(err, gc.ErrorMatches, "charm publishing previously failed: boom")
+	logEvent(&charmstore.CharmEvent{
+		Kind: charmstore.EventRetryRequested,
+		Time: time.Unix(5, 0),
+	})
+	attempts, err = charmstore.PublishAttempts(s.backend, urls, "some-digest")
+	c.Assert(err, gc.IsNil)
+	c.Assert(attempts, gc.Equals, 1)
+
+	// Other digests are unaffected.
+	attempts, err = charmstore.PublishAttempts(s.backend, urls, "another-digest")
+	c.Assert(err, gc.IsNil)
+	c.Assert(attempts, gc.Equals, 1)
+}
+
+// publishFake publishes a FakeCharmDir, whose archive
+// is 16 bytes long, at the given urls in the backend.
+func (s *BackendSuite) publishFake(c *gc.C, urls ...string) error {
+	curls := make([]*charm.URL, len(urls))
+	for i, url := range urls {
+		curls[i] = charm.MustParseURL(url)
+	}
+	pub, err := s.backend.CharmPublisher(curls, "digest-"+urls[0])
+	c.Assert(err, gc.IsNil)
+	return pub.Publish(&FakeCharmDir{})
+}
+
+func (s *BackendSuite) TestMaxArchiveSize(c *gc.C) {
+	s.backend.SetStorageLimits(charmstore.StorageLimits{MaxArchiveSize: 10})
+	err := s.publishFake(c, "cs:precise/wordpress")
+	c.Assert(err, gc.ErrorMatches, "archive exceeds the maximum size of 10 bytes")
+	c.Assert(err, gc.FitsTypeOf, &charmstore.StorageLimitError{})
+	_, err = s.backend.CharmInfo(charm.MustParseURL("cs:precise/wordpress"))
+	c.Assert(err, gc.Equals, charmstore.ErrNotFound)
+
+	// The limit error holds even if the archive writer ignores it.
+	pub, err := s.backend.CharmPublisher([]*charm.URL{charm.MustParseURL("cs:precise/wordpress")}, "some-digest")
+	c.Assert(err, gc.IsNil)
+	err = pub.Publish(&FakeCharmDir{error: "ignoreWriteError"})
+	c.Assert(err, gc.FitsTypeOf, &charmstore.StorageLimitError{})
+	_, err = s.backend.CharmInfo(charm.MustParseURL("cs:precise/wordpress"))
+	c.Assert(err, gc.Equals, charmstore.ErrNotFound)
+
+	s.backend.SetStorageLimits(charmstore.StorageLimits{MaxArchiveSize: 16})
+	err = s.publishFake(c, "cs:precise/wordpress")
+	c.Assert(err, gc.IsNil)
+}
+
+func (s *BackendSuite) TestNamespaceQuota(c *gc.C) {
+	s.backend.SetStorageLimits(charmstore.StorageLimits{
+		NamespaceQuota:  40,
+		NamespaceQuotas: map[string]int64{"joe": 20},
+	})
+	err := s.publishFake(c, "cs:~joe/precise/a")
+	c.Assert(err, gc.IsNil)
+	err = s.publishFake(c, "cs:~joe/precise/b")
+	c.Assert(err, gc.ErrorMatches, "archive exceeds the storage quota of 20 bytes for ~joe, with 16 bytes already used")
+	c.Assert(err, gc.FitsTypeOf, &charmstore.StorageLimitError{})
+
+	err = s.publishFake(c, "cs:precise/a")
+	c.Assert(err, gc.IsNil)
+	err = s.publishFake(c, "cs:precise/b")
+	c.Assert(err, gc.IsNil)
+	err = s.publishFake(c, "cs:precise/c")
+	c.Assert(err, gc.ErrorMatches, "archive exceeds the storage quota of 40 bytes for unqualified charm URLs, with 32 bytes already used")
+
+	// The quotas of all the namespaces apply.
+	err = s.publishFake(c, "cs:~alice/precise/c", "cs:~joe/precise/c")
+	c.Assert(err, gc.ErrorMatches, "archive exceeds the storage quota of 20 bytes for ~joe, with 16 bytes already used")
+}
+
+func (s *BackendSuite) TestLockUpdates(c *gc.C) {
+	urls := []*charm.URL{
+		charm.MustParseURL("cs:oneiric/wordpress-a"),
+		charm.MustParseURL("cs:oneiric/wordpress-b"),
+	}
+	lock1, err := s.backend.LockUpdates(urls[1:])
+	c.Assert(err, gc.IsNil)
+
+	lock2, err := s.backend.LockUpdates(urls)
+	c.Assert(err, gc.Equals, charmstore.ErrUpdateConflict)
+	c.Assert(lock2, gc.IsNil)
+
+	// The failed attempt left urls[0] unlocked.
+	lock3, err := s.backend.LockUpdates(urls[:1])
+	c.Assert(err, gc.IsNil)
+	lock3.Unlock()
+
+	lock1.Unlock()
+	lock4, err := s.backend.LockUpdates(urls)
+	c.Assert(err, gc.IsNil)
+	lock4.Unlock()
+}
+
+func (s *BackendSuite) TestCounters(c *gc.C) {
+	if s.needsJs && *noTestMongoJs {
+		c.Skip("MongoDB javascript not available")
+	}
+	for _, key := range [][]string{
+		{"a", "b"},
+		{"a", "b"},
+		{"a", "c"},
+		{"a", "c", "d"},
+		{"a", "c", "e"},
+		{"a", "c", "e"},
+	} {
+		err := s.backend.IncCounter(key)
+		c.Assert(err, gc.IsNil)
+	}
+	err := s.backend.IncCounter(nil)
+	c.Assert(err, gc.ErrorMatches, "store: empty statistics key")
+
+	for i, test := range []struct {
+		req    charmstore.CounterRequest
+		expect []charmstore.Counter
+	}{{
+		charmstore.CounterRequest{Key: []string{"a", "b"}},
+		[]charmstore.Counter{{Key: []string{"a", "b"}, Count: 2}},
+	}, {
+		charmstore.CounterRequest{Key: []string{"a"}, Prefix: true},
+		[]charmstore.Counter{{Key: []string{"a"}, Prefix: true, Count: 6}},
+	}, {
+		charmstore.CounterRequest{Key: []string{"a", "c"}, Prefix: true},
+		[]charmstore.Counter{{Key: []string{"a", "c"}, Prefix: true, Count: 3}},
+	}, {
+		charmstore.CounterRequest{Key: []string{"a"}, Prefix: true, List: true},
+		[]charmstore.Counter{
+			{Key: []string{"a", "c"}, Prefix: true, Count: 3},
+			{Key: []string{"a", "b"}, Count: 2},
+			{Key: []string{"a", "c"}, Count: 1},
+		},
+	}, {
+		charmstore.CounterRequest{Key: []string{"x"}},
+		[]charmstore.Counter{{Key: []string{"x"}, Count: 0}},
+	}, {
+		charmstore.CounterRequest{Key: []string{"x"}, Prefix: true, List: true},
+		nil,
+	}} {
+		c.Logf("test %d: %#v", i, test.req)
+		counters, err := s.backend.Counters(&test.req)
+		c.Assert(err, gc.IsNil)
+		c.Assert(counters, gc.DeepEquals, test.expect)
+	}
+}
+
+func (s *BackendSuite) TestIncUniqueCounter(c *gc.C) {
+	if s.needsJs && *noTestMongoJs {
+		c.Skip("MongoDB javascript not available")
+	}
+	key := []string{"a-unique", "b"}
+	for _, client := range []string{"client1", "client1", "client2", "client1"} {
+		err := s.backend.IncUniqueCounter(key, client, 24*time.Hour)
+		c.Assert(err, gc.IsNil)
+	}
+	err := s.backend.IncUniqueCounter([]string{"a-unique", "c"}, "client1", 24*time.Hour)
+	c.Assert(err, gc.IsNil)
+	err = s.backend.IncUniqueCounter(nil, "client1", time.Hour)
+	c.Assert(err, gc.ErrorMatches, "store: empty statistics key")
+	err = s.backend.IncUniqueCounter(key, "client1", 0)
+	c.Assert(err, gc.ErrorMatches, "store: invalid unique counter window 0s")
+
+	counters, err := s.backend.Counters(&charmstore.CounterRequest{Key: key})
+	c.Assert(err, gc.IsNil)
+	c.Assert(counters, gc.DeepEquals, []charmstore.Counter{{Key: key, Count: 2}})
+	counters, err = s.backend.Counters(&charmstore.CounterRequest{Key: []string{"a-unique"}, Prefix: true})
+	c.Assert(err, gc.IsNil)
+	c.Assert(counters, gc.DeepEquals, []charmstore.Counter{{Key: []string{"a-unique"}, Prefix: true, Count: 3}})
+}
+
+func (s *BackendSuite) TestServer(c *gc.C) {
+	curl := charm.MustParseURL("cs:precise/wordpress")
+	s.publish(c, &FakeCharmDir{}, "some-digest", curl)
+	handler, err := charmstore.NewServer(s.backend)
+	c.Assert(err, gc.IsNil)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/charm-info?stats=0&charms=cs:wordpress")
+	c.Assert(err, gc.IsNil)
+	defer resp.Body.Close()
+	var info map[string]map[string]interface{}
+	err = json.NewDecoder(resp.Body).Decode(&info)
+	c.Assert(err, gc.IsNil)
+	c.Assert(info, gc.DeepEquals, map[string]map[string]interface{}{
+		"cs:wordpress": {
+			"canonical-url": "cs:precise/wordpress",
+			"revision":      float64(0),
+			"sha256":        fakeRevZeroSha,
+			"digest":        "some-digest",
+		},
+	})
+
+	resp, err = http.Get(server.URL + "/charm/precise/wordpress?stats=0")
+	c.Assert(err, gc.IsNil)
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(data), gc.Equals, "charm-revision-0")
+}
@@ -11,6 +11,8 @@ import (
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/juju/charm"
 )
@@ -24,6 +26,17 @@ import (
 // revision id of the checked out branch's tip, though, which may
 // differ from the digest parameter.
 func PublishBazaarBranch(store *Store, urls []*charm.URL, burl string, digest string) error {
+	return publishBazaarBranch(store, urls, burl, digest, 0)
+}
+
+// publishBazaarBranch is like PublishBazaarBranch, but kills the bzr
+// commands run if they haven't completed within timeout, and fails
+// with a transient error. A zero timeout means no timeout.
+func publishBazaarBranch(store *Store, urls []*charm.URL, burl string, digest string, timeout time.Duration) error {
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
 
 	// Prevent other publishers from updating these specific URLs
 	// concurrently.
@@ -43,13 +56,8 @@ NewTip:
 		return err
 	}
 
-	// Figure if publishing this charm was already attempted before and
-	// failed. We won't try again endlessly if so. In the future we may
-	// retry automatically in certain circumstances.
-	event, err := store.CharmEvent(urls[0], digest)
-	if err == nil && event.Kind != EventPublished {
-		return fmt.Errorf("charm publishing previously failed: %s", strings.Join(event.Errors, "; "))
-	} else if err != nil && err != ErrNotFound {
+	attempts, err := publishAttempts(store, urls, digest)
+	if err != nil {
 		return err
 	}
 
@@ -63,9 +71,13 @@ NewTip:
 		}
 		defer os.RemoveAll(tempDir)
 		branchDir = filepath.Join(tempDir, "branch")
-		output, err := exec.Command("bzr", "checkout", "--lightweight", burl, branchDir).CombinedOutput()
-		if err != nil {
-			return outputErr(output, err)
+		var output bytes.Buffer
+		cmd := exec.Command("bzr", "checkout", "--lightweight", burl, branchDir)
+		cmd.Stdout = &output
+		cmd.Stderr = &output
+		if err := runDeadline(cmd, deadline); err != nil {
+			err = newBzrError(output.Bytes(), err)
+			return logPublishError(store, urls, digest, err, isTransientBzrError(err), attempts)
 		}
 
 		// Pick actual digest from tip. Publishing the real tip
@@ -76,9 +88,9 @@ NewTip:
 		// newer revision and published that first, and the digest
 		// parameter provided is in fact an old version that would
 		// overwrite the new version.
-		tipDigest, err := bzrRevisionId(branchDir)
+		tipDigest, err := bzrRevisionId(branchDir, deadline)
 		if err != nil {
-			return err
+			return logPublishError(store, urls, digest, err, isTransientBzrError(err), attempts)
 		}
 		if tipDigest != digest {
 			digest = tipDigest
@@ -86,56 +98,199 @@ NewTip:
 		}
 	}
 
-	ch, err := charm.ReadDir(branchDir)
-	if err == nil {
-		// Hand over the charm to the store for bundling and
-		// streaming its content into the database.
-		err = pub.Publish(ch)
-		if err == ErrUpdateConflict {
-			// A conflict may happen in edge cases if the whole
-			// locking mechanism fails due to an expiration event,
-			// and then the expired concurrent publisher revives
-			// for whatever reason and attempts to finish
-			// publishing. The state of the system is still
-			// consistent in that case, and the error isn't logged
-			// since the revision was properly published before.
-			return err
+	return publishCharm(store, pub, urls, branchDir, digest, attempts)
+}
+
+// publishAttempts returns the number of the attempt to publish digest
+// at urls about to be made. If publishing was already attempted
+// before and failed, it returns an error rather than trying again
+// endlessly: permanent failures are only retried on request, and
+// transient ones after a delay that grows with the number of failed
+// attempts.
+func publishAttempts(store publishEventFinder, urls []*charm.URL, digest string) (int, error) {
+	event, err := store.lastPublishEvent(urls[0], digest)
+	if err == ErrNotFound {
+		return 1, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return eventPublishAttempts(event, time.Now())
+}
+
+// publishEventFinder is implemented by the backends which
+// record the outcome of the attempts to publish charms.
+type publishEventFinder interface {
+	lastPublishEvent(url *charm.URL, digest string) (*CharmEvent, error)
+}
+
+// Statically ensure that *Store and *MemStore are publishEventFinders.
+var (
+	_ publishEventFinder = (*Store)(nil)
+	_ publishEventFinder = (*MemStore)(nil)
+)
+
+// publishOutcomeKinds holds the kinds of the events recording the
+// outcome of attempts to publish a digest, or requests to retry them.
+// Other events, such as deletions or releases, record changes made to
+// published charms which don't affect publishing.
+var publishOutcomeKinds = []CharmEventKind{
+	EventPublished,
+	EventPublishError,
+	EventVerifyError,
+	EventRetryRequested,
+}
+
+// lastPublishEvent returns the latest event recording the outcome
+// of an attempt to publish digest at url, or any digest if empty.
+func (s *Store) lastPublishEvent(url *charm.URL, digest string) (*CharmEvent, error) {
+	return s.charmEvent(url.WithRevision(-1), digest, publishOutcomeKinds)
+}
+
+// eventPublishAttempts returns the number of the attempt to publish
+// a digest about to be made at time now, given the latest event
+// recording the outcome of a previous attempt, as publishAttempts.
+func eventPublishAttempts(event *CharmEvent, now time.Time) (int, error) {
+	switch {
+	case event.Kind == EventPublishError && event.Transient:
+		if now.Before(event.RetryAfter) {
+			return 0, ErrPublishDeferred
 		}
+		return event.Attempts + 1, nil
+	case event.Kind == EventPublishError, event.Kind == EventVerifyError:
+		return 0, fmt.Errorf("charm publishing previously failed: %s", strings.Join(event.Errors, "; "))
+	}
+	return 1, nil
+}
+
+// publishCharm reads the charm in dir and publishes it with pub,
+// logging the outcome in a charm event.
+func publishCharm(store *Store, pub *CharmPublisher, urls []*charm.URL, dir, digest string, attempts int) error {
+	// Errors reading the charm are problems in its content, which
+	// won't go away until a new revision is committed. Other errors
+	// come from the store, and may be solved by trying again.
+	ch, err := charm.ReadDir(dir)
+	if err != nil {
+		return logPublishError(store, urls, digest, err, false, attempts)
+	}
+	// Hand over the charm to the store for bundling and
+	// streaming its content into the database.
+	err = pub.Publish(ch)
+	switch err.(type) {
+	case *LintError, *StorageLimitError:
+		// Lint problems are in the charm content too, and storage
+		// limits won't change until an administrator steps in.
+		return logPublishError(store, urls, digest, err, false, attempts)
+	}
+	if err == ErrUpdateConflict {
+		// A conflict may happen in edge cases if the whole
+		// locking mechanism fails due to an expiration event,
+		// and then the expired concurrent publisher revives
+		// for whatever reason and attempts to finish
+		// publishing. The state of the system is still
+		// consistent in that case, and the error isn't logged
+		// since the revision was properly published before.
+		return err
+	}
+	if err != nil {
+		return logPublishError(store, urls, digest, err, true, attempts)
+	}
+
+	// Publishing is done.
+	event := &CharmEvent{
+		Kind:     EventPublished,
+		URLs:     urls,
+		Digest:   digest,
+		Revision: pub.Revision(),
+		Warnings: pub.Warnings(),
+	}
+	return store.LogCharmEvent(event)
+}
+
+const (
+	// publishRetryDelay holds the delay before publishing is
+	// attempted again after a first transient failure. The
+	// delay doubles after each failed attempt, up to
+	// maxPublishRetryDelay.
+	publishRetryDelay    = 10 * time.Minute
+	maxPublishRetryDelay = 24 * time.Hour
+)
+
+// retryDelay returns the time to wait before publishing
+// again after the given number of failed attempts.
+func retryDelay(attempts int) time.Duration {
+	delay := publishRetryDelay
+	for i := 1; i < attempts && delay < maxPublishRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxPublishRetryDelay {
+		delay = maxPublishRetryDelay
 	}
+	return delay
+}
 
-	// Publishing is done. Log failure or error.
-	event = &CharmEvent{
-		URLs:   urls,
-		Digest: digest,
+// logPublishError logs an EventPublishError event for the failure to
+// publish digest at urls, and returns err. Transient failures are
+// recorded with the time after which publishing may be retried, and
+// lint failures with each of the problems found.
+func logPublishError(store *Store, urls []*charm.URL, digest string, err error, transient bool, attempts int) error {
+	errors := []string{err.Error()}
+	if lintErr, ok := err.(*LintError); ok {
+		errors = lintErr.Problems
+	}
+	event := &CharmEvent{
+		Kind:      EventPublishError,
+		URLs:      urls,
+		Digest:    digest,
+		Errors:    errors,
+		Transient: transient,
+		Attempts:  attempts,
+		Time:      time.Now(),
 	}
-	if err == nil {
-		event.Kind = EventPublished
-		event.Revision = pub.Revision()
-	} else {
-		event.Kind = EventPublishError
-		event.Errors = []string{err.Error()}
+	if transient {
+		event.RetryAfter = event.Time.Add(retryDelay(attempts))
 	}
 	if logerr := store.LogCharmEvent(event); logerr != nil {
-		if err == nil {
-			err = logerr
-		} else {
-			err = fmt.Errorf("%v; %v", err, logerr)
-		}
+		err = fmt.Errorf("%v; %v", err, logerr)
 	}
 	return err
 }
 
-// bzrRevisionId returns the Bazaar revision id for the branch in branchDir.
-func bzrRevisionId(branchDir string) (string, error) {
-	cmd := exec.Command("bzr", "revision-info")
-	cmd.Dir = branchDir
+// RetryPublish requests publishing to be attempted again for the charm
+// at url, whose last publishing attempt failed, regardless of the
+// kind of failure and of when it happened. The charm is published on
+// the next run of the publisher over its branch.
+func (s *Store) RetryPublish(url *charm.URL, origin Origin) error {
+	event, err := s.lastPublishEvent(url, "")
+	if err != nil {
+		return err
+	}
+	if event.Kind != EventPublishError && event.Kind != EventVerifyError {
+		return fmt.Errorf("cannot retry publishing charm %s: last publishing attempt did not fail", url)
+	}
+	return s.LogCharmEvent(&CharmEvent{
+		Kind:   EventRetryRequested,
+		URLs:   event.URLs,
+		Digest: event.Digest,
+		Actor:  origin.Actor,
+		Reason: origin.Reason,
+	})
+}
+
+// bzrRevisionId returns the Bazaar revision id for the tip of the
+// branch at burl, which may be a local directory.
+func bzrRevisionId(burl string, deadline time.Time) (string, error) {
+	cmd := exec.Command("bzr", "revision-info", "-d", burl)
+	stdout := &bytes.Buffer{}
 	stderr := &bytes.Buffer{}
+	cmd.Stdout = stdout
 	cmd.Stderr = stderr
-	output, err := cmd.Output()
+	err := runDeadline(cmd, deadline)
+	output := stdout.Bytes()
 	if err != nil {
 		output = append(output, '\n')
 		output = append(output, stderr.Bytes()...)
-		return "", outputErr(output, err)
+		return "", newBzrError(output, err)
 	}
 	pair := bytes.Fields(output)
 	if len(pair) != 2 {
@@ -146,6 +301,32 @@ func bzrRevisionId(branchDir string) (string, error) {
 	return string(pair[1]), nil
 }
 
+// runDeadline runs cmd and waits for it to complete. If it hasn't
+// completed by the given deadline, the process is killed and an
+// error is returned. A zero deadline means no deadline.
+func runDeadline(cmd *exec.Cmd, deadline time.Time) error {
+	if deadline.IsZero() {
+		return cmd.Run()
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(deadline.Sub(time.Now())):
+	}
+	// Ignore error. The process may have completed meanwhile,
+	// and it's waited for below either way.
+	_ = cmd.Process.Kill()
+	<-done
+	return fmt.Errorf("%s timed out", strings.Join(cmd.Args[:2], " "))
+}
+
 // outputErr returns an error that assembles some command's output and its
 // error, if both output and err are set, and returns only err if output is nil.
 func outputErr(output []byte, err error) error {
@@ -154,3 +335,60 @@ func outputErr(output []byte, err error) error {
 	}
 	return err
 }
+
+// bzrError holds the failure of a Bazaar command.
+type bzrError struct {
+	err       error
+	transient bool
+}
+
+func (e *bzrError) Error() string {
+	return e.err.Error()
+}
+
+// transientBzrMessages holds the messages reported by Bazaar for
+// failures that may go away by trying again: network problems and
+// locks held by other processes. Other failures, such as a branch
+// that doesn't exist or can't be accessed, need someone to step in.
+var transientBzrMessages = []string{
+	"Connection error",
+	"Connection closed",
+	"Connection reset",
+	"Connection refused",
+	"Connection timed out",
+	"Temporary failure in name resolution",
+	"Transport error",
+	"Invalid http response",
+	"Could not acquire lock",
+	"Unable to obtain lock",
+	"LockContention",
+}
+
+// newBzrError returns the error for the failure err of a Bazaar command
+// with the given output, classified as transient or permanent. Failures
+// to run the command, timeouts and terminations by a signal are
+// transient, as are the network and lock failures bzr reports. Other
+// failures reported by bzr exiting with an error status are permanent.
+func newBzrError(output []byte, err error) error {
+	transient := true
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		transient = false
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			transient = true
+		}
+		for _, msg := range transientBzrMessages {
+			if bytes.Contains(output, []byte(msg)) {
+				transient = true
+				break
+			}
+		}
+	}
+	return &bzrError{outputErr(output, err), transient}
+}
+
+// isTransientBzrError reports whether err is the failure
+// of a Bazaar command that may go away by trying again.
+func isTransientBzrError(err error) bool {
+	bzrErr, ok := err.(*bzrError)
+	return ok && bzrErr.transient
+}
@@ -31,6 +31,8 @@ func (s *StoreSuite) dummyBranch(c *gc.C, suffix string) bzrDir {
 	branch.init()
 
 	copyCharmDir(branch.path(), charmtesting.Charms.Dir("dummy"))
+	// Add an icon so that the charm passes lint checks.
+	branch.write("icon.svg", "<svg/>")
 	branch.add()
 	branch.commit("Imported charm.")
 	return branch
@@ -144,6 +146,23 @@ func (s *StoreSuite) TestPublishErrorFromBzr(c *gc.C) {
 	c.Assert(err, gc.ErrorMatches, "(?s).*STDERR STUFF.*")
 }
 
+func (s *StoreSuite) TestPublishExceedingStorageLimits(c *gc.C) {
+	branch := s.dummyBranch(c, "")
+	s.store.SetStorageLimits(charmstore.StorageLimits{MaxArchiveSize: 100})
+
+	err := charmstore.PublishBazaarBranch(s.store, urls, branch.path(), branch.digest())
+	c.Assert(err, gc.ErrorMatches, "archive exceeds the maximum size of 100 bytes")
+
+	// The failure is logged, and not retried automatically.
+	event, err := s.store.CharmEvent(urls[0], branch.digest())
+	c.Assert(err, gc.IsNil)
+	c.Assert(event.Kind, gc.Equals, charmstore.EventPublishError)
+	c.Assert(event.Errors, gc.DeepEquals, []string{"archive exceeds the maximum size of 100 bytes"})
+	c.Assert(event.Transient, gc.Equals, false)
+	_, err = s.store.CharmInfo(urls[0])
+	c.Assert(err, gc.Equals, charmstore.ErrNotFound)
+}
+
 func (s *StoreSuite) TestPublishErrorInCharm(c *gc.C) {
 	branch := s.dummyBranch(c, "")
 
@@ -164,6 +183,244 @@ func (s *StoreSuite) TestPublishErrorInCharm(c *gc.C) {
 	c.Assert(event.Errors, gc.NotNil)
 	c.Assert(event.Errors[0], gc.Matches, ".*/metadata.yaml: no such file or directory")
 	c.Assert(event.Warnings, gc.IsNil)
+	c.Assert(event.Transient, gc.Equals, false)
+	c.Assert(event.Attempts, gc.Equals, 1)
+
+	// Errors in the charm are not retried automatically.
+	err = charmstore.PublishBazaarBranch(s.store, urls, branch.path(), branch.digest())
+	c.Assert(err, gc.ErrorMatches, "charm publishing previously failed: .*/metadata.yaml: no such file or directory")
+
+	// Unless a retry is requested.
+	err = s.store.RetryPublish(urls[0], charmstore.Origin{Actor: "joe"})
+	c.Assert(err, gc.IsNil)
+	err = charmstore.PublishBazaarBranch(s.store, urls, branch.path(), branch.digest())
+	c.Assert(err, gc.ErrorMatches, ".*/metadata.yaml: no such file or directory")
+	event, err = s.store.CharmEvent(urls[0], branch.digest())
+	c.Assert(err, gc.IsNil)
+	c.Assert(event.Kind, gc.Equals, charmstore.EventPublishError)
+	c.Assert(event.Attempts, gc.Equals, 1)
+}
+
+func (s *StoreSuite) TestPublishLintProblems(c *gc.C) {
+	branch := s.dummyBranch(c, "")
+	err := os.MkdirAll(branch.path("hooks"), 0755)
+	c.Assert(err, gc.IsNil)
+	branch.write("hooks/start", "#!/bin/sh\n")
+	branch.add("hooks/start")
+	branch.commit("Added start hook.")
+
+	// Under the default lenient policy, lint problems are recorded
+	// as warnings in the publishing event.
+	err = charmstore.PublishBazaarBranch(s.store, urls, branch.path(), "wrong-rev")
+	c.Assert(err, gc.IsNil)
+	event, err := s.store.CharmEvent(urls[0], branch.digest())
+	c.Assert(err, gc.IsNil)
+	c.Assert(event.Kind, gc.Equals, charmstore.EventPublished)
+	c.Assert(event.Errors, gc.IsNil)
+	c.Assert(event.Warnings, gc.DeepEquals, []string{"hooks/start: hook is not executable"})
+
+	// Under the strict policy, they prevent the charm from being
+	// published, and are recorded as errors.
+	s.store.SetLintPolicy("joe", charmstore.LintStrict)
+	branch.change()
+	err = charmstore.PublishBazaarBranch(s.store, urls, branch.path(), "wrong-rev")
+	c.Assert(err, gc.ErrorMatches, "charm failed lint checks: hooks/start: hook is not executable")
+	event, err = s.store.CharmEvent(urls[0], branch.digest())
+	c.Assert(err, gc.IsNil)
+	c.Assert(event.Kind, gc.Equals, charmstore.EventPublishError)
+	c.Assert(event.Errors, gc.DeepEquals, []string{"hooks/start: hook is not executable"})
+	c.Assert(event.Transient, gc.Equals, false)
+	info, err := s.store.CharmInfo(urls[0])
+	c.Assert(err, gc.IsNil)
+	c.Assert(info.Revision(), gc.Equals, 0)
+}
+
+func (s *StoreSuite) TestPublishTransientError(c *gc.C) {
+	branch := s.dummyBranch(c, "")
+	digest := branch.digest()
+
+	plugin := fakePlugin{}
+	plugin.install(c.MkDir(), `import sys; sys.stderr.write("bzr: ERROR: Connection error: NETWORK DOWN\n"); sys.exit(3)`)
+	defer plugin.uninstall()
+
+	before := time.Now()
+	err := charmstore.PublishBazaarBranch(s.store, urls, branch.path(), digest)
+	c.Assert(err, gc.ErrorMatches, "(?s).*NETWORK DOWN.*")
+
+	// The failure is recorded as transient, to be retried later.
+	event, err := s.store.CharmEvent(urls[0], digest)
+	c.Assert(err, gc.IsNil)
+	c.Assert(event.Kind, gc.Equals, charmstore.EventPublishError)
+	c.Assert(event.Transient, gc.Equals, true)
+	c.Assert(event.Attempts, gc.Equals, 1)
+	retryAfter := before.Add(charmstore.RetryDelay(1))
+	c.Assert(event.RetryAfter.After(retryAfter.Add(-time.Second)), gc.Equals, true)
+	c.Assert(event.RetryAfter.Before(retryAfter.Add(time.Minute)), gc.Equals, true)
+
+	// Publishing isn't attempted again before the retry time,
+	// even if the problem went away.
+	plugin.uninstall()
+	err = charmstore.PublishBazaarBranch(s.store, urls, branch.path(), digest)
+	c.Assert(err, gc.Equals, charmstore.ErrPublishDeferred)
+
+	// A retry can be forced.
+	err = s.store.RetryPublish(urls[1], charmstore.Origin{Actor: "joe", Reason: "network is back"})
+	c.Assert(err, gc.IsNil)
+	event, err = s.store.CharmEvent(urls[0], digest)
+	c.Assert(err, gc.IsNil)
+	c.Assert(event.Kind, gc.Equals, charmstore.EventRetryRequested)
+	c.Assert(event.Actor, gc.Equals, "joe")
+
+	err = charmstore.PublishBazaarBranch(s.store, urls, branch.path(), digest)
+	c.Assert(err, gc.IsNil)
+	info, err := s.store.CharmInfo(urls[0])
+	c.Assert(err, gc.IsNil)
+	c.Assert(info.Digest(), gc.Equals, digest)
+
+	// Only failed publishing can be retried.
+	err = s.store.RetryPublish(urls[0], charmstore.Origin{})
+	c.Assert(err, gc.ErrorMatches, "cannot retry publishing charm cs:~joe/oneiric/dummy: last publishing attempt did not fail")
+	err = s.store.RetryPublish(charm.MustParseURL("cs:oneiric/unknown"), charmstore.Origin{})
+	c.Assert(err, gc.Equals, charmstore.ErrNotFound)
+}
+
+func (s *StoreSuite) TestPublishBzrErrorClassification(c *gc.C) {
+	tests := []struct {
+		stderr    string
+		status    int
+		transient bool
+	}{{
+		stderr:    `bzr: ERROR: Not a branch: "/srv/charms/mysql/".`,
+		status:    3,
+		transient: false,
+	}, {
+		stderr:    `bzr: ERROR: Permission denied: "/srv/charms/mysql/.bzr/branch-format"`,
+		status:    3,
+		transient: false,
+	}, {
+		stderr:    `bzr: ERROR: Connection error: Couldn't resolve host 'bazaar.launchpad.net' [Errno -3] Temporary failure in name resolution`,
+		status:    3,
+		transient: true,
+	}, {
+		stderr:    `bzr: ERROR: Could not acquire lock "(remote lock)"`,
+		status:    3,
+		transient: true,
+	}, {
+		stderr:    `bzr: ERROR: exceptions.KeyError: 'revision'`,
+		status:    4,
+		transient: false,
+	}}
+	for i, test := range tests {
+		c.Logf("test %d: %s", i, test.stderr)
+		branch := s.dummyBranch(c, "")
+		digest := branch.digest()
+		plugin := fakePlugin{}
+		plugin.install(c.MkDir(), fmt.Sprintf("import sys; sys.stderr.write(%q); sys.exit(%d)", test.stderr+"\n", test.status))
+		err := charmstore.PublishBazaarBranch(s.store, urls, branch.path(), digest)
+		plugin.uninstall()
+		c.Assert(err, gc.NotNil)
+
+		event, err := s.store.CharmEvent(urls[0], digest)
+		c.Assert(err, gc.IsNil)
+		c.Assert(event.Kind, gc.Equals, charmstore.EventPublishError)
+		c.Assert(event.Transient, gc.Equals, test.transient)
+	}
+}
+
+func (s *StoreSuite) TestPublishTimeout(c *gc.C) {
+	branch := s.dummyBranch(c, "")
+	digest := branch.digest()
+
+	plugin := fakePlugin{}
+	plugin.install(c.MkDir(), `import time; time.sleep(10)`)
+	defer plugin.uninstall()
+
+	start := time.Now()
+	err := charmstore.PublishBazaarBranchTimeout(s.store, urls, branch.path(), digest, 500*time.Millisecond)
+	c.Assert(err, gc.ErrorMatches, "bzr checkout timed out")
+	c.Assert(time.Since(start) < 5*time.Second, gc.Equals, true)
+
+	// Timeouts are transient failures.
+	event, err := s.store.CharmEvent(urls[0], digest)
+	c.Assert(err, gc.IsNil)
+	c.Assert(event.Kind, gc.Equals, charmstore.EventPublishError)
+	c.Assert(event.Transient, gc.Equals, true)
+}
+
+func (s *StoreSuite) TestPublishTransientErrorAttempts(c *gc.C) {
+	branch := s.dummyBranch(c, "")
+	digest := branch.digest()
+
+	// Simulate a previous transient failure whose retry time has passed.
+	err := s.store.LogCharmEvent(&charmstore.CharmEvent{
+		Kind:       charmstore.EventPublishError,
+		URLs:       urls,
+		Digest:     digest,
+		Errors:     []string{"network down"},
+		Transient:  true,
+		Attempts:   3,
+		RetryAfter: time.Now().Add(-time.Minute),
+	})
+	c.Assert(err, gc.IsNil)
+
+	plugin := fakePlugin{}
+	plugin.install(c.MkDir(), `import sys; sys.stderr.write("bzr: ERROR: Could not acquire lock\n"); sys.exit(3)`)
+	defer plugin.uninstall()
+	before := time.Now()
+	err = charmstore.PublishBazaarBranch(s.store, urls, branch.path(), digest)
+	c.Assert(err, gc.NotNil)
+
+	// The delay grows with the number of failed attempts.
+	event, err := s.store.CharmEvent(urls[0], digest)
+	c.Assert(err, gc.IsNil)
+	c.Assert(event.Attempts, gc.Equals, 4)
+	c.Assert(event.RetryAfter.After(before.Add(charmstore.RetryDelay(4)).Add(-time.Second)), gc.Equals, true)
+}
+
+func (s *StoreSuite) TestPublishAfterDelete(c *gc.C) {
+	branch := s.dummyBranch(c, "")
+	digest := branch.digest()
+	err := charmstore.PublishBazaarBranch(s.store, urls, branch.path(), digest)
+	c.Assert(err, gc.IsNil)
+
+	// A deleted charm is published again from the same branch tip.
+	_, err = s.store.DeleteCharm(urls[1], charmstore.Origin{Actor: "joe"})
+	c.Assert(err, gc.IsNil)
+	err = charmstore.PublishBazaarBranch(s.store, urls, branch.path(), digest)
+	c.Assert(err, gc.IsNil)
+	info, err := s.store.CharmInfo(urls[0])
+	c.Assert(err, gc.IsNil)
+	c.Assert(info.Digest(), gc.Equals, digest)
+}
+
+func (s *StoreSuite) TestPublishFailureBeforeLifecycleEvents(c *gc.C) {
+	branch := s.dummyBranch(c, "")
+	digest := branch.digest()
+	for _, kind := range []charmstore.CharmEventKind{charmstore.EventPublishError, charmstore.EventPromulgated} {
+		err := s.store.LogCharmEvent(&charmstore.CharmEvent{
+			Kind:   kind,
+			URLs:   urls,
+			Digest: digest,
+			Errors: []string{"boom"},
+		})
+		c.Assert(err, gc.IsNil)
+	}
+
+	// Lifecycle events don't hide previous failures.
+	err := charmstore.PublishBazaarBranch(s.store, urls, branch.path(), digest)
+	c.Assert(err, gc.ErrorMatches, "charm publishing previously failed: boom")
+
+	err = s.store.RetryPublish(urls[0], charmstore.Origin{Actor: "joe"})
+	c.Assert(err, gc.IsNil)
+	err = charmstore.PublishBazaarBranch(s.store, urls, branch.path(), digest)
+	c.Assert(err, gc.IsNil)
+}
+
+func (s *TrivialSuite) TestRetryDelay(c *gc.C) {
+	c.Assert(charmstore.RetryDelay(1), gc.Equals, 10*time.Minute)
+	c.Assert(charmstore.RetryDelay(2), gc.Equals, 20*time.Minute)
+	c.Assert(charmstore.RetryDelay(4), gc.Equals, 80*time.Minute)
+	c.Assert(charmstore.RetryDelay(100), gc.Equals, 24*time.Hour)
 }
 
 type bzrDir string
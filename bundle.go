@@ -0,0 +1,415 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/juju/charm"
+	"labix.org/v2/mgo/bson"
+	"launchpad.net/goyaml"
+)
+
+// BundleSeries is the series assumed for bundle URLs that don't
+// specify one, as in cs:~user/bundle/wordpress-simple.
+const BundleSeries = "bundle"
+
+// BundleData holds the contents of a bundle.yaml file, which
+// describes a set of services to be deployed together and the
+// relations between them.
+type BundleData struct {
+	// Series holds the default series for the charms
+	// referenced by services that don't specify one.
+	Series string `yaml:"series,omitempty"`
+
+	// Services maps service names to their specification.
+	Services map[string]*ServiceSpec `yaml:"services"`
+
+	// Relations holds the relations to be established between
+	// services. Each relation holds two endpoints in the form
+	// "service" or "service:relation".
+	Relations [][]string `yaml:"relations,omitempty"`
+}
+
+// ServiceSpec describes a single service in a bundle.
+type ServiceSpec struct {
+	Charm       string                 `yaml:"charm"`
+	NumUnits    int                    `yaml:"num_units,omitempty"`
+	Options     map[string]interface{} `yaml:"options,omitempty"`
+	Constraints string                 `yaml:"constraints,omitempty"`
+}
+
+// BundleDir matches the interface of a bundle that is necessary
+// to publish it in the store.
+type BundleDir interface {
+	Data() *BundleData
+	ReadMe() string
+	ArchiveTo(w io.Writer) error
+}
+
+// ReadBundleDir returns a BundleDir for the bundle in the given directory,
+// which must hold a bundle.yaml file and may hold a README.md file.
+func ReadBundleDir(path string) (BundleDir, error) {
+	data, err := ioutil.ReadFile(filepath.Join(path, "bundle.yaml"))
+	if err != nil {
+		return nil, err
+	}
+	b := &bundleDir{path: path}
+	if err := goyaml.Unmarshal(data, &b.data); err != nil {
+		return nil, fmt.Errorf("cannot parse bundle.yaml: %v", err)
+	}
+	readMe, err := ioutil.ReadFile(filepath.Join(path, "README.md"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	b.readMe = string(readMe)
+	return b, nil
+}
+
+type bundleDir struct {
+	path   string
+	data   BundleData
+	readMe string
+}
+
+// Data implements BundleDir.Data.
+func (b *bundleDir) Data() *BundleData {
+	return &b.data
+}
+
+// ReadMe implements BundleDir.ReadMe.
+func (b *bundleDir) ReadMe() string {
+	return b.readMe
+}
+
+// ArchiveTo implements BundleDir.ArchiveTo by writing a zip archive
+// with all the files in the bundle directory. Hidden files and
+// directories, such as VCS metadata, are left out.
+func (b *bundleDir) ArchiveTo(w io.Writer) error {
+	zw := zip.NewWriter(w)
+	err := filepath.Walk(b.path, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(b.path, path)
+		if err != nil {
+			return err
+		}
+		if relPath == "." {
+			return nil
+		}
+		if strings.HasPrefix(fi.Name(), ".") {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		h, err := zip.FileInfoHeader(fi)
+		if err != nil {
+			return err
+		}
+		h.Name = filepath.ToSlash(relPath)
+		h.Method = zip.Deflate
+		fw, err := zw.CreateHeader(h)
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(fw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// verifyBundle checks that data is a valid bundle description,
+// and that all the charms it refers to are available in the store.
+func (s *Store) verifyBundle(data *BundleData) error {
+	var errs []string
+	if len(data.Services) == 0 {
+		errs = append(errs, "bundle has no services")
+	}
+	names := make([]string, 0, len(data.Services))
+	for name := range data.Services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := s.verifyService(data, data.Services[name]); err != nil {
+			errs = append(errs, fmt.Sprintf("service %q: %v", name, err))
+		}
+	}
+	for _, rel := range data.Relations {
+		if len(rel) != 2 {
+			errs = append(errs, fmt.Sprintf("relation %q must have two endpoints", rel))
+			continue
+		}
+		for _, endpoint := range rel {
+			service := endpoint
+			if i := strings.Index(endpoint, ":"); i >= 0 {
+				service = endpoint[:i]
+			}
+			if data.Services[service] == nil {
+				errs = append(errs, fmt.Sprintf("relation %q refers to unknown service %q", rel, service))
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid bundle: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// verifyService checks that the service spec in the bundle
+// described by data refers to a charm available in the store.
+func (s *Store) verifyService(data *BundleData, spec *ServiceSpec) error {
+	if spec == nil || spec.Charm == "" {
+		return fmt.Errorf("no charm specified")
+	}
+	if spec.NumUnits < 0 {
+		return fmt.Errorf("negative number of units")
+	}
+	curlStr := spec.Charm
+	if !strings.Contains(curlStr, ":") {
+		curlStr = "cs:" + curlStr
+	}
+	ref, series, err := charm.ParseReference(curlStr)
+	if err != nil {
+		return err
+	}
+	if ref.Schema != "cs" {
+		return fmt.Errorf("charm %q is not in the charm store", spec.Charm)
+	}
+	if series == "" {
+		series = data.Series
+	}
+	if series == "" {
+		prefSeries, err := s.Series(ref)
+		if err != nil {
+			return err
+		}
+		if len(prefSeries) == 0 {
+			return fmt.Errorf("charm %q not found", spec.Charm)
+		}
+		series = prefSeries[0]
+	}
+	curl := &charm.URL{Reference: ref, Series: series}
+	if _, err := s.CharmInfo(curl); err == ErrNotFound {
+		return fmt.Errorf("charm %q not found", curl)
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+// A BundlePublisher is responsible for importing a bundle onto the store.
+type BundlePublisher struct {
+	revision int
+	w        *charmWriter
+}
+
+// Revision returns the revision that will be assigned to the published bundle.
+func (p *BundlePublisher) Revision() int {
+	return p.revision
+}
+
+// Publish verifies that all the charms used by bundle are available
+// in the store, and then archives the bundle and writes it to the store.
+// Publish must be called only once for a BundlePublisher.
+func (p *BundlePublisher) Publish(bundle BundleDir) error {
+	w := p.w
+	if w == nil {
+		panic("BundlePublisher already published a bundle")
+	}
+	p.w = nil
+	if err := w.store.verifyBundle(bundle.Data()); err != nil {
+		logerr := w.store.LogCharmEvent(&CharmEvent{
+			Kind:   EventVerifyError,
+			Digest: w.digest,
+			URLs:   w.urls,
+			Errors: []string{err.Error()},
+		})
+		if logerr != nil {
+			err = fmt.Errorf("%v; %v", err, logerr)
+		}
+		return err
+	}
+	w.bundle = bundle
+	err := bundle.ArchiveTo(w)
+	if err == nil {
+		err = w.finish()
+	} else {
+		w.abort()
+	}
+	return err
+}
+
+// BundlePublisher returns a new BundlePublisher for importing a bundle
+// that will be made available in the store at all of the provided URLs.
+// The digest parameter must contain the unique identifier that
+// represents the bundle data being imported. ErrRedundantUpdate is
+// returned if all of the provided urls are already associated to
+// that digest.
+func (s *Store) BundlePublisher(urls []*charm.URL, digest string) (*BundlePublisher, error) {
+	logger.Infof("trying to add bundles %v with key %q...", urls, digest)
+	if err := mustLackRevision("BundlePublisher", urls...); err != nil {
+		return nil, err
+	}
+	session := s.session.Copy()
+	defer session.Close()
+
+	revision, err := nextRevision(session.Bundles(), urls, digest)
+	if err != nil {
+		return nil, err
+	}
+	logger.Infof("preparing writer to add bundles with revision %d.", revision)
+	w := &charmWriter{
+		store:    s,
+		urls:     urls,
+		revision: revision,
+		digest:   digest,
+	}
+	return &BundlePublisher{revision, w}, nil
+}
+
+// insertBundle inserts the document describing the bundle
+// just written into the GridFS file with the given id.
+func (w *charmWriter) insertBundle(fileId bson.ObjectId, size int64, sha256 string) error {
+	bundle := bundleDoc{
+		URLs:     w.urls,
+		Revision: w.revision,
+		Digest:   w.digest,
+		Sha256:   sha256,
+		Size:     size,
+		FileId:   fileId,
+		Data:     w.bundle.Data(),
+		ReadMe:   w.bundle.ReadMe(),
+	}
+	if err := w.session.Bundles().Insert(&bundle); err != nil {
+		err = maybeConflict(err)
+		logger.Errorf("failed to insert new revision of bundle %v: %v", w.urls, err)
+		return err
+	}
+	return nil
+}
+
+// bundleDoc represents the document stored in MongoDB for a bundle.
+type bundleDoc struct {
+	URLs     []*charm.URL
+	Revision int
+	Digest   string
+	Sha256   string
+	Size     int64
+	FileId   bson.ObjectId
+	Data     *BundleData
+	ReadMe   string
+}
+
+// BundleInfo holds information about a bundle in the store.
+type BundleInfo struct {
+	revision int
+	digest   string
+	sha256   string
+	size     int64
+	fileId   bson.ObjectId
+	data     *BundleData
+	readMe   string
+}
+
+// Revision returns the store bundle's revision.
+func (bi *BundleInfo) Revision() int {
+	return bi.revision
+}
+
+// Digest returns the unique identifier that represents the
+// bundle data imported.
+func (bi *BundleInfo) Digest() string {
+	return bi.digest
+}
+
+// ArchiveSha256 returns the sha256 checksum for the stored bundle archive.
+func (bi *BundleInfo) ArchiveSha256() string {
+	return bi.sha256
+}
+
+// ArchiveSize returns the size of the stored bundle archive.
+func (bi *BundleInfo) ArchiveSize() int64 {
+	return bi.size
+}
+
+// Data returns the contents of the bundle.yaml file of the stored bundle.
+func (bi *BundleInfo) Data() *BundleData {
+	return bi.data
+}
+
+// ReadMe returns the contents of the README.md file of the stored bundle.
+func (bi *BundleInfo) ReadMe() string {
+	return bi.readMe
+}
+
+// BundleInfo retrieves the BundleInfo value for the bundle at url.
+// If url has no revision, the latest revision is returned.
+func (s *Store) BundleInfo(url *charm.URL) (*BundleInfo, error) {
+	session := s.session.Copy()
+	defer session.Close()
+
+	logger.Debugf("retrieving bundle info for %s", url)
+	rev := url.Revision
+	url = url.WithRevision(-1)
+	var qdoc interface{}
+	if rev == -1 {
+		qdoc = bson.D{{"urls", url}}
+	} else {
+		qdoc = bson.D{{"urls", url}, {"revision", rev}}
+	}
+	var bdoc bundleDoc
+	if err := session.Bundles().Find(qdoc).Sort("-revision").One(&bdoc); err != nil {
+		logger.Errorf("failed to find bundle %s: %v", url, err)
+		return nil, ErrNotFound
+	}
+	return &BundleInfo{
+		bdoc.Revision,
+		bdoc.Digest,
+		bdoc.Sha256,
+		bdoc.Size,
+		bdoc.FileId,
+		bdoc.Data,
+		bdoc.ReadMe,
+	}, nil
+}
+
+// OpenBundle opens for reading via rc the bundle archive currently
+// available at url. rc must be closed after dealing with it or
+// resources will leak.
+func (s *Store) OpenBundle(url *charm.URL) (info *BundleInfo, rc io.ReadCloser, err error) {
+	logger.Debugf("opening bundle %s", url)
+	info, err = s.BundleInfo(url)
+	if err != nil {
+		return nil, nil, err
+	}
+	session := s.session.Copy()
+	file, err := session.CharmFS().OpenId(info.fileId)
+	if err != nil {
+		logger.Errorf("failed to open GridFS file for bundle %s: %v", url, err)
+		session.Close()
+		return nil, nil, err
+	}
+	return info, &reader{session, file}, nil
+}
@@ -0,0 +1,282 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"sort"
+
+	"github.com/juju/charm"
+	gc "launchpad.net/gocheck"
+
+	"github.com/juju/charmstore"
+)
+
+const wordpressBundle = `
+series: trusty
+services:
+    wordpress:
+        charm: cs:trusty/wordpress
+        num_units: 2
+        options:
+            blog-title: Awesome
+    mysql:
+        charm: mysql
+relations:
+    - ["wordpress:db", "mysql:server"]
+`
+
+// bundleDir creates a directory holding a bundle with the
+// given bundle.yaml contents and returns its path.
+func bundleDir(c *gc.C, bundleYAML string) string {
+	dir := c.MkDir()
+	err := ioutil.WriteFile(filepath.Join(dir, "bundle.yaml"), []byte(bundleYAML), 0644)
+	c.Assert(err, gc.IsNil)
+	err = ioutil.WriteFile(filepath.Join(dir, "README.md"), []byte("A bundle.\n"), 0644)
+	c.Assert(err, gc.IsNil)
+	return dir
+}
+
+func (s *StoreSuite) publishBundleCharms(c *gc.C) {
+	for _, url := range []string{"cs:trusty/wordpress", "cs:trusty/mysql"} {
+		curl := charm.MustParseURL(url)
+		pub, err := s.store.CharmPublisher([]*charm.URL{curl}, "some-digest")
+		c.Assert(err, gc.IsNil)
+		err = pub.Publish(&FakeCharmDir{})
+		c.Assert(err, gc.IsNil)
+	}
+}
+
+func (s *StoreSuite) TestReadBundleDir(c *gc.C) {
+	bundle, err := charmstore.ReadBundleDir(bundleDir(c, wordpressBundle))
+	c.Assert(err, gc.IsNil)
+	data := bundle.Data()
+	c.Assert(data.Series, gc.Equals, "trusty")
+	c.Assert(data.Services, gc.HasLen, 2)
+	c.Assert(data.Services["wordpress"].Charm, gc.Equals, "cs:trusty/wordpress")
+	c.Assert(data.Services["wordpress"].NumUnits, gc.Equals, 2)
+	c.Assert(data.Relations, gc.DeepEquals, [][]string{{"wordpress:db", "mysql:server"}})
+	c.Assert(bundle.ReadMe(), gc.Equals, "A bundle.\n")
+
+	_, err = charmstore.ReadBundleDir(c.MkDir())
+	c.Assert(err, gc.ErrorMatches, ".*/bundle.yaml: no such file or directory")
+}
+
+func (s *StoreSuite) TestBundlePublisher(c *gc.C) {
+	s.publishBundleCharms(c)
+	burl := charm.MustParseURL("cs:~joe/bundle/wordpress-simple")
+	bundle, err := charmstore.ReadBundleDir(bundleDir(c, wordpressBundle))
+	c.Assert(err, gc.IsNil)
+
+	pub, err := s.store.BundlePublisher([]*charm.URL{burl}, "bundle-digest-0")
+	c.Assert(err, gc.IsNil)
+	c.Assert(pub.Revision(), gc.Equals, 0)
+	err = pub.Publish(bundle)
+	c.Assert(err, gc.IsNil)
+
+	info, rc, err := s.store.OpenBundle(burl)
+	c.Assert(err, gc.IsNil)
+	data, err := ioutil.ReadAll(rc)
+	c.Check(err, gc.IsNil)
+	err = rc.Close()
+	c.Assert(err, gc.IsNil)
+	c.Assert(info.Revision(), gc.Equals, 0)
+	c.Assert(info.Digest(), gc.Equals, "bundle-digest-0")
+	c.Assert(info.ArchiveSize(), gc.Equals, int64(len(data)))
+	c.Assert(info.Data(), gc.DeepEquals, bundle.Data())
+	c.Assert(info.ReadMe(), gc.Equals, "A bundle.\n")
+
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	c.Assert(err, gc.IsNil)
+	var names []string
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+	}
+	sort.Strings(names)
+	c.Assert(names, gc.DeepEquals, []string{"README.md", "bundle.yaml"})
+
+	// Publishing the same digest again is redundant.
+	_, err = s.store.BundlePublisher([]*charm.URL{burl}, "bundle-digest-0")
+	c.Assert(err, gc.Equals, charmstore.ErrRedundantUpdate)
+
+	// A new digest bumps the revision.
+	pub, err = s.store.BundlePublisher([]*charm.URL{burl}, "bundle-digest-1")
+	c.Assert(err, gc.IsNil)
+	c.Assert(pub.Revision(), gc.Equals, 1)
+	err = pub.Publish(bundle)
+	c.Assert(err, gc.IsNil)
+
+	info, err = s.store.BundleInfo(burl)
+	c.Assert(err, gc.IsNil)
+	c.Assert(info.Revision(), gc.Equals, 1)
+	info, err = s.store.BundleInfo(burl.WithRevision(0))
+	c.Assert(err, gc.IsNil)
+	c.Assert(info.Digest(), gc.Equals, "bundle-digest-0")
+
+	// Bundles and charms don't share their namespace.
+	_, err = s.store.CharmInfo(burl)
+	c.Assert(err, gc.Equals, charmstore.ErrNotFound)
+}
+
+var bundleVerificationTests = []struct {
+	about      string
+	bundleYAML string
+	err        string
+}{{
+	about:      "no services",
+	bundleYAML: "services: {}\n",
+	err:        "invalid bundle: bundle has no services",
+}, {
+	about: "charm not in the store",
+	bundleYAML: `
+services:
+    wordpress:
+        charm: cs:trusty/wordpress
+    haproxy:
+        charm: cs:precise/haproxy
+`,
+	err: `invalid bundle: service "haproxy": charm "cs:precise/haproxy" not found`,
+}, {
+	about: "charm without series not in the store",
+	bundleYAML: `
+services:
+    haproxy:
+        charm: haproxy
+`,
+	err: `invalid bundle: service "haproxy": charm "haproxy" not found`,
+}, {
+	about: "local charm",
+	bundleYAML: `
+services:
+    wordpress:
+        charm: local:trusty/wordpress
+`,
+	err: `invalid bundle: service "wordpress": charm "local:trusty/wordpress" is not in the charm store`,
+}, {
+	about: "missing charm",
+	bundleYAML: `
+services:
+    wordpress:
+        num_units: 1
+`,
+	err: `invalid bundle: service "wordpress": no charm specified`,
+}, {
+	about: "relation to unknown service",
+	bundleYAML: `
+services:
+    wordpress:
+        charm: cs:trusty/wordpress
+relations:
+    - ["wordpress:db", "mysql:server"]
+`,
+	err: `invalid bundle: relation \["wordpress:db" "mysql:server"\] refers to unknown service "mysql"`,
+}, {
+	about: "relation with a single endpoint",
+	bundleYAML: `
+services:
+    wordpress:
+        charm: cs:trusty/wordpress
+relations:
+    - ["wordpress:db"]
+`,
+	err: `invalid bundle: relation \["wordpress:db"\] must have two endpoints`,
+}}
+
+func (s *StoreSuite) TestBundlePublisherVerification(c *gc.C) {
+	s.publishBundleCharms(c)
+	burl := charm.MustParseURL("cs:bundle/wordpress-simple")
+	for i, test := range bundleVerificationTests {
+		c.Logf("test %d: %s", i, test.about)
+		bundle, err := charmstore.ReadBundleDir(bundleDir(c, test.bundleYAML))
+		c.Assert(err, gc.IsNil)
+		pub, err := s.store.BundlePublisher([]*charm.URL{burl}, "some-digest")
+		c.Assert(err, gc.IsNil)
+		err = pub.Publish(bundle)
+		c.Assert(err, gc.ErrorMatches, test.err)
+		_, err = s.store.BundleInfo(burl)
+		c.Assert(err, gc.Equals, charmstore.ErrNotFound)
+	}
+}
+
+func (s *StoreSuite) TestBundlePublisherWithRevisionedURL(c *gc.C) {
+	urls := []*charm.URL{charm.MustParseURL("cs:bundle/wordpress-simple-0")}
+	pub, err := s.store.BundlePublisher(urls, "some-digest")
+	c.Assert(err, gc.ErrorMatches, "BundlePublisher: got charm URL with revision: cs:bundle/wordpress-simple-0")
+	c.Assert(pub, gc.IsNil)
+}
+
+func (s *StoreSuite) prepareBundleServer(c *gc.C) (*charmstore.Server, *charm.URL, *charmstore.BundleInfo) {
+	s.publishBundleCharms(c)
+	burl := charm.MustParseURL("cs:bundle/wordpress-simple")
+	bundle, err := charmstore.ReadBundleDir(bundleDir(c, wordpressBundle))
+	c.Assert(err, gc.IsNil)
+	pub, err := s.store.BundlePublisher([]*charm.URL{burl}, "bundle-digest")
+	c.Assert(err, gc.IsNil)
+	err = pub.Publish(bundle)
+	c.Assert(err, gc.IsNil)
+	info, err := s.store.BundleInfo(burl)
+	c.Assert(err, gc.IsNil)
+
+	server, err := charmstore.NewServer(s.store)
+	c.Assert(err, gc.IsNil)
+	return server, burl, info
+}
+
+func (s *StoreSuite) TestServerBundleInfo(c *gc.C) {
+	server, burl, info := s.prepareBundleServer(c)
+	req, err := http.NewRequest("GET", "/bundle-info", nil)
+	c.Assert(err, gc.IsNil)
+	req.Form = url.Values{"bundles": {"cs:wordpress-simple", "cs:bundle/non-existent"}}
+	rec := httptest.NewRecorder()
+	server.ServeHTTP(rec, req)
+	c.Assert(rec.Code, gc.Equals, http.StatusOK)
+	c.Assert(rec.Header().Get("Content-Type"), gc.Equals, "application/json")
+
+	expected := map[string]interface{}{
+		"cs:wordpress-simple": map[string]interface{}{
+			"canonical-url": burl.String(),
+			"revision":      float64(0),
+			"sha256":        info.ArchiveSha256(),
+			"digest":        "bundle-digest",
+		},
+		"cs:bundle/non-existent": map[string]interface{}{
+			"revision": float64(0),
+			"errors":   []interface{}{"entry not found"},
+		},
+	}
+	obtained := map[string]interface{}{}
+	err = json.NewDecoder(rec.Body).Decode(&obtained)
+	c.Assert(err, gc.IsNil)
+	c.Assert(obtained, gc.DeepEquals, expected)
+
+	s.checkCounterSum(c, []string{"bundle-info", "bundle", "wordpress-simple"}, false, 1)
+	s.checkCounterSum(c, []string{"bundle-missing", "bundle", "non-existent"}, false, 1)
+}
+
+func (s *StoreSuite) TestServerBundleStreaming(c *gc.C) {
+	server, _, info := s.prepareBundleServer(c)
+	for _, path := range []string{"/bundle/bundle/wordpress-simple", "/bundle/wordpress-simple-0"} {
+		req, err := http.NewRequest("GET", path, nil)
+		c.Assert(err, gc.IsNil)
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, req)
+		c.Assert(rec.Code, gc.Equals, http.StatusOK)
+		c.Assert(rec.Header().Get("Content-Type"), gc.Equals, "application/zip")
+		c.Assert(rec.Body.Len(), gc.Equals, int(info.ArchiveSize()))
+	}
+	s.checkCounterSum(c, []string{"bundle-archive", "bundle", "wordpress-simple"}, false, 2)
+
+	req, err := http.NewRequest("GET", "/bundle/bundle/non-existent", nil)
+	c.Assert(err, gc.IsNil)
+	rec := httptest.NewRecorder()
+	server.ServeHTTP(rec, req)
+	c.Assert(rec.Code, gc.Equals, http.StatusNotFound)
+}
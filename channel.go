@@ -0,0 +1,144 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/juju/charm"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+// Channel identifies a release channel. Each charm URL may have a
+// revision released in each channel, so that revisions can be tested
+// by a few before being made available to everyone.
+type Channel string
+
+const (
+	// StableChannel holds revisions ready for general use.
+	StableChannel Channel = "stable"
+
+	// CandidateChannel holds revisions being considered for
+	// release in the stable channel.
+	CandidateChannel Channel = "candidate"
+
+	// EdgeChannel always holds the latest published revision.
+	EdgeChannel Channel = "edge"
+)
+
+var channels = map[Channel]bool{
+	StableChannel:    true,
+	CandidateChannel: true,
+	EdgeChannel:      true,
+}
+
+// ParseChannel returns the channel with the given name.
+func ParseChannel(name string) (Channel, error) {
+	channel := Channel(name)
+	if !channels[channel] {
+		return "", fmt.Errorf("unknown channel %q", name)
+	}
+	return channel, nil
+}
+
+// channelDoc represents the document stored in MongoDB for
+// the revision released in a channel for a charm URL.
+type channelDoc struct {
+	URL      *charm.URL
+	Channel  Channel
+	Revision int
+	Time     time.Time
+}
+
+// Release makes the revision of the charm at url the one resolved
+// for url in the given channel. The url must have a revision, and
+// that revision must be available in the store. The edge channel
+// always holds the latest revision, so nothing may be released to it.
+func (s *Store) Release(url *charm.URL, channel Channel, origin Origin) error {
+	if !channels[channel] {
+		return fmt.Errorf("unknown channel %q", channel)
+	}
+	if channel == EdgeChannel {
+		return fmt.Errorf("cannot release to the %s channel", channel)
+	}
+	if url.Revision == -1 {
+		return fmt.Errorf("Release: got charm URL without revision: %s", url)
+	}
+	if _, err := s.CharmInfo(url); err != nil {
+		return err
+	}
+	session := s.session.Copy()
+	defer session.Close()
+
+	logger.Infof("releasing charm %s to the %s channel", url, channel)
+	doc := channelDoc{
+		URL:      url.WithRevision(-1),
+		Channel:  channel,
+		Revision: url.Revision,
+		Time:     time.Now(),
+	}
+	_, err := session.Channels().Upsert(bson.D{{"url", doc.URL}, {"channel", channel}}, &doc)
+	if err != nil {
+		return err
+	}
+	return s.LogCharmEvent(&CharmEvent{
+		Kind:     EventReleased,
+		Revision: url.Revision,
+		URLs:     []*charm.URL{doc.URL},
+		Time:     doc.Time,
+		Actor:    origin.Actor,
+		Reason:   origin.Reason,
+		Channel:  channel,
+	})
+}
+
+// ChannelRevision returns the revision of the charm at url that is
+// released in the given channel. The url must not have a revision.
+// Unqualified URLs with a promulgated name are resolved to the backing
+// user charm, if it has a revision released in the channel.
+// ErrNotFound is returned if no revision was released in the channel.
+func (s *Store) ChannelRevision(url *charm.URL, channel Channel) (int, error) {
+	if err := mustLackRevision("ChannelRevision", url); err != nil {
+		return 0, err
+	}
+	if !channels[channel] {
+		return 0, fmt.Errorf("unknown channel %q", channel)
+	}
+	if channel == EdgeChannel {
+		info, err := s.CharmInfo(url)
+		if err != nil {
+			return 0, err
+		}
+		return info.Revision(), nil
+	}
+	purl, err := s.promulgatedURL(url)
+	if err != nil {
+		return 0, err
+	}
+	if purl != nil {
+		if rev, err := s.channelRevision(purl, channel); err != ErrNotFound {
+			return rev, err
+		}
+	}
+	return s.channelRevision(url, channel)
+}
+
+// channelRevision returns the revision released in
+// the given channel for the charm stored at url.
+func (s *Store) channelRevision(url *charm.URL, channel Channel) (int, error) {
+	session := s.session.Copy()
+	defer session.Close()
+
+	var doc channelDoc
+	err := session.Channels().Find(bson.D{{"url", url}, {"channel", channel}}).One(&doc)
+	if err == mgo.ErrNotFound {
+		return 0, ErrNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+	return doc.Revision, nil
+}
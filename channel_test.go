@@ -0,0 +1,210 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+
+	"github.com/juju/charm"
+	gc "launchpad.net/gocheck"
+
+	"github.com/juju/charmstore"
+)
+
+func (s *TrivialSuite) TestParseChannel(c *gc.C) {
+	for _, name := range []string{"stable", "candidate", "edge"} {
+		channel, err := charmstore.ParseChannel(name)
+		c.Assert(err, gc.IsNil)
+		c.Assert(channel, gc.Equals, charmstore.Channel(name))
+	}
+	_, err := charmstore.ParseChannel("beta")
+	c.Assert(err, gc.ErrorMatches, `unknown channel "beta"`)
+}
+
+// publishRevisions publishes n revisions of a fake charm at curl.
+func (s *StoreSuite) publishRevisions(c *gc.C, curl *charm.URL, n int) {
+	for i := 0; i < n; i++ {
+		pub, err := s.store.CharmPublisher([]*charm.URL{curl}, fmt.Sprintf("digest-%d", i))
+		c.Assert(err, gc.IsNil)
+		err = pub.Publish(&FakeCharmDir{})
+		c.Assert(err, gc.IsNil)
+	}
+}
+
+func (s *StoreSuite) TestRelease(c *gc.C) {
+	curl := charm.MustParseURL("cs:trusty/wordpress")
+	s.publishRevisions(c, curl, 3)
+
+	_, err := s.store.ChannelRevision(curl, charmstore.StableChannel)
+	c.Assert(err, gc.Equals, charmstore.ErrNotFound)
+
+	// The edge channel always holds the latest revision.
+	rev, err := s.store.ChannelRevision(curl, charmstore.EdgeChannel)
+	c.Assert(err, gc.IsNil)
+	c.Assert(rev, gc.Equals, 2)
+
+	err = s.store.Release(curl.WithRevision(1), charmstore.StableChannel, charmstore.Origin{})
+	c.Assert(err, gc.IsNil)
+	err = s.store.Release(curl.WithRevision(2), charmstore.CandidateChannel, charmstore.Origin{})
+	c.Assert(err, gc.IsNil)
+
+	rev, err = s.store.ChannelRevision(curl, charmstore.StableChannel)
+	c.Assert(err, gc.IsNil)
+	c.Assert(rev, gc.Equals, 1)
+	rev, err = s.store.ChannelRevision(curl, charmstore.CandidateChannel)
+	c.Assert(err, gc.IsNil)
+	c.Assert(rev, gc.Equals, 2)
+
+	// Revisions can be moved back and forth.
+	err = s.store.Release(curl.WithRevision(0), charmstore.StableChannel, charmstore.Origin{})
+	c.Assert(err, gc.IsNil)
+	rev, err = s.store.ChannelRevision(curl, charmstore.StableChannel)
+	c.Assert(err, gc.IsNil)
+	c.Assert(rev, gc.Equals, 0)
+
+	// Channels are independent for each URL.
+	_, err = s.store.ChannelRevision(charm.MustParseURL("cs:precise/wordpress"), charmstore.StableChannel)
+	c.Assert(err, gc.Equals, charmstore.ErrNotFound)
+}
+
+func (s *StoreSuite) TestReleasePromulgated(c *gc.C) {
+	curl := charm.MustParseURL("cs:~joe/trusty/wordpress")
+	s.publishRevisions(c, curl, 2)
+	err := s.store.Release(curl.WithRevision(0), charmstore.StableChannel, charmstore.Origin{})
+	c.Assert(err, gc.IsNil)
+	err = s.store.Promulgate(mustParseReference(c, "cs:~joe/wordpress"), charmstore.Origin{})
+	c.Assert(err, gc.IsNil)
+
+	// The release of the user charm applies to its promulgated URL.
+	rev, err := s.store.ChannelRevision(charm.MustParseURL("cs:trusty/wordpress"), charmstore.StableChannel)
+	c.Assert(err, gc.IsNil)
+	c.Assert(rev, gc.Equals, 0)
+	rev, err = s.store.ChannelRevision(charm.MustParseURL("cs:trusty/wordpress"), charmstore.EdgeChannel)
+	c.Assert(err, gc.IsNil)
+	c.Assert(rev, gc.Equals, 1)
+	_, err = s.store.ChannelRevision(charm.MustParseURL("cs:trusty/wordpress"), charmstore.CandidateChannel)
+	c.Assert(err, gc.Equals, charmstore.ErrNotFound)
+}
+
+func (s *StoreSuite) TestReleaseErrors(c *gc.C) {
+	curl := charm.MustParseURL("cs:trusty/wordpress")
+	s.publishRevisions(c, curl, 1)
+
+	err := s.store.Release(curl.WithRevision(5), charmstore.StableChannel, charmstore.Origin{})
+	c.Assert(err, gc.Equals, charmstore.ErrNotFound)
+	err = s.store.Release(curl, charmstore.StableChannel, charmstore.Origin{})
+	c.Assert(err, gc.ErrorMatches, "Release: got charm URL without revision: cs:trusty/wordpress")
+	err = s.store.Release(curl.WithRevision(0), charmstore.EdgeChannel, charmstore.Origin{})
+	c.Assert(err, gc.ErrorMatches, "cannot release to the edge channel")
+	err = s.store.Release(curl.WithRevision(0), charmstore.Channel("beta"), charmstore.Origin{})
+	c.Assert(err, gc.ErrorMatches, `unknown channel "beta"`)
+	_, err = s.store.ChannelRevision(curl.WithRevision(0), charmstore.StableChannel)
+	c.Assert(err, gc.ErrorMatches, "ChannelRevision: got charm URL with revision: cs:trusty/wordpress-0")
+}
+
+func (s *StoreSuite) TestServerCharmInfoChannel(c *gc.C) {
+	curl := charm.MustParseURL("cs:trusty/wordpress")
+	s.publishRevisions(c, curl, 3)
+	err := s.store.Release(curl.WithRevision(1), charmstore.StableChannel, charmstore.Origin{})
+	c.Assert(err, gc.IsNil)
+	server, err := charmstore.NewServer(s.store)
+	c.Assert(err, gc.IsNil)
+
+	tests := []struct {
+		defaultChannel charmstore.Channel
+		query          url.Values
+		revision       int
+		err            string
+	}{{
+		query:    url.Values{"charms": {"cs:wordpress"}},
+		revision: 2,
+	}, {
+		query:    url.Values{"charms": {"cs:wordpress"}, "channel": {"stable"}},
+		revision: 1,
+	}, {
+		query: url.Values{"charms": {"cs:wordpress"}, "channel": {"candidate"}},
+		err:   "entry not found",
+	}, {
+		query: url.Values{"charms": {"cs:wordpress"}, "channel": {"beta"}},
+		err:   `unknown channel "beta"`,
+	}, {
+		defaultChannel: charmstore.StableChannel,
+		query:          url.Values{"charms": {"cs:trusty/wordpress"}},
+		revision:       1,
+	}, {
+		defaultChannel: charmstore.StableChannel,
+		query:          url.Values{"charms": {"cs:trusty/wordpress"}, "channel": {"edge"}},
+		revision:       2,
+	}, {
+		// URLs with no revision released in the default
+		// channel resolve to the latest revision.
+		defaultChannel: charmstore.CandidateChannel,
+		query:          url.Values{"charms": {"cs:trusty/wordpress"}},
+		revision:       2,
+	}, {
+		defaultChannel: charmstore.StableChannel,
+		query:          url.Values{"charms": {"cs:trusty/wordpress"}, "channel": {"candidate"}},
+		err:            "entry not found",
+	}}
+	for i, test := range tests {
+		c.Logf("test %d: %v (default %q)", i, test.query, test.defaultChannel)
+		server.SetDefaultChannel(test.defaultChannel)
+		req, err := http.NewRequest("GET", "/charm-info", nil)
+		c.Assert(err, gc.IsNil)
+		req.Form = test.query
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, req)
+
+		var obtained map[string]*charm.InfoResponse
+		err = json.NewDecoder(rec.Body).Decode(&obtained)
+		c.Assert(err, gc.IsNil)
+		info := obtained[test.query.Get("charms")]
+		c.Assert(info, gc.NotNil)
+		if test.err != "" {
+			c.Assert(info.Errors, gc.DeepEquals, []string{test.err})
+			continue
+		}
+		c.Assert(info.Errors, gc.IsNil)
+		c.Assert(info.Revision, gc.Equals, test.revision)
+		c.Assert(info.Digest, gc.Equals, fmt.Sprintf("digest-%d", test.revision))
+		c.Assert(info.CanonicalURL, gc.Equals, "cs:trusty/wordpress")
+	}
+}
+
+func (s *StoreSuite) TestServerCharmStreamingChannel(c *gc.C) {
+	curl := charm.MustParseURL("cs:trusty/wordpress")
+	s.publishRevisions(c, curl, 2)
+	err := s.store.Release(curl.WithRevision(0), charmstore.StableChannel, charmstore.Origin{})
+	c.Assert(err, gc.IsNil)
+	server, err := charmstore.NewServer(s.store)
+	c.Assert(err, gc.IsNil)
+	server.SetDefaultChannel(charmstore.StableChannel)
+
+	tests := []struct {
+		path string
+		code int
+		data string
+	}{
+		{"/charm/trusty/wordpress", http.StatusOK, "charm-revision-0"},
+		{"/charm/trusty/wordpress?channel=edge", http.StatusOK, "charm-revision-1"},
+		{"/charm/trusty/wordpress-1", http.StatusOK, "charm-revision-1"},
+		{"/charm/trusty/wordpress?channel=candidate", http.StatusNotFound, ""},
+		{"/charm/trusty/wordpress?channel=beta", http.StatusBadRequest, `unknown channel "beta"`},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest("GET", test.path, nil)
+		c.Assert(err, gc.IsNil)
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, req)
+		c.Assert(rec.Code, gc.Equals, test.code, gc.Commentf("Path: %s", test.path))
+		data, err := ioutil.ReadAll(rec.Body)
+		c.Assert(err, gc.IsNil)
+		c.Assert(string(data), gc.Equals, test.data, gc.Commentf("Path: %s", test.path))
+	}
+}
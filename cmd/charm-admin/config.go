@@ -5,6 +5,7 @@ package main
 
 import (
 	"fmt"
+	"os"
 
 	"github.com/juju/cmd"
 	"launchpad.net/gnuflag"
@@ -38,3 +39,12 @@ func (c *ConfigCommand) ReadConfig(ctx *cmd.Context) (err error) {
 	c.Config, err = charmstore.ReadConfig(ctx.AbsPath(c.ConfigPath))
 	return err
 }
+
+// commandOrigin returns the origin recorded in the events logged for
+// the changes made by a command, attributing them to the user running it.
+func commandOrigin(reason string) charmstore.Origin {
+	return charmstore.Origin{
+		Actor:  os.Getenv("USER"),
+		Reason: reason,
+	}
+}
@@ -15,7 +15,8 @@ import (
 
 type DeleteCharmCommand struct {
 	ConfigCommand
-	Url string
+	Url    string
+	Reason string
 }
 
 func (c *DeleteCharmCommand) Info() *cmd.Info {
@@ -28,6 +29,7 @@ func (c *DeleteCharmCommand) Info() *cmd.Info {
 func (c *DeleteCharmCommand) SetFlags(f *gnuflag.FlagSet) {
 	c.ConfigCommand.SetFlags(f)
 	f.StringVar(&c.Url, "url", "", "charm URL")
+	f.StringVar(&c.Reason, "reason", "", "reason for the deletion, recorded in the charm events")
 }
 
 func (c *DeleteCharmCommand) Init(args []string) error {
@@ -63,7 +65,7 @@ func (c *DeleteCharmCommand) Run(ctx *cmd.Context) error {
 	defer s.Close()
 
 	// Delete the charm by URL
-	_, err = s.DeleteCharm(charmUrl)
+	_, err = s.DeleteCharm(charmUrl, commandOrigin(c.Reason))
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,83 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/juju/cmd"
+	"launchpad.net/gnuflag"
+
+	"github.com/juju/charmstore"
+)
+
+type ExportCommand struct {
+	ConfigCommand
+	File  string
+	Stats bool
+}
+
+func (c *ExportCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "export",
+		Purpose: "write an archive of the store contents",
+		Doc: `
+The archive holds the charms and bundles in the store, along with
+the charm events, channel releases and promulgations, and can be
+loaded into another store with the import command.
+`,
+	}
+}
+
+func (c *ExportCommand) SetFlags(f *gnuflag.FlagSet) {
+	c.ConfigCommand.SetFlags(f)
+	f.StringVar(&c.File, "file", "", "path of the archive written")
+	f.BoolVar(&c.Stats, "stats", false, "include the statistics counters")
+}
+
+func (c *ExportCommand) Init(args []string) error {
+	err := c.ConfigCommand.Init(args)
+	if err != nil {
+		return err
+	}
+	if c.File == "" {
+		return fmt.Errorf("--file is required")
+	}
+	return nil
+}
+
+func (c *ExportCommand) Run(ctx *cmd.Context) error {
+	err := c.ConfigCommand.ReadConfig(ctx)
+	if err != nil {
+		return err
+	}
+
+	s, err := charmstore.Open(c.Config.MongoURL)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	f, err := os.Create(ctx.AbsPath(c.File))
+	if err != nil {
+		return err
+	}
+	report, err := s.Export(f, &charmstore.ExportOptions{Stats: c.Stats})
+	if err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err != nil {
+		os.Remove(ctx.AbsPath(c.File))
+		return err
+	}
+	fmt.Fprintf(ctx.Stdout, "Exported %s.\n", report)
+	return nil
+}
+
+func (c *ExportCommand) AllowInterspersedFlags() bool {
+	return true
+}
@@ -0,0 +1,69 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/juju/charm"
+	charmtesting "github.com/juju/charm/testing"
+	"github.com/juju/cmd/cmdtesting"
+	gitjujutesting "github.com/juju/testing"
+	gc "launchpad.net/gocheck"
+
+	"github.com/juju/charmstore"
+)
+
+type exportSuite struct {
+	gitjujutesting.IsolationSuite
+}
+
+var _ = gc.Suite(&exportSuite{})
+
+func (s *exportSuite) TestInit(c *gc.C) {
+	export := &ExportCommand{}
+	err := cmdtesting.InitCommand(export, []string{"--config", "/etc/charmd.conf", "--file", "store.tar.gz", "--stats"})
+	c.Assert(err, gc.IsNil)
+	c.Assert(export.File, gc.Equals, "store.tar.gz")
+	c.Assert(export.Stats, gc.Equals, true)
+
+	err = cmdtesting.InitCommand(&ExportCommand{}, []string{"--config", "/etc/charmd.conf"})
+	c.Assert(err, gc.ErrorMatches, "--file is required")
+
+	imp := &ImportCommand{}
+	err = cmdtesting.InitCommand(imp, []string{"--config", "/etc/charmd.conf", "--file", "store.tar.gz"})
+	c.Assert(err, gc.IsNil)
+	c.Assert(imp.OnConflict, gc.Equals, "fail")
+
+	err = cmdtesting.InitCommand(&ImportCommand{}, []string{"--config", "/etc/charmd.conf", "--file", "store.tar.gz", "--on-conflict", "bad"})
+	c.Assert(err, gc.ErrorMatches, `unknown conflict policy "bad"`)
+}
+
+func (s *exportSuite) TestRun(c *gc.C) {
+	dir := c.MkDir()
+	configPath := filepath.Join(dir, "charmd.conf")
+	contents := "mongo-url: " + gitjujutesting.MgoServer.Addr() + "\n"
+	err := ioutil.WriteFile(configPath, []byte(contents), 0666)
+	c.Assert(err, gc.IsNil)
+
+	store, err := charmstore.Open(gitjujutesting.MgoServer.Addr())
+	c.Assert(err, gc.IsNil)
+	defer store.Close()
+	pub, err := store.CharmPublisher([]*charm.URL{charm.MustParseURL("cs:precise/exported")}, "digest")
+	c.Assert(err, gc.IsNil)
+	err = pub.Publish(charmtesting.Charms.ClonedDir(c.MkDir(), "dummy"))
+	c.Assert(err, gc.IsNil)
+
+	archivePath := filepath.Join(dir, "store.tar.gz")
+	ctx, err := cmdtesting.RunCommand(c, &ExportCommand{}, "--config", configPath, "--file", archivePath)
+	c.Assert(err, gc.IsNil)
+	c.Assert(cmdtesting.Stdout(ctx), gc.Equals, "Exported 1 charms, 0 bundles, 0 events, 0 channel releases, 0 promulgations, 0 counters.\n")
+
+	ctx, err = cmdtesting.RunCommand(c, &ImportCommand{}, "--config", configPath, "--file", archivePath)
+	c.Assert(err, gc.IsNil)
+	c.Assert(cmdtesting.Stdout(ctx), gc.Equals, ""+
+		"Imported 0 charms, 0 bundles, 0 events, 0 channel releases, 0 promulgations, 0 counters.\n"+
+		"Already present: 1 charms and bundles.\n")
+}
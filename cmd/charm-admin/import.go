@@ -0,0 +1,90 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/juju/cmd"
+	"launchpad.net/gnuflag"
+
+	"github.com/juju/charmstore"
+)
+
+type ImportCommand struct {
+	ConfigCommand
+	File       string
+	OnConflict string
+}
+
+func (c *ImportCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "import",
+		Purpose: "load an archive written by the export command",
+		Doc: `
+Charms and bundles already in the store are left untouched. When an
+archived charm or bundle has the same URL and revision as a different
+one in the store, the import fails without changing the store, unless
+--on-conflict=skip is used to import the other entries.
+`,
+	}
+}
+
+func (c *ImportCommand) SetFlags(f *gnuflag.FlagSet) {
+	c.ConfigCommand.SetFlags(f)
+	f.StringVar(&c.File, "file", "", "path of the archive loaded")
+	f.StringVar(&c.OnConflict, "on-conflict", string(charmstore.ConflictFail), `conflict handling ("fail" or "skip")`)
+}
+
+func (c *ImportCommand) Init(args []string) error {
+	err := c.ConfigCommand.Init(args)
+	if err != nil {
+		return err
+	}
+	if c.File == "" {
+		return fmt.Errorf("--file is required")
+	}
+	_, err = charmstore.ParseConflictPolicy(c.OnConflict)
+	return err
+}
+
+func (c *ImportCommand) Run(ctx *cmd.Context) error {
+	err := c.ConfigCommand.ReadConfig(ctx)
+	if err != nil {
+		return err
+	}
+	policy, err := charmstore.ParseConflictPolicy(c.OnConflict)
+	if err != nil {
+		return err
+	}
+
+	s, err := charmstore.Open(c.Config.MongoURL)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	f, err := os.Open(ctx.AbsPath(c.File))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	report, err := s.Import(f, &charmstore.ImportOptions{OnConflict: policy})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(ctx.Stdout, "Imported %s.\n", report)
+	if report.Existing > 0 {
+		fmt.Fprintf(ctx.Stdout, "Already present: %d charms and bundles.\n", report.Existing)
+	}
+	for _, url := range report.Conflicts {
+		fmt.Fprintln(ctx.Stdout, "Conflict:", url)
+	}
+	return nil
+}
+
+func (c *ImportCommand) AllowInterspersedFlags() bool {
+	return true
+}
@@ -23,6 +23,22 @@ func main() {
 	})
 
 	admcmd.Register(&DeleteCharmCommand{})
+	admcmd.Register(&EventsCommand{})
+	admcmd.Register(&ExportCommand{})
+	admcmd.Register(&FetchCommand{})
+	admcmd.Register(&ImportCommand{})
+	admcmd.Register(&InfoCommand{})
+	admcmd.Register(&MapURLCommand{})
+	admcmd.Register(&MirrorCommand{})
+	admcmd.Register(&PublishBundleCommand{})
+	admcmd.Register(&PromulgateCommand{})
+	admcmd.Register(&ReleaseCommand{})
+	admcmd.Register(&RetryPublishCommand{})
+	admcmd.Register(&RevisionsCommand{})
+	admcmd.Register(&StatsCommand{})
+	admcmd.Register(&SubsetCommand{})
+	admcmd.Register(&UsageCommand{})
+	admcmd.Register(newWebhookCommand())
 
 	os.Exit(cmd.Main(admcmd, ctx, os.Args[1:]))
 }
@@ -0,0 +1,74 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/juju/cmd"
+	"launchpad.net/gnuflag"
+
+	"github.com/juju/charmstore"
+)
+
+type MapURLCommand struct {
+	ConfigCommand
+	Name string
+}
+
+func (c *MapURLCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "map-url",
+		Purpose: "show the charm URLs a branch is published at",
+		Doc: `
+The branch name is mapped according to the url-mapping rules
+in the configuration file, as done when publishing charms from
+Launchpad, e.g. ~joe/charms/precise/foo/trunk.
+`,
+	}
+}
+
+func (c *MapURLCommand) SetFlags(f *gnuflag.FlagSet) {
+	c.ConfigCommand.SetFlags(f)
+	f.StringVar(&c.Name, "name", "", "unique name of the branch")
+}
+
+func (c *MapURLCommand) Init(args []string) error {
+	err := c.ConfigCommand.Init(args)
+	if err != nil {
+		return err
+	}
+	if c.Name == "" {
+		return fmt.Errorf("--name is required")
+	}
+	return nil
+}
+
+func (c *MapURLCommand) Run(ctx *cmd.Context) error {
+	err := c.ConfigCommand.ReadConfig(ctx)
+	if err != nil {
+		return err
+	}
+	mapping := c.Config.URLMapping
+	if mapping == nil {
+		mapping = charmstore.DefaultURLMapping
+	}
+	bm, err := mapping.Map(c.Name)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(ctx.Stdout, "Branch:", bm.BranchURL)
+	if bm.Skipped != "" {
+		fmt.Fprintln(ctx.Stdout, "Skipped:", bm.Skipped)
+		return nil
+	}
+	for _, url := range bm.URLs {
+		fmt.Fprintln(ctx.Stdout, "Charm URL:", url)
+	}
+	return nil
+}
+
+func (c *MapURLCommand) AllowInterspersedFlags() bool {
+	return true
+}
@@ -0,0 +1,100 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/juju/cmd/cmdtesting"
+	gitjujutesting "github.com/juju/testing"
+	gc "launchpad.net/gocheck"
+)
+
+type mapURLSuite struct {
+	gitjujutesting.IsolationSuite
+}
+
+var _ = gc.Suite(&mapURLSuite{})
+
+func (s *mapURLSuite) TestInit(c *gc.C) {
+	config := &MapURLCommand{}
+	err := cmdtesting.InitCommand(config, []string{"--config", "/etc/charmd.conf", "--name", "~joe/charms/precise/foo/trunk"})
+	c.Assert(err, gc.IsNil)
+	c.Assert(config.Name, gc.Equals, "~joe/charms/precise/foo/trunk")
+
+	err = cmdtesting.InitCommand(&MapURLCommand{}, []string{"--config", "/etc/charmd.conf"})
+	c.Assert(err, gc.ErrorMatches, "--name is required")
+}
+
+const mapURLConfig = `
+mongo-url: localhost:23456
+url-mapping:
+  suffixes: [/trunk, /stable]
+  exclude: ["^~evil/"]
+  rules:
+    - pattern: '^~charmers/charms/(?P<series>[^/]+)/(?P<name>[^/]+)/(trunk|stable)$'
+      urls: [cs:~charmers/$series/$name, cs:$series/$name]
+    - pattern: '^~(?P<user>[^/]+)/charms/(?P<series>[^/]+)/(?P<name>[^/]+)/trunk$'
+      urls: [cs:~$user/$series/$name]
+`
+
+var mapURLTests = []struct {
+	about  string
+	config string
+	name   string
+	output string
+	err    string
+}{{
+	about:  "default mapping",
+	config: "mongo-url: localhost:23456\n",
+	name:   "~joe/charms/precise/foo/trunk",
+	output: "Branch: lp:~joe/charms/precise/foo/trunk\nCharm URL: cs:~joe/precise/foo\n",
+}, {
+	about:  "default mapping, skipped",
+	config: "mongo-url: localhost:23456\n",
+	name:   "~joe/charms/precise/foo/stable",
+	output: "Branch: lp:~joe/charms/precise/foo/stable\nSkipped: branch name suffix not accepted\n",
+}, {
+	about:  "default mapping, unwanted",
+	config: "mongo-url: localhost:23456\n",
+	name:   "~joe/foo/trunk",
+	err:    "unwanted branch name: ~joe/foo/trunk",
+}, {
+	about:  "extra URLs",
+	config: mapURLConfig,
+	name:   "~charmers/charms/precise/foo/stable",
+	output: "Branch: lp:~charmers/charms/precise/foo/stable\nCharm URL: cs:~charmers/precise/foo\nCharm URL: cs:precise/foo\n",
+}, {
+	about:  "second rule",
+	config: mapURLConfig,
+	name:   "~joe/charms/precise/foo/trunk",
+	output: "Branch: lp:~joe/charms/precise/foo/trunk\nCharm URL: cs:~joe/precise/foo\n",
+}, {
+	about:  "excluded",
+	config: mapURLConfig,
+	name:   "~evil/charms/precise/foo/trunk",
+	output: "Branch: lp:~evil/charms/precise/foo/trunk\nSkipped: branch name excluded by pattern \"^~evil/\"\n",
+}, {
+	about:  "invalid rules",
+	config: "url-mapping:\n  exclude: ['(']\n",
+	name:   "~joe/charms/precise/foo/trunk",
+	err:    "invalid exclusion pattern: .*",
+}}
+
+func (s *mapURLSuite) TestRun(c *gc.C) {
+	for i, test := range mapURLTests {
+		c.Logf("test %d: %s", i, test.about)
+		configPath := filepath.Join(c.MkDir(), "charmd.conf")
+		err := ioutil.WriteFile(configPath, []byte(test.config), 0666)
+		c.Assert(err, gc.IsNil)
+		ctx, err := cmdtesting.RunCommand(c, &MapURLCommand{}, "--config", configPath, "--name", test.name)
+		if test.err != "" {
+			c.Assert(err, gc.ErrorMatches, test.err)
+			continue
+		}
+		c.Assert(err, gc.IsNil)
+		c.Assert(cmdtesting.Stdout(ctx), gc.Equals, test.output)
+	}
+}
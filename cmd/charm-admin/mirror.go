@@ -0,0 +1,115 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/juju/charm"
+	"github.com/juju/cmd"
+	"launchpad.net/gnuflag"
+
+	"github.com/juju/charmstore"
+)
+
+type MirrorCommand struct {
+	ConfigCommand
+	From   string
+	Users  string
+	Series string
+	Urls   string
+}
+
+func (c *MirrorCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "mirror",
+		Purpose: "replicate charms from another charm store",
+		Doc: `
+The charms published in the remote store since the last run are
+replicated, preserving their revisions and digests. The charms are
+selected by namespace (--users), series (--series) or charm URL
+(--urls); each flag takes a comma-separated list. Use "-" in --users
+to select the charms with no user namespace.
+`,
+	}
+}
+
+func (c *MirrorCommand) SetFlags(f *gnuflag.FlagSet) {
+	c.ConfigCommand.SetFlags(f)
+	f.StringVar(&c.From, "from", "", "base URL of the remote charm store API")
+	f.StringVar(&c.Users, "users", "", "namespaces of the charms replicated")
+	f.StringVar(&c.Series, "series", "", "series of the charms replicated")
+	f.StringVar(&c.Urls, "urls", "", "charm URLs replicated")
+}
+
+func (c *MirrorCommand) Init(args []string) error {
+	err := c.ConfigCommand.Init(args)
+	if err != nil {
+		return err
+	}
+	if c.From == "" {
+		return fmt.Errorf("--from is required")
+	}
+	return nil
+}
+
+func (c *MirrorCommand) Run(ctx *cmd.Context) error {
+	err := c.ConfigCommand.ReadConfig(ctx)
+	if err != nil {
+		return err
+	}
+	sel := &charmstore.MirrorSelection{
+		Series: splitList(c.Series),
+	}
+	for _, user := range splitList(c.Users) {
+		if user == "-" {
+			user = ""
+		}
+		sel.Users = append(sel.Users, user)
+	}
+	for _, url := range splitList(c.Urls) {
+		curl, err := charm.ParseURL(url)
+		if err != nil {
+			return err
+		}
+		sel.URLs = append(sel.URLs, curl)
+	}
+
+	s, err := charmstore.Open(c.Config.MongoURL)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	if err := s.LoadSigningKey(c.Config); err != nil {
+		return err
+	}
+	if err := s.LoadStorageLimits(c.Config); err != nil {
+		return err
+	}
+
+	report, err := charmstore.NewMirror(s, c.From, sel).Run()
+	if report != nil {
+		for _, url := range report.Mirrored {
+			fmt.Fprintln(ctx.Stdout, "Mirrored:", url)
+		}
+		fmt.Fprintf(ctx.Stdout, "Charms: %s.\n", report)
+	}
+	return err
+}
+
+// splitList returns the elements of the comma-separated list s.
+func splitList(s string) []string {
+	var list []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+func (c *MirrorCommand) AllowInterspersedFlags() bool {
+	return true
+}
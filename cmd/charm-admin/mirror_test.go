@@ -0,0 +1,75 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"path/filepath"
+
+	"github.com/juju/charm"
+	charmtesting "github.com/juju/charm/testing"
+	"github.com/juju/cmd/cmdtesting"
+	gitjujutesting "github.com/juju/testing"
+	gc "launchpad.net/gocheck"
+
+	"github.com/juju/charmstore"
+)
+
+type mirrorSuite struct {
+	gitjujutesting.IsolationSuite
+}
+
+var _ = gc.Suite(&mirrorSuite{})
+
+func (s *mirrorSuite) TestInit(c *gc.C) {
+	config := &MirrorCommand{}
+	err := cmdtesting.InitCommand(config, []string{"--config", "/etc/charmd.conf", "--from", "http://remote", "--users", "joe,-"})
+	c.Assert(err, gc.IsNil)
+	c.Assert(config.From, gc.Equals, "http://remote")
+	c.Assert(config.Users, gc.Equals, "joe,-")
+
+	err = cmdtesting.InitCommand(&MirrorCommand{}, []string{"--config", "/etc/charmd.conf"})
+	c.Assert(err, gc.ErrorMatches, "--from is required")
+}
+
+func (s *mirrorSuite) TestRun(c *gc.C) {
+	configPath := filepath.Join(c.MkDir(), "charmd.conf")
+	contents := "mongo-url: " + gitjujutesting.MgoServer.Addr() + "\n"
+	err := ioutil.WriteFile(configPath, []byte(contents), 0666)
+	c.Assert(err, gc.IsNil)
+
+	remote, err := charmstore.OpenDB(gitjujutesting.MgoServer.Addr(), "juju-remote")
+	c.Assert(err, gc.IsNil)
+	defer remote.Close()
+	handler, err := charmstore.NewServer(remote)
+	c.Assert(err, gc.IsNil)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	for _, url := range []string{"cs:precise/mirrored", "cs:~joe/precise/ignored"} {
+		curl := charm.MustParseURL(url)
+		pub, err := remote.CharmPublisher([]*charm.URL{curl}, "digest")
+		c.Assert(err, gc.IsNil)
+		err = pub.Publish(charmtesting.Charms.ClonedDir(c.MkDir(), "dummy"))
+		c.Assert(err, gc.IsNil)
+		err = remote.LogCharmEvent(&charmstore.CharmEvent{
+			Kind:   charmstore.EventPublished,
+			Digest: "digest",
+			URLs:   []*charm.URL{curl},
+		})
+		c.Assert(err, gc.IsNil)
+	}
+
+	ctx, err := cmdtesting.RunCommand(c, &MirrorCommand{}, "--config", configPath, "--from", server.URL, "--users", "-")
+	c.Assert(err, gc.IsNil)
+	c.Assert(cmdtesting.Stdout(ctx), gc.Equals, "Mirrored: cs:precise/mirrored-0\nCharms: 1 mirrored, 0 redundant, 0 skipped.\n")
+
+	store, err := charmstore.Open(gitjujutesting.MgoServer.Addr())
+	c.Assert(err, gc.IsNil)
+	defer store.Close()
+	info, err := store.CharmInfo(charm.MustParseURL("cs:precise/mirrored"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(info.Digest(), gc.Equals, "digest")
+}
@@ -0,0 +1,92 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/juju/charm"
+	"github.com/juju/cmd"
+	"launchpad.net/gnuflag"
+
+	"github.com/juju/charmstore"
+)
+
+type PromulgateCommand struct {
+	ConfigCommand
+	Url    string
+	Revoke bool
+	Reason string
+}
+
+func (c *PromulgateCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "promulgate",
+		Purpose: "make a user charm available at the unqualified charm URL",
+		Doc: `
+The promulgate command makes all the series of the charm in a user
+namespace, e.g. cs:~joe/mysql, also available at the unqualified charm
+URLs, e.g. cs:trusty/mysql. With --revoke, the promulgation is removed.
+When the signing-key option is set, the charm revisions are signed for
+the unqualified URLs.
+`,
+	}
+}
+
+func (c *PromulgateCommand) SetFlags(f *gnuflag.FlagSet) {
+	c.ConfigCommand.SetFlags(f)
+	f.StringVar(&c.Url, "url", "", "charm URL in a user namespace, without series")
+	f.BoolVar(&c.Revoke, "revoke", false, "remove the promulgation")
+	f.StringVar(&c.Reason, "reason", "", "reason for the change, recorded in the charm events")
+}
+
+func (c *PromulgateCommand) Init(args []string) error {
+	err := c.ConfigCommand.Init(args)
+	if err != nil {
+		return err
+	}
+	if c.Url == "" {
+		return fmt.Errorf("--url is required")
+	}
+	return nil
+}
+
+func (c *PromulgateCommand) Run(ctx *cmd.Context) error {
+	err := c.ConfigCommand.ReadConfig(ctx)
+	if err != nil {
+		return err
+	}
+	ref, series, err := charm.ParseReference(c.Url)
+	if err != nil {
+		return err
+	}
+	if series != "" {
+		return fmt.Errorf("charm URL must not include a series: %s", c.Url)
+	}
+	if ref.User == "" {
+		return fmt.Errorf("charm URL must be in a user namespace: %s", c.Url)
+	}
+
+	s, err := charmstore.Open(c.Config.MongoURL)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	if err := s.LoadSigningKey(c.Config); err != nil {
+		return err
+	}
+
+	if c.Revoke {
+		if err := s.Unpromulgate(ref, commandOrigin(c.Reason)); err != nil {
+			return err
+		}
+		fmt.Fprintln(ctx.Stdout, "Charm", ref, "unpromulgated.")
+		return nil
+	}
+	if err := s.Promulgate(ref, commandOrigin(c.Reason)); err != nil {
+		return err
+	}
+	fmt.Fprintln(ctx.Stdout, "Charm", ref, "promulgated.")
+	return nil
+}
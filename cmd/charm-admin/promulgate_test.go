@@ -0,0 +1,68 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/juju/charm"
+	charmtesting "github.com/juju/charm/testing"
+	"github.com/juju/cmd/cmdtesting"
+	gitjujutesting "github.com/juju/testing"
+	gc "launchpad.net/gocheck"
+
+	"github.com/juju/charmstore"
+)
+
+type promulgateSuite struct {
+	gitjujutesting.IsolationSuite
+}
+
+var _ = gc.Suite(&promulgateSuite{})
+
+func (s *promulgateSuite) TestInit(c *gc.C) {
+	config := &PromulgateCommand{}
+	err := cmdtesting.InitCommand(config, []string{"--config", "/etc/charmd.conf", "--url", "cs:~joe/go", "--revoke"})
+	c.Assert(err, gc.IsNil)
+	c.Assert(config.Url, gc.Equals, "cs:~joe/go")
+	c.Assert(config.Revoke, gc.Equals, true)
+
+	err = cmdtesting.InitCommand(&PromulgateCommand{}, []string{"--config", "/etc/charmd.conf"})
+	c.Assert(err, gc.ErrorMatches, "--url is required")
+}
+
+func (s *promulgateSuite) TestRun(c *gc.C) {
+	configPath := filepath.Join(c.MkDir(), "charmd.conf")
+	contents := "mongo-url: " + gitjujutesting.MgoServer.Addr() + "\n"
+	err := ioutil.WriteFile(configPath, []byte(contents), 0666)
+	c.Assert(err, gc.IsNil)
+
+	store, err := charmstore.Open(gitjujutesting.MgoServer.Addr())
+	c.Assert(err, gc.IsNil)
+	defer store.Close()
+	url := charm.MustParseURL("cs:~joe/unreleased/promulgate-me")
+	pub, err := store.CharmPublisher([]*charm.URL{url}, "promulgate-digest")
+	c.Assert(err, gc.IsNil)
+	err = pub.Publish(charmtesting.Charms.ClonedDir(c.MkDir(), "dummy"))
+	c.Assert(err, gc.IsNil)
+
+	_, err = cmdtesting.RunCommand(c, &PromulgateCommand{}, "--config", configPath, "--url", "cs:~joe/unreleased/promulgate-me")
+	c.Assert(err, gc.ErrorMatches, "charm URL must not include a series: .*")
+	_, err = cmdtesting.RunCommand(c, &PromulgateCommand{}, "--config", configPath, "--url", "cs:promulgate-me")
+	c.Assert(err, gc.ErrorMatches, "charm URL must be in a user namespace: cs:promulgate-me")
+
+	ctx, err := cmdtesting.RunCommand(c, &PromulgateCommand{}, "--config", configPath, "--url", "cs:~joe/promulgate-me")
+	c.Assert(err, gc.IsNil)
+	c.Assert(cmdtesting.Stdout(ctx), gc.Equals, "Charm cs:~joe/promulgate-me promulgated.\n")
+	info, err := store.CharmInfo(charm.MustParseURL("cs:unreleased/promulgate-me"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(info.Digest(), gc.Equals, "promulgate-digest")
+
+	ctx, err = cmdtesting.RunCommand(c, &PromulgateCommand{}, "--config", configPath, "--url", "cs:~joe/promulgate-me", "--revoke")
+	c.Assert(err, gc.IsNil)
+	c.Assert(cmdtesting.Stdout(ctx), gc.Equals, "Charm cs:~joe/promulgate-me unpromulgated.\n")
+	_, err = store.CharmInfo(charm.MustParseURL("cs:unreleased/promulgate-me"))
+	c.Assert(err, gc.Equals, charmstore.ErrNotFound)
+}
@@ -0,0 +1,105 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/juju/charm"
+	"github.com/juju/cmd"
+	"launchpad.net/gnuflag"
+
+	"github.com/juju/charmstore"
+)
+
+type PublishBundleCommand struct {
+	ConfigCommand
+	Url    string
+	Path   string
+	Digest string
+}
+
+func (c *PublishBundleCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "publish-bundle",
+		Purpose: "publish a bundle to the charm store",
+		Doc: `
+The bundle directory must contain a bundle.yaml file describing the
+services to deploy and their relations. All the charms referred to
+by the bundle must be available in the charm store.
+
+If no digest is provided, the SHA256 checksum of the bundle archive
+is used, so that publishing unchanged content is a no-op.
+`,
+	}
+}
+
+func (c *PublishBundleCommand) SetFlags(f *gnuflag.FlagSet) {
+	c.ConfigCommand.SetFlags(f)
+	f.StringVar(&c.Url, "url", "", "bundle URL")
+	f.StringVar(&c.Path, "path", "", "bundle directory")
+	f.StringVar(&c.Digest, "digest", "", "unique identifier of the bundle content")
+}
+
+func (c *PublishBundleCommand) Init(args []string) error {
+	err := c.ConfigCommand.Init(args)
+	if err != nil {
+		return err
+	}
+	if c.Url == "" {
+		return fmt.Errorf("--url is required")
+	}
+	if c.Path == "" {
+		return fmt.Errorf("--path is required")
+	}
+	return nil
+}
+
+func (c *PublishBundleCommand) Run(ctx *cmd.Context) error {
+	err := c.ConfigCommand.ReadConfig(ctx)
+	if err != nil {
+		return err
+	}
+	bundleUrl, err := charm.ParseURL(c.Url)
+	if err != nil {
+		return err
+	}
+	bundle, err := charmstore.ReadBundleDir(ctx.AbsPath(c.Path))
+	if err != nil {
+		return err
+	}
+	digest := c.Digest
+	if digest == "" {
+		h := sha256.New()
+		if err := bundle.ArchiveTo(h); err != nil {
+			return err
+		}
+		digest = hex.EncodeToString(h.Sum(nil))
+	}
+
+	s, err := charmstore.Open(c.Config.MongoURL)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	if err := s.LoadStorageLimits(c.Config); err != nil {
+		return err
+	}
+
+	pub, err := s.BundlePublisher([]*charm.URL{bundleUrl}, digest)
+	if err != nil {
+		return err
+	}
+	if err := pub.Publish(bundle); err != nil {
+		return err
+	}
+	fmt.Fprintln(ctx.Stdout, "Bundle", bundleUrl.WithRevision(pub.Revision()), "published.")
+	return nil
+}
+
+func (c *PublishBundleCommand) AllowInterspersedFlags() bool {
+	return true
+}
@@ -0,0 +1,66 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/juju/charm"
+	charmtesting "github.com/juju/charm/testing"
+	"github.com/juju/cmd/cmdtesting"
+	gitjujutesting "github.com/juju/testing"
+	gc "launchpad.net/gocheck"
+
+	"github.com/juju/charmstore"
+)
+
+type publishBundleSuite struct {
+	gitjujutesting.IsolationSuite
+}
+
+var _ = gc.Suite(&publishBundleSuite{})
+
+func (s *publishBundleSuite) TestInit(c *gc.C) {
+	config := &PublishBundleCommand{}
+	err := cmdtesting.InitCommand(config, []string{"--config", "/etc/charmd.conf", "--url", "cs:bundle/go", "--path", "/tmp/go"})
+	c.Assert(err, gc.IsNil)
+	c.Assert(config.ConfigPath, gc.Equals, "/etc/charmd.conf")
+	c.Assert(config.Url, gc.Equals, "cs:bundle/go")
+	c.Assert(config.Path, gc.Equals, "/tmp/go")
+
+	err = cmdtesting.InitCommand(&PublishBundleCommand{}, []string{"--config", "/etc/charmd.conf", "--url", "cs:bundle/go"})
+	c.Assert(err, gc.ErrorMatches, "--path is required")
+}
+
+func (s *publishBundleSuite) TestRun(c *gc.C) {
+	configPath := filepath.Join(c.MkDir(), "charmd.conf")
+	contents := "mongo-url: " + gitjujutesting.MgoServer.Addr() + "\n"
+	err := ioutil.WriteFile(configPath, []byte(contents), 0666)
+	c.Assert(err, gc.IsNil)
+
+	store, err := charmstore.Open(gitjujutesting.MgoServer.Addr())
+	c.Assert(err, gc.IsNil)
+	defer store.Close()
+	pub, err := store.CharmPublisher([]*charm.URL{charm.MustParseURL("cs:trusty/dummy")}, "dummy-digest")
+	c.Assert(err, gc.IsNil)
+	err = pub.Publish(charmtesting.Charms.ClonedDir(c.MkDir(), "dummy"))
+	c.Assert(err, gc.IsNil)
+
+	bundlePath := c.MkDir()
+	err = ioutil.WriteFile(filepath.Join(bundlePath, "bundle.yaml"), []byte("services: {dummy: {charm: cs:trusty/dummy}}\n"), 0644)
+	c.Assert(err, gc.IsNil)
+
+	ctx, err := cmdtesting.RunCommand(c, &PublishBundleCommand{}, "--config", configPath, "--url", "cs:bundle/dummy", "--path", bundlePath)
+	c.Assert(err, gc.IsNil)
+	c.Assert(cmdtesting.Stdout(ctx), gc.Equals, "Bundle cs:bundle/dummy-0 published.\n")
+
+	info, err := store.BundleInfo(charm.MustParseURL("cs:bundle/dummy"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(info.Data().Services["dummy"].Charm, gc.Equals, "cs:trusty/dummy")
+
+	// Publishing the same content again is redundant.
+	_, err = cmdtesting.RunCommand(c, &PublishBundleCommand{}, "--config", configPath, "--url", "cs:bundle/dummy", "--path", bundlePath)
+	c.Assert(err, gc.Equals, charmstore.ErrRedundantUpdate)
+}
@@ -0,0 +1,559 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/juju/cmd"
+	"launchpad.net/gnuflag"
+
+	"github.com/juju/charmstore"
+	"github.com/juju/charmstore/csclient"
+)
+
+// StoreCommand defines a command querying a running charm store
+// over HTTP, so that it can be used without access to its database.
+type StoreCommand struct {
+	cmd.CommandBase
+	StoreURL string
+	out      cmd.Output
+
+	// publicKey, if set, holds the key the
+	// downloaded charms must be signed with.
+	publicKey ed25519.PublicKey
+}
+
+// setFlags sets the flags of the command, which prints
+// its results as tables formatted by formatTable by default.
+func (c *StoreCommand) setFlags(f *gnuflag.FlagSet, formatTable cmd.Formatter) {
+	f.StringVar(&c.StoreURL, "store-url", "", "base URL of the charm store API")
+	c.out.AddFlags(f, "table", map[string]cmd.Formatter{
+		"table": formatTable,
+		"json":  cmd.FormatJson,
+	})
+}
+
+func (c *StoreCommand) Init(args []string) error {
+	if c.StoreURL == "" {
+		return fmt.Errorf("--store-url is required")
+	}
+	return nil
+}
+
+// client returns a client of the charm store API. The requests
+// it makes are not counted in the charm store statistics.
+func (c *StoreCommand) client() *csclient.Client {
+	return csclient.New(csclient.Params{
+		URL:          c.StoreURL,
+		Retries:      2,
+		DisableStats: true,
+		PublicKey:    c.publicKey,
+	})
+}
+
+// formatTable returns the rows formatted as a table with aligned columns.
+func formatTable(rows [][]string) []byte {
+	var buf bytes.Buffer
+	tw := tabwriter.NewWriter(&buf, 0, 1, 2, ' ', 0)
+	for _, row := range rows {
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+	tw.Flush()
+	return bytes.TrimRight(buf.Bytes(), "\n")
+}
+
+// charmRevision holds the information printed about a charm revision.
+type charmRevision struct {
+	URL          string   `json:"url"`
+	CanonicalURL string   `json:"canonical-url,omitempty"`
+	Revision     int      `json:"revision"`
+	Digest       string   `json:"digest,omitempty"`
+	Sha256       string   `json:"sha256,omitempty"`
+	Published    string   `json:"published,omitempty"`
+	Signature    string   `json:"signature,omitempty"`
+	Errors       []string `json:"errors,omitempty"`
+}
+
+// addPublished sets the time each of the revs was published, as reported
+// by the published events logged by the charm store for their digests.
+func addPublished(client *csclient.Client, revs []*charmRevision) error {
+	var keys []string
+	for _, rev := range revs {
+		if rev.CanonicalURL != "" {
+			keys = append(keys, rev.CanonicalURL+"@"+rev.Digest)
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	events, err := client.Event(keys...)
+	if err != nil {
+		return err
+	}
+	for _, rev := range revs {
+		event := events[rev.CanonicalURL+"@"+rev.Digest]
+		if event != nil && event.Kind == "published" {
+			rev.Published = event.Time
+		}
+	}
+	return nil
+}
+
+// formatRevisionsTable formats a []*charmRevision as a table.
+func formatRevisionsTable(value interface{}) ([]byte, error) {
+	revs, ok := value.([]*charmRevision)
+	if !ok {
+		return nil, fmt.Errorf("unexpected value %T", value)
+	}
+	rows := [][]string{{"URL", "REVISION", "PUBLISHED", "DIGEST"}}
+	for _, rev := range revs {
+		if len(rev.Errors) > 0 {
+			rows = append(rows, []string{rev.URL, "-", "-", "error: " + strings.Join(rev.Errors, "; ")})
+			continue
+		}
+		published := rev.Published
+		if published == "" {
+			published = "-"
+		}
+		rows = append(rows, []string{rev.URL, fmt.Sprint(rev.Revision), published, rev.Digest})
+	}
+	return formatTable(rows), nil
+}
+
+type InfoCommand struct {
+	StoreCommand
+	Urls []string
+}
+
+func (c *InfoCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "info",
+		Args:    "<charm URL> ...",
+		Purpose: "show the revision of charms served by a charm store",
+		Doc: `
+The revision served by the charm store at --store-url for each of
+the given charm URLs is shown, with the time it was published.
+`,
+	}
+}
+
+func (c *InfoCommand) SetFlags(f *gnuflag.FlagSet) {
+	c.StoreCommand.setFlags(f, formatRevisionsTable)
+}
+
+func (c *InfoCommand) Init(args []string) error {
+	if err := c.StoreCommand.Init(args); err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		return fmt.Errorf("no charm URLs specified")
+	}
+	c.Urls = args
+	return nil
+}
+
+func (c *InfoCommand) Run(ctx *cmd.Context) error {
+	client := c.client()
+	infos, err := client.Info(c.Urls...)
+	if err != nil {
+		return err
+	}
+	var revs []*charmRevision
+	for _, url := range c.Urls {
+		rev := &charmRevision{URL: url}
+		if info := infos[url]; info == nil {
+			rev.Errors = []string{"no information in charm store response"}
+		} else if len(info.Errors) > 0 {
+			rev.Errors = info.Errors
+		} else if curl, err := info.URL(); err != nil {
+			rev.Errors = []string{err.Error()}
+		} else {
+			rev.CanonicalURL = curl.WithRevision(-1).String()
+			rev.Revision = info.Revision
+			rev.Digest = info.Digest
+			rev.Sha256 = info.Sha256
+			rev.Signature = info.Signature
+		}
+		revs = append(revs, rev)
+	}
+	if err := addPublished(client, revs); err != nil {
+		return err
+	}
+	return c.out.Write(ctx, revs)
+}
+
+func (c *InfoCommand) AllowInterspersedFlags() bool {
+	return true
+}
+
+type RevisionsCommand struct {
+	StoreCommand
+	Url string
+}
+
+func (c *RevisionsCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "revisions",
+		Args:    "<charm URL>",
+		Purpose: "list the revisions of a charm served by a charm store",
+		Doc: `
+The revisions of the charm served by the charm store at --store-url
+are listed from the latest one, with the time each was published.
+Deleted revisions are not listed.
+`,
+	}
+}
+
+func (c *RevisionsCommand) SetFlags(f *gnuflag.FlagSet) {
+	c.StoreCommand.setFlags(f, formatRevisionsTable)
+}
+
+func (c *RevisionsCommand) Init(args []string) error {
+	if err := c.StoreCommand.Init(args); err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		return fmt.Errorf("no charm URL specified")
+	}
+	if len(args) > 1 {
+		return fmt.Errorf("only one charm URL can be specified")
+	}
+	c.Url = args[0]
+	return nil
+}
+
+func (c *RevisionsCommand) Run(ctx *cmd.Context) error {
+	client := c.client()
+	infos, err := client.Info(c.Url)
+	if err != nil {
+		return err
+	}
+	latest := infos[c.Url]
+	if latest == nil {
+		return fmt.Errorf("no information on charm %s in charm store response", c.Url)
+	}
+	if len(latest.Errors) > 0 {
+		return fmt.Errorf("cannot get charm %s: %s", c.Url, strings.Join(latest.Errors, "; "))
+	}
+	curl, err := latest.URL()
+	if err != nil {
+		return err
+	}
+	curl = curl.WithRevision(-1)
+
+	// Query all the revisions up to the latest one at once.
+	urls := make([]string, latest.Revision+1)
+	for rev := range urls {
+		urls[rev] = curl.WithRevision(latest.Revision - rev).String()
+	}
+	infos, err = client.Info(urls...)
+	if err != nil {
+		return err
+	}
+	var revs []*charmRevision
+	for _, url := range urls {
+		info := infos[url]
+		if info == nil || len(info.Errors) > 0 {
+			continue
+		}
+		revs = append(revs, &charmRevision{
+			URL:          url,
+			CanonicalURL: curl.String(),
+			Revision:     info.Revision,
+			Digest:       info.Digest,
+			Sha256:       info.Sha256,
+			Signature:    info.Signature,
+		})
+	}
+	if err := addPublished(client, revs); err != nil {
+		return err
+	}
+	return c.out.Write(ctx, revs)
+}
+
+func (c *RevisionsCommand) AllowInterspersedFlags() bool {
+	return true
+}
+
+type FetchCommand struct {
+	StoreCommand
+	Url       string
+	File      string
+	PublicKey string
+}
+
+func (c *FetchCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "fetch",
+		Args:    "<charm URL>",
+		Purpose: "download a charm from a charm store",
+		Doc: `
+The archive of the charm is downloaded from the charm store at
+--store-url and verified against the SHA256 hash reported by it.
+By default the archive is written to <name>-<revision>.zip in
+the current directory. When --public-key is given, the charm must
+be signed with the matching private key.
+`,
+	}
+}
+
+func (c *FetchCommand) SetFlags(f *gnuflag.FlagSet) {
+	f.StringVar(&c.StoreURL, "store-url", "", "base URL of the charm store API")
+	f.StringVar(&c.File, "file", "", "path of the downloaded charm archive")
+	f.StringVar(&c.PublicKey, "public-key", "", "path of the public key charms must be signed with")
+}
+
+func (c *FetchCommand) Init(args []string) error {
+	if err := c.StoreCommand.Init(args); err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		return fmt.Errorf("no charm URL specified")
+	}
+	if len(args) > 1 {
+		return fmt.Errorf("only one charm URL can be specified")
+	}
+	c.Url = args[0]
+	return nil
+}
+
+func (c *FetchCommand) Run(ctx *cmd.Context) error {
+	if c.PublicKey != "" {
+		key, err := charmstore.ReadPublicKey(ctx.AbsPath(c.PublicKey))
+		if err != nil {
+			return err
+		}
+		c.publicKey = key
+	}
+	info, data, err := c.client().Download(c.Url)
+	if err == csclient.ErrNotFound {
+		return fmt.Errorf("charm %s not found", c.Url)
+	}
+	if err != nil {
+		return err
+	}
+	curl, err := info.URL()
+	if err != nil {
+		return err
+	}
+	file := c.File
+	if file == "" {
+		file = fmt.Sprintf("%s-%d.zip", curl.Name, curl.Revision)
+	}
+	if err := ioutil.WriteFile(ctx.AbsPath(file), data, 0644); err != nil {
+		return err
+	}
+	fmt.Fprintf(ctx.Stdout, "Fetched %s to %s.\n", curl, file)
+	return nil
+}
+
+func (c *FetchCommand) AllowInterspersedFlags() bool {
+	return true
+}
+
+// charmEvent holds the information printed about a charm event.
+type charmEvent struct {
+	Key string `json:"key"`
+	*csclient.EventResponse
+}
+
+type EventsCommand struct {
+	StoreCommand
+	Keys []string
+}
+
+func (c *EventsCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "events",
+		Args:    "<charm URL>[@<digest>] ...",
+		Purpose: "show the events logged by a charm store for charms",
+		Doc: `
+The latest event logged by the charm store at --store-url for each of
+the given charm URLs is shown. URLs followed by "@" and a digest select
+the event logged for that digest instead.
+`,
+	}
+}
+
+func (c *EventsCommand) SetFlags(f *gnuflag.FlagSet) {
+	c.StoreCommand.setFlags(f, formatEventsTable)
+}
+
+func (c *EventsCommand) Init(args []string) error {
+	if err := c.StoreCommand.Init(args); err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		return fmt.Errorf("no charm URLs specified")
+	}
+	c.Keys = args
+	return nil
+}
+
+func (c *EventsCommand) Run(ctx *cmd.Context) error {
+	responses, err := c.client().Event(c.Keys...)
+	if err != nil {
+		return err
+	}
+	var events []*charmEvent
+	for _, key := range c.Keys {
+		event := responses[key]
+		if event == nil {
+			event = &csclient.EventResponse{}
+			event.Errors = []string{"no event in charm store response"}
+		}
+		events = append(events, &charmEvent{key, event})
+	}
+	return c.out.Write(ctx, events)
+}
+
+func (c *EventsCommand) AllowInterspersedFlags() bool {
+	return true
+}
+
+// formatEventsTable formats a []*charmEvent as a table.
+func formatEventsTable(value interface{}) ([]byte, error) {
+	events, ok := value.([]*charmEvent)
+	if !ok {
+		return nil, fmt.Errorf("unexpected value %T", value)
+	}
+	rows := [][]string{{"KEY", "KIND", "REVISION", "TIME", "ACTOR", "DETAILS"}}
+	for _, event := range events {
+		if event.Kind == "" {
+			rows = append(rows, []string{event.Key, "-", "-", "-", "-", "error: " + strings.Join(event.Errors, "; ")})
+			continue
+		}
+		var details []string
+		if event.Reason != "" {
+			details = append(details, event.Reason)
+		}
+		for _, e := range event.Errors {
+			details = append(details, "error: "+e)
+		}
+		for _, w := range event.Warnings {
+			details = append(details, "warning: "+w)
+		}
+		if len(details) == 0 {
+			details = []string{"-"}
+		}
+		actor := event.Actor
+		if actor == "" {
+			actor = "-"
+		}
+		rows = append(rows, []string{event.Key, event.Kind, fmt.Sprint(event.Revision), event.Time, actor, strings.Join(details, "; ")})
+	}
+	return formatTable(rows), nil
+}
+
+type StatsCommand struct {
+	StoreCommand
+	List bool
+	By   string
+	Key  string
+}
+
+func (c *StatsCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "stats",
+		Args:    "<key>",
+		Purpose: "query the statistics counters of a charm store",
+		Doc: `
+The key selects the counters of the charm store at --store-url to sum,
+as in its /stats/counter/ API, e.g. "charm-bundle:trusty:juju-gui" or
+"charm-bundle:trusty:*". Use --list to show the counters under a key
+ending in "*" separately, and --by to show them by day or week.
+`,
+	}
+}
+
+func (c *StatsCommand) SetFlags(f *gnuflag.FlagSet) {
+	c.StoreCommand.setFlags(f, formatCountersTable)
+	f.BoolVar(&c.List, "list", false, "list the counters under the key separately")
+	f.StringVar(&c.By, "by", "", `period to aggregate counts by ("day" or "week")`)
+}
+
+func (c *StatsCommand) Init(args []string) error {
+	if err := c.StoreCommand.Init(args); err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		return fmt.Errorf("no statistics key specified")
+	}
+	if len(args) > 1 {
+		return fmt.Errorf("only one statistics key can be specified")
+	}
+	switch csclient.StatsBy(c.By) {
+	case csclient.StatsByAll, csclient.StatsByDay, csclient.StatsByWeek:
+	default:
+		return fmt.Errorf("invalid --by value %q", c.By)
+	}
+	c.Key = args[0]
+	return nil
+}
+
+func (c *StatsCommand) Run(ctx *cmd.Context) error {
+	req := &csclient.StatsRequest{
+		Key:  strings.Split(c.Key, ":"),
+		List: c.List,
+		By:   csclient.StatsBy(c.By),
+	}
+	if n := len(req.Key); req.Key[n-1] == "*" {
+		req.Key = req.Key[:n-1]
+		req.Prefix = true
+	}
+	counters, err := c.client().Stats(req)
+	if err != nil {
+		return err
+	}
+	result := make([]*statsCounter, len(counters))
+	for i, counter := range counters {
+		key := strings.Join(counter.Key, ":")
+		if counter.Prefix {
+			key += ":*"
+		}
+		result[i] = &statsCounter{Key: key, Count: counter.Count}
+		if !counter.Time.IsZero() {
+			result[i].Time = counter.Time.Format("2006-01-02")
+		}
+	}
+	return c.out.Write(ctx, result)
+}
+
+func (c *StatsCommand) AllowInterspersedFlags() bool {
+	return true
+}
+
+// statsCounter holds the information printed about a statistics counter.
+type statsCounter struct {
+	Key   string `json:"key"`
+	Time  string `json:"time,omitempty"`
+	Count int64  `json:"count"`
+}
+
+// formatCountersTable formats a []*statsCounter as a table.
+func formatCountersTable(value interface{}) ([]byte, error) {
+	counters, ok := value.([]*statsCounter)
+	if !ok {
+		return nil, fmt.Errorf("unexpected value %T", value)
+	}
+	header := []string{"KEY", "COUNT"}
+	if len(counters) > 0 && counters[0].Time != "" {
+		header = []string{"KEY", "TIME", "COUNT"}
+	}
+	rows := [][]string{header}
+	for _, counter := range counters {
+		row := []string{counter.Key}
+		if len(header) == 3 {
+			row = append(row, counter.Time)
+		}
+		rows = append(rows, append(row, fmt.Sprint(counter.Count)))
+	}
+	return formatTable(rows), nil
+}
@@ -0,0 +1,272 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http/httptest"
+	"path/filepath"
+	"time"
+
+	"github.com/juju/charm"
+	charmtesting "github.com/juju/charm/testing"
+	"github.com/juju/cmd"
+	"github.com/juju/cmd/cmdtesting"
+	gitjujutesting "github.com/juju/testing"
+	gc "launchpad.net/gocheck"
+
+	"github.com/juju/charmstore"
+)
+
+type querySuite struct {
+	gitjujutesting.IsolationSuite
+	store  *charmstore.MemStore
+	server *httptest.Server
+}
+
+var _ = gc.Suite(&querySuite{})
+
+func (s *querySuite) SetUpTest(c *gc.C) {
+	s.IsolationSuite.SetUpTest(c)
+	s.store = charmstore.NewMemStore()
+	handler, err := charmstore.NewServer(s.store)
+	c.Assert(err, gc.IsNil)
+	s.server = httptest.NewServer(handler)
+}
+
+func (s *querySuite) TearDownTest(c *gc.C) {
+	s.server.Close()
+	s.IsolationSuite.TearDownTest(c)
+}
+
+// publish publishes the dummy charm at cs:precise/dummy with the given
+// digest, logging the event published for it if logEvent is true.
+func (s *querySuite) publish(c *gc.C, digest string, logEvent bool) {
+	urls := []*charm.URL{charm.MustParseURL("cs:precise/dummy")}
+	pub, err := s.store.CharmPublisher(urls, digest)
+	c.Assert(err, gc.IsNil)
+	err = pub.Publish(charmtesting.Charms.ClonedDir(c.MkDir(), "dummy"))
+	c.Assert(err, gc.IsNil)
+	if !logEvent {
+		return
+	}
+	err = s.store.LogCharmEvent(&charmstore.CharmEvent{
+		Kind:     charmstore.EventPublished,
+		Digest:   digest,
+		Revision: pub.Revision(),
+		URLs:     urls,
+		Time:     time.Date(2014, 6, 1, 10, 0, pub.Revision(), 0, time.UTC),
+	})
+	c.Assert(err, gc.IsNil)
+}
+
+// run runs the command with the given arguments
+// against the test server and returns its output.
+func (s *querySuite) run(c *gc.C, command cmd.Command, args ...string) (string, error) {
+	args = append([]string{"--store-url", s.server.URL}, args...)
+	ctx, err := cmdtesting.RunCommand(c, command, args...)
+	if err != nil {
+		return "", err
+	}
+	return cmdtesting.Stdout(ctx), nil
+}
+
+func (s *querySuite) TestInit(c *gc.C) {
+	for _, command := range []cmd.Command{
+		&InfoCommand{},
+		&RevisionsCommand{},
+		&FetchCommand{},
+		&EventsCommand{},
+		&StatsCommand{},
+	} {
+		err := cmdtesting.InitCommand(command, []string{"cs:precise/dummy"})
+		c.Assert(err, gc.ErrorMatches, "--store-url is required")
+	}
+
+	info := &InfoCommand{}
+	err := cmdtesting.InitCommand(info, []string{"--store-url", "http://remote", "cs:precise/dummy", "cs:mysql"})
+	c.Assert(err, gc.IsNil)
+	c.Assert(info.StoreURL, gc.Equals, "http://remote")
+	c.Assert(info.Urls, gc.DeepEquals, []string{"cs:precise/dummy", "cs:mysql"})
+
+	err = cmdtesting.InitCommand(&InfoCommand{}, []string{"--store-url", "http://remote"})
+	c.Assert(err, gc.ErrorMatches, "no charm URLs specified")
+
+	err = cmdtesting.InitCommand(&RevisionsCommand{}, []string{"--store-url", "http://remote", "cs:precise/dummy", "cs:mysql"})
+	c.Assert(err, gc.ErrorMatches, "only one charm URL can be specified")
+
+	fetch := &FetchCommand{}
+	err = cmdtesting.InitCommand(fetch, []string{"--store-url", "http://remote", "--file", "dummy.zip", "cs:precise/dummy"})
+	c.Assert(err, gc.IsNil)
+	c.Assert(fetch.File, gc.Equals, "dummy.zip")
+	c.Assert(fetch.Url, gc.Equals, "cs:precise/dummy")
+
+	stats := &StatsCommand{}
+	err = cmdtesting.InitCommand(stats, []string{"--store-url", "http://remote", "--list", "--by", "week", "charm-bundle:*"})
+	c.Assert(err, gc.IsNil)
+	c.Assert(stats.List, gc.Equals, true)
+	c.Assert(stats.By, gc.Equals, "week")
+	c.Assert(stats.Key, gc.Equals, "charm-bundle:*")
+
+	err = cmdtesting.InitCommand(&StatsCommand{}, []string{"--store-url", "http://remote", "--by", "month", "charm-bundle:*"})
+	c.Assert(err, gc.ErrorMatches, `invalid --by value "month"`)
+}
+
+func (s *querySuite) TestInfo(c *gc.C) {
+	s.publish(c, "digest-0", true)
+	s.publish(c, "digest-1", true)
+
+	out, err := s.run(c, &InfoCommand{}, "cs:dummy", "cs:precise/missing")
+	c.Assert(err, gc.IsNil)
+	c.Assert(out, gc.Equals, ""+
+		"URL                 REVISION  PUBLISHED             DIGEST\n"+
+		"cs:dummy            1         2014-06-01T10:00:01Z  digest-1\n"+
+		"cs:precise/missing  -         -                     error: entry not found\n")
+
+	out, err = s.run(c, &InfoCommand{}, "--format", "json", "cs:dummy")
+	c.Assert(err, gc.IsNil)
+	var revs []map[string]interface{}
+	err = json.Unmarshal([]byte(out), &revs)
+	c.Assert(err, gc.IsNil)
+	c.Assert(revs, gc.HasLen, 1)
+	c.Assert(revs[0]["url"], gc.Equals, "cs:dummy")
+	c.Assert(revs[0]["canonical-url"], gc.Equals, "cs:precise/dummy")
+	c.Assert(revs[0]["revision"], gc.Equals, 1.0)
+	c.Assert(revs[0]["published"], gc.Equals, "2014-06-01T10:00:01Z")
+	c.Assert(revs[0]["sha256"], gc.Matches, "[0-9a-f]{64}")
+}
+
+func (s *querySuite) TestRevisions(c *gc.C) {
+	s.publish(c, "digest-0", true)
+	s.publish(c, "digest-1", true)
+	s.publish(c, "digest-2", false)
+	s.publish(c, "digest-3", true)
+	_, err := s.store.DeleteCharm(charm.MustParseURL("cs:precise/dummy-1"), charmstore.Origin{})
+	c.Assert(err, gc.IsNil)
+
+	out, err := s.run(c, &RevisionsCommand{}, "cs:dummy")
+	c.Assert(err, gc.IsNil)
+	c.Assert(out, gc.Equals, ""+
+		"URL                 REVISION  PUBLISHED             DIGEST\n"+
+		"cs:precise/dummy-3  3         2014-06-01T10:00:03Z  digest-3\n"+
+		"cs:precise/dummy-2  2         -                     digest-2\n"+
+		"cs:precise/dummy-0  0         2014-06-01T10:00:00Z  digest-0\n")
+
+	_, err = s.run(c, &RevisionsCommand{}, "cs:precise/missing")
+	c.Assert(err, gc.ErrorMatches, "cannot get charm cs:precise/missing: entry not found")
+}
+
+func (s *querySuite) TestFetch(c *gc.C) {
+	s.publish(c, "digest-0", true)
+	_, rc, err := s.store.OpenCharm(charm.MustParseURL("cs:precise/dummy"))
+	c.Assert(err, gc.IsNil)
+	defer rc.Close()
+	expected, err := ioutil.ReadAll(rc)
+	c.Assert(err, gc.IsNil)
+
+	file := filepath.Join(c.MkDir(), "dummy.zip")
+	out, err := s.run(c, &FetchCommand{}, "--file", file, "cs:dummy")
+	c.Assert(err, gc.IsNil)
+	c.Assert(out, gc.Equals, "Fetched cs:precise/dummy-0 to "+file+".\n")
+	data, err := ioutil.ReadFile(file)
+	c.Assert(err, gc.IsNil)
+	c.Assert(data, gc.DeepEquals, expected)
+
+	_, err = s.run(c, &FetchCommand{}, "cs:precise/missing")
+	c.Assert(err, gc.ErrorMatches, "charm cs:precise/missing not found")
+}
+
+func (s *querySuite) TestFetchSigned(c *gc.C) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	c.Assert(err, gc.IsNil)
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	c.Assert(err, gc.IsNil)
+	keyPath := filepath.Join(c.MkDir(), "public.pem")
+	err = ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644)
+	c.Assert(err, gc.IsNil)
+
+	s.publish(c, "digest-0", true)
+	s.store.SetSigningKey(priv)
+	s.publish(c, "digest-1", true)
+
+	file := filepath.Join(c.MkDir(), "dummy.zip")
+	out, err := s.run(c, &FetchCommand{}, "--public-key", keyPath, "--file", file, "cs:dummy")
+	c.Assert(err, gc.IsNil)
+	c.Assert(out, gc.Equals, "Fetched cs:precise/dummy-1 to "+file+".\n")
+
+	_, err = s.run(c, &FetchCommand{}, "--public-key", keyPath, "--file", file, "cs:precise/dummy-0")
+	c.Assert(err, gc.ErrorMatches, "cannot download charm cs:precise/dummy-0: charm cs:precise/dummy-0 is not signed")
+}
+
+func (s *querySuite) TestEvents(c *gc.C) {
+	s.publish(c, "digest-0", true)
+	s.publish(c, "digest-1", true)
+	err := s.store.LogCharmEvent(&charmstore.CharmEvent{
+		Kind:   charmstore.EventPublishError,
+		Digest: "digest-2",
+		URLs:   []*charm.URL{charm.MustParseURL("cs:precise/dummy")},
+		Errors: []string{"bad charm"},
+		Time:   time.Date(2014, 6, 1, 11, 0, 0, 0, time.UTC),
+		Actor:  "bob",
+		Reason: "retry",
+	})
+	c.Assert(err, gc.IsNil)
+
+	out, err := s.run(c, &EventsCommand{}, "cs:precise/dummy@digest-1", "cs:precise/dummy", "cs:precise/missing")
+	c.Assert(err, gc.IsNil)
+	c.Assert(out, gc.Equals, ""+
+		"KEY                        KIND           REVISION  TIME                  ACTOR  DETAILS\n"+
+		"cs:precise/dummy@digest-1  published      1         2014-06-01T10:00:01Z  -      -\n"+
+		"cs:precise/dummy           publish-error  0         2014-06-01T11:00:00Z  bob    retry; error: bad charm\n"+
+		"cs:precise/missing         -              -         -                     -      error: entry not found\n")
+
+	out, err = s.run(c, &EventsCommand{}, "--format", "json", "cs:precise/dummy@digest-0")
+	c.Assert(err, gc.IsNil)
+	var events []map[string]interface{}
+	err = json.Unmarshal([]byte(out), &events)
+	c.Assert(err, gc.IsNil)
+	c.Assert(events, gc.DeepEquals, []map[string]interface{}{{
+		"key":      "cs:precise/dummy@digest-0",
+		"kind":     "published",
+		"revision": 0.0,
+		"digest":   "digest-0",
+		"time":     "2014-06-01T10:00:00Z",
+	}})
+}
+
+func (s *querySuite) TestStats(c *gc.C) {
+	for _, key := range [][]string{
+		{"charm-bundle", "precise", "dummy"},
+		{"charm-bundle", "precise", "dummy"},
+		{"charm-bundle", "trusty", "mysql"},
+	} {
+		err := s.store.IncCounter(key)
+		c.Assert(err, gc.IsNil)
+	}
+
+	out, err := s.run(c, &StatsCommand{}, "charm-bundle:precise:dummy")
+	c.Assert(err, gc.IsNil)
+	c.Assert(out, gc.Equals, ""+
+		"KEY                         COUNT\n"+
+		"charm-bundle:precise:dummy  2\n")
+
+	out, err = s.run(c, &StatsCommand{}, "--list", "charm-bundle:*")
+	c.Assert(err, gc.IsNil)
+	c.Assert(out, gc.Equals, ""+
+		"KEY                     COUNT\n"+
+		"charm-bundle:precise:*  2\n"+
+		"charm-bundle:trusty:*   1\n")
+
+	today := time.Now().UTC().Format("2006-01-02")
+	out, err = s.run(c, &StatsCommand{}, "--by", "day", "charm-bundle:*")
+	c.Assert(err, gc.IsNil)
+	c.Assert(out, gc.Equals, ""+
+		"KEY             TIME        COUNT\n"+
+		"charm-bundle:*  "+today+"  3\n")
+}
@@ -0,0 +1,86 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/juju/charm"
+	"github.com/juju/cmd"
+	"launchpad.net/gnuflag"
+
+	"github.com/juju/charmstore"
+)
+
+type ReleaseCommand struct {
+	ConfigCommand
+	Url     string
+	Channel string
+	Reason  string
+}
+
+func (c *ReleaseCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "release",
+		Purpose: "release a charm revision to a channel",
+		Doc: `
+The charm URL must include the revision to be released, which must
+already be published in the store. Once released, the revision is
+served for requests of the charm URL in the given channel.
+`,
+	}
+}
+
+func (c *ReleaseCommand) SetFlags(f *gnuflag.FlagSet) {
+	c.ConfigCommand.SetFlags(f)
+	f.StringVar(&c.Url, "url", "", "charm URL, including the revision")
+	f.StringVar(&c.Channel, "channel", string(charmstore.StableChannel), "channel to release the revision to")
+	f.StringVar(&c.Reason, "reason", "", "reason for the release, recorded in the charm events")
+}
+
+func (c *ReleaseCommand) Init(args []string) error {
+	err := c.ConfigCommand.Init(args)
+	if err != nil {
+		return err
+	}
+	if c.Url == "" {
+		return fmt.Errorf("--url is required")
+	}
+	_, err = charmstore.ParseChannel(c.Channel)
+	return err
+}
+
+func (c *ReleaseCommand) Run(ctx *cmd.Context) error {
+	err := c.ConfigCommand.ReadConfig(ctx)
+	if err != nil {
+		return err
+	}
+	charmUrl, err := charm.ParseURL(c.Url)
+	if err != nil {
+		return err
+	}
+	if charmUrl.Revision == -1 {
+		return fmt.Errorf("charm URL must include a revision: %s", charmUrl)
+	}
+	channel, err := charmstore.ParseChannel(c.Channel)
+	if err != nil {
+		return err
+	}
+
+	s, err := charmstore.Open(c.Config.MongoURL)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	if err := s.Release(charmUrl, channel, commandOrigin(c.Reason)); err != nil {
+		return err
+	}
+	fmt.Fprintln(ctx.Stdout, "Charm", charmUrl, "released to the", channel, "channel.")
+	return nil
+}
+
+func (c *ReleaseCommand) AllowInterspersedFlags() bool {
+	return true
+}
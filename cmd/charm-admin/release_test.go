@@ -0,0 +1,62 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/juju/charm"
+	charmtesting "github.com/juju/charm/testing"
+	"github.com/juju/cmd/cmdtesting"
+	gitjujutesting "github.com/juju/testing"
+	gc "launchpad.net/gocheck"
+
+	"github.com/juju/charmstore"
+)
+
+type releaseSuite struct {
+	gitjujutesting.IsolationSuite
+}
+
+var _ = gc.Suite(&releaseSuite{})
+
+func (s *releaseSuite) TestInit(c *gc.C) {
+	config := &ReleaseCommand{}
+	err := cmdtesting.InitCommand(config, []string{"--config", "/etc/charmd.conf", "--url", "cs:go-1"})
+	c.Assert(err, gc.IsNil)
+	c.Assert(config.Url, gc.Equals, "cs:go-1")
+	c.Assert(config.Channel, gc.Equals, "stable")
+
+	err = cmdtesting.InitCommand(&ReleaseCommand{}, []string{"--config", "/etc/charmd.conf", "--url", "cs:go-1", "--channel", "beta"})
+	c.Assert(err, gc.ErrorMatches, `unknown channel "beta"`)
+}
+
+func (s *releaseSuite) TestRun(c *gc.C) {
+	configPath := filepath.Join(c.MkDir(), "charmd.conf")
+	contents := "mongo-url: " + gitjujutesting.MgoServer.Addr() + "\n"
+	err := ioutil.WriteFile(configPath, []byte(contents), 0666)
+	c.Assert(err, gc.IsNil)
+
+	url := charm.MustParseURL("cs:unreleased/release-me")
+	store, err := charmstore.Open(gitjujutesting.MgoServer.Addr())
+	c.Assert(err, gc.IsNil)
+	defer store.Close()
+	pub, err := store.CharmPublisher([]*charm.URL{url}, "release-digest")
+	c.Assert(err, gc.IsNil)
+	err = pub.Publish(charmtesting.Charms.ClonedDir(c.MkDir(), "dummy"))
+	c.Assert(err, gc.IsNil)
+
+	// The URL must have a revision.
+	_, err = cmdtesting.RunCommand(c, &ReleaseCommand{}, "--config", configPath, "--url", "cs:unreleased/release-me")
+	c.Assert(err, gc.ErrorMatches, "charm URL must include a revision: cs:unreleased/release-me")
+
+	ctx, err := cmdtesting.RunCommand(c, &ReleaseCommand{}, "--config", configPath, "--url", "cs:unreleased/release-me-0", "--channel", "candidate")
+	c.Assert(err, gc.IsNil)
+	c.Assert(cmdtesting.Stdout(ctx), gc.Equals, "Charm cs:unreleased/release-me-0 released to the candidate channel.\n")
+
+	rev, err := store.ChannelRevision(url, charmstore.CandidateChannel)
+	c.Assert(err, gc.IsNil)
+	c.Assert(rev, gc.Equals, 0)
+}
@@ -0,0 +1,78 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/juju/charm"
+	"github.com/juju/cmd"
+	"launchpad.net/gnuflag"
+
+	"github.com/juju/charmstore"
+)
+
+type RetryPublishCommand struct {
+	ConfigCommand
+	Url    string
+	Reason string
+}
+
+func (c *RetryPublishCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "retry-publish",
+		Purpose: "retry publishing a charm that failed to be published",
+	}
+}
+
+func (c *RetryPublishCommand) SetFlags(f *gnuflag.FlagSet) {
+	c.ConfigCommand.SetFlags(f)
+	f.StringVar(&c.Url, "url", "", "charm URL")
+	f.StringVar(&c.Reason, "reason", "", "reason for the retry, recorded in the charm events")
+}
+
+func (c *RetryPublishCommand) Init(args []string) error {
+	// Check flags
+	err := c.ConfigCommand.Init(args)
+	if err != nil {
+		return err
+	}
+	if c.Url == "" {
+		return fmt.Errorf("--url is required")
+	}
+	return nil
+}
+
+func (c *RetryPublishCommand) Run(ctx *cmd.Context) error {
+	// Read config
+	err := c.ConfigCommand.ReadConfig(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Parse the charm URL
+	charmUrl, err := charm.ParseURL(c.Url)
+	if err != nil {
+		return err
+	}
+
+	// Open the charm store storage
+	s, err := charmstore.Open(c.Config.MongoURL)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	// Request the charm to be published again
+	err = s.RetryPublish(charmUrl, commandOrigin(c.Reason))
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(ctx.Stdout, "Charm", charmUrl, "will be published again on the next charmload run.")
+	return nil
+}
+
+func (c *RetryPublishCommand) AllowInterspersedFlags() bool {
+	return true
+}
@@ -0,0 +1,66 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/juju/charm"
+	"github.com/juju/cmd/cmdtesting"
+	gitjujutesting "github.com/juju/testing"
+	gc "launchpad.net/gocheck"
+
+	"github.com/juju/charmstore"
+)
+
+type retryPublishSuite struct {
+	gitjujutesting.IsolationSuite
+}
+
+var _ = gc.Suite(&retryPublishSuite{})
+
+func (s *retryPublishSuite) TestInit(c *gc.C) {
+	config := &RetryPublishCommand{}
+	err := cmdtesting.InitCommand(config, []string{"--config", "/etc/charmd.conf", "--url", "cs:go"})
+	c.Assert(err, gc.IsNil)
+	c.Assert(config.Url, gc.Equals, "cs:go")
+
+	err = cmdtesting.InitCommand(&RetryPublishCommand{}, []string{"--config", "/etc/charmd.conf"})
+	c.Assert(err, gc.ErrorMatches, "--url is required")
+}
+
+func (s *retryPublishSuite) TestRun(c *gc.C) {
+	s.PatchEnvironment("USER", "joe")
+	configPath := filepath.Join(c.MkDir(), "charmd.conf")
+	contents := "mongo-url: " + gitjujutesting.MgoServer.Addr() + "\n"
+	err := ioutil.WriteFile(configPath, []byte(contents), 0666)
+	c.Assert(err, gc.IsNil)
+
+	url := charm.MustParseURL("cs:unreleased/retry-me")
+	store, err := charmstore.Open(gitjujutesting.MgoServer.Addr())
+	c.Assert(err, gc.IsNil)
+	defer store.Close()
+	err = store.LogCharmEvent(&charmstore.CharmEvent{
+		Kind:   charmstore.EventPublishError,
+		URLs:   []*charm.URL{url},
+		Digest: "retry-digest",
+		Errors: []string{"invalid metadata"},
+	})
+	c.Assert(err, gc.IsNil)
+
+	ctx, err := cmdtesting.RunCommand(c, &RetryPublishCommand{}, "--config", configPath, "--url", "cs:unreleased/retry-me", "--reason", "fixed")
+	c.Assert(err, gc.IsNil)
+	c.Assert(cmdtesting.Stdout(ctx), gc.Equals, "Charm cs:unreleased/retry-me will be published again on the next charmload run.\n")
+
+	event, err := store.CharmEvent(url, "retry-digest")
+	c.Assert(err, gc.IsNil)
+	c.Assert(event.Kind, gc.Equals, charmstore.EventRetryRequested)
+	c.Assert(event.Actor, gc.Equals, "joe")
+	c.Assert(event.Reason, gc.Equals, "fixed")
+
+	// The retry was already requested.
+	_, err = cmdtesting.RunCommand(c, &RetryPublishCommand{}, "--config", configPath, "--url", "cs:unreleased/retry-me")
+	c.Assert(err, gc.ErrorMatches, "cannot retry publishing charm cs:unreleased/retry-me: last publishing attempt did not fail")
+}
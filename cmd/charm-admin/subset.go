@@ -0,0 +1,74 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/juju/cmd"
+	"launchpad.net/gnuflag"
+
+	"github.com/juju/charmstore"
+)
+
+type SubsetCommand struct {
+	cmd.CommandBase
+	From   string
+	Dir    string
+	Series string
+	Urls   []string
+}
+
+func (c *SubsetCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "subset",
+		Args:    "<charm URL> ...",
+		Purpose: "write a static directory with charms from a charm store",
+		Doc: `
+The charms at the given URLs are downloaded from the remote store,
+with the information needed to serve them without access to it.
+URLs without a revision select the latest revision of the charm.
+URLs without a series are resolved in each of the series given with
+--series, or in the preferred series of the charm if none is given.
+Charms already in the directory are kept.
+`,
+	}
+}
+
+func (c *SubsetCommand) SetFlags(f *gnuflag.FlagSet) {
+	f.StringVar(&c.From, "from", "", "base URL of the remote charm store API")
+	f.StringVar(&c.Dir, "dir", "", "path of the static charm directory")
+	f.StringVar(&c.Series, "series", "", "comma-separated series of the charm URLs with no series")
+}
+
+func (c *SubsetCommand) Init(args []string) error {
+	if c.From == "" {
+		return fmt.Errorf("--from is required")
+	}
+	if c.Dir == "" {
+		return fmt.Errorf("--dir is required")
+	}
+	if len(args) == 0 {
+		return fmt.Errorf("no charm URLs specified")
+	}
+	c.Urls = args
+	return nil
+}
+
+func (c *SubsetCommand) Run(ctx *cmd.Context) error {
+	opts := &charmstore.SubsetOptions{Series: splitList(c.Series)}
+	report, err := charmstore.WriteSubset(c.From, ctx.AbsPath(c.Dir), c.Urls, opts)
+	if err != nil {
+		return err
+	}
+	for _, url := range report.Added {
+		fmt.Fprintln(ctx.Stdout, "Added:", url)
+	}
+	fmt.Fprintf(ctx.Stdout, "Charms: %s.\n", report)
+	return nil
+}
+
+func (c *SubsetCommand) AllowInterspersedFlags() bool {
+	return true
+}
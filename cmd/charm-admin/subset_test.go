@@ -0,0 +1,34 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"github.com/juju/cmd/cmdtesting"
+	gitjujutesting "github.com/juju/testing"
+	gc "launchpad.net/gocheck"
+)
+
+type subsetSuite struct {
+	gitjujutesting.IsolationSuite
+}
+
+var _ = gc.Suite(&subsetSuite{})
+
+func (s *subsetSuite) TestInit(c *gc.C) {
+	subset := &SubsetCommand{}
+	err := cmdtesting.InitCommand(subset, []string{"--from", "http://remote", "--dir", "static", "cs:precise/mysql", "cs:wordpress-3"})
+	c.Assert(err, gc.IsNil)
+	c.Assert(subset.From, gc.Equals, "http://remote")
+	c.Assert(subset.Dir, gc.Equals, "static")
+	c.Assert(subset.Urls, gc.DeepEquals, []string{"cs:precise/mysql", "cs:wordpress-3"})
+
+	err = cmdtesting.InitCommand(&SubsetCommand{}, []string{"--dir", "static", "cs:precise/mysql"})
+	c.Assert(err, gc.ErrorMatches, "--from is required")
+
+	err = cmdtesting.InitCommand(&SubsetCommand{}, []string{"--from", "http://remote", "cs:precise/mysql"})
+	c.Assert(err, gc.ErrorMatches, "--dir is required")
+
+	err = cmdtesting.InitCommand(&SubsetCommand{}, []string{"--from", "http://remote", "--dir", "static"})
+	c.Assert(err, gc.ErrorMatches, "no charm URLs specified")
+}
@@ -0,0 +1,113 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/juju/cmd"
+	"launchpad.net/gnuflag"
+
+	"github.com/juju/charmstore"
+)
+
+type UsageCommand struct {
+	ConfigCommand
+	out cmd.Output
+}
+
+func (c *UsageCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "usage",
+		Purpose: "show the storage used in each namespace",
+		Doc: `
+The number of charms and bundles published in each user namespace, and
+in the namespace of unqualified charm URLs (shown as "-"), is shown
+with the total size of their archives and the namespace quota, as set
+in the namespace-quota and namespace-quotas configuration options.
+`,
+	}
+}
+
+func (c *UsageCommand) SetFlags(f *gnuflag.FlagSet) {
+	c.ConfigCommand.SetFlags(f)
+	c.out.AddFlags(f, "table", map[string]cmd.Formatter{
+		"table": formatUsageTable,
+		"json":  cmd.FormatJson,
+	})
+}
+
+func (c *UsageCommand) Run(ctx *cmd.Context) error {
+	err := c.ConfigCommand.ReadConfig(ctx)
+	if err != nil {
+		return err
+	}
+	s, err := charmstore.Open(c.Config.MongoURL)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	if err := s.LoadStorageLimits(c.Config); err != nil {
+		return err
+	}
+
+	usages, err := s.StorageUsage()
+	if err != nil {
+		return err
+	}
+	result := make([]*namespaceUsage, len(usages))
+	for i, usage := range usages {
+		namespace := "-"
+		if usage.User != "" {
+			namespace = "~" + usage.User
+		}
+		result[i] = &namespaceUsage{
+			Namespace: namespace,
+			Charms:    usage.Charms,
+			Bundles:   usage.Bundles,
+			Size:      usage.Size,
+			Quota:     usage.Quota,
+		}
+	}
+	return c.out.Write(ctx, result)
+}
+
+func (c *UsageCommand) AllowInterspersedFlags() bool {
+	return true
+}
+
+// namespaceUsage holds the information printed
+// about the storage used in a namespace.
+type namespaceUsage struct {
+	Namespace string `json:"namespace"`
+	Charms    int    `json:"charms"`
+	Bundles   int    `json:"bundles"`
+	Size      int64  `json:"size"`
+	Quota     int64  `json:"quota,omitempty"`
+}
+
+// formatUsageTable formats a []*namespaceUsage as a table.
+func formatUsageTable(value interface{}) ([]byte, error) {
+	usages, ok := value.([]*namespaceUsage)
+	if !ok {
+		return nil, fmt.Errorf("unexpected value %T", value)
+	}
+	rows := [][]string{{"NAMESPACE", "CHARMS", "BUNDLES", "SIZE", "QUOTA", "USED"}}
+	for _, usage := range usages {
+		quota, used := "-", "-"
+		if usage.Quota > 0 {
+			quota = fmt.Sprint(usage.Quota)
+			used = fmt.Sprintf("%d%%", usage.Size*100/usage.Quota)
+		}
+		rows = append(rows, []string{
+			usage.Namespace,
+			fmt.Sprint(usage.Charms),
+			fmt.Sprint(usage.Bundles),
+			fmt.Sprint(usage.Size),
+			quota,
+			used,
+		})
+	}
+	return formatTable(rows), nil
+}
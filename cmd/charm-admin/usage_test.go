@@ -0,0 +1,94 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/juju/charm"
+	charmtesting "github.com/juju/charm/testing"
+	"github.com/juju/cmd/cmdtesting"
+	gitjujutesting "github.com/juju/testing"
+	gc "launchpad.net/gocheck"
+
+	"github.com/juju/charmstore"
+)
+
+type usageSuite struct {
+	gitjujutesting.IsolationSuite
+}
+
+var _ = gc.Suite(&usageSuite{})
+
+func (s *usageSuite) TestInit(c *gc.C) {
+	err := cmdtesting.InitCommand(&UsageCommand{}, []string{"--config", "/etc/charmd.conf"})
+	c.Assert(err, gc.IsNil)
+
+	err = cmdtesting.InitCommand(&UsageCommand{}, nil)
+	c.Assert(err, gc.ErrorMatches, "--config is required")
+}
+
+func (s *usageSuite) TestRun(c *gc.C) {
+	configPath := filepath.Join(c.MkDir(), "charmd.conf")
+	contents := "mongo-url: " + gitjujutesting.MgoServer.Addr() + "\n" +
+		"namespace-quotas:\n  usage-joe: 1000000\n"
+	err := ioutil.WriteFile(configPath, []byte(contents), 0666)
+	c.Assert(err, gc.IsNil)
+
+	store, err := charmstore.Open(gitjujutesting.MgoServer.Addr())
+	c.Assert(err, gc.IsNil)
+	defer store.Close()
+	var size int64
+	for _, url := range []string{"cs:~usage-joe/precise/dummy", "cs:~usage-bob/precise/dummy"} {
+		pub, err := store.CharmPublisher([]*charm.URL{charm.MustParseURL(url)}, "usage-digest")
+		c.Assert(err, gc.IsNil)
+		err = pub.Publish(charmtesting.Charms.ClonedDir(c.MkDir(), "dummy"))
+		c.Assert(err, gc.IsNil)
+		info, err := store.CharmInfo(charm.MustParseURL(url))
+		c.Assert(err, gc.IsNil)
+		size = info.BundleSize()
+	}
+
+	ctx, err := cmdtesting.RunCommand(c, &UsageCommand{}, "--config", configPath, "--format", "json")
+	c.Assert(err, gc.IsNil)
+	var usages []*namespaceUsage
+	err = json.Unmarshal([]byte(cmdtesting.Stdout(ctx)), &usages)
+	c.Assert(err, gc.IsNil)
+	found := make(map[string]*namespaceUsage)
+	for _, usage := range usages {
+		found[usage.Namespace] = usage
+	}
+	c.Assert(found["~usage-joe"], gc.DeepEquals, &namespaceUsage{
+		Namespace: "~usage-joe",
+		Charms:    1,
+		Size:      size,
+		Quota:     1000000,
+	})
+	c.Assert(found["~usage-bob"], gc.DeepEquals, &namespaceUsage{
+		Namespace: "~usage-bob",
+		Charms:    1,
+		Size:      size,
+	})
+}
+
+func (s *usageSuite) TestFormatTable(c *gc.C) {
+	out, err := formatUsageTable([]*namespaceUsage{{
+		Namespace: "-",
+		Charms:    120,
+		Bundles:   3,
+		Size:      123456789,
+	}, {
+		Namespace: "~joe",
+		Charms:    2,
+		Size:      2500,
+		Quota:     10000,
+	}})
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(out), gc.Equals, ""+
+		"NAMESPACE  CHARMS  BUNDLES  SIZE       QUOTA  USED\n"+
+		"-          120     3        123456789  -      -\n"+
+		"~joe       2       0        2500       10000  25%")
+}
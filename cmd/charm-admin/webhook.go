@@ -0,0 +1,320 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/juju/cmd"
+	"labix.org/v2/mgo/bson"
+	"launchpad.net/gnuflag"
+
+	"github.com/juju/charmstore"
+)
+
+const webhookDoc = `
+The webhook commands manage the HTTP URLs notified about charm events,
+such as charms being published or failing to be published. Notifications
+are POSTed as JSON documents in the same format used by the /changes API.
+When a secret is given, each notification holds the hex-encoded
+HMAC-SHA256 signature of its body in the X-Charmstore-Signature header.
+Notifications that fail are retried by charmd, or by the replay command,
+and are listed by the dead-letters command once all the attempts failed.
+`
+
+func newWebhookCommand() cmd.Command {
+	webhookcmd := cmd.NewSuperCommand(cmd.SuperCommandParams{
+		Name:    "webhook",
+		Purpose: "manage webhooks notified about charm events",
+		Doc:     webhookDoc,
+	})
+	webhookcmd.Register(&WebhookAddCommand{})
+	webhookcmd.Register(&WebhookListCommand{})
+	webhookcmd.Register(&WebhookRemoveCommand{})
+	webhookcmd.Register(&WebhookTestCommand{})
+	webhookcmd.Register(&WebhookReplayCommand{})
+	webhookcmd.Register(&WebhookDeadLettersCommand{})
+	return webhookcmd
+}
+
+// parseWebhookId returns the webhook id represented by the given string.
+func parseWebhookId(id string) (bson.ObjectId, error) {
+	if id == "" {
+		return "", fmt.Errorf("--id is required")
+	}
+	if !bson.IsObjectIdHex(id) {
+		return "", fmt.Errorf("invalid webhook id %q", id)
+	}
+	return bson.ObjectIdHex(id), nil
+}
+
+type WebhookAddCommand struct {
+	ConfigCommand
+	Url    string
+	Secret string
+	Scope  string
+}
+
+func (c *WebhookAddCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "add",
+		Purpose: "add a webhook",
+		Doc: `
+By default the webhook is notified about all the charm events. Use --scope
+to restrict the notifications to the charms in a user namespace, e.g.
+"~joe", or to a single charm, e.g. "cs:trusty/mysql".
+`,
+	}
+}
+
+func (c *WebhookAddCommand) SetFlags(f *gnuflag.FlagSet) {
+	c.ConfigCommand.SetFlags(f)
+	f.StringVar(&c.Url, "url", "", "HTTP URL notified about charm events")
+	f.StringVar(&c.Secret, "secret", "", "secret used to sign the notifications")
+	f.StringVar(&c.Scope, "scope", "", "user namespace or charm URL the notifications are restricted to")
+}
+
+func (c *WebhookAddCommand) Init(args []string) error {
+	err := c.ConfigCommand.Init(args)
+	if err != nil {
+		return err
+	}
+	if c.Url == "" {
+		return fmt.Errorf("--url is required")
+	}
+	return nil
+}
+
+func (c *WebhookAddCommand) Run(ctx *cmd.Context) error {
+	err := c.ConfigCommand.ReadConfig(ctx)
+	if err != nil {
+		return err
+	}
+	s, err := charmstore.Open(c.Config.MongoURL)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	hook, err := s.AddWebhook(c.Url, c.Secret, c.Scope)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(ctx.Stdout, "Webhook", hook.Id.Hex(), "added.")
+	return nil
+}
+
+type WebhookListCommand struct {
+	ConfigCommand
+}
+
+func (c *WebhookListCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "list",
+		Purpose: "list the webhooks",
+	}
+}
+
+func (c *WebhookListCommand) Run(ctx *cmd.Context) error {
+	err := c.ConfigCommand.ReadConfig(ctx)
+	if err != nil {
+		return err
+	}
+	s, err := charmstore.Open(c.Config.MongoURL)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	hooks, err := s.Webhooks()
+	if err != nil {
+		return err
+	}
+	for _, hook := range hooks {
+		scope := hook.Scope
+		if scope == "" {
+			scope = "*"
+		}
+		fmt.Fprintf(ctx.Stdout, "%s %s %s\n", hook.Id.Hex(), scope, hook.URL)
+	}
+	return nil
+}
+
+type WebhookRemoveCommand struct {
+	ConfigCommand
+	Id string
+}
+
+func (c *WebhookRemoveCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "remove",
+		Purpose: "remove a webhook",
+	}
+}
+
+func (c *WebhookRemoveCommand) SetFlags(f *gnuflag.FlagSet) {
+	c.ConfigCommand.SetFlags(f)
+	f.StringVar(&c.Id, "id", "", "webhook id, as shown by the list command")
+}
+
+func (c *WebhookRemoveCommand) Init(args []string) error {
+	err := c.ConfigCommand.Init(args)
+	if err != nil {
+		return err
+	}
+	_, err = parseWebhookId(c.Id)
+	return err
+}
+
+func (c *WebhookRemoveCommand) Run(ctx *cmd.Context) error {
+	err := c.ConfigCommand.ReadConfig(ctx)
+	if err != nil {
+		return err
+	}
+	id, err := parseWebhookId(c.Id)
+	if err != nil {
+		return err
+	}
+	s, err := charmstore.Open(c.Config.MongoURL)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	if err := s.RemoveWebhook(id); err != nil {
+		return err
+	}
+	fmt.Fprintln(ctx.Stdout, "Webhook", c.Id, "removed.")
+	return nil
+}
+
+type WebhookTestCommand struct {
+	ConfigCommand
+	Id string
+}
+
+func (c *WebhookTestCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "test",
+		Purpose: "send a test notification to a webhook",
+	}
+}
+
+func (c *WebhookTestCommand) SetFlags(f *gnuflag.FlagSet) {
+	c.ConfigCommand.SetFlags(f)
+	f.StringVar(&c.Id, "id", "", "webhook id, as shown by the list command")
+}
+
+func (c *WebhookTestCommand) Init(args []string) error {
+	err := c.ConfigCommand.Init(args)
+	if err != nil {
+		return err
+	}
+	_, err = parseWebhookId(c.Id)
+	return err
+}
+
+func (c *WebhookTestCommand) Run(ctx *cmd.Context) error {
+	err := c.ConfigCommand.ReadConfig(ctx)
+	if err != nil {
+		return err
+	}
+	id, err := parseWebhookId(c.Id)
+	if err != nil {
+		return err
+	}
+	s, err := charmstore.Open(c.Config.MongoURL)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	if err := s.TestWebhook(id); err != nil {
+		return err
+	}
+	fmt.Fprintln(ctx.Stdout, "Webhook", c.Id, "notified.")
+	return nil
+}
+
+type WebhookReplayCommand struct {
+	ConfigCommand
+}
+
+func (c *WebhookReplayCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "replay",
+		Purpose: "retry the notifications that failed to be delivered",
+		Doc: `
+The notifications due to be retried are delivered. Notifications that fail
+again are retried later, until they are recorded as dead letters.
+`,
+	}
+}
+
+func (c *WebhookReplayCommand) Run(ctx *cmd.Context) error {
+	err := c.ConfigCommand.ReadConfig(ctx)
+	if err != nil {
+		return err
+	}
+	s, err := charmstore.Open(c.Config.MongoURL)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	delivered, err := s.DeliverWebhooks()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(ctx.Stdout, delivered, "notifications delivered.")
+	return nil
+}
+
+type WebhookDeadLettersCommand struct {
+	ConfigCommand
+	Payload bool
+}
+
+func (c *WebhookDeadLettersCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "dead-letters",
+		Purpose: "list the notifications that could not be delivered",
+		Doc: `
+Each notification is listed with its id, the time it was given up on, its
+kind, the webhook URL, the number of attempts and the last error. Use
+--payload to also print the notification bodies.
+`,
+	}
+}
+
+func (c *WebhookDeadLettersCommand) SetFlags(f *gnuflag.FlagSet) {
+	c.ConfigCommand.SetFlags(f)
+	f.BoolVar(&c.Payload, "payload", false, "print the body of each notification")
+}
+
+func (c *WebhookDeadLettersCommand) Run(ctx *cmd.Context) error {
+	err := c.ConfigCommand.ReadConfig(ctx)
+	if err != nil {
+		return err
+	}
+	s, err := charmstore.Open(c.Config.MongoURL)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	letters, err := s.WebhookDeadLetters()
+	if err != nil {
+		return err
+	}
+	for _, letter := range letters {
+		fmt.Fprintf(ctx.Stdout, "%s %s %s %s %d %s\n",
+			letter.Id.Hex(), letter.Time.UTC().Format(time.RFC3339), letter.Kind, letter.URL, letter.Attempts, letter.Error)
+		if c.Payload {
+			fmt.Fprintf(ctx.Stdout, "  %s\n", letter.Payload)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"time"
+
+	"github.com/juju/cmd/cmdtesting"
+	gitjujutesting "github.com/juju/testing"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+	gc "launchpad.net/gocheck"
+
+	"github.com/juju/charmstore"
+)
+
+type webhookSuite struct {
+	gitjujutesting.IsolationSuite
+}
+
+var _ = gc.Suite(&webhookSuite{})
+
+func (s *webhookSuite) TestInit(c *gc.C) {
+	add := &WebhookAddCommand{}
+	err := cmdtesting.InitCommand(add, []string{"--config", "/etc/charmd.conf", "--url", "http://example.com", "--scope", "~joe"})
+	c.Assert(err, gc.IsNil)
+	c.Assert(add.Url, gc.Equals, "http://example.com")
+	c.Assert(add.Scope, gc.Equals, "~joe")
+
+	err = cmdtesting.InitCommand(&WebhookAddCommand{}, []string{"--config", "/etc/charmd.conf"})
+	c.Assert(err, gc.ErrorMatches, "--url is required")
+	err = cmdtesting.InitCommand(&WebhookRemoveCommand{}, []string{"--config", "/etc/charmd.conf"})
+	c.Assert(err, gc.ErrorMatches, "--id is required")
+	err = cmdtesting.InitCommand(&WebhookTestCommand{}, []string{"--config", "/etc/charmd.conf", "--id", "bad"})
+	c.Assert(err, gc.ErrorMatches, `invalid webhook id "bad"`)
+}
+
+func (s *webhookSuite) TestRun(c *gc.C) {
+	configPath := filepath.Join(c.MkDir(), "charmd.conf")
+	contents := "mongo-url: " + gitjujutesting.MgoServer.Addr() + "\n"
+	err := ioutil.WriteFile(configPath, []byte(contents), 0666)
+	c.Assert(err, gc.IsNil)
+
+	notified := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		notified++
+	}))
+	defer server.Close()
+
+	ctx, err := cmdtesting.RunCommand(c, &WebhookAddCommand{}, "--config", configPath, "--url", server.URL, "--scope", "cs:trusty/mysql")
+	c.Assert(err, gc.IsNil)
+	c.Assert(cmdtesting.Stdout(ctx), gc.Matches, "Webhook [0-9a-f]{24} added.\n")
+
+	store, err := charmstore.Open(gitjujutesting.MgoServer.Addr())
+	c.Assert(err, gc.IsNil)
+	defer store.Close()
+	hooks, err := store.Webhooks()
+	c.Assert(err, gc.IsNil)
+	c.Assert(hooks, gc.HasLen, 1)
+	id := hooks[0].Id.Hex()
+
+	ctx, err = cmdtesting.RunCommand(c, &WebhookListCommand{}, "--config", configPath)
+	c.Assert(err, gc.IsNil)
+	c.Assert(cmdtesting.Stdout(ctx), gc.Equals, id+" cs:trusty/mysql "+server.URL+"\n")
+
+	ctx, err = cmdtesting.RunCommand(c, &WebhookTestCommand{}, "--config", configPath, "--id", id)
+	c.Assert(err, gc.IsNil)
+	c.Assert(cmdtesting.Stdout(ctx), gc.Equals, "Webhook "+id+" notified.\n")
+	c.Assert(notified, gc.Equals, 1)
+
+	ctx, err = cmdtesting.RunCommand(c, &WebhookReplayCommand{}, "--config", configPath)
+	c.Assert(err, gc.IsNil)
+	c.Assert(cmdtesting.Stdout(ctx), gc.Equals, "0 notifications delivered.\n")
+
+	ctx, err = cmdtesting.RunCommand(c, &WebhookRemoveCommand{}, "--config", configPath, "--id", id)
+	c.Assert(err, gc.IsNil)
+	c.Assert(cmdtesting.Stdout(ctx), gc.Equals, "Webhook "+id+" removed.\n")
+	hooks, err = store.Webhooks()
+	c.Assert(err, gc.IsNil)
+	c.Assert(hooks, gc.HasLen, 0)
+}
+
+func (s *webhookSuite) TestDeadLetters(c *gc.C) {
+	configPath := filepath.Join(c.MkDir(), "charmd.conf")
+	contents := "mongo-url: " + gitjujutesting.MgoServer.Addr() + "\n"
+	err := ioutil.WriteFile(configPath, []byte(contents), 0666)
+	c.Assert(err, gc.IsNil)
+
+	ctx, err := cmdtesting.RunCommand(c, &WebhookDeadLettersCommand{}, "--config", configPath)
+	c.Assert(err, gc.IsNil)
+	c.Assert(cmdtesting.Stdout(ctx), gc.Equals, "")
+
+	session, err := mgo.Dial(gitjujutesting.MgoServer.Addr())
+	c.Assert(err, gc.IsNil)
+	defer session.Close()
+	letter := &charmstore.WebhookDeadLetter{
+		Id:       bson.NewObjectId(),
+		HookId:   bson.NewObjectId(),
+		URL:      "http://example.com/hook",
+		Kind:     "published",
+		Payload:  `{"kind":"published"}`,
+		Attempts: 5,
+		Error:    `webhook returned status "500 Internal Server Error"`,
+		Time:     time.Date(2014, 5, 1, 12, 0, 0, 0, time.UTC),
+	}
+	err = session.DB("juju").C("deadletters").Insert(letter)
+	c.Assert(err, gc.IsNil)
+
+	line := letter.Id.Hex() + " 2014-05-01T12:00:00Z published http://example.com/hook 5 " + letter.Error + "\n"
+	ctx, err = cmdtesting.RunCommand(c, &WebhookDeadLettersCommand{}, "--config", configPath)
+	c.Assert(err, gc.IsNil)
+	c.Assert(cmdtesting.Stdout(ctx), gc.Equals, line)
+	ctx, err = cmdtesting.RunCommand(c, &WebhookDeadLettersCommand{}, "--config", configPath, "--payload")
+	c.Assert(err, gc.IsNil)
+	c.Assert(cmdtesting.Stdout(ctx), gc.Equals, line+"  "+letter.Payload+"\n")
+}
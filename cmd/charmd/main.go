@@ -8,10 +8,15 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"time"
+
+	"github.com/juju/loggo"
 
 	"github.com/juju/charmstore"
 )
 
+var logger = loggo.GetLogger("juju.charmd")
+
 func main() {
 	err := serve()
 	if err != nil {
@@ -34,17 +39,73 @@ func serve() error {
 	if err != nil {
 		return err
 	}
-	if conf.MongoURL == "" || conf.APIAddr == "" {
-		return fmt.Errorf("missing mongo-url or api-addr in config file")
+	if conf.APIAddr == "" {
+		return fmt.Errorf("missing api-addr in config file")
 	}
-	s, err := charmstore.Open(conf.MongoURL)
+	var store charmstore.StoreReader
+	if conf.StaticDir != "" {
+		s, err := charmstore.OpenStatic(conf.StaticDir, conf.StaticStats)
+		if err != nil {
+			return err
+		}
+		defer s.Close()
+		store = s
+	} else {
+		if conf.MongoURL == "" {
+			return fmt.Errorf("missing mongo-url or static-dir in config file")
+		}
+		s, err := charmstore.Open(conf.MongoURL)
+		if err != nil {
+			return err
+		}
+		defer s.Close()
+		store = s
+		go deliverWebhooks(s)
+	}
+	server, err := charmstore.NewServer(store)
 	if err != nil {
 		return err
 	}
-	defer s.Close()
-	server, err := charmstore.NewServer(s)
+	if conf.DefaultChannel != "" {
+		channel, err := charmstore.ParseChannel(conf.DefaultChannel)
+		if err != nil {
+			return err
+		}
+		server.SetDefaultChannel(channel)
+	}
+	key, err := charmstore.ConfigPublicKey(conf)
 	if err != nil {
 		return err
 	}
+	server.SetPublicKey(key)
+	if conf.RateLimits != nil {
+		limiter, err := charmstore.NewRateLimiter(conf.RateLimits)
+		if err != nil {
+			return err
+		}
+		server.SetRateLimiter(limiter)
+	}
+	if conf.UniqueStatsWindow != "" {
+		window, err := time.ParseDuration(conf.UniqueStatsWindow)
+		if err != nil {
+			return fmt.Errorf("invalid unique-stats-window in config file: %v", err)
+		}
+		server.SetUniqueStatsWindow(window)
+	}
 	return http.ListenAndServe(conf.APIAddr, server)
 }
+
+// webhookRetryInterval holds the interval between
+// retries of the failed webhook notifications.
+const webhookRetryInterval = 10 * time.Second
+
+// deliverWebhooks retries delivering the webhook
+// notifications that failed, forever.
+func deliverWebhooks(s *charmstore.Store) {
+	for {
+		time.Sleep(webhookRetryInterval)
+		if _, err := s.DeliverWebhooks(); err != nil {
+			logger.Errorf("cannot deliver webhook notifications: %v", err)
+		}
+	}
+}
@@ -4,9 +4,13 @@
 package main
 
 import (
+	"encoding/json"
+	"flag"
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"launchpad.net/lpad"
 
@@ -21,15 +25,28 @@ func main() {
 	}
 }
 
+var (
+	full        = flag.Bool("full", false, "consider all branches rather than only the ones changed since the last run")
+	dryRun      = flag.Bool("dry-run", false, "report the branches that would be published without publishing them")
+	jsonOutput  = flag.Bool("json", false, "print the results of the run in JSON format")
+	failOnError = flag.Bool("fail-on-error", false, "exit with a non-zero status if any branch fails to be published")
+	manifest    = flag.String("manifest", "", "publish the branches listed in the given YAML manifest rather than the ones in Launchpad")
+	charmDir    = flag.String("charm-dir", "", "publish the charms in the given local repository directory rather than the ones in Launchpad")
+)
+
 func load() error {
+	flag.Parse()
 	var confPath string
-	if len(os.Args) == 2 {
-		if _, err := os.Stat(os.Args[1]); err == nil {
-			confPath = os.Args[1]
+	if flag.NArg() == 1 {
+		if _, err := os.Stat(flag.Arg(0)); err == nil {
+			confPath = flag.Arg(0)
 		}
 	}
 	if confPath == "" {
-		return fmt.Errorf("usage: %s <config path>", filepath.Base(os.Args[0]))
+		return fmt.Errorf("usage: %s [--full] [--dry-run] [--json] [--fail-on-error] [--manifest <path> | --charm-dir <path>] <config path>", filepath.Base(os.Args[0]))
+	}
+	if *manifest != "" && *charmDir != "" {
+		return fmt.Errorf("cannot use both --manifest and --charm-dir")
 	}
 	conf, err := charmstore.ReadConfig(confPath)
 	if err != nil {
@@ -38,16 +55,88 @@ func load() error {
 	if conf.MongoURL == "" {
 		return fmt.Errorf("missing mongo-url in config file")
 	}
+	src := charmstore.NewLaunchpadSource(lpad.Production, conf.URLMapping)
+	switch {
+	case *manifest != "":
+		src = charmstore.NewManifestSource(*manifest)
+	case *charmDir != "":
+		src = charmstore.NewDirSource(*charmDir)
+	}
 	s, err := charmstore.Open(conf.MongoURL)
 	if err != nil {
 		return err
 	}
 	defer s.Close()
-	err = charmstore.PublishCharmsDistro(s, lpad.Production)
-	if _, ok := err.(charmstore.PublishBranchErrors); ok {
+	if err := s.SetLintPolicies(conf); err != nil {
+		return err
+	}
+	if err := s.LoadSigningKey(conf); err != nil {
+		return err
+	}
+	if err := s.LoadStorageLimits(conf); err != nil {
+		return err
+	}
+	opts := &charmstore.PublishOptions{
+		Parallelism: conf.PublishParallelism,
+		Full:        *full,
+		DryRun:      *dryRun,
+	}
+	if conf.PublishTimeout != "" {
+		opts.Timeout, err = time.ParseDuration(conf.PublishTimeout)
+		if err != nil {
+			return fmt.Errorf("invalid publish-timeout in config file: %v", err)
+		}
+	}
+	report, err := charmstore.PublishSource(s, src, opts)
+	errs, _ := err.(charmstore.PublishBranchErrors)
+	if report != nil {
+		if err := printReport(report, errs); err != nil {
+			return err
+		}
+	}
+	if errs != nil && !*failOnError {
 		// Ignore branch errors since they're commonplace here.
 		// They're logged, though.
 		return nil
 	}
 	return err
 }
+
+// loadResult holds the results of a run in JSON format.
+type loadResult struct {
+	*charmstore.PublishReport
+	Errors []branchError `json:"errors"`
+}
+
+type branchError struct {
+	Branch string `json:"branch"`
+	Error  string `json:"error"`
+}
+
+// printReport prints the results of a run to stdout.
+func printReport(report *charmstore.PublishReport, errs charmstore.PublishBranchErrors) error {
+	if *jsonOutput {
+		result := loadResult{
+			PublishReport: report,
+			Errors:        []branchError{},
+		}
+		for _, err := range errs {
+			result.Errors = append(result.Errors, branchError{err.URL, err.Err.Error()})
+		}
+		data, err := json.MarshalIndent(result, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s\n", data)
+		return nil
+	}
+	if report.DryRun {
+		for _, burl := range report.Published {
+			fmt.Printf("Would publish %s at %s.\n", burl, strings.Join(report.URLs[burl], ", "))
+		}
+		fmt.Printf("Dry run: %s.\n", report)
+		return nil
+	}
+	fmt.Printf("Branches: %s.\n", report)
+	return nil
+}
@@ -12,8 +12,53 @@ import (
 )
 
 type Config struct {
-	MongoURL string `yaml:"mongo-url"`
-	APIAddr  string `yaml:"api-addr"`
+	MongoURL       string            `yaml:"mongo-url"`
+	APIAddr        string            `yaml:"api-addr"`
+	DefaultChannel string            `yaml:"default-channel"`
+	LintPolicy     string            `yaml:"lint-policy"`
+	LintPolicies   map[string]string `yaml:"lint-policies"`
+
+	// PublishParallelism and PublishTimeout configure the publishing
+	// of charms from Launchpad. See PublishOptions for details.
+	// The timeout is specified as a duration string, such as "10m".
+	PublishParallelism int    `yaml:"publish-parallelism"`
+	PublishTimeout     string `yaml:"publish-timeout"`
+
+	// URLMapping holds the rules mapping branch names to charm
+	// URLs when publishing charms from Launchpad.
+	URLMapping *URLMapping `yaml:"url-mapping"`
+
+	// StaticDir, if set, holds the path of a static charm directory
+	// served read-only by charmd instead of the charms in MongoDB.
+	// StaticStats optionally holds the path of the file where the
+	// statistics are recorded in that case. See OpenStatic.
+	StaticDir   string `yaml:"static-dir"`
+	StaticStats string `yaml:"static-stats"`
+
+	// SigningKey, if set, holds the path of the file holding the
+	// Ed25519 private key charms are signed with when published.
+	// PublicKey optionally holds the path of the file holding the
+	// matching public key served by charmd. See ReadSigningKey and
+	// ReadPublicKey for the file formats.
+	SigningKey string `yaml:"signing-key"`
+	PublicKey  string `yaml:"public-key"`
+
+	// MaxArchiveSize, NamespaceQuota and NamespaceQuotas limit the
+	// storage used by published charms and bundles, in bytes. See
+	// StorageLimits for details.
+	MaxArchiveSize  int64            `yaml:"max-archive-size"`
+	NamespaceQuota  int64            `yaml:"namespace-quota"`
+	NamespaceQuotas map[string]int64 `yaml:"namespace-quotas"`
+
+	// RateLimits, if set, holds the limits on the rate of requests
+	// charmd accepts from each client. See RateLimits for details.
+	RateLimits *RateLimits `yaml:"rate-limits"`
+
+	// UniqueStatsWindow, if set, enables the unique download
+	// counters maintained by charmd, counting the downloads by each
+	// client once per window. The window is specified as a duration
+	// string, such as "24h". See Server.SetUniqueStatsWindow.
+	UniqueStatsWindow string `yaml:"unique-stats-window"`
 }
 
 func ReadConfig(path string) (*Config, error) {
@@ -22,6 +22,16 @@ var _ = gc.Suite(&ConfigSuite{})
 
 const testConfig = `
 mongo-url: localhost:23456
+lint-policy: lenient
+lint-policies:
+  charmers: strict
+static-dir: /srv/charms
+static-stats: /var/log/charmd-stats.log
+rate-limits:
+  download: {rate: 0.5, burst: 10, uncounted: true}
+  stats: {rate: 1}
+  allow: [10.0.0.0/8]
+unique-stats-window: 24h
 foo: 1
 bar: false
 `
@@ -39,4 +49,14 @@ func (s *ConfigSuite) TestReadConfig(c *gc.C) {
 	dstr, err := charmstore.ReadConfig(cfgPath)
 	c.Assert(err, gc.IsNil)
 	c.Assert(dstr.MongoURL, gc.Equals, "localhost:23456")
+	c.Assert(dstr.LintPolicy, gc.Equals, "lenient")
+	c.Assert(dstr.LintPolicies, gc.DeepEquals, map[string]string{"charmers": "strict"})
+	c.Assert(dstr.StaticDir, gc.Equals, "/srv/charms")
+	c.Assert(dstr.StaticStats, gc.Equals, "/var/log/charmd-stats.log")
+	c.Assert(dstr.RateLimits, gc.DeepEquals, &charmstore.RateLimits{
+		Download: charmstore.RateLimit{Rate: 0.5, Burst: 10, Uncounted: true},
+		Stats:    charmstore.RateLimit{Rate: 1},
+		Allow:    []string{"10.0.0.0/8"},
+	})
+	c.Assert(dstr.UniqueStatsWindow, gc.Equals, "24h")
 }
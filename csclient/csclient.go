@@ -0,0 +1,461 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package csclient implements a client of the charm store HTTP API.
+//
+// The package doesn't depend on the charm store implementation, so
+// that it can be used without pulling in the MongoDB driver. New API
+// endpoints served by the charm store get a method on Client here.
+package csclient
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/juju/charm"
+)
+
+// DefaultURL holds the base URL of the public charm store API.
+const DefaultURL = "https://store.juju.ubuntu.com"
+
+// defaultRetryDelay holds the time waited before retrying
+// a failed request when Params.RetryDelay is zero.
+const defaultRetryDelay = time.Second
+
+// ErrNotFound is returned when the requested charm
+// is not found in the charm store.
+var ErrNotFound = errors.New("entry not found")
+
+// Params holds the parameters for creating a new Client.
+type Params struct {
+	// URL holds the base URL of the charm store API.
+	// If empty, DefaultURL is used.
+	URL string
+
+	// HTTPClient holds the HTTP client used to send requests.
+	// If nil, http.DefaultClient is used.
+	HTTPClient *http.Client
+
+	// Retries holds the number of times a request is retried when
+	// it can't be sent or the charm store responds with a server
+	// error status, or rejects it because of its rate limits.
+	// Requests are not retried if it's zero.
+	Retries int
+
+	// RetryDelay holds the time waited before retrying
+	// a request. If zero, one second is waited. A longer delay
+	// is waited if requested by the charm store with the
+	// Retry-After header of a rate limited response.
+	RetryDelay time.Duration
+
+	// DisableStats prevents the requests made by the client
+	// from being counted in the charm store statistics.
+	DisableStats bool
+
+	// PublicKey, if set, holds the key the charm store signs charms
+	// with. Charms downloaded by the client must then be signed by it.
+	PublicKey ed25519.PublicKey
+}
+
+// Client is a client of the charm store HTTP API.
+type Client struct {
+	params Params
+}
+
+// New returns a new Client using the given parameters.
+func New(p Params) *Client {
+	if p.URL == "" {
+		p.URL = DefaultURL
+	}
+	p.URL = strings.TrimRight(p.URL, "/")
+	if p.HTTPClient == nil {
+		p.HTTPClient = http.DefaultClient
+	}
+	if p.RetryDelay == 0 {
+		p.RetryDelay = defaultRetryDelay
+	}
+	return &Client{p}
+}
+
+// URL returns the base URL of the charm store API used by c.
+func (c *Client) URL() string {
+	return c.params.URL
+}
+
+// InfoResponse holds the information about a charm, as returned
+// by the charm store. It extends charm.InfoResponse with the
+// signature of the charm, when the charm store signs charms.
+type InfoResponse struct {
+	charm.InfoResponse
+	Signature string `json:"signature,omitempty"`
+}
+
+// URL returns the URL of the charm revision described by info.
+func (info *InfoResponse) URL() (*charm.URL, error) {
+	curl, err := charm.ParseURL(info.CanonicalURL)
+	if err != nil {
+		return nil, err
+	}
+	return curl.WithRevision(info.Revision), nil
+}
+
+// Info returns the information held by the charm store about
+// the charms at the given URLs, which may lack a series or revision.
+// The result is keyed by the given URLs. Problems with a single charm,
+// such as it not being found, are reported in the Errors field of
+// its entry rather than as an error.
+func (c *Client) Info(curls ...string) (map[string]*InfoResponse, error) {
+	query := url.Values{"charms": curls}
+	var response map[string]*InfoResponse
+	if err := c.getJSON("/charm-info", query, &response); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// EventResponse holds the information about a charm event,
+// as returned by the charm store. It extends charm.EventResponse
+// with the details of who made the change and why.
+type EventResponse struct {
+	charm.EventResponse
+	Actor  string `json:"actor,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// Event returns the events logged by the charm store for the charms
+// at the given keys. Each key holds a charm URL with no revision,
+// optionally followed by "@" and a digest to select the event logged
+// for that digest rather than the latest one. The result is keyed by
+// the given keys, so that several events may be requested for the
+// same charm. Problems with a single key are reported in the Errors
+// field of its entry rather than as an error.
+func (c *Client) Event(keys ...string) (map[string]*EventResponse, error) {
+	query := url.Values{
+		"charms":    keys,
+		"long_keys": {"1"},
+	}
+	var response map[string]*EventResponse
+	if err := c.getJSON("/charm-event", query, &response); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// CharmInfo returns the information held by the charm store about the
+// charm at curl, which may lack a series or revision. Unlike Info, it
+// reports the problems with the charm as an error. ErrNotFound is
+// returned if the charm is not found in the charm store.
+func (c *Client) CharmInfo(curl string) (*InfoResponse, error) {
+	infos, err := c.Info(curl)
+	if err != nil {
+		return nil, err
+	}
+	info := infos[curl]
+	if info == nil {
+		return nil, fmt.Errorf("no information on charm %s in charm store response", curl)
+	}
+	if len(info.Errors) > 0 {
+		if info.Errors[0] == ErrNotFound.Error() {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("cannot get information on charm %s: %s", curl, strings.Join(info.Errors, "; "))
+	}
+	return info, nil
+}
+
+// ChangeEntry describes a single charm event,
+// as returned by the /changes API.
+type ChangeEntry struct {
+	Id       string   `json:"id"`
+	Kind     string   `json:"kind"`
+	URLs     []string `json:"urls"`
+	Revision int      `json:"revision"`
+	Digest   string   `json:"digest,omitempty"`
+	Errors   []string `json:"errors,omitempty"`
+	Warnings []string `json:"warnings,omitempty"`
+	Time     string   `json:"time"`
+	Actor    string   `json:"actor,omitempty"`
+	Reason   string   `json:"reason,omitempty"`
+	Channel  string   `json:"channel,omitempty"`
+}
+
+// ChangesRequest holds the parameters of a request
+// for the events logged by the charm store.
+type ChangesRequest struct {
+	// After, if not empty, holds the id of a previously
+	// returned event, and restricts the results to the
+	// events logged after it.
+	After string
+
+	// Kinds, if not empty, restricts the results to
+	// events of the given kinds.
+	Kinds []string
+
+	// Limit, if greater than zero, holds the maximum number
+	// of events returned. Otherwise the charm store default
+	// is used.
+	Limit int
+}
+
+// Changes returns the events logged by the charm store
+// matching req, in the order they were logged.
+func (c *Client) Changes(req *ChangesRequest) ([]ChangeEntry, error) {
+	query := make(url.Values)
+	if req.After != "" {
+		query.Set("after", req.After)
+	}
+	for _, kind := range req.Kinds {
+		query.Add("kind", kind)
+	}
+	if req.Limit > 0 {
+		query.Set("limit", strconv.Itoa(req.Limit))
+	}
+	var entries []ChangeEntry
+	if err := c.getJSON("/changes", query, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// Download returns the archive of the charm at curl, which may lack
+// a series or revision, and the information held by the charm store
+// about it. The archive is verified against the SHA256 hash in the
+// charm information, and the charm information against its signature
+// when Params.PublicKey is set. ErrNotFound is returned if the charm
+// is not found in the charm store.
+func (c *Client) Download(curl string) (*InfoResponse, []byte, error) {
+	info, err := c.CharmInfo(curl)
+	if err != nil {
+		return nil, nil, err
+	}
+	rurl, err := info.URL()
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot download charm %s: %v", curl, err)
+	}
+	if c.params.PublicKey != nil {
+		if err := VerifyInfo(c.params.PublicKey, info); err != nil {
+			return nil, nil, fmt.Errorf("cannot download charm %s: %v", curl, err)
+		}
+	}
+	// Download the exact revision described by info, in case
+	// another one is published in the meantime.
+	path := "/charm/" + strings.TrimPrefix(rurl.String(), "cs:")
+	resp, err := c.get(path, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot download charm %s: %v", curl, err)
+	}
+	hash := sha256.Sum256(data)
+	if sum := hex.EncodeToString(hash[:]); sum != info.Sha256 {
+		return nil, nil, fmt.Errorf("cannot download charm %s: archive has SHA256 %s, expected %s", curl, sum, info.Sha256)
+	}
+	return info, data, nil
+}
+
+// StatsBy defines the period covered by each
+// data point returned by Client.Stats.
+type StatsBy string
+
+const (
+	StatsByAll  StatsBy = ""
+	StatsByDay  StatsBy = "day"
+	StatsByWeek StatsBy = "week"
+)
+
+// StatsRequest holds the parameters of a request for the
+// statistics counters of the charm store. The fields have
+// the same meaning as in the charmstore.CounterRequest type.
+type StatsRequest struct {
+	Key    []string
+	Prefix bool
+	List   bool
+	By     StatsBy
+
+	// Start and Stop, if not zero, restrict the counted data
+	// points to the given days. Only their date is used.
+	Start time.Time
+	Stop  time.Time
+}
+
+// Counter holds a statistics counter returned by the charm store.
+type Counter struct {
+	Key    []string
+	Prefix bool
+	Count  int64
+
+	// Time holds the day the count was aggregated
+	// under, if the counter was requested by period.
+	Time time.Time
+}
+
+// Stats returns the statistics counters matching req.
+func (c *Client) Stats(req *StatsRequest) ([]Counter, error) {
+	if len(req.Key) == 0 {
+		return nil, fmt.Errorf("empty statistics key")
+	}
+	tokens := make([]string, len(req.Key))
+	for i, token := range req.Key {
+		tokens[i] = strings.Replace(url.QueryEscape(token), "+", "%20", -1)
+	}
+	key := strings.Join(tokens, ":")
+	if req.Prefix {
+		key += ":*"
+	}
+	query := url.Values{"format": {"json"}}
+	if req.List {
+		query.Set("list", "1")
+	}
+	if req.By != StatsByAll {
+		query.Set("by", string(req.By))
+	}
+	if !req.Start.IsZero() {
+		query.Set("start", req.Start.Format("2006-01-02"))
+	}
+	if !req.Stop.IsZero() {
+		query.Set("stop", req.Stop.Format("2006-01-02"))
+	}
+	var items [][]interface{}
+	if err := c.getJSON("/stats/counter/"+key, query, &items); err != nil {
+		return nil, err
+	}
+	counters := make([]Counter, len(items))
+	for i, item := range items {
+		counter, err := parseCounter(req, item)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse counter %v: %v", item, err)
+		}
+		counters[i] = counter
+	}
+	return counters, nil
+}
+
+// parseCounter returns the counter returned by the charm store as item,
+// which holds the counter key if req.List is true, its day if req.By is
+// not StatsByAll, and its count.
+func parseCounter(req *StatsRequest, item []interface{}) (Counter, error) {
+	counter := Counter{Key: req.Key, Prefix: req.Prefix}
+	if len(item) == 0 {
+		return counter, fmt.Errorf("no count")
+	}
+	count, ok := item[len(item)-1].(float64)
+	if !ok {
+		return counter, fmt.Errorf("invalid count")
+	}
+	counter.Count = int64(count)
+	fields := item[:len(item)-1]
+	if req.List {
+		if len(fields) == 0 {
+			return counter, fmt.Errorf("no key")
+		}
+		key, ok := fields[0].(string)
+		if !ok {
+			return counter, fmt.Errorf("invalid key")
+		}
+		counter.Key = strings.Split(key, ":")
+		counter.Prefix = false
+		if n := len(counter.Key); counter.Key[n-1] == "*" {
+			counter.Key = counter.Key[:n-1]
+			counter.Prefix = true
+		}
+		fields = fields[1:]
+	}
+	if req.By != StatsByAll {
+		if len(fields) == 0 {
+			return counter, fmt.Errorf("no time")
+		}
+		day, ok := fields[0].(string)
+		if !ok {
+			return counter, fmt.Errorf("invalid time")
+		}
+		t, err := time.Parse("2006-01-02", day)
+		if err != nil {
+			return counter, err
+		}
+		counter.Time = t
+	}
+	return counter, nil
+}
+
+// getJSON decodes into v the JSON response to a GET request
+// to the charm store at the given path and query.
+func (c *Client) getJSON(path string, query url.Values, v interface{}) error {
+	resp, err := c.get(path, query)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("cannot decode response from %s%s: %v", c.params.URL, path, err)
+	}
+	return nil
+}
+
+// get sends a GET request to the charm store at the given path and
+// query, retrying it as configured in the client parameters. The
+// response body must be closed by the caller. ErrNotFound is returned
+// if the charm store responds to a charm download or a signing key
+// request with a 404 status.
+func (c *Client) get(path string, query url.Values) (*http.Response, error) {
+	if c.params.DisableStats {
+		if query == nil {
+			query = make(url.Values)
+		}
+		query.Set("stats", "0")
+	}
+	reqURL := c.params.URL + path
+	if len(query) > 0 {
+		reqURL += "?" + query.Encode()
+	}
+	for attempt := 0; ; attempt++ {
+		resp, err := c.params.HTTPClient.Get(reqURL)
+		if err == nil && resp.StatusCode == http.StatusOK {
+			return resp, nil
+		}
+		delay := c.params.RetryDelay
+		if err == nil {
+			err = responseError(reqURL, resp)
+			if resp.StatusCode == http.StatusNotFound && (strings.HasPrefix(path, "/charm/") || path == "/signing-key") {
+				return nil, ErrNotFound
+			}
+			if resp.StatusCode == http.StatusTooManyRequests {
+				secs, _ := strconv.Atoi(resp.Header.Get("Retry-After"))
+				if wait := time.Duration(secs) * time.Second; wait > delay {
+					delay = wait
+				}
+			} else if resp.StatusCode < 500 {
+				return nil, err
+			}
+		}
+		if attempt >= c.params.Retries {
+			return nil, err
+		}
+		time.Sleep(delay)
+	}
+}
+
+// responseError returns the error describing
+// the failed response to a request to reqURL.
+func responseError(reqURL string, resp *http.Response) error {
+	defer resp.Body.Close()
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	if msg = bytes.TrimSpace(msg); len(msg) > 0 {
+		return fmt.Errorf("cannot get %s: %s: %s", reqURL, resp.Status, msg)
+	}
+	return fmt.Errorf("cannot get %s: %s", reqURL, resp.Status)
+}
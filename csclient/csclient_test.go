@@ -0,0 +1,388 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package csclient_test
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/juju/charm"
+	charmtesting "github.com/juju/charm/testing"
+	gc "launchpad.net/gocheck"
+
+	"github.com/juju/charmstore"
+	"github.com/juju/charmstore/csclient"
+)
+
+func Test(t *testing.T) {
+	gc.TestingT(t)
+}
+
+var _ = gc.Suite(&ClientSuite{})
+
+// ClientSuite runs the client against a charm store
+// server backed by an in-memory store.
+type ClientSuite struct {
+	store   *charmstore.MemStore
+	csrv    *charmstore.Server
+	handler http.Handler
+	server  *httptest.Server
+	client  *csclient.Client
+}
+
+func (s *ClientSuite) SetUpTest(c *gc.C) {
+	s.store = charmstore.NewMemStore()
+	csrv, err := charmstore.NewServer(s.store)
+	c.Assert(err, gc.IsNil)
+	s.csrv = csrv
+	s.handler = csrv
+	s.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.handler.ServeHTTP(w, r)
+	}))
+	s.client = csclient.New(csclient.Params{
+		URL:          s.server.URL,
+		DisableStats: true,
+	})
+}
+
+func (s *ClientSuite) TearDownTest(c *gc.C) {
+	s.server.Close()
+}
+
+// publish publishes the dummy charm at curl with the given digest.
+func (s *ClientSuite) publish(c *gc.C, curl, digest string) {
+	urls := []*charm.URL{charm.MustParseURL(curl)}
+	pub, err := s.store.CharmPublisher(urls, digest)
+	c.Assert(err, gc.IsNil)
+	err = pub.Publish(charmtesting.Charms.ClonedDir(c.MkDir(), "dummy"))
+	c.Assert(err, gc.IsNil)
+	err = s.store.LogCharmEvent(&charmstore.CharmEvent{
+		Kind:     charmstore.EventPublished,
+		Digest:   digest,
+		Revision: pub.Revision(),
+		URLs:     urls,
+		Time:     time.Date(2014, 6, 1, 10, 0, pub.Revision(), 0, time.UTC),
+	})
+	c.Assert(err, gc.IsNil)
+}
+
+func (s *ClientSuite) TestInfo(c *gc.C) {
+	s.publish(c, "cs:precise/dummy", "digest-0")
+	s.publish(c, "cs:precise/dummy", "digest-1")
+
+	infos, err := s.client.Info("cs:dummy", "cs:precise/dummy-0", "cs:precise/missing")
+	c.Assert(err, gc.IsNil)
+	c.Assert(infos, gc.HasLen, 3)
+	info := infos["cs:dummy"]
+	c.Assert(info.Errors, gc.HasLen, 0)
+	c.Assert(info.CanonicalURL, gc.Equals, "cs:precise/dummy")
+	c.Assert(info.Revision, gc.Equals, 1)
+	c.Assert(info.Digest, gc.Equals, "digest-1")
+	c.Assert(infos["cs:precise/dummy-0"].Digest, gc.Equals, "digest-0")
+	c.Assert(infos["cs:precise/missing"].Errors, gc.DeepEquals, []string{"entry not found"})
+}
+
+func (s *ClientSuite) TestEvent(c *gc.C) {
+	s.publish(c, "cs:precise/dummy", "digest-0")
+	s.publish(c, "cs:precise/dummy", "digest-1")
+
+	events, err := s.client.Event("cs:precise/dummy@digest-0", "cs:precise/dummy@digest-1", "cs:precise/dummy")
+	c.Assert(err, gc.IsNil)
+	c.Assert(events, gc.HasLen, 3)
+	c.Assert(events["cs:precise/dummy@digest-0"].Revision, gc.Equals, 0)
+	c.Assert(events["cs:precise/dummy@digest-0"].Time, gc.Equals, "2014-06-01T10:00:00Z")
+	c.Assert(events["cs:precise/dummy@digest-1"].Revision, gc.Equals, 1)
+	c.Assert(events["cs:precise/dummy"].Digest, gc.Equals, "digest-1")
+	c.Assert(events["cs:precise/dummy"].Kind, gc.Equals, "published")
+}
+
+func (s *ClientSuite) TestCharmInfo(c *gc.C) {
+	s.publish(c, "cs:precise/dummy", "digest-0")
+	info, err := s.client.CharmInfo("cs:dummy")
+	c.Assert(err, gc.IsNil)
+	c.Assert(info.CanonicalURL, gc.Equals, "cs:precise/dummy")
+	c.Assert(info.Digest, gc.Equals, "digest-0")
+
+	_, err = s.client.CharmInfo("cs:precise/missing")
+	c.Assert(err, gc.Equals, csclient.ErrNotFound)
+	_, err = s.client.CharmInfo("gopher:archie-server")
+	c.Assert(err, gc.ErrorMatches, `cannot get information on charm gopher:archie-server: charm URL has invalid schema: .*`)
+}
+
+func (s *ClientSuite) TestChanges(c *gc.C) {
+	for i := 0; i < 3; i++ {
+		s.publish(c, "cs:precise/dummy", fmt.Sprintf("digest-%d", i))
+	}
+	err := s.store.LogCharmEvent(&charmstore.CharmEvent{
+		Kind:   charmstore.EventPublishError,
+		Digest: "digest-3",
+		URLs:   []*charm.URL{charm.MustParseURL("cs:precise/dummy")},
+	})
+	c.Assert(err, gc.IsNil)
+
+	entries, err := s.client.Changes(&csclient.ChangesRequest{})
+	c.Assert(err, gc.IsNil)
+	c.Assert(entries, gc.HasLen, 4)
+	c.Assert(entries[0].URLs, gc.DeepEquals, []string{"cs:precise/dummy"})
+	c.Assert(entries[0].Digest, gc.Equals, "digest-0")
+	c.Assert(entries[0].Time, gc.Equals, "2014-06-01T10:00:00Z")
+
+	entries, err = s.client.Changes(&csclient.ChangesRequest{
+		After: entries[0].Id,
+		Kinds: []string{"published"},
+		Limit: 1,
+	})
+	c.Assert(err, gc.IsNil)
+	c.Assert(entries, gc.HasLen, 1)
+	c.Assert(entries[0].Digest, gc.Equals, "digest-1")
+	c.Assert(entries[0].Kind, gc.Equals, "published")
+}
+
+func (s *ClientSuite) TestDownload(c *gc.C) {
+	s.publish(c, "cs:precise/dummy", "digest-0")
+	info, data, err := s.client.Download("cs:dummy")
+	c.Assert(err, gc.IsNil)
+	c.Assert(info.CanonicalURL, gc.Equals, "cs:precise/dummy")
+	_, rc, err := s.store.OpenCharm(charm.MustParseURL("cs:precise/dummy"))
+	c.Assert(err, gc.IsNil)
+	defer rc.Close()
+	expected, err := ioutil.ReadAll(rc)
+	c.Assert(err, gc.IsNil)
+	c.Assert(data, gc.DeepEquals, expected)
+
+	_, _, err = s.client.Download("cs:precise/missing")
+	c.Assert(err, gc.Equals, csclient.ErrNotFound)
+}
+
+func (s *ClientSuite) TestDownloadVerifiesSha256(c *gc.C) {
+	s.publish(c, "cs:precise/dummy", "digest-0")
+	handler := s.handler
+	s.handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/charm/precise/dummy-0" {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, r)
+		data := rec.Body.Bytes()
+		data[len(data)/2] ^= 0xff
+		w.Write(data)
+	})
+	_, _, err := s.client.Download("cs:precise/dummy")
+	c.Assert(err, gc.ErrorMatches, "cannot download charm cs:precise/dummy: archive has SHA256 [0-9a-f]+, expected [0-9a-f]+")
+}
+
+func (s *ClientSuite) TestSignedDownload(c *gc.C) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	c.Assert(err, gc.IsNil)
+	s.publish(c, "cs:precise/dummy", "digest-0")
+	s.store.SetSigningKey(priv)
+	s.publish(c, "cs:precise/dummy", "digest-1")
+	client := csclient.New(csclient.Params{
+		URL:       s.server.URL,
+		PublicKey: pub,
+	})
+
+	info, _, err := client.Download("cs:dummy")
+	c.Assert(err, gc.IsNil)
+	c.Assert(info.Revision, gc.Equals, 1)
+	err = csclient.VerifyInfo(pub, info)
+	c.Assert(err, gc.IsNil)
+
+	_, _, err = client.Download("cs:precise/dummy-0")
+	c.Assert(err, gc.ErrorMatches, "cannot download charm cs:precise/dummy-0: charm cs:precise/dummy-0 is not signed")
+
+	otherPub, _, err := ed25519.GenerateKey(rand.Reader)
+	c.Assert(err, gc.IsNil)
+	client = csclient.New(csclient.Params{
+		URL:       s.server.URL,
+		PublicKey: otherPub,
+	})
+	_, _, err = client.Download("cs:dummy")
+	c.Assert(err, gc.ErrorMatches, "cannot download charm cs:dummy: invalid signature for charm cs:precise/dummy-1")
+
+	// A hash tampered with in the charm information
+	// is detected by the signature verification.
+	handler := s.handler
+	s.handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/charm-info" {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, r)
+		var infos map[string]*csclient.InfoResponse
+		err := json.Unmarshal(rec.Body.Bytes(), &infos)
+		c.Check(err, gc.IsNil)
+		for _, info := range infos {
+			info.Sha256 = strings.Repeat("0", 64)
+		}
+		data, err := json.Marshal(infos)
+		c.Check(err, gc.IsNil)
+		w.Write(data)
+	})
+	_, _, err = s.client.Download("cs:dummy")
+	c.Assert(err, gc.ErrorMatches, "cannot download charm cs:dummy: archive has SHA256 [0-9a-f]+, expected 0+")
+	client = csclient.New(csclient.Params{
+		URL:       s.server.URL,
+		PublicKey: pub,
+	})
+	_, _, err = client.Download("cs:dummy")
+	c.Assert(err, gc.ErrorMatches, "cannot download charm cs:dummy: invalid signature for charm cs:precise/dummy-1")
+}
+
+func (s *ClientSuite) TestSigningKey(c *gc.C) {
+	_, err := s.client.SigningKey()
+	c.Assert(err, gc.Equals, csclient.ErrNotFound)
+
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	c.Assert(err, gc.IsNil)
+	s.csrv.SetPublicKey(pub)
+	key, err := s.client.SigningKey()
+	c.Assert(err, gc.IsNil)
+	c.Assert(key, gc.DeepEquals, pub)
+}
+
+func (s *ClientSuite) TestStats(c *gc.C) {
+	for _, key := range [][]string{
+		{"charm-bundle", "precise", "dummy"},
+		{"charm-bundle", "precise", "dummy"},
+		{"charm-bundle", "trusty", "mysql"},
+	} {
+		err := s.store.IncCounter(key)
+		c.Assert(err, gc.IsNil)
+	}
+
+	counters, err := s.client.Stats(&csclient.StatsRequest{
+		Key: []string{"charm-bundle", "precise", "dummy"},
+	})
+	c.Assert(err, gc.IsNil)
+	c.Assert(counters, gc.DeepEquals, []csclient.Counter{{
+		Key:   []string{"charm-bundle", "precise", "dummy"},
+		Count: 2,
+	}})
+
+	counters, err = s.client.Stats(&csclient.StatsRequest{
+		Key:    []string{"charm-bundle"},
+		Prefix: true,
+		List:   true,
+	})
+	c.Assert(err, gc.IsNil)
+	c.Assert(counters, gc.DeepEquals, []csclient.Counter{{
+		Key:    []string{"charm-bundle", "precise"},
+		Prefix: true,
+		Count:  2,
+	}, {
+		Key:    []string{"charm-bundle", "trusty"},
+		Prefix: true,
+		Count:  1,
+	}})
+
+	today := time.Now().UTC()
+	counters, err = s.client.Stats(&csclient.StatsRequest{
+		Key:    []string{"charm-bundle"},
+		Prefix: true,
+		By:     csclient.StatsByDay,
+		Start:  today,
+	})
+	c.Assert(err, gc.IsNil)
+	c.Assert(counters, gc.HasLen, 1)
+	c.Assert(counters[0].Count, gc.Equals, int64(3))
+	c.Assert(counters[0].Time.Format("2006-01-02"), gc.Equals, today.Format("2006-01-02"))
+
+	_, err = s.client.Stats(&csclient.StatsRequest{})
+	c.Assert(err, gc.ErrorMatches, "empty statistics key")
+}
+
+func (s *ClientSuite) TestRetries(c *gc.C) {
+	s.publish(c, "cs:precise/dummy", "digest-0")
+	handler := s.handler
+	failures := 2
+	s.handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failures > 0 {
+			failures--
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+
+	_, err := s.client.Info("cs:precise/dummy")
+	c.Assert(err, gc.ErrorMatches, `cannot get .*/charm-info\?charms=cs%3Aprecise%2Fdummy&stats=0: 503 Service Unavailable: try again`)
+	c.Assert(failures, gc.Equals, 1)
+
+	client := csclient.New(csclient.Params{
+		URL:        s.server.URL,
+		Retries:    2,
+		RetryDelay: time.Millisecond,
+	})
+	failures = 2
+	infos, err := client.Info("cs:precise/dummy")
+	c.Assert(err, gc.IsNil)
+	c.Assert(infos["cs:precise/dummy"].Digest, gc.Equals, "digest-0")
+	c.Assert(failures, gc.Equals, 0)
+
+	// Rate limited requests are retried.
+	failures = 2
+	s.handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failures > 0 {
+			failures--
+			w.Header().Set("Retry-After", "0")
+			http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+	infos, err = client.Info("cs:precise/dummy")
+	c.Assert(err, gc.IsNil)
+	c.Assert(infos["cs:precise/dummy"].Digest, gc.Equals, "digest-0")
+	c.Assert(failures, gc.Equals, 0)
+
+	// Client errors are not retried.
+	s.handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		failures++
+		http.Error(w, "bad request", http.StatusBadRequest)
+	})
+	_, err = client.Info("cs:precise/dummy")
+	c.Assert(err, gc.ErrorMatches, `cannot get .*: 400 Bad Request: bad request`)
+	c.Assert(failures, gc.Equals, 1)
+}
+
+func (s *ClientSuite) TestParams(c *gc.C) {
+	client := csclient.New(csclient.Params{})
+	c.Assert(client.URL(), gc.Equals, csclient.DefaultURL)
+	client = csclient.New(csclient.Params{URL: "http://example.com/"})
+	c.Assert(client.URL(), gc.Equals, "http://example.com")
+
+	var buf bytes.Buffer
+	client = csclient.New(csclient.Params{
+		URL: s.server.URL,
+		HTTPClient: &http.Client{
+			Transport: recordingTransport{&buf},
+		},
+	})
+	_, err := client.Info("cs:precise/dummy")
+	c.Assert(err, gc.IsNil)
+	c.Assert(buf.String(), gc.Equals, "GET /charm-info?charms=cs%3Aprecise%2Fdummy\n")
+}
+
+// recordingTransport is an http.RoundTripper recording
+// the requests sent through it.
+type recordingTransport struct {
+	buf *bytes.Buffer
+}
+
+func (t recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.buf.WriteString(req.Method + " " + req.URL.RequestURI() + "\n")
+	return http.DefaultTransport.RoundTrip(req)
+}
@@ -0,0 +1,82 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package csclient
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+
+	"github.com/juju/charm"
+)
+
+// SignatureAlgorithm names the algorithm used by
+// the charm store to sign charms.
+const SignatureAlgorithm = "ed25519"
+
+// SignatureMessage returns the message signed by the charm store for
+// the charm revision at curl, whose archive has the given hex-encoded
+// SHA256 hash.
+func SignatureMessage(curl *charm.URL, sha256 string) []byte {
+	return []byte("charmstore-signature-v1\n" + curl.String() + "\n" + sha256 + "\n")
+}
+
+// VerifySignature checks that sig holds the base64-encoded signature
+// made with the private key matching key of the charm revision at curl
+// with the given SHA256 hash.
+func VerifySignature(key ed25519.PublicKey, curl *charm.URL, sha256, sig string) error {
+	if curl.Revision == -1 {
+		return fmt.Errorf("cannot verify signature of charm %s: no revision", curl)
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return fmt.Errorf("cannot verify signature of charm %s: invalid public key", curl)
+	}
+	if sig == "" {
+		return fmt.Errorf("charm %s is not signed", curl)
+	}
+	data, err := base64.StdEncoding.DecodeString(sig)
+	if err != nil {
+		return fmt.Errorf("cannot verify signature of charm %s: %v", curl, err)
+	}
+	if !ed25519.Verify(key, SignatureMessage(curl, sha256), data) {
+		return fmt.Errorf("invalid signature for charm %s", curl)
+	}
+	return nil
+}
+
+// VerifyInfo checks the signature held in info against
+// the charm URL, revision and SHA256 hash it describes.
+func VerifyInfo(key ed25519.PublicKey, info *InfoResponse) error {
+	curl, err := info.URL()
+	if err != nil {
+		return err
+	}
+	return VerifySignature(key, curl, info.Sha256, info.Signature)
+}
+
+// SigningKeyResponse holds the key the charm store signs charms
+// with, as returned by the /signing-key API.
+type SigningKeyResponse struct {
+	Algorithm string `json:"algorithm"`
+	PublicKey string `json:"public-key"`
+}
+
+// SigningKey returns the public key of the key the charm store signs
+// charms with. ErrNotFound is returned if the charm store doesn't sign
+// charms. As the key is retrieved from the charm store itself, it
+// should be checked against a trusted copy before being relied upon.
+func (c *Client) SigningKey() (ed25519.PublicKey, error) {
+	var response SigningKeyResponse
+	if err := c.getJSON("/signing-key", nil, &response); err != nil {
+		return nil, err
+	}
+	if response.Algorithm != SignatureAlgorithm {
+		return nil, fmt.Errorf("unsupported signature algorithm %q", response.Algorithm)
+	}
+	key, err := base64.StdEncoding.DecodeString(response.PublicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid public key %q", response.PublicKey)
+	}
+	return ed25519.PublicKey(key), nil
+}
@@ -0,0 +1,178 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/juju/charm"
+)
+
+// dirSource is a Source for the charms in a local directory tree.
+type dirSource struct {
+	root string
+}
+
+// NewDirSource returns a Source for the charm directories found in the
+// directory tree at root, laid out as a local charm repository:
+// root/<series>/<charm name> is published at cs:<series>/<charm name>,
+// and root/~<user>/<series>/<charm name> at the respective charm URL
+// in the user namespace. The digest of each charm is computed from the
+// content of its files.
+func NewDirSource(root string) Source {
+	return &dirSource{root}
+}
+
+// Name implements Source.Name.
+func (src *dirSource) Name() string {
+	return "dir:" + src.root
+}
+
+// Candidates implements Source.Candidates.
+func (src *dirSource) Candidates(since time.Time) ([]*Candidate, error) {
+	var candidates []*Candidate
+	names, err := subdirs(src.root)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		if !strings.HasPrefix(name, "~") {
+			cs, err := src.seriesCandidates("", name)
+			if err != nil {
+				return nil, err
+			}
+			candidates = append(candidates, cs...)
+			continue
+		}
+		series, err := subdirs(filepath.Join(src.root, name))
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range series {
+			cs, err := src.seriesCandidates(name, s)
+			if err != nil {
+				return nil, err
+			}
+			candidates = append(candidates, cs...)
+		}
+	}
+	return candidates, nil
+}
+
+// seriesCandidates returns the candidates for the charms in the given
+// series directory, within the user namespace directory if not empty.
+func (src *dirSource) seriesCandidates(user, series string) ([]*Candidate, error) {
+	dir := filepath.Join(src.root, user, series)
+	names, err := subdirs(dir)
+	if err != nil {
+		return nil, err
+	}
+	var candidates []*Candidate
+	for _, name := range names {
+		path, err := filepath.Abs(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		c := &Candidate{SourceURL: path}
+		ref := "cs:" + series + "/" + name
+		if user != "" {
+			ref = "cs:" + user + "/" + series + "/" + name
+		}
+		curl, err := charm.ParseURL(ref)
+		if err != nil {
+			c.Err = err
+		} else {
+			c.URLs = []*charm.URL{curl}
+			c.Digest, c.Err = dirDigest(path)
+		}
+		candidates = append(candidates, c)
+	}
+	return candidates, nil
+}
+
+// Publish implements Source.Publish.
+func (src *dirSource) Publish(store *Store, c *Candidate, timeout time.Duration) error {
+	// Prevent other publishers from updating these specific URLs
+	// concurrently.
+	lock, err := store.LockUpdates(c.URLs)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	// The content may have changed since the candidate was found.
+	digest, err := dirDigest(c.SourceURL)
+	if err != nil {
+		return err
+	}
+	pub, err := store.CharmPublisher(c.URLs, digest)
+	if err != nil {
+		return err
+	}
+	attempts, err := publishAttempts(store, c.URLs, digest)
+	if err != nil {
+		return err
+	}
+	return publishCharm(store, pub, c.URLs, c.SourceURL, digest, attempts)
+}
+
+// subdirs returns the names of the directories within dir,
+// ignoring hidden ones.
+func subdirs(dir string) ([]string, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, info := range infos {
+		if info.IsDir() && !strings.HasPrefix(info.Name(), ".") {
+			names = append(names, info.Name())
+		}
+	}
+	return names, nil
+}
+
+// dirDigest returns a digest of the content of the files in the
+// directory tree at dir, ignoring hidden files and directories.
+func dirDigest(dir string) (string, error) {
+	h := sha256.New()
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(info.Name(), ".") && rel != "." {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		fmt.Fprintf(h, "%s %o\n", filepath.ToSlash(rel), info.Mode())
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(h, f)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
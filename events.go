@@ -0,0 +1,148 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore
+
+import (
+	"fmt"
+	"time"
+
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+// ParseCharmEventKind returns the event kind with the given name,
+// as returned by CharmEventKind.String.
+func ParseCharmEventKind(name string) (CharmEventKind, error) {
+	for kind := CharmEventKind(1); kind < EventKindCount; kind++ {
+		if kind.String() == name {
+			return kind, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown charm event kind %q", name)
+}
+
+// EventsRequest represents a request to list the charm events
+// logged in the store.
+type EventsRequest struct {
+	// Since, if not zero, restricts the results to
+	// the events logged at or after the given time.
+	Since time.Time
+
+	// AfterId, if not empty, holds the id of a previously
+	// returned event, and restricts the results to the events
+	// logged after it. This allows clients to poll for new
+	// events incrementally.
+	AfterId bson.ObjectId
+
+	// Kinds, if not empty, restricts the results to
+	// events of the given kinds.
+	Kinds []CharmEventKind
+
+	// Actor, if not empty, restricts the results to
+	// the events about changes made by the given actor.
+	Actor string
+
+	// Limit, if greater than zero, holds the maximum
+	// number of events returned.
+	Limit int
+}
+
+// Events returns the charm events matching req, in the order they were
+// logged. ErrNotFound is returned if req.AfterId is not a known event.
+func (s *Store) Events(req *EventsRequest) ([]*CharmEvent, error) {
+	session := s.session.Copy()
+	defer session.Close()
+
+	events := session.Events()
+	query := bson.D{{"seq", bson.D{{"$exists", true}}}}
+	if req.AfterId != "" {
+		var after CharmEvent
+		err := events.FindId(req.AfterId).One(&after)
+		if err == mgo.ErrNotFound {
+			return nil, ErrNotFound
+		}
+		if err != nil {
+			return nil, err
+		}
+		// Events are paged on their sequence number rather than
+		// on their time, which is set before they are inserted and
+		// kept by imported events: an event logged later than the
+		// one the client saw last may be older than it.
+		query[0] = bson.DocElem{"seq", bson.D{{"$gt", after.Seq}}}
+	}
+	if !req.Since.IsZero() {
+		query = append(query, bson.DocElem{"time", bson.D{{"$gte", req.Since}}})
+	}
+	if len(req.Kinds) > 0 {
+		query = append(query, bson.DocElem{"kind", bson.D{{"$in", req.Kinds}}})
+	}
+	if req.Actor != "" {
+		query = append(query, bson.DocElem{"actor", req.Actor})
+	}
+	q := events.Find(query).Sort("seq")
+	if req.Limit > 0 {
+		q = q.Limit(req.Limit)
+	}
+	var result []*CharmEvent
+	if err := q.All(&result); err != nil {
+		logger.Errorf("cannot query charm events: %v", err)
+		return nil, err
+	}
+	return result, nil
+}
+
+// insertEvent calls insert with the sequence number of the next event
+// to log, until it doesn't fail because another event got the same
+// number concurrently. The unique index on the sequence numbers
+// ensures that an event is only visible once all the events logged
+// before it are, so that clients polling for new events don't miss any.
+func insertEvent(events *mgo.Collection, insert func(seq int64) error) error {
+	for {
+		var last struct{ Seq int64 }
+		err := events.Find(bson.D{{"seq", bson.D{{"$exists", true}}}}).Sort("-seq").Select(bson.D{{"seq", 1}}).One(&last)
+		if err != nil && err != mgo.ErrNotFound {
+			return err
+		}
+		seq := last.Seq + 1
+		err = insert(seq)
+		if !mgo.IsDup(err) {
+			return err
+		}
+		// The error may be about another key, such as the event id.
+		if n, cerr := events.Find(bson.D{{"seq", seq}}).Count(); cerr != nil || n == 0 {
+			return err
+		}
+	}
+}
+
+// sequenceEvents assigns sequence numbers to the events logged by
+// older versions of the store, in the order of their time.
+func (s *Store) sequenceEvents() error {
+	session := s.session.Copy()
+	defer session.Close()
+
+	events := session.Events()
+	iter := events.Find(bson.D{{"seq", bson.D{{"$exists", false}}}}).Sort("time", "_id").Select(bson.D{{"_id", 1}}).Iter()
+	var event struct {
+		Id bson.ObjectId `bson:"_id"`
+	}
+	for iter.Next(&event) {
+		err := insertEvent(events, func(seq int64) error {
+			err := events.Update(
+				bson.D{{"_id", event.Id}, {"seq", bson.D{{"$exists", false}}}},
+				bson.D{{"$set", bson.D{{"seq", seq}}}},
+			)
+			if err == mgo.ErrNotFound {
+				// Another process sequenced the event.
+				return nil
+			}
+			return err
+		})
+		if err != nil {
+			iter.Close()
+			return fmt.Errorf("cannot assign sequence number to event %s: %v", event.Id.Hex(), err)
+		}
+	}
+	return iter.Close()
+}
@@ -0,0 +1,332 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore_test
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"time"
+
+	"github.com/juju/charm"
+	gc "launchpad.net/gocheck"
+
+	"github.com/juju/charmstore"
+	"github.com/juju/charmstore/csclient"
+)
+
+func (s *TrivialSuite) TestParseCharmEventKind(c *gc.C) {
+	for kind := charmstore.CharmEventKind(1); kind < charmstore.EventKindCount; kind++ {
+		parsed, err := charmstore.ParseCharmEventKind(kind.String())
+		c.Assert(err, gc.IsNil)
+		c.Assert(parsed, gc.Equals, kind)
+	}
+	_, err := charmstore.ParseCharmEventKind("exploded")
+	c.Assert(err, gc.ErrorMatches, `unknown charm event kind "exploded"`)
+}
+
+// logEvents logs a sequence of events, one second apart, and
+// returns them.
+func (s *StoreSuite) logEvents(c *gc.C) []*charmstore.CharmEvent {
+	urls := []*charm.URL{charm.MustParseURL("cs:trusty/wordpress")}
+	t0 := time.Unix(1e9, 0)
+	events := []*charmstore.CharmEvent{{
+		Kind:     charmstore.EventPublished,
+		Digest:   "digest-0",
+		Revision: 0,
+		URLs:     urls,
+		Time:     t0,
+	}, {
+		Kind:   charmstore.EventPublishError,
+		Digest: "digest-1",
+		URLs:   urls,
+		Errors: []string{"An error."},
+		Time:   t0.Add(time.Second),
+	}, {
+		Kind:     charmstore.EventPublished,
+		Digest:   "digest-2",
+		Revision: 1,
+		URLs:     urls,
+		Time:     t0.Add(2 * time.Second),
+	}, {
+		Kind:     charmstore.EventDeleted,
+		Digest:   "digest-2",
+		Revision: 1,
+		URLs:     urls,
+		Time:     t0.Add(2 * time.Second),
+	}}
+	for _, event := range events {
+		err := s.store.LogCharmEvent(event)
+		c.Assert(err, gc.IsNil)
+	}
+	return events
+}
+
+func eventDigests(events []*charmstore.CharmEvent) []string {
+	digests := make([]string, len(events))
+	for i, event := range events {
+		digests[i] = event.Kind.String() + " " + event.Digest
+	}
+	return digests
+}
+
+func (s *StoreSuite) TestEvents(c *gc.C) {
+	logged := s.logEvents(c)
+	tests := []struct {
+		req     charmstore.EventsRequest
+		digests []string
+	}{{
+		digests: []string{"published digest-0", "publish-error digest-1", "published digest-2", "deleted digest-2"},
+	}, {
+		req:     charmstore.EventsRequest{Limit: 2},
+		digests: []string{"published digest-0", "publish-error digest-1"},
+	}, {
+		req:     charmstore.EventsRequest{Since: logged[1].Time},
+		digests: []string{"publish-error digest-1", "published digest-2", "deleted digest-2"},
+	}, {
+		req:     charmstore.EventsRequest{AfterId: logged[1].Id},
+		digests: []string{"published digest-2", "deleted digest-2"},
+	}, {
+		// Events logged at the same time are ordered by id.
+		req:     charmstore.EventsRequest{AfterId: logged[2].Id},
+		digests: []string{"deleted digest-2"},
+	}, {
+		req:     charmstore.EventsRequest{AfterId: logged[3].Id},
+		digests: []string{},
+	}, {
+		req: charmstore.EventsRequest{
+			Kinds: []charmstore.CharmEventKind{charmstore.EventPublished, charmstore.EventDeleted},
+		},
+		digests: []string{"published digest-0", "published digest-2", "deleted digest-2"},
+	}, {
+		req: charmstore.EventsRequest{
+			AfterId: logged[0].Id,
+			Kinds:   []charmstore.CharmEventKind{charmstore.EventPublished},
+		},
+		digests: []string{"published digest-2"},
+	}}
+	for i, test := range tests {
+		c.Logf("test %d: %#v", i, test.req)
+		events, err := s.store.Events(&test.req)
+		c.Assert(err, gc.IsNil)
+		c.Assert(eventDigests(events), gc.DeepEquals, test.digests)
+	}
+}
+
+func (s *StoreSuite) TestEventsUnknownAfterId(c *gc.C) {
+	s.logEvents(c)
+	_, err := s.store.Events(&charmstore.EventsRequest{AfterId: "0123456789ab"})
+	c.Assert(err, gc.Equals, charmstore.ErrNotFound)
+}
+
+func (s *StoreSuite) TestDeleteCharmLogsEvent(c *gc.C) {
+	curl := charm.MustParseURL("cs:trusty/wordpress")
+	s.publishRevisions(c, curl, 2)
+	_, err := s.store.DeleteCharm(curl, charmstore.Origin{})
+	c.Assert(err, gc.IsNil)
+
+	events, err := s.store.Events(&charmstore.EventsRequest{
+		Kinds: []charmstore.CharmEventKind{charmstore.EventDeleted},
+	})
+	c.Assert(err, gc.IsNil)
+	c.Assert(events, gc.HasLen, 2)
+	for _, event := range events {
+		c.Assert(urlStrings(event.URLs), gc.DeepEquals, []string{"cs:trusty/wordpress"})
+	}
+	revisions := []int{events[0].Revision, events[1].Revision}
+	c.Assert(revisions, gc.DeepEquals, []int{1, 0})
+
+	// The charm files are removed along with the charm.
+	s.checkNoGridFSFiles(c)
+}
+
+func (s *StoreSuite) TestServerChanges(c *gc.C) {
+	logged := s.logEvents(c)
+	server, err := charmstore.NewServer(s.store)
+	c.Assert(err, gc.IsNil)
+
+	tests := []struct {
+		query url.Values
+		code  int
+		ids   []string
+	}{{
+		query: url.Values{},
+		code:  http.StatusOK,
+		ids:   []string{logged[0].Id.Hex(), logged[1].Id.Hex(), logged[2].Id.Hex(), logged[3].Id.Hex()},
+	}, {
+		query: url.Values{"after": {logged[1].Id.Hex()}, "limit": {"1"}},
+		code:  http.StatusOK,
+		ids:   []string{logged[2].Id.Hex()},
+	}, {
+		query: url.Values{"since": {"2001-09-09T01:46:41Z"}, "kind": {"published"}},
+		code:  http.StatusOK,
+		ids:   []string{logged[2].Id.Hex()},
+	}, {
+		query: url.Values{"since": {"yesterday"}},
+		code:  http.StatusBadRequest,
+	}, {
+		query: url.Values{"after": {"bad-id"}},
+		code:  http.StatusBadRequest,
+	}, {
+		query: url.Values{"after": {"0123456789abcdef01234567"}},
+		code:  http.StatusNotFound,
+	}, {
+		query: url.Values{"kind": {"exploded"}},
+		code:  http.StatusBadRequest,
+	}, {
+		query: url.Values{"limit": {"0"}},
+		code:  http.StatusBadRequest,
+	}, {
+		query: url.Values{"format": {"xml"}},
+		code:  http.StatusBadRequest,
+	}}
+	for i, test := range tests {
+		c.Logf("test %d: %v", i, test.query)
+		req, err := http.NewRequest("GET", "/changes", nil)
+		c.Assert(err, gc.IsNil)
+		req.Form = test.query
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, req)
+		c.Assert(rec.Code, gc.Equals, test.code)
+		if test.code != http.StatusOK {
+			continue
+		}
+		c.Assert(rec.Header().Get("Content-Type"), gc.Equals, "application/json")
+		var entries []csclient.ChangeEntry
+		err = json.NewDecoder(rec.Body).Decode(&entries)
+		c.Assert(err, gc.IsNil)
+		ids := make([]string, len(entries))
+		for i, entry := range entries {
+			ids[i] = entry.Id
+		}
+		c.Assert(ids, gc.DeepEquals, test.ids)
+	}
+}
+
+func (s *StoreSuite) TestServerChangesJSON(c *gc.C) {
+	logged := s.logEvents(c)
+	server, err := charmstore.NewServer(s.store)
+	c.Assert(err, gc.IsNil)
+
+	req, err := http.NewRequest("GET", "/changes?kind=publish-error", nil)
+	c.Assert(err, gc.IsNil)
+	rec := httptest.NewRecorder()
+	server.ServeHTTP(rec, req)
+	c.Assert(rec.Code, gc.Equals, http.StatusOK)
+	var obtained []interface{}
+	err = json.NewDecoder(rec.Body).Decode(&obtained)
+	c.Assert(err, gc.IsNil)
+	c.Assert(obtained, gc.DeepEquals, []interface{}{
+		map[string]interface{}{
+			"id":       logged[1].Id.Hex(),
+			"kind":     "publish-error",
+			"urls":     []interface{}{"cs:trusty/wordpress"},
+			"revision": float64(0),
+			"digest":   "digest-1",
+			"errors":   []interface{}{"An error."},
+			"time":     "2001-09-09T01:46:41Z",
+		},
+	})
+}
+
+func (s *StoreSuite) TestServerChangesAtom(c *gc.C) {
+	logged := s.logEvents(c)
+	server, err := charmstore.NewServer(s.store)
+	c.Assert(err, gc.IsNil)
+
+	req, err := http.NewRequest("GET", "/changes?format=atom&kind=published", nil)
+	c.Assert(err, gc.IsNil)
+	rec := httptest.NewRecorder()
+	server.ServeHTTP(rec, req)
+	c.Assert(rec.Code, gc.Equals, http.StatusOK)
+	c.Assert(rec.Header().Get("Content-Type"), gc.Equals, "application/atom+xml")
+
+	var feed struct {
+		Updated string `xml:"updated"`
+		Entries []struct {
+			Id      string `xml:"id"`
+			Title   string `xml:"title"`
+			Updated string `xml:"updated"`
+		} `xml:"entry"`
+	}
+	err = xml.NewDecoder(rec.Body).Decode(&feed)
+	c.Assert(err, gc.IsNil)
+	c.Assert(feed.Updated, gc.Equals, "2001-09-09T01:46:42Z")
+	c.Assert(feed.Entries, gc.HasLen, 2)
+	c.Assert(feed.Entries[0].Id, gc.Equals, "urn:juju-charmstore:event:"+logged[0].Id.Hex())
+	c.Assert(feed.Entries[0].Title, gc.Equals, "cs:trusty/wordpress-0 published")
+	c.Assert(feed.Entries[0].Updated, gc.Equals, "2001-09-09T01:46:40Z")
+	c.Assert(feed.Entries[1].Title, gc.Equals, "cs:trusty/wordpress-1 published")
+}
+
+func (s *StoreSuite) TestLifecycleEvents(c *gc.C) {
+	curl := charm.MustParseURL("cs:~joe/trusty/mysql")
+	s.publishRevisions(c, curl, 1)
+	origin := charmstore.Origin{Actor: "admin", Reason: "reviewed"}
+
+	err := s.store.Release(curl.WithRevision(0), charmstore.StableChannel, origin)
+	c.Assert(err, gc.IsNil)
+	err = s.store.Promulgate(mustParseReference(c, "cs:~joe/mysql"), origin)
+	c.Assert(err, gc.IsNil)
+	err = s.store.Unpromulgate(mustParseReference(c, "cs:~joe/mysql"), origin)
+	c.Assert(err, gc.IsNil)
+
+	events, err := s.store.Events(&charmstore.EventsRequest{Actor: "admin"})
+	c.Assert(err, gc.IsNil)
+	c.Assert(events, gc.HasLen, 3)
+	c.Assert(events[0].Kind, gc.Equals, charmstore.EventReleased)
+	c.Assert(events[0].Channel, gc.Equals, charmstore.StableChannel)
+	c.Assert(events[0].Revision, gc.Equals, 0)
+	c.Assert(urlStrings(events[0].URLs), gc.DeepEquals, []string{"cs:~joe/trusty/mysql"})
+	c.Assert(events[1].Kind, gc.Equals, charmstore.EventPromulgated)
+	c.Assert(events[2].Kind, gc.Equals, charmstore.EventUnpromulgated)
+	for _, event := range events {
+		c.Assert(event.Reason, gc.Equals, "reviewed")
+	}
+
+	events, err = s.store.Events(&charmstore.EventsRequest{Actor: "nobody"})
+	c.Assert(err, gc.IsNil)
+	c.Assert(events, gc.HasLen, 0)
+}
+
+func (s *StoreSuite) TestBundleVerifyErrorEvent(c *gc.C) {
+	burl := charm.MustParseURL("cs:bundle/wordpress-simple")
+	bundle, err := charmstore.ReadBundleDir(bundleDir(c, "services: {}\n"))
+	c.Assert(err, gc.IsNil)
+	pub, err := s.store.BundlePublisher([]*charm.URL{burl}, "bundle-digest")
+	c.Assert(err, gc.IsNil)
+	err = pub.Publish(bundle)
+	c.Assert(err, gc.ErrorMatches, "invalid bundle: bundle has no services")
+
+	event, err := s.store.CharmEvent(burl, "bundle-digest")
+	c.Assert(err, gc.IsNil)
+	c.Assert(event.Kind, gc.Equals, charmstore.EventVerifyError)
+	c.Assert(event.Errors, gc.DeepEquals, []string{"invalid bundle: bundle has no services"})
+}
+
+func (s *StoreSuite) TestServerCharmEventOrigin(c *gc.C) {
+	curl := charm.MustParseURL("cs:trusty/wordpress")
+	s.publishRevisions(c, curl, 1)
+	_, err := s.store.DeleteCharm(curl, charmstore.Origin{Actor: "joe", Reason: "obsolete"})
+	c.Assert(err, gc.IsNil)
+	server, err := charmstore.NewServer(s.store)
+	c.Assert(err, gc.IsNil)
+
+	req, err := http.NewRequest("GET", "/charm-event", nil)
+	c.Assert(err, gc.IsNil)
+	req.Form = url.Values{"charms": {"cs:trusty/wordpress"}}
+	rec := httptest.NewRecorder()
+	server.ServeHTTP(rec, req)
+	c.Assert(rec.Code, gc.Equals, http.StatusOK)
+	var obtained map[string]map[string]interface{}
+	err = json.NewDecoder(rec.Body).Decode(&obtained)
+	c.Assert(err, gc.IsNil)
+	response := obtained["cs:trusty/wordpress"]
+	c.Assert(response["kind"], gc.Equals, "deleted")
+	c.Assert(response["digest"], gc.Equals, "digest-0")
+	c.Assert(response["actor"], gc.Equals, "joe")
+	c.Assert(response["reason"], gc.Equals, "obsolete")
+}
@@ -3,4 +3,28 @@
 
 package charmstore
 
+import (
+	"github.com/juju/charm"
+)
+
 var TimeToStamp = timeToStamp
+
+var WebhookBackoff = &webhookBackoff
+
+var RetryDelay = retryDelay
+
+var LintCharm = lintCharm
+
+var PublishBazaarBranchTimeout = publishBazaarBranch
+
+var MirrorPageSize = &mirrorPageSize
+
+func (sel *MirrorSelection) Match(curl *charm.URL) bool {
+	return sel.match(curl)
+}
+
+var RateLimitNow = &rateLimitNow
+
+func PublishAttempts(backend Backend, urls []*charm.URL, digest string) (int, error) {
+	return publishAttempts(backend.(publishEventFinder), urls, digest)
+}
@@ -0,0 +1,235 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+
+	"github.com/juju/charm"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+// interfaceNames returns the sorted and unique interface names
+// used by the given relations.
+func interfaceNames(relations map[string]charm.Relation) []string {
+	seen := make(map[string]bool)
+	var names []string
+	for _, rel := range relations {
+		if rel.Interface == "" || seen[rel.Interface] {
+			continue
+		}
+		seen[rel.Interface] = true
+		names = append(names, rel.Interface)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// roleField returns the name of the charm document field holding
+// the interfaces implemented by charms with the given relation role.
+func roleField(role charm.RelationRole) (string, error) {
+	switch role {
+	case charm.RoleProvider:
+		return "provides", nil
+	case charm.RoleRequirer:
+		return "requires", nil
+	}
+	return "", fmt.Errorf("unsupported relation role %q", role)
+}
+
+// InterfaceCharms returns the URLs of the charms that have a relation with
+// the given role on interface iface in their latest revision. If series is
+// not empty, only charms for that series are returned. The URLs are sorted
+// and have no revision.
+func (s *Store) InterfaceCharms(iface string, role charm.RelationRole, series string) ([]*charm.URL, error) {
+	field, err := roleField(role)
+	if err != nil {
+		return nil, err
+	}
+	session := s.session.Copy()
+	defer session.Close()
+
+	charms := session.Charms()
+	query := bson.D{{field, iface}}
+	var seriesPrefix *regexp.Regexp
+	if series != "" {
+		pattern := fmt.Sprintf("^cs:(~[^/]+/)?%s/", regexp.QuoteMeta(series))
+		seriesPrefix = regexp.MustCompile(pattern)
+		query = append(query, bson.DocElem{"urls", bson.RegEx{Pattern: pattern}})
+	}
+	var cdocs []charmDoc
+	err = charms.Find(query).Select(bson.D{{"urls", 1}}).All(&cdocs)
+	if err != nil {
+		logger.Errorf("failed to find charms with interface %q: %v", iface, err)
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	var candidates []*charm.URL
+	for _, cdoc := range cdocs {
+		for _, url := range cdoc.URLs {
+			urlStr := url.String()
+			if seen[urlStr] || seriesPrefix != nil && !seriesPrefix.MatchString(urlStr) {
+				continue
+			}
+			seen[urlStr] = true
+			candidates = append(candidates, url)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, nil
+	}
+
+	// Any revision of a charm may have matched, so only keep the
+	// URLs where the latest revision still implements iface. The
+	// first revision found for each URL, in reverse revision order,
+	// is its latest one.
+	var revisions []charmDoc
+	err = charms.Find(bson.D{{"urls", bson.D{{"$in", candidates}}}}).
+		Sort("-revision").Select(bson.D{{"urls", 1}, {field, 1}}).All(&revisions)
+	if err != nil {
+		logger.Errorf("failed to find latest revisions of charms with interface %q: %v", iface, err)
+		return nil, err
+	}
+	latest := make(map[string]bool)
+	var result []*charm.URL
+	for _, cdoc := range revisions {
+		ifaces := cdoc.Provides
+		if role == charm.RoleRequirer {
+			ifaces = cdoc.Requires
+		}
+		implements := false
+		for _, name := range ifaces {
+			if name == iface {
+				implements = true
+				break
+			}
+		}
+		for _, url := range cdoc.URLs {
+			urlStr := url.String()
+			if !seen[urlStr] || latest[urlStr] {
+				continue
+			}
+			latest[urlStr] = true
+			if implements {
+				result = append(result, url)
+			}
+		}
+	}
+	sort.Sort(byURLString(result))
+	return result, nil
+}
+
+// RelatedCharm describes a charm that can be related to another one.
+type RelatedCharm struct {
+	// Relation holds the name of the relation in the charm
+	// the related charm was looked up for.
+	Relation string
+
+	// Interface holds the interface used by the relation.
+	Interface string
+
+	// Role holds the role of the related charm in the relation.
+	Role charm.RelationRole
+
+	// URL holds the URL of the related charm.
+	URL *charm.URL
+}
+
+// RelatedCharms returns the charms for the same series that can be related
+// to the charm at url through any of its provided or required relations.
+// Peer relations are not considered.
+func (s *Store) RelatedCharms(url *charm.URL) ([]RelatedCharm, error) {
+	return relatedCharms(s, url)
+}
+
+// relatedCharms implements RelatedCharms on top of
+// the CharmInfo and InterfaceCharms methods of s.
+func relatedCharms(s StoreReader, url *charm.URL) ([]RelatedCharm, error) {
+	info, err := s.CharmInfo(url)
+	if err != nil {
+		return nil, err
+	}
+	self := url.WithRevision(-1).String()
+	var related []RelatedCharm
+	lookup := func(relations map[string]charm.Relation, role charm.RelationRole) error {
+		names := make([]string, 0, len(relations))
+		for name := range relations {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			iface := relations[name].Interface
+			urls, err := s.InterfaceCharms(iface, role, url.Series)
+			if err != nil {
+				return err
+			}
+			for _, rurl := range urls {
+				if rurl.String() == self {
+					continue
+				}
+				related = append(related, RelatedCharm{
+					Relation:  name,
+					Interface: iface,
+					Role:      role,
+					URL:       rurl,
+				})
+			}
+		}
+		return nil
+	}
+	meta := info.Meta()
+	if err := lookup(meta.Requires, charm.RoleProvider); err != nil {
+		return nil, err
+	}
+	if err := lookup(meta.Provides, charm.RoleRequirer); err != nil {
+		return nil, err
+	}
+	return related, nil
+}
+
+type byURLString []*charm.URL
+
+func (s byURLString) Len() int           { return len(s) }
+func (s byURLString) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byURLString) Less(i, j int) bool { return s[i].String() < s[j].String() }
+
+// addInterfaceNames records the names of the interfaces implemented by
+// the charms published by older versions of the store, which didn't
+// record them, so that InterfaceCharms finds them.
+func (s *Store) addInterfaceNames() error {
+	session := s.session.Copy()
+	defer session.Close()
+
+	charms := session.Charms()
+	iter := charms.Find(bson.D{{"provides", bson.D{{"$exists", false}}}}).
+		Select(bson.D{{"_id", 1}, {"meta", 1}}).Iter()
+	for {
+		var doc struct {
+			Id   bson.ObjectId `bson:"_id"`
+			Meta *charm.Meta
+		}
+		if !iter.Next(&doc) {
+			break
+		}
+		// Empty lists are recorded too, so that
+		// the charm isn't looked at again.
+		provides, requires := []string{}, []string{}
+		if doc.Meta != nil {
+			provides = append(provides, interfaceNames(doc.Meta.Provides)...)
+			requires = append(requires, interfaceNames(doc.Meta.Requires)...)
+		}
+		err := charms.UpdateId(doc.Id, bson.D{{"$set", bson.D{
+			{"provides", provides},
+			{"requires", requires},
+		}}})
+		if err != nil && err != mgo.ErrNotFound {
+			iter.Close()
+			return fmt.Errorf("cannot record interfaces of charm: %v", err)
+		}
+	}
+	return iter.Close()
+}
@@ -0,0 +1,264 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+
+	"github.com/juju/charm"
+	gitjujutesting "github.com/juju/testing"
+	"labix.org/v2/mgo/bson"
+	gc "launchpad.net/gocheck"
+
+	"github.com/juju/charmstore"
+)
+
+// relationMeta returns charm metadata with the given provided and
+// required relations, each one mapping relation names to interfaces.
+func relationMeta(name string, provides, requires map[string]string) *charm.Meta {
+	meta := &charm.Meta{
+		Name:        name,
+		Summary:     "Charm with relations.",
+		Description: "Charm with relations.\n",
+		Provides:    make(map[string]charm.Relation),
+		Requires:    make(map[string]charm.Relation),
+		Peers:       make(map[string]charm.Relation),
+	}
+	for rel, iface := range provides {
+		meta.Provides[rel] = charm.Relation{Name: rel, Role: charm.RoleProvider, Interface: iface}
+	}
+	for rel, iface := range requires {
+		meta.Requires[rel] = charm.Relation{Name: rel, Role: charm.RoleRequirer, Interface: iface}
+	}
+	return meta
+}
+
+func (s *StoreSuite) publishMeta(c *gc.C, url string, digest string, meta *charm.Meta) {
+	curl := charm.MustParseURL(url)
+	pub, err := s.store.CharmPublisher([]*charm.URL{curl}, digest)
+	c.Assert(err, gc.IsNil)
+	err = pub.Publish(&FakeCharmDir{meta: meta})
+	c.Assert(err, gc.IsNil)
+}
+
+func (s *StoreSuite) publishRelationCharms(c *gc.C) {
+	s.publishMeta(c, "cs:trusty/mysql", "mysql-0", relationMeta("mysql",
+		map[string]string{"db": "mysql"}, nil))
+	s.publishMeta(c, "cs:precise/mysql", "mysql-0", relationMeta("mysql",
+		map[string]string{"db": "mysql"}, nil))
+	s.publishMeta(c, "cs:~joe/trusty/mariadb", "mariadb-0", relationMeta("mariadb",
+		map[string]string{"db": "mysql", "admin": "mysql-root"}, nil))
+	s.publishMeta(c, "cs:trusty/wordpress", "wordpress-0", relationMeta("wordpress",
+		map[string]string{"url": "http"}, map[string]string{"db": "mysql", "cache": "varnish"}))
+	s.publishMeta(c, "cs:trusty/varnish", "varnish-0", relationMeta("varnish",
+		map[string]string{"webcache": "varnish"}, map[string]string{"backend": "http"}))
+
+	// The latest revision of this charm doesn't provide mysql anymore.
+	s.publishMeta(c, "cs:trusty/postgresql", "postgresql-0", relationMeta("postgresql",
+		map[string]string{"db": "mysql"}, nil))
+	s.publishMeta(c, "cs:trusty/postgresql", "postgresql-1", relationMeta("postgresql",
+		map[string]string{"db": "pgsql"}, nil))
+}
+
+func urlStrings(urls []*charm.URL) []string {
+	strs := make([]string, len(urls))
+	for i, url := range urls {
+		strs[i] = url.String()
+	}
+	return strs
+}
+
+var interfaceCharmsTests = []struct {
+	iface  string
+	role   charm.RelationRole
+	series string
+	urls   []string
+}{{
+	iface:  "mysql",
+	role:   charm.RoleProvider,
+	series: "trusty",
+	urls:   []string{"cs:trusty/mysql", "cs:~joe/trusty/mariadb"},
+}, {
+	iface: "mysql",
+	role:  charm.RoleProvider,
+	urls:  []string{"cs:precise/mysql", "cs:trusty/mysql", "cs:~joe/trusty/mariadb"},
+}, {
+	iface:  "mysql",
+	role:   charm.RoleProvider,
+	series: "precise",
+	urls:   []string{"cs:precise/mysql"},
+}, {
+	iface:  "mysql",
+	role:   charm.RoleRequirer,
+	series: "trusty",
+	urls:   []string{"cs:trusty/wordpress"},
+}, {
+	iface:  "pgsql",
+	role:   charm.RoleProvider,
+	series: "trusty",
+	urls:   []string{"cs:trusty/postgresql"},
+}, {
+	iface: "no-such-interface",
+	role:  charm.RoleProvider,
+	urls:  []string{},
+}}
+
+func (s *StoreSuite) TestInterfaceCharms(c *gc.C) {
+	s.publishRelationCharms(c)
+	for i, test := range interfaceCharmsTests {
+		c.Logf("test %d: %s %s %q", i, test.role, test.iface, test.series)
+		urls, err := s.store.InterfaceCharms(test.iface, test.role, test.series)
+		c.Assert(err, gc.IsNil)
+		c.Assert(urlStrings(urls), gc.DeepEquals, test.urls)
+	}
+}
+
+func (s *StoreSuite) TestInterfaceCharmsOfOlderCharms(c *gc.C) {
+	s.publishRelationCharms(c)
+
+	// Charms published by older versions of the store don't
+	// record their interfaces, until the store is opened again.
+	_, err := s.Session.DB("juju").C("charms").UpdateAll(nil, bson.D{{"$unset", bson.D{{"provides", 1}, {"requires", 1}}}})
+	c.Assert(err, gc.IsNil)
+	urls, err := s.store.InterfaceCharms("mysql", charm.RoleProvider, "")
+	c.Assert(err, gc.IsNil)
+	c.Assert(urls, gc.HasLen, 0)
+
+	s.store.Close()
+	s.store, err = charmstore.Open(gitjujutesting.MgoServer.Addr())
+	c.Assert(err, gc.IsNil)
+	for i, test := range interfaceCharmsTests {
+		c.Logf("test %d: %s %s %q", i, test.role, test.iface, test.series)
+		urls, err := s.store.InterfaceCharms(test.iface, test.role, test.series)
+		c.Assert(err, gc.IsNil)
+		c.Assert(urlStrings(urls), gc.DeepEquals, test.urls)
+	}
+}
+
+func (s *StoreSuite) TestInterfaceCharmsBadRole(c *gc.C) {
+	_, err := s.store.InterfaceCharms("mysql", charm.RolePeer, "")
+	c.Assert(err, gc.ErrorMatches, `unsupported relation role "peer"`)
+}
+
+func (s *StoreSuite) TestRelatedCharms(c *gc.C) {
+	s.publishRelationCharms(c)
+	related, err := s.store.RelatedCharms(charm.MustParseURL("cs:trusty/wordpress"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(related, gc.DeepEquals, []charmstore.RelatedCharm{{
+		Relation:  "cache",
+		Interface: "varnish",
+		Role:      charm.RoleProvider,
+		URL:       charm.MustParseURL("cs:trusty/varnish"),
+	}, {
+		Relation:  "db",
+		Interface: "mysql",
+		Role:      charm.RoleProvider,
+		URL:       charm.MustParseURL("cs:trusty/mysql"),
+	}, {
+		Relation:  "db",
+		Interface: "mysql",
+		Role:      charm.RoleProvider,
+		URL:       charm.MustParseURL("cs:~joe/trusty/mariadb"),
+	}, {
+		Relation:  "url",
+		Interface: "http",
+		Role:      charm.RoleRequirer,
+		URL:       charm.MustParseURL("cs:trusty/varnish"),
+	}})
+
+	_, err = s.store.RelatedCharms(charm.MustParseURL("cs:trusty/non-existent"))
+	c.Assert(err, gc.Equals, charmstore.ErrNotFound)
+}
+
+func (s *StoreSuite) TestServerInterface(c *gc.C) {
+	s.publishRelationCharms(c)
+	server, err := charmstore.NewServer(s.store)
+	c.Assert(err, gc.IsNil)
+
+	tests := []struct {
+		query    url.Values
+		code     int
+		expected map[string]interface{}
+	}{{
+		query: url.Values{"interface": {"mysql"}, "series": {"trusty"}},
+		code:  http.StatusOK,
+		expected: map[string]interface{}{
+			"provides": []interface{}{"cs:trusty/mysql", "cs:~joe/trusty/mariadb"},
+			"requires": []interface{}{"cs:trusty/wordpress"},
+		},
+	}, {
+		query: url.Values{"interface": {"mysql"}, "series": {"trusty"}, "role": {"requires"}},
+		code:  http.StatusOK,
+		expected: map[string]interface{}{
+			"requires": []interface{}{"cs:trusty/wordpress"},
+		},
+	}, {
+		query: url.Values{"interface": {"mysql"}, "role": {"peer"}},
+		code:  http.StatusBadRequest,
+	}, {
+		query: url.Values{},
+		code:  http.StatusBadRequest,
+	}}
+	for i, test := range tests {
+		c.Logf("test %d: %v", i, test.query)
+		req, err := http.NewRequest("GET", "/charm-interface", nil)
+		c.Assert(err, gc.IsNil)
+		req.Form = test.query
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, req)
+		c.Assert(rec.Code, gc.Equals, test.code)
+		if test.expected == nil {
+			continue
+		}
+		c.Assert(rec.Header().Get("Content-Type"), gc.Equals, "application/json")
+		obtained := map[string]interface{}{}
+		err = json.NewDecoder(rec.Body).Decode(&obtained)
+		c.Assert(err, gc.IsNil)
+		c.Assert(obtained, gc.DeepEquals, test.expected)
+	}
+}
+
+func (s *StoreSuite) TestServerRelated(c *gc.C) {
+	s.publishRelationCharms(c)
+	server, err := charmstore.NewServer(s.store)
+	c.Assert(err, gc.IsNil)
+
+	req, err := http.NewRequest("GET", "/charm-related", nil)
+	c.Assert(err, gc.IsNil)
+	req.Form = url.Values{"charms": {"cs:trusty/varnish", "cs:trusty/non-existent"}}
+	rec := httptest.NewRecorder()
+	server.ServeHTTP(rec, req)
+	c.Assert(rec.Code, gc.Equals, http.StatusOK)
+	c.Assert(rec.Header().Get("Content-Type"), gc.Equals, "application/json")
+
+	expected := map[string]interface{}{
+		"cs:trusty/varnish": map[string]interface{}{
+			"canonical-url": "cs:trusty/varnish",
+			"related": []interface{}{
+				map[string]interface{}{
+					"relation":  "backend",
+					"interface": "http",
+					"role":      "provider",
+					"url":       "cs:trusty/wordpress",
+				},
+				map[string]interface{}{
+					"relation":  "webcache",
+					"interface": "varnish",
+					"role":      "requirer",
+					"url":       "cs:trusty/wordpress",
+				},
+			},
+		},
+		"cs:trusty/non-existent": map[string]interface{}{
+			"errors": []interface{}{"entry not found"},
+		},
+	}
+	obtained := map[string]interface{}{}
+	err = json.NewDecoder(rec.Body).Decode(&obtained)
+	c.Assert(err, gc.IsNil)
+	c.Assert(obtained, gc.DeepEquals, expected)
+}
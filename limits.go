@@ -0,0 +1,239 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+
+	"github.com/juju/charm"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+// StorageLimits holds the limits on the storage used by the archives
+// of the charms and bundles published in the store. Zero values mean
+// no limit.
+type StorageLimits struct {
+	// MaxArchiveSize holds the maximum size of an archive, in bytes.
+	MaxArchiveSize int64
+
+	// NamespaceQuota holds the maximum total size, in bytes, of the
+	// archives published in a namespace, either a user namespace or
+	// the one of unqualified charm URLs. NamespaceQuotas holds the
+	// quotas of specific user namespaces, overriding NamespaceQuota.
+	NamespaceQuota  int64
+	NamespaceQuotas map[string]int64
+}
+
+// quota returns the quota of the namespace of the given user.
+func (l *StorageLimits) quota(user string) int64 {
+	if quota, ok := l.NamespaceQuotas[user]; ok {
+		return quota
+	}
+	return l.NamespaceQuota
+}
+
+// StorageLimitError is returned when publishing an archive which
+// would exceed the storage limits set for the store.
+type StorageLimitError struct {
+	msg string
+}
+
+func (e *StorageLimitError) Error() string {
+	return e.msg
+}
+
+// SetStorageLimits sets the storage limits enforced when publishing
+// charms and bundles. By default there are no limits.
+func (s *Store) SetStorageLimits(limits StorageLimits) {
+	s.limitsMu.Lock()
+	defer s.limitsMu.Unlock()
+	s.limits = limits
+}
+
+// storageLimits returns the storage limits set for the store.
+func (s *Store) storageLimits() StorageLimits {
+	s.limitsMu.RLock()
+	defer s.limitsMu.RUnlock()
+	return s.limits
+}
+
+// LoadStorageLimits configures the store with the storage limits
+// held in conf.
+func (s *Store) LoadStorageLimits(conf *Config) error {
+	if conf.MaxArchiveSize < 0 {
+		return fmt.Errorf("negative max-archive-size %d", conf.MaxArchiveSize)
+	}
+	if conf.NamespaceQuota < 0 {
+		return fmt.Errorf("negative namespace-quota %d", conf.NamespaceQuota)
+	}
+	limits := StorageLimits{
+		MaxArchiveSize: conf.MaxArchiveSize,
+		NamespaceQuota: conf.NamespaceQuota,
+	}
+	for user, quota := range conf.NamespaceQuotas {
+		if user == "" {
+			return fmt.Errorf("empty user in namespace quotas")
+		}
+		if quota < 0 {
+			return fmt.Errorf("negative namespace quota %d for user %q", quota, user)
+		}
+		if limits.NamespaceQuotas == nil {
+			limits.NamespaceQuotas = make(map[string]int64)
+		}
+		limits.NamespaceQuotas[user] = quota
+	}
+	s.SetStorageLimits(limits)
+	return nil
+}
+
+// namespaceName returns the name of the namespace
+// of the given user, as used in messages.
+func namespaceName(user string) string {
+	if user == "" {
+		return "unqualified charm URLs"
+	}
+	return "~" + user
+}
+
+// namespaceRegex returns a regular expression matching
+// the charm URLs in the namespace of the given user.
+func namespaceRegex(user string) bson.RegEx {
+	if user == "" {
+		return bson.RegEx{Pattern: "^cs:[^~]"}
+	}
+	return bson.RegEx{Pattern: "^cs:~" + regexp.QuoteMeta(user) + "/"}
+}
+
+// archiveLimit returns the maximum size of an archive published at urls
+// given the storage limits and the storage already used, as reported by
+// usage for the namespace of each user, along with the error reported
+// when the archive exceeds it. A zero size means no limit.
+func archiveLimit(limits StorageLimits, urls []*charm.URL, usage func(user string) (int64, error)) (int64, *StorageLimitError, error) {
+	max := limits.MaxArchiveSize
+	limitErr := &StorageLimitError{fmt.Sprintf("archive exceeds the maximum size of %d bytes", max)}
+	seen := make(map[string]bool)
+	for _, url := range urls {
+		if seen[url.User] {
+			continue
+		}
+		seen[url.User] = true
+		quota := limits.quota(url.User)
+		if quota == 0 {
+			continue
+		}
+		used, err := usage(url.User)
+		if err != nil {
+			return 0, nil, err
+		}
+		remaining := quota - used
+		if remaining <= 0 {
+			// Make sure the limit is exceeded by any archive.
+			remaining = -1
+		}
+		if max == 0 || remaining < max {
+			max = remaining
+			limitErr = &StorageLimitError{fmt.Sprintf("archive exceeds the storage quota of %d bytes for %s, with %d bytes already used", quota, namespaceName(url.User), used)}
+		}
+	}
+	return max, limitErr, nil
+}
+
+// archiveCollections returns the collections holding the
+// documents of the charms and bundles published in the store.
+func archiveCollections(session *storeSession) []*mgo.Collection {
+	return []*mgo.Collection{session.Charms(), session.Bundles()}
+}
+
+// namespaceUsage returns the total size of the archives of the charms
+// and bundles published in the namespace of the given user.
+func namespaceUsage(session *storeSession, user string) (int64, error) {
+	var total int64
+	query := bson.D{{"urls", namespaceRegex(user)}}
+	for _, coll := range archiveCollections(session) {
+		iter := coll.Find(query).Select(bson.D{{"size", 1}}).Iter()
+		var doc struct{ Size int64 }
+		for iter.Next(&doc) {
+			total += doc.Size
+		}
+		if err := iter.Close(); err != nil {
+			return 0, err
+		}
+	}
+	return total, nil
+}
+
+// NamespaceUsage holds the storage used by the
+// archives published in a namespace.
+type NamespaceUsage struct {
+	// User holds the user owning the namespace, or the
+	// empty string for the namespace of unqualified URLs.
+	User string
+
+	Charms  int
+	Bundles int
+	Size    int64
+
+	// Quota holds the quota of the namespace, or zero if
+	// it has none.
+	Quota int64
+}
+
+// StorageUsage returns the storage used in each of the namespaces
+// holding charms or bundles, sorted by user. Archives published in
+// several namespaces are accounted in all of them.
+func (s *Store) StorageUsage() ([]*NamespaceUsage, error) {
+	session := s.session.Copy()
+	defer session.Close()
+
+	limits := s.storageLimits()
+	usages := make(map[string]*NamespaceUsage)
+	for i, coll := range archiveCollections(session) {
+		iter := coll.Find(nil).Select(bson.D{{"urls", 1}, {"size", 1}}).Iter()
+		for {
+			var doc struct {
+				URLs []*charm.URL
+				Size int64
+			}
+			if !iter.Next(&doc) {
+				break
+			}
+			seen := make(map[string]bool)
+			for _, url := range doc.URLs {
+				if seen[url.User] {
+					continue
+				}
+				seen[url.User] = true
+				usage := usages[url.User]
+				if usage == nil {
+					usage = &NamespaceUsage{User: url.User, Quota: limits.quota(url.User)}
+					usages[url.User] = usage
+				}
+				if i == 0 {
+					usage.Charms++
+				} else {
+					usage.Bundles++
+				}
+				usage.Size += doc.Size
+			}
+		}
+		if err := iter.Close(); err != nil {
+			return nil, err
+		}
+	}
+	result := make([]*NamespaceUsage, 0, len(usages))
+	for _, usage := range usages {
+		result = append(result, usage)
+	}
+	sort.Sort(usagesByUser(result))
+	return result, nil
+}
+
+type usagesByUser []*NamespaceUsage
+
+func (u usagesByUser) Len() int           { return len(u) }
+func (u usagesByUser) Swap(i, j int)      { u[i], u[j] = u[j], u[i] }
+func (u usagesByUser) Less(i, j int) bool { return u[i].User < u[j].User }
@@ -0,0 +1,138 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore_test
+
+import (
+	"github.com/juju/charm"
+	gc "launchpad.net/gocheck"
+
+	"github.com/juju/charmstore"
+)
+
+// publishFake publishes a FakeCharmDir, whose archive
+// is 16 bytes long, at the given URLs.
+func (s *StoreSuite) publishFake(c *gc.C, urls ...string) error {
+	curls := make([]*charm.URL, len(urls))
+	for i, url := range urls {
+		curls[i] = charm.MustParseURL(url)
+	}
+	pub, err := s.store.CharmPublisher(curls, "digest-"+urls[0])
+	c.Assert(err, gc.IsNil)
+	return pub.Publish(&FakeCharmDir{})
+}
+
+// checkNoGridFSFiles checks that the charms GridFS holds no data.
+func (s *StoreSuite) checkNoGridFSFiles(c *gc.C) {
+	for _, name := range []string{"charmfs.files", "charmfs.chunks"} {
+		n, err := s.Session.DB("juju").C(name).Count()
+		c.Assert(err, gc.IsNil)
+		c.Assert(n, gc.Equals, 0, gc.Commentf("collection %s", name))
+	}
+}
+
+func (s *StoreSuite) TestMaxArchiveSize(c *gc.C) {
+	s.store.SetStorageLimits(charmstore.StorageLimits{MaxArchiveSize: 10})
+	err := s.publishFake(c, "cs:precise/wordpress")
+	c.Assert(err, gc.ErrorMatches, "archive exceeds the maximum size of 10 bytes")
+	c.Assert(err, gc.FitsTypeOf, &charmstore.StorageLimitError{})
+	_, err = s.store.CharmInfo(charm.MustParseURL("cs:precise/wordpress"))
+	c.Assert(err, gc.Equals, charmstore.ErrNotFound)
+	s.checkNoGridFSFiles(c)
+
+	s.store.SetStorageLimits(charmstore.StorageLimits{MaxArchiveSize: 16})
+	err = s.publishFake(c, "cs:precise/wordpress")
+	c.Assert(err, gc.IsNil)
+}
+
+func (s *StoreSuite) TestNamespaceQuota(c *gc.C) {
+	s.store.SetStorageLimits(charmstore.StorageLimits{
+		NamespaceQuota:  40,
+		NamespaceQuotas: map[string]int64{"joe": 20},
+	})
+	err := s.publishFake(c, "cs:~joe/precise/a")
+	c.Assert(err, gc.IsNil)
+	err = s.publishFake(c, "cs:~joe/precise/b")
+	c.Assert(err, gc.ErrorMatches, "archive exceeds the storage quota of 20 bytes for ~joe, with 16 bytes already used")
+
+	// Other namespaces get the default quota.
+	err = s.publishFake(c, "cs:~bob/precise/a")
+	c.Assert(err, gc.IsNil)
+	err = s.publishFake(c, "cs:~bob/precise/b")
+	c.Assert(err, gc.IsNil)
+	err = s.publishFake(c, "cs:precise/a")
+	c.Assert(err, gc.IsNil)
+	err = s.publishFake(c, "cs:precise/b")
+	c.Assert(err, gc.IsNil)
+	err = s.publishFake(c, "cs:precise/c")
+	c.Assert(err, gc.ErrorMatches, "archive exceeds the storage quota of 40 bytes for unqualified charm URLs, with 32 bytes already used")
+
+	// The quotas of all the namespaces apply.
+	err = s.publishFake(c, "cs:~alice/precise/c", "cs:~joe/precise/c")
+	c.Assert(err, gc.ErrorMatches, "archive exceeds the storage quota of 20 bytes for ~joe, with 16 bytes already used")
+
+	// Deleting a charm frees its storage.
+	_, err = s.store.DeleteCharm(charm.MustParseURL("cs:~joe/precise/a"), charmstore.Origin{})
+	c.Assert(err, gc.IsNil)
+	err = s.publishFake(c, "cs:~joe/precise/b")
+	c.Assert(err, gc.IsNil)
+}
+
+func (s *StoreSuite) TestStorageUsage(c *gc.C) {
+	usages, err := s.store.StorageUsage()
+	c.Assert(err, gc.IsNil)
+	c.Assert(usages, gc.HasLen, 0)
+
+	for _, urls := range [][]string{
+		{"cs:~joe/precise/a"},
+		{"cs:~joe/trusty/a", "cs:~joe/precise/b"},
+		{"cs:~charmers/precise/mysql", "cs:precise/mysql"},
+		{"cs:precise/wordpress"},
+	} {
+		err := s.publishFake(c, urls...)
+		c.Assert(err, gc.IsNil)
+	}
+	s.store.SetStorageLimits(charmstore.StorageLimits{
+		NamespaceQuota:  100,
+		NamespaceQuotas: map[string]int64{"joe": 50},
+	})
+	usages, err = s.store.StorageUsage()
+	c.Assert(err, gc.IsNil)
+	c.Assert(usages, gc.DeepEquals, []*charmstore.NamespaceUsage{
+		{User: "", Charms: 2, Size: 32, Quota: 100},
+		{User: "charmers", Charms: 1, Size: 16, Quota: 100},
+		{User: "joe", Charms: 2, Size: 32, Quota: 50},
+	})
+}
+
+func (s *StoreSuite) TestLoadStorageLimits(c *gc.C) {
+	for _, test := range []struct {
+		conf charmstore.Config
+		err  string
+	}{{
+		conf: charmstore.Config{MaxArchiveSize: -1},
+		err:  "negative max-archive-size -1",
+	}, {
+		conf: charmstore.Config{NamespaceQuota: -1},
+		err:  "negative namespace-quota -1",
+	}, {
+		conf: charmstore.Config{NamespaceQuotas: map[string]int64{"": 10}},
+		err:  "empty user in namespace quotas",
+	}, {
+		conf: charmstore.Config{NamespaceQuotas: map[string]int64{"joe": -1}},
+		err:  `negative namespace quota -1 for user "joe"`,
+	}} {
+		err := s.store.LoadStorageLimits(&test.conf)
+		c.Assert(err, gc.ErrorMatches, test.err)
+	}
+
+	err := s.store.LoadStorageLimits(&charmstore.Config{
+		MaxArchiveSize:  100,
+		NamespaceQuotas: map[string]int64{"joe": 10},
+	})
+	c.Assert(err, gc.IsNil)
+	err = s.publishFake(c, "cs:~joe/precise/a")
+	c.Assert(err, gc.ErrorMatches, "archive exceeds the storage quota of 10 bytes for ~joe, with 0 bytes already used")
+	err = s.publishFake(c, "cs:~bob/precise/a")
+	c.Assert(err, gc.IsNil)
+}
@@ -0,0 +1,252 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/juju/charm"
+)
+
+// LintPolicy defines how the problems found when linting a charm
+// being published are handled.
+type LintPolicy string
+
+const (
+	// LintLenient publishes charms regardless of lint problems,
+	// which are recorded as warnings in the publishing event.
+	LintLenient LintPolicy = "lenient"
+
+	// LintStrict refuses to publish charms with lint errors, which
+	// are recorded as errors in the publishing event. Lint warnings
+	// don't prevent publishing, and are recorded as warnings.
+	LintStrict LintPolicy = "strict"
+)
+
+// ParseLintPolicy returns the lint policy with the given name.
+func ParseLintPolicy(name string) (LintPolicy, error) {
+	switch policy := LintPolicy(name); policy {
+	case LintLenient, LintStrict:
+		return policy, nil
+	}
+	return "", fmt.Errorf("unknown lint policy %q", name)
+}
+
+// LintError holds the errors found when linting a charm under the
+// strict policy, which prevented the charm from being published.
+type LintError struct {
+	Problems []string
+}
+
+func (e *LintError) Error() string {
+	return "charm failed lint checks: " + strings.Join(e.Problems, "; ")
+}
+
+// lintPolicies holds the lint policies of a Backend, keyed by
+// the user owning the namespace they apply to.
+type lintPolicies struct {
+	mu       sync.RWMutex
+	policies map[string]LintPolicy
+}
+
+// SetLintPolicy sets the policy applied when publishing charms under
+// the namespace of the given user. The empty user sets the default
+// policy, used for charms with unqualified URLs and for users without
+// a policy of their own. The default policy is LintLenient.
+func (p *lintPolicies) SetLintPolicy(user string, policy LintPolicy) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.policies == nil {
+		p.policies = make(map[string]LintPolicy)
+	}
+	p.policies[user] = policy
+}
+
+// lintPolicy returns the policy for publishing a charm at urls.
+// The strict policy applies if it applies to any of the urls.
+func (p *lintPolicies) lintPolicy(urls []*charm.URL) LintPolicy {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	defaultPolicy, ok := p.policies[""]
+	if !ok {
+		defaultPolicy = LintLenient
+	}
+	for _, url := range urls {
+		policy, ok := p.policies[url.User]
+		if !ok {
+			policy = defaultPolicy
+		}
+		if policy == LintStrict {
+			return LintStrict
+		}
+	}
+	return LintLenient
+}
+
+// SetLintPolicies sets the lint policies
+// held in conf.
+func (p *lintPolicies) SetLintPolicies(conf *Config) error {
+	if conf.LintPolicy != "" {
+		policy, err := ParseLintPolicy(conf.LintPolicy)
+		if err != nil {
+			return err
+		}
+		p.SetLintPolicy("", policy)
+	}
+	for user, name := range conf.LintPolicies {
+		if user == "" {
+			return fmt.Errorf("empty user in lint policies")
+		}
+		policy, err := ParseLintPolicy(name)
+		if err != nil {
+			return err
+		}
+		p.SetLintPolicy(user, policy)
+	}
+	return nil
+}
+
+var validName = regexp.MustCompile("^[a-z][a-z0-9]*(-[a-z0-9]+)*$")
+
+// lintCharm returns the problems found in the metadata and
+// configuration of ch and, when ch is a charm directory, in its files.
+// Errors are problems which break the charm, and prevent it from being
+// published under the strict lint policy. Warnings are problems which
+// don't, such as a missing icon.
+func lintCharm(ch CharmDir) (errors, warnings []string) {
+	meta := ch.Meta()
+	if meta.Summary == "" {
+		errors = append(errors, "metadata: missing summary")
+	}
+	if meta.Description == "" {
+		errors = append(errors, "metadata: missing description")
+	}
+	for _, relations := range []map[string]charm.Relation{meta.Provides, meta.Requires, meta.Peers} {
+		for _, name := range relationNames(relations) {
+			if !validName.MatchString(name) {
+				errors = append(errors, fmt.Sprintf("relation %q: invalid relation name", name))
+			}
+			if iface := relations[name].Interface; !validName.MatchString(iface) {
+				errors = append(errors, fmt.Sprintf("relation %q: invalid interface name %q", name, iface))
+			}
+		}
+	}
+	errors = append(errors, lintConfig(ch.Config())...)
+	if dir, ok := ch.(*charm.Dir); ok {
+		fileErrors, fileWarnings := lintFiles(dir.Path, meta)
+		errors = append(errors, fileErrors...)
+		warnings = append(warnings, fileWarnings...)
+	}
+	return errors, warnings
+}
+
+// relationNames returns the sorted names of relations.
+func relationNames(relations map[string]charm.Relation) []string {
+	names := make([]string, 0, len(relations))
+	for name := range relations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// lintConfig returns the problems found in the options of config.
+func lintConfig(config *charm.Config) []string {
+	if config == nil {
+		return nil
+	}
+	var problems []string
+	names := make([]string, 0, len(config.Options))
+	for name := range config.Options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		option := config.Options[name]
+		var ok bool
+		switch option.Type {
+		case "string":
+			_, ok = option.Default.(string)
+		case "int":
+			switch option.Default.(type) {
+			case int, int64:
+				ok = true
+			}
+		case "float":
+			_, ok = option.Default.(float64)
+		case "boolean":
+			_, ok = option.Default.(bool)
+		default:
+			problems = append(problems, fmt.Sprintf("config option %q: unknown type %q", name, option.Type))
+			continue
+		}
+		if !ok && option.Default != nil {
+			problems = append(problems, fmt.Sprintf("config option %q: default value %#v is not of type %s", name, option.Default, option.Type))
+		}
+	}
+	return problems
+}
+
+// charmHooks holds the names of the hooks run for every charm.
+var charmHooks = []string{
+	"install",
+	"config-changed",
+	"start",
+	"upgrade-charm",
+	"stop",
+}
+
+// relationHookSuffixes holds the suffixes of the names of
+// the hooks run for each relation of a charm.
+var relationHookSuffixes = []string{
+	"-relation-joined",
+	"-relation-changed",
+	"-relation-departed",
+	"-relation-broken",
+}
+
+// hookNames returns the set of names of the hooks
+// that may be run for a charm with the given metadata.
+func hookNames(meta *charm.Meta) map[string]bool {
+	names := make(map[string]bool)
+	for _, name := range charmHooks {
+		names[name] = true
+	}
+	for _, relations := range []map[string]charm.Relation{meta.Provides, meta.Requires, meta.Peers} {
+		for name := range relations {
+			for _, suffix := range relationHookSuffixes {
+				names[name+suffix] = true
+			}
+		}
+	}
+	return names
+}
+
+// lintFiles returns the errors and warnings found in the files of
+// the charm directory at path, given the charm metadata. Only files
+// named after the hooks of the charm must be executable, so that
+// hooks/ may hold libraries and data used by the hooks.
+func lintFiles(path string, meta *charm.Meta) (errors, warnings []string) {
+	if _, err := os.Stat(filepath.Join(path, "icon.svg")); os.IsNotExist(err) {
+		warnings = append(warnings, "icon.svg: missing charm icon")
+	}
+	infos, err := ioutil.ReadDir(filepath.Join(path, "hooks"))
+	if err != nil && !os.IsNotExist(err) {
+		errors = append(errors, fmt.Sprintf("hooks: %v", err))
+	}
+	hooks := hookNames(meta)
+	for _, info := range infos {
+		if hooks[info.Name()] && info.Mode().IsRegular() && info.Mode()&0111 == 0 {
+			errors = append(errors, fmt.Sprintf("hooks/%s: hook is not executable", info.Name()))
+		}
+	}
+	return errors, warnings
+}
@@ -0,0 +1,149 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/juju/charm"
+	charmtesting "github.com/juju/charm/testing"
+	gc "launchpad.net/gocheck"
+
+	"github.com/juju/charmstore"
+)
+
+func (s *TrivialSuite) TestParseLintPolicy(c *gc.C) {
+	policy, err := charmstore.ParseLintPolicy("strict")
+	c.Assert(err, gc.IsNil)
+	c.Assert(policy, gc.Equals, charmstore.LintStrict)
+	policy, err = charmstore.ParseLintPolicy("lenient")
+	c.Assert(err, gc.IsNil)
+	c.Assert(policy, gc.Equals, charmstore.LintLenient)
+	_, err = charmstore.ParseLintPolicy("picky")
+	c.Assert(err, gc.ErrorMatches, `unknown lint policy "picky"`)
+}
+
+var lintCharmTests = []struct {
+	about    string
+	meta     *charm.Meta
+	config   *charm.Config
+	problems []string
+}{{
+	about: "no problems",
+}, {
+	about: "incomplete metadata",
+	meta: &charm.Meta{
+		Name: "fakecharm",
+	},
+	problems: []string{
+		"metadata: missing summary",
+		"metadata: missing description",
+	},
+}, {
+	about: "relation names",
+	meta: &charm.Meta{
+		Name:        "fakecharm",
+		Summary:     "Fake charm.",
+		Description: "Fake charm.",
+		Provides: map[string]charm.Relation{
+			"website":  {Name: "website", Interface: "http"},
+			"Admin_UI": {Name: "Admin_UI", Interface: "http"},
+		},
+		Requires: map[string]charm.Relation{
+			"db": {Name: "db", Interface: "my sql"},
+		},
+		Peers: map[string]charm.Relation{
+			"cluster-": {Name: "cluster-", Interface: "fakecharm-peer"},
+		},
+	},
+	problems: []string{
+		`relation "Admin_UI": invalid relation name`,
+		`relation "db": invalid interface name "my sql"`,
+		`relation "cluster-": invalid relation name`,
+	},
+}, {
+	about: "config options",
+	config: &charm.Config{map[string]charm.Option{
+		"title":   {Type: "string", Default: "My Title"},
+		"outlook": {Type: "string"},
+		"port":    {Type: "int", Default: "80"},
+		"ratio":   {Type: "float", Default: 0.5},
+		"debug":   {Type: "boolean", Default: 1},
+		"colour":  {Type: "color", Default: "red"},
+	}},
+	problems: []string{
+		`config option "colour": unknown type "color"`,
+		`config option "debug": default value 1 is not of type boolean`,
+		`config option "port": default value "80" is not of type int`,
+	},
+}}
+
+func (s *TrivialSuite) TestLintCharm(c *gc.C) {
+	for i, test := range lintCharmTests {
+		c.Logf("test %d: %s", i, test.about)
+		dir := &FakeCharmDir{meta: test.meta, config: test.config}
+		problems, warnings := charmstore.LintCharm(dir)
+		c.Assert(problems, gc.DeepEquals, test.problems)
+		c.Assert(warnings, gc.IsNil)
+	}
+}
+
+func (s *TrivialSuite) TestLintCharmFiles(c *gc.C) {
+	dir := charmtesting.Charms.ClonedDir(c.MkDir(), "dummy")
+	err := os.MkdirAll(filepath.Join(dir.Path, "hooks"), 0755)
+	c.Assert(err, gc.IsNil)
+	err = ioutil.WriteFile(filepath.Join(dir.Path, "hooks", "start"), []byte("#!/bin/sh\n"), 0644)
+	c.Assert(err, gc.IsNil)
+	// Files which aren't hooks needn't be executable.
+	err = ioutil.WriteFile(filepath.Join(dir.Path, "hooks", "common.sh"), []byte("PORT=80\n"), 0644)
+	c.Assert(err, gc.IsNil)
+	problems, warnings := charmstore.LintCharm(dir)
+	c.Assert(problems, gc.DeepEquals, []string{"hooks/start: hook is not executable"})
+	c.Assert(warnings, gc.DeepEquals, []string{"icon.svg: missing charm icon"})
+
+	err = ioutil.WriteFile(filepath.Join(dir.Path, "icon.svg"), []byte("<svg/>"), 0644)
+	c.Assert(err, gc.IsNil)
+	err = os.Chmod(filepath.Join(dir.Path, "hooks", "start"), 0755)
+	c.Assert(err, gc.IsNil)
+	problems, warnings = charmstore.LintCharm(dir)
+	c.Assert(problems, gc.IsNil)
+	c.Assert(warnings, gc.IsNil)
+}
+
+func (s *TrivialSuite) TestLintCharmRelationHooks(c *gc.C) {
+	dir := charmtesting.Charms.ClonedDir(c.MkDir(), "dummy")
+	err := ioutil.WriteFile(filepath.Join(dir.Path, "icon.svg"), []byte("<svg/>"), 0644)
+	c.Assert(err, gc.IsNil)
+	err = os.MkdirAll(filepath.Join(dir.Path, "hooks"), 0755)
+	c.Assert(err, gc.IsNil)
+	for _, name := range []string{"website-relation-joined", "cache-relation-joined"} {
+		err = ioutil.WriteFile(filepath.Join(dir.Path, "hooks", name), []byte("#!/bin/sh\n"), 0644)
+		c.Assert(err, gc.IsNil)
+	}
+	meta := dir.Meta()
+	meta.Provides = map[string]charm.Relation{
+		"website": {Name: "website", Interface: "http"},
+	}
+	// Only the hooks of the relations of the charm are checked.
+	problems, warnings := charmstore.LintCharm(dir)
+	c.Assert(problems, gc.DeepEquals, []string{"hooks/website-relation-joined: hook is not executable"})
+	c.Assert(warnings, gc.IsNil)
+}
+
+func (s *StoreSuite) TestCharmPublisherLintWarnings(c *gc.C) {
+	s.store.SetLintPolicy("", charmstore.LintStrict)
+
+	// Warnings don't prevent publishing under the strict policy.
+	dir := charmtesting.Charms.ClonedDir(c.MkDir(), "dummy")
+	curl := charm.MustParseURL("cs:oneiric/dummy")
+	pub, err := s.store.CharmPublisher([]*charm.URL{curl}, "some-digest")
+	c.Assert(err, gc.IsNil)
+	err = pub.Publish(dir)
+	c.Assert(err, gc.IsNil)
+	c.Assert(pub.Warnings(), gc.DeepEquals, []string{"icon.svg: missing charm icon"})
+	_, err = s.store.CharmInfo(curl)
+	c.Assert(err, gc.IsNil)
+}
@@ -5,115 +5,102 @@ package charmstore
 
 import (
 	"fmt"
-	"strings"
 	"time"
 
 	"github.com/juju/charm"
 	"launchpad.net/lpad"
 )
 
-type PublishBranchError struct {
-	URL string
-	Err error
+// launchpadSource is a Source for the branches in the
+// /charms distribution in Launchpad.
+type launchpadSource struct {
+	apiBase lpad.APIBase
+	mapping *URLMapping
 }
 
-type PublishBranchErrors []PublishBranchError
+// NewLaunchpadSource returns a Source for the branch tips in the
+// /charms distribution in Launchpad. The branches are published at the
+// charm URLs given by mapping, which may be nil to use
+// DefaultURLMapping, and in any explicitly assigned official series.
+// By default, only the charm trunk branches, named as
+// ~<user>/charms/<series>/<charm name>/trunk, are published.
+// apiBase specifies the Launchpad base API URL, such
+// as lpad.Production or lpad.Staging.
+func NewLaunchpadSource(apiBase lpad.APIBase, mapping *URLMapping) Source {
+	if mapping == nil {
+		mapping = DefaultURLMapping
+	}
+	return &launchpadSource{apiBase, mapping}
+}
 
-func (errs PublishBranchErrors) Error() string {
-	return fmt.Sprintf("%d branch(es) failed to be published", len(errs))
+// Name implements Source.Name.
+func (src *launchpadSource) Name() string {
+	return string(src.apiBase)
 }
 
-// PublishCharmsDistro publishes all branch tips found in
-// the /charms distribution in Launchpad onto store under
-// the "cs:" scheme.
-// apiBase specifies the Launchpad base API URL, such
-// as lpad.Production or lpad.Staging.
-// Errors found while processing one or more branches are
-// all returned as a PublishBranchErrors value.
-func PublishCharmsDistro(store *Store, apiBase lpad.APIBase) error {
+// Candidates implements Source.Candidates.
+func (src *launchpadSource) Candidates(since time.Time) ([]*Candidate, error) {
 	oauth := &lpad.OAuth{Anonymous: true, Consumer: "juju"}
-	root, err := lpad.Login(apiBase, oauth)
+	root, err := lpad.Login(src.apiBase, oauth)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	distro, err := root.Distro("charms")
 	if err != nil {
-		return err
+		return nil, err
 	}
-	tips, err := distro.BranchTips(time.Time{})
+	tips, err := distro.BranchTips(since)
 	if err != nil {
-		return err
+		return nil, err
 	}
-
-	var errs PublishBranchErrors
-	for _, tip := range tips {
-		if !strings.HasSuffix(tip.UniqueName, "/trunk") {
-			continue
-		}
-		burl, curl, err := uniqueNameURLs(tip.UniqueName)
-		if err != nil {
-			errs = append(errs, PublishBranchError{tip.UniqueName, err})
-			logger.Errorf("%v", err)
-			continue
-		}
-		logger.Infof("%s\n", burl)
-		if tip.Revision == "" {
-			errs = append(errs, PublishBranchError{burl, fmt.Errorf("branch has no revisions")})
-			logger.Errorf("branch has no revisions\n")
-			continue
-		}
-		// Charm is published in the personal URL and in any explicitly
-		// assigned official series.
-		urls := []*charm.URL{curl}
-		schema, name := curl.Schema, curl.Name
-		for _, series := range tip.OfficialSeries {
-			curl = &charm.URL{
-				Reference: charm.Reference{Schema: schema, Name: name, Revision: -1},
-				Series:    series,
-			}
-			curl.Series = series
-			curl.User = ""
-			urls = append(urls, curl)
-		}
-
-		err = PublishBazaarBranch(store, urls, burl, tip.Revision)
-		if err == ErrRedundantUpdate {
-			continue
-		}
-		if err != nil {
-			errs = append(errs, PublishBranchError{burl, err})
-			logger.Errorf("%v", err)
-		}
+	if err := src.mapping.Validate(); err != nil {
+		return nil, err
 	}
-	if errs != nil {
-		return errs
+	candidates := make([]*Candidate, len(tips))
+	for i, tip := range tips {
+		candidates[i] = src.tipCandidate(tip)
 	}
-	return nil
+	return candidates, nil
 }
 
-// uniqueNameURLs returns the branch URL and the charm URL for the
-// provided Launchpad branch unique name. The unique name must be
-// in the form:
-//
-//     ~<user>/charms/<series>/<charm name>/trunk
-//
-// For testing purposes, if name has a prefix preceding a string in
-// this format, the prefix is stripped out for computing the charm
-// URL, and the unique name is returned unchanged as the branch URL.
-func uniqueNameURLs(name string) (burl string, curl *charm.URL, err error) {
-	u := strings.Split(name, "/")
-	if len(u) > 5 {
-		u = u[len(u)-5:]
-		burl = name
-	} else {
-		burl = "lp:" + name
+// tipCandidate returns the candidate for publishing tip.
+func (src *launchpadSource) tipCandidate(tip lpad.BranchTip) *Candidate {
+	bm, err := src.mapping.Map(tip.UniqueName)
+	if err != nil {
+		return &Candidate{SourceURL: tip.UniqueName, Err: err}
 	}
-	if len(u) < 5 || u[1] != "charms" || u[4] != "trunk" || len(u[0]) == 0 || u[0][0] != '~' {
-		return "", nil, fmt.Errorf("unwanted branch name: %s", name)
+	if bm.Skipped != "" {
+		return &Candidate{SourceURL: tip.UniqueName, Skip: true}
 	}
-	curl, err = charm.ParseURL(fmt.Sprintf("cs:%s/%s/%s", u[0], u[2], u[3]))
-	if err != nil {
-		return "", nil, err
+	if tip.Revision == "" {
+		return &Candidate{SourceURL: bm.BranchURL, Err: fmt.Errorf("branch has no revisions")}
+	}
+	// Charm is published in the mapped URLs and in any explicitly
+	// assigned official series.
+	urls := bm.URLs
+	curl := urls[0]
+	for _, series := range tip.OfficialSeries {
+		urls = append(urls, &charm.URL{
+			Reference: charm.Reference{Schema: curl.Schema, Name: curl.Name, Revision: -1},
+			Series:    series,
+		})
 	}
-	return burl, curl, nil
+	return &Candidate{
+		SourceURL: bm.BranchURL,
+		URLs:      urls,
+		Digest:    tip.Revision,
+	}
+}
+
+// Publish implements Source.Publish.
+func (src *launchpadSource) Publish(store *Store, c *Candidate, timeout time.Duration) error {
+	return publishBazaarBranch(store, c.URLs, c.SourceURL, c.Digest, timeout)
+}
+
+// PublishCharmsDistro publishes all branch tips found in
+// the /charms distribution in Launchpad onto store under
+// the "cs:" scheme. See NewLaunchpadSource and PublishSource
+// for details.
+func PublishCharmsDistro(store *Store, apiBase lpad.APIBase, opts *PublishOptions) (*PublishReport, error) {
+	return PublishSource(store, NewLaunchpadSource(apiBase, nil), opts)
 }
@@ -5,6 +5,9 @@ package charmstore_test
 
 import (
 	"fmt"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/juju/charm"
 	gitjujutesting "github.com/juju/testing"
@@ -35,7 +38,7 @@ func (s *StoreSuite) TestPublishCharmDistro(c *gc.C) {
 	gitjujutesting.Server.Response(200, jsonType, []byte(data))
 
 	apiBase := lpad.APIBase(gitjujutesting.Server.URL)
-	err := charmstore.PublishCharmsDistro(s.store, apiBase)
+	report, err := charmstore.PublishCharmsDistro(s.store, apiBase, nil)
 
 	// Should have a single failure from the trunk branch that doesn't
 	// exist. The redundant update with the known digest should be
@@ -46,6 +49,17 @@ func (s *StoreSuite) TestPublishCharmDistro(c *gc.C) {
 	c.Assert(berr.URL, gc.Equals, "file:///non-existent/~jeff/charms/precise/bad/trunk")
 	c.Assert(berr.Err, gc.ErrorMatches, "(?s).*bzr: ERROR: Not a branch.*")
 
+	c.Assert(report, gc.DeepEquals, &charmstore.PublishReport{
+		Published: []string{"file://" + branch.path()},
+		Redundant: []string{"file://" + branch.path()},
+		Failed:    []string{"file:///non-existent/~jeff/charms/precise/bad/trunk"},
+		Skipped:   []string{"file:///non-existent/~jeff/charms/precise/bad/skip-me"},
+		URLs: map[string][]string{
+			"file://" + branch.path(): {"cs:~joe/oneiric/dummy", "cs:oneiric/dummy", "cs:precise/dummy"},
+		},
+	})
+	c.Assert(report.String(), gc.Equals, "1 published, 1 redundant, 1 failed, 1 skipped")
+
 	for _, url := range []string{"cs:oneiric/dummy", "cs:precise/dummy-0", "cs:~joe/oneiric/dummy-0"} {
 		dummy, err := s.store.CharmInfo(charm.MustParseURL(url))
 		c.Assert(err, gc.IsNil)
@@ -71,3 +85,127 @@ func (s *StoreSuite) TestPublishCharmDistro(c *gc.C) {
 	// Request must be signed by juju.
 	c.Assert(req.Header.Get("Authorization"), gc.Matches, `.*oauth_consumer_key="juju".*`)
 }
+
+func (s *StoreSuite) TestPublishCharmDistroIncremental(c *gc.C) {
+	branch := s.dummyBranch(c, "~joe/charms/oneiric/dummy/trunk")
+	burl := "file://" + branch.path()
+	bad := "file:///non-existent/~jeff/charms/precise/bad/trunk"
+	apiBase := lpad.APIBase(gitjujutesting.Server.URL)
+	publish := func(opts *charmstore.PublishOptions, tips ...string) (*charmstore.PublishReport, []string) {
+		gitjujutesting.Server.Response(200, jsonType, []byte("{}"))
+		gitjujutesting.Server.Response(200, jsonType, []byte("["+strings.Join(tips, ",")+"]"))
+		report, _ := charmstore.PublishCharmsDistro(s.store, apiBase, opts)
+		gitjujutesting.Server.WaitRequest()
+		req := gitjujutesting.Server.WaitRequest()
+		return report, req.Form["since"]
+	}
+	tip := fmt.Sprintf(`["%s", "%s", []]`, burl, branch.digest())
+	badTip := fmt.Sprintf(`["%s", "rev1", []]`, bad)
+
+	// The first synchronization considers all branches.
+	before := time.Now()
+	report, since := publish(nil, tip, badTip)
+	c.Assert(since, gc.IsNil)
+	c.Assert(report.String(), gc.Equals, "1 published, 0 redundant, 1 failed, 0 skipped")
+	last, err := s.store.LastSync(gitjujutesting.Server.URL)
+	c.Assert(err, gc.IsNil)
+	c.Assert(last.Before(before.Add(-time.Second)), gc.Equals, false)
+
+	// Later ones only consider the changed branches, along with
+	// the ones that failed to be published before. The bad branch
+	// failure is transient, so it's deferred.
+	report, since = publish(nil, tip)
+	c.Assert(since, gc.NotNil)
+	c.Assert(report, gc.DeepEquals, &charmstore.PublishReport{
+		Redundant: []string{burl},
+		Skipped:   []string{bad},
+	})
+
+	// A full synchronization considers all branches again.
+	report, since = publish(&charmstore.PublishOptions{Full: true}, tip)
+	c.Assert(since, gc.IsNil)
+	c.Assert(report, gc.DeepEquals, &charmstore.PublishReport{
+		Redundant: []string{burl},
+		Skipped:   []string{bad},
+	})
+
+	// New branch tips are published.
+	branch.change()
+	report, _ = publish(nil, fmt.Sprintf(`["%s", "%s", []]`, burl, branch.digest()))
+	c.Assert(report.Published, gc.DeepEquals, []string{burl})
+	_, err = s.store.CharmInfo(charm.MustParseURL("cs:~joe/oneiric/dummy-1"))
+	c.Assert(err, gc.IsNil)
+}
+
+func (s *StoreSuite) TestPublishCharmDistroDryRun(c *gc.C) {
+	branch := s.dummyBranch(c, "~joe/charms/oneiric/dummy/trunk")
+	burl := "file://" + branch.path()
+	data := fmt.Sprintf(`[`+
+		`["%s", "%s", ["oneiric"]],`+
+		`["file:///non-existent/~jeff/charms/precise/bad/trunk", "", []]`+
+		`]`, burl, branch.digest())
+	apiBase := lpad.APIBase(gitjujutesting.Server.URL)
+	gitjujutesting.Server.Response(200, jsonType, []byte("{}"))
+	gitjujutesting.Server.Response(200, jsonType, []byte(data))
+
+	report, err := charmstore.PublishCharmsDistro(s.store, apiBase, &charmstore.PublishOptions{DryRun: true})
+	c.Assert(err, gc.ErrorMatches, `1 branch\(es\) failed to be published`)
+	c.Assert(report, gc.DeepEquals, &charmstore.PublishReport{
+		DryRun:    true,
+		Published: []string{burl},
+		Failed:    []string{"file:///non-existent/~jeff/charms/precise/bad/trunk"},
+		URLs: map[string][]string{
+			burl: {"cs:~joe/oneiric/dummy", "cs:oneiric/dummy"},
+		},
+	})
+
+	// Nothing was published or recorded.
+	_, err = s.store.CharmInfo(charm.MustParseURL("cs:~joe/oneiric/dummy"))
+	c.Assert(err, gc.Equals, charmstore.ErrNotFound)
+	last, err := s.store.LastSync(gitjujutesting.Server.URL)
+	c.Assert(err, gc.IsNil)
+	c.Assert(last.IsZero(), gc.Equals, true)
+	gitjujutesting.Server.WaitRequest()
+	gitjujutesting.Server.WaitRequest()
+
+	// Published tips are reported as redundant.
+	err = charmstore.PublishBazaarBranch(s.store, []*charm.URL{charm.MustParseURL("cs:~joe/oneiric/dummy")}, burl, branch.digest())
+	c.Assert(err, gc.IsNil)
+	gitjujutesting.Server.Response(200, jsonType, []byte("{}"))
+	gitjujutesting.Server.Response(200, jsonType, []byte(fmt.Sprintf(`[["%s", "%s", []]]`, burl, branch.digest())))
+	report, err = charmstore.PublishCharmsDistro(s.store, apiBase, &charmstore.PublishOptions{DryRun: true})
+	c.Assert(err, gc.IsNil)
+	c.Assert(report.String(), gc.Equals, "0 published, 1 redundant, 0 failed, 0 skipped")
+	gitjujutesting.Server.WaitRequest()
+	gitjujutesting.Server.WaitRequest()
+}
+
+func (s *StoreSuite) TestPublishCharmDistroParallel(c *gc.C) {
+	var data []string
+	var burls []string
+	for _, user := range []string{"joe", "jeff", "jane"} {
+		branch := s.dummyBranch(c, "~"+user+"/charms/oneiric/dummy/trunk")
+		data = append(data, fmt.Sprintf(`["file://%s", "%s", []]`, branch.path(), branch.digest()))
+		burls = append(burls, "file://"+branch.path())
+	}
+	gitjujutesting.Server.Response(200, jsonType, []byte("{}"))
+	gitjujutesting.Server.Response(200, jsonType, []byte("["+strings.Join(data, ",")+"]"))
+
+	apiBase := lpad.APIBase(gitjujutesting.Server.URL)
+	report, err := charmstore.PublishCharmsDistro(s.store, apiBase, &charmstore.PublishOptions{
+		Parallelism: 2,
+		Timeout:     time.Minute,
+	})
+	c.Assert(err, gc.IsNil)
+	sort.Strings(burls)
+	sort.Strings(report.Published)
+	c.Assert(report.Published, gc.DeepEquals, burls)
+	c.Assert(report.String(), gc.Equals, "3 published, 0 redundant, 0 failed, 0 skipped")
+
+	for _, user := range []string{"joe", "jeff", "jane"} {
+		_, err := s.store.CharmInfo(charm.MustParseURL("cs:~" + user + "/oneiric/dummy-0"))
+		c.Assert(err, gc.IsNil)
+	}
+	gitjujutesting.Server.WaitRequest()
+	gitjujutesting.Server.WaitRequest()
+}
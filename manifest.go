@@ -0,0 +1,117 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/juju/charm"
+	"launchpad.net/goyaml"
+)
+
+// manifest represents the YAML manifest of Bazaar branches
+// read by a manifest source.
+type manifest struct {
+	Charms []manifestCharm `yaml:"charms"`
+}
+
+// manifestCharm represents a charm branch in a manifest.
+type manifestCharm struct {
+	// Branch holds the Bazaar branch URL.
+	Branch string `yaml:"branch"`
+
+	// URLs holds the charm URLs the branch is published at.
+	URLs []string `yaml:"urls"`
+
+	// Revision optionally holds the Bazaar revision id of the branch
+	// tip. If not set, it's retrieved from the branch.
+	Revision string `yaml:"revision"`
+}
+
+// manifestSource is a Source for the Bazaar branches
+// listed in a YAML manifest.
+type manifestSource struct {
+	path string
+}
+
+// NewManifestSource returns a Source for the Bazaar branches listed in
+// the YAML manifest file at path, in the following format:
+//
+//	charms:
+//	  - branch: lp:~charmers/charms/trusty/mysql/trunk
+//	    urls: [cs:trusty/mysql, cs:~charmers/trusty/mysql]
+//
+// Each entry may also specify the revision id of the branch tip with
+// the revision field, which is otherwise retrieved from the branch
+// when the candidate is published. The manifest is read every time the
+// candidates are requested, and all of its entries are returned.
+func NewManifestSource(path string) Source {
+	return &manifestSource{path}
+}
+
+// Name implements Source.Name.
+func (src *manifestSource) Name() string {
+	return "manifest:" + src.path
+}
+
+// Candidates implements Source.Candidates.
+func (src *manifestSource) Candidates(since time.Time) ([]*Candidate, error) {
+	data, err := ioutil.ReadFile(src.path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read manifest: %v", err)
+	}
+	var m manifest
+	if err := goyaml.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("cannot parse manifest %s: %v", src.path, err)
+	}
+	candidates := make([]*Candidate, len(m.Charms))
+	for i, mc := range m.Charms {
+		candidates[i] = mc.candidate()
+	}
+	return candidates, nil
+}
+
+// candidate returns the candidate for publishing mc.
+func (mc *manifestCharm) candidate() *Candidate {
+	c := &Candidate{
+		SourceURL: mc.Branch,
+		Digest:    mc.Revision,
+	}
+	if mc.Branch == "" {
+		c.Err = fmt.Errorf("manifest entry with no branch")
+		return c
+	}
+	if len(mc.URLs) == 0 {
+		c.Err = fmt.Errorf("no charm URLs for branch %s", mc.Branch)
+		return c
+	}
+	for _, url := range mc.URLs {
+		curl, err := charm.ParseURL(url)
+		if err != nil {
+			c.Err = err
+			return c
+		}
+		if err := mustLackRevision("manifest", curl); err != nil {
+			c.Err = err
+			return c
+		}
+		c.URLs = append(c.URLs, curl)
+	}
+	if c.Digest == "" {
+		// The branch tip is looked up when the candidate is
+		// published, concurrently with the other branches.
+		branch := mc.Branch
+		c.resolveDigest = func(deadline time.Time) (string, error) {
+			return bzrRevisionId(branch, deadline)
+		}
+	}
+	return c
+}
+
+// Publish implements Source.Publish.
+func (src *manifestSource) Publish(store *Store, c *Candidate, timeout time.Duration) error {
+	return publishBazaarBranch(store, c.URLs, c.SourceURL, c.Digest, timeout)
+}
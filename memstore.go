@@ -0,0 +1,647 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juju/charm"
+	"labix.org/v2/mgo/bson"
+)
+
+// Backend holds the store operations for publishing and serving
+// charms. It is implemented by *Store, which holds its data in
+// MongoDB, and by *MemStore, which holds it in memory.
+type Backend interface {
+	StoreReader
+	CharmPublisher(urls []*charm.URL, digest string) (*CharmPublisher, error)
+	SetStorageLimits(limits StorageLimits)
+	SetLintPolicy(user string, policy LintPolicy)
+	DeleteCharm(url *charm.URL, origin Origin) ([]*CharmInfo, error)
+	LockUpdates(urls []*charm.URL) (*UpdateLock, error)
+	LogCharmEvent(event *CharmEvent) error
+	Close()
+}
+
+// Statically ensure that *Store and *MemStore are Backends.
+var (
+	_ Backend = (*Store)(nil)
+	_ Backend = (*MemStore)(nil)
+)
+
+// MemStore is a Backend holding all of its data in memory. It allows
+// code using the store, including Server, to be tested without
+// a MongoDB server. Channels, promulgations, bundles and webhooks
+// are not supported.
+type MemStore struct {
+	lintPolicies
+	signer
+
+	mu       sync.Mutex
+	limits   StorageLimits
+	charms   []*memCharm
+	events   []*CharmEvent
+	locks    map[string]time.Time
+	counters map[memCounter]int64
+	seen     seenClients
+}
+
+// memCharm holds a charm revision published in a MemStore.
+type memCharm struct {
+	urls []*charm.URL
+	info *CharmInfo
+	data []byte
+}
+
+// memCounter identifies the counter for a key
+// incremented during the minute at stamp.
+type memCounter struct {
+	key   string
+	stamp int32
+}
+
+// memKeySep separates the tokens of the counter keys of a MemStore.
+const memKeySep = "\x00"
+
+// NewMemStore returns a new empty MemStore.
+func NewMemStore() *MemStore {
+	return &MemStore{
+		locks:    make(map[string]time.Time),
+		counters: make(map[memCounter]int64),
+		seen:     make(seenClients),
+	}
+}
+
+// Close implements Backend.Close. It does nothing.
+func (s *MemStore) Close() {}
+
+// CharmPublisher implements Backend.CharmPublisher.
+func (s *MemStore) CharmPublisher(urls []*charm.URL, digest string) (*CharmPublisher, error) {
+	if err := mustLackRevision("CharmPublisher", urls...); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	maxRev := -1
+	newKey := false
+	for _, url := range urls {
+		latest := s.latest(url, -1)
+		if latest == nil {
+			newKey = true
+			continue
+		}
+		if latest.info.digest != digest {
+			newKey = true
+		}
+		if latest.info.revision > maxRev {
+			maxRev = latest.info.revision
+		}
+	}
+	if !newKey {
+		return nil, ErrRedundantUpdate
+	}
+	w := &memCharmWriter{
+		store:    s,
+		urls:     urls,
+		revision: maxRev + 1,
+		digest:   digest,
+	}
+	return &CharmPublisher{revision: w.revision, urls: urls, w: w, policy: s.lintPolicy(urls)}, nil
+}
+
+// SetStorageLimits implements Backend.SetStorageLimits.
+func (s *MemStore) SetStorageLimits(limits StorageLimits) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.limits = limits
+}
+
+// archiveLimit returns the maximum size of an archive published at
+// urls and the error reported when the archive exceeds it, as the
+// archiveLimit function.
+func (s *MemStore) archiveLimit(urls []*charm.URL) (int64, *StorageLimitError) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	max, limitErr, _ := archiveLimit(s.limits, urls, func(user string) (int64, error) {
+		var used int64
+		for _, c := range s.charms {
+			for _, url := range c.urls {
+				if url.User == user {
+					used += c.info.size
+					break
+				}
+			}
+		}
+		return used, nil
+	})
+	return max, limitErr
+}
+
+// latest returns the latest revision of the charm at url, or the given
+// revision if it's not -1. It returns nil if there is no such charm.
+// It must be called with s.mu held.
+func (s *MemStore) latest(url *charm.URL, revision int) *memCharm {
+	var found *memCharm
+	for _, c := range s.charms {
+		if !hasURL(c.urls, url) {
+			continue
+		}
+		if revision != -1 && c.info.revision != revision {
+			continue
+		}
+		if found == nil || c.info.revision > found.info.revision {
+			found = c
+		}
+	}
+	return found
+}
+
+// memCharmWriter is a charmSink holding the
+// archive of a charm published in a MemStore.
+type memCharmWriter struct {
+	store    *MemStore
+	urls     []*charm.URL
+	revision int
+	digest   string
+	buf      bytes.Buffer
+	err      error
+
+	// started records whether the storage limits were looked up.
+	started  bool
+	maxSize  int64
+	limitErr *StorageLimitError
+}
+
+// Write fails with a *StorageLimitError when the data
+// exceeds the storage limits of the store.
+func (w *memCharmWriter) Write(data []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	if !w.started {
+		w.started = true
+		w.maxSize, w.limitErr = w.store.archiveLimit(w.urls)
+	}
+	if w.maxSize != 0 && int64(w.buf.Len()+len(data)) > w.maxSize {
+		logger.Errorf("cannot publish %v: %v", w.urls, w.limitErr)
+		w.err = w.limitErr
+		return 0, w.err
+	}
+	return w.buf.Write(data)
+}
+
+func (w *memCharmWriter) written() int64 {
+	return int64(w.buf.Len())
+}
+
+func (w *memCharmWriter) abort() {
+	w.buf.Reset()
+}
+
+func (w *memCharmWriter) finishCharm(ch CharmDir) error {
+	if w.err != nil {
+		// The error may have been swallowed by the code
+		// writing the archive.
+		w.abort()
+		return w.err
+	}
+	if w.buf.Len() == 0 {
+		return errEmptyArchive
+	}
+	data := w.buf.Bytes()
+	hash := sha256.Sum256(data)
+	sum := hex.EncodeToString(hash[:])
+	meta := ch.Meta()
+	s := w.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := &memCharm{
+		urls: w.urls,
+		info: &CharmInfo{
+			revision:   w.revision,
+			digest:     w.digest,
+			sha256:     sum,
+			size:       int64(len(data)),
+			meta:       meta,
+			config:     ch.Config(),
+			actions:    ch.Actions(),
+			signatures: s.signCharm(w.urls, w.revision, sum),
+		},
+		data: data,
+	}
+	for _, url := range w.urls {
+		if s.latest(url, w.revision) != nil {
+			return ErrUpdateConflict
+		}
+	}
+	s.charms = append(s.charms, c)
+	return nil
+}
+
+// Series implements StoreReader.Series.
+func (s *MemStore) Series(ref charm.Reference) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	seriesSet := make(map[string]bool)
+	for _, c := range s.charms {
+		for _, url := range c.urls {
+			if url.Reference == ref {
+				seriesSet[url.Series] = true
+			}
+		}
+	}
+	var result []string
+	for series := range seriesSet {
+		result = append(result, series)
+	}
+	sort.Sort(byPreferredSeries(result))
+	return result, nil
+}
+
+// CharmInfo implements StoreReader.CharmInfo.
+func (s *MemStore) CharmInfo(url *charm.URL) (*CharmInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := s.latest(url.WithRevision(-1), url.Revision)
+	if c == nil {
+		return nil, ErrNotFound
+	}
+	return c.info, nil
+}
+
+// OpenCharm implements StoreReader.OpenCharm.
+func (s *MemStore) OpenCharm(url *charm.URL) (*CharmInfo, io.ReadCloser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := s.latest(url.WithRevision(-1), url.Revision)
+	if c == nil {
+		return nil, nil, ErrNotFound
+	}
+	return c.info, ioutil.NopCloser(bytes.NewReader(c.data)), nil
+}
+
+// DeleteCharm implements Backend.DeleteCharm.
+func (s *MemStore) DeleteCharm(url *charm.URL, origin Origin) ([]*CharmInfo, error) {
+	s.mu.Lock()
+	curl := url.WithRevision(-1)
+	var kept, removed []*memCharm
+	for _, c := range s.charms {
+		if hasURL(c.urls, curl) && (url.Revision == -1 || c.info.revision == url.Revision) {
+			removed = append(removed, c)
+		} else {
+			kept = append(kept, c)
+		}
+	}
+	s.charms = kept
+	s.mu.Unlock()
+
+	if len(removed) == 0 {
+		return nil, ErrNotFound
+	}
+	sort.Sort(memCharmsByRevision(removed))
+	var deleted []*CharmInfo
+	for _, c := range removed {
+		deleted = append(deleted, c.info)
+		err := s.LogCharmEvent(&CharmEvent{
+			Kind:     EventDeleted,
+			Digest:   c.info.digest,
+			Revision: c.info.revision,
+			URLs:     []*charm.URL{curl},
+			Actor:    origin.Actor,
+			Reason:   origin.Reason,
+		})
+		if err != nil {
+			return deleted, err
+		}
+	}
+	return deleted, nil
+}
+
+// memCharmsByRevision sorts charms in descending revision order.
+type memCharmsByRevision []*memCharm
+
+func (cs memCharmsByRevision) Len() int           { return len(cs) }
+func (cs memCharmsByRevision) Swap(i, j int)      { cs[i], cs[j] = cs[j], cs[i] }
+func (cs memCharmsByRevision) Less(i, j int) bool { return cs[i].info.revision > cs[j].info.revision }
+
+// LockUpdates implements Backend.LockUpdates.
+func (s *MemStore) LockUpdates(urls []*charm.URL) (*UpdateLock, error) {
+	keys := make([]string, len(urls))
+	for i := range urls {
+		keys[i] = urls[i].String()
+	}
+	sort.Strings(keys)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for _, key := range keys {
+		if t, ok := s.locks[key]; ok && t.After(now.Add(-UpdateTimeout)) {
+			return nil, ErrUpdateConflict
+		}
+	}
+	for _, key := range keys {
+		s.locks[key] = now
+	}
+	return &UpdateLock{keys: keys, time: now, mem: s}, nil
+}
+
+// unlock releases the locks on keys acquired at time t.
+func (s *MemStore) unlock(keys []string, t time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, key := range keys {
+		if s.locks[key].Equal(t) {
+			delete(s.locks, key)
+		}
+	}
+}
+
+// LogCharmEvent implements Backend.LogCharmEvent.
+func (s *MemStore) LogCharmEvent(event *CharmEvent) error {
+	if err := mustLackRevision("LogCharmEvent", event.URLs...); err != nil {
+		return err
+	}
+	if event.Kind == 0 || len(event.URLs) == 0 {
+		return fmt.Errorf("LogCharmEvent: need valid Kind and URLs")
+	}
+	if event.Digest == "" && (event.Kind == EventPublished || event.Kind == EventPublishError) {
+		return fmt.Errorf("LogCharmEvent: need valid Digest for %s events", event.Kind)
+	}
+	if event.Id == "" {
+		event.Id = bson.NewObjectId()
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	event.Seq = int64(len(s.events) + 1)
+	stored := *event
+	s.events = append(s.events, &stored)
+	return nil
+}
+
+// CharmEvent implements StoreReader.CharmEvent.
+func (s *MemStore) CharmEvent(url *charm.URL, digest string) (*CharmEvent, error) {
+	if err := mustLackRevision("CharmEvent", url); err != nil {
+		return nil, err
+	}
+	return s.charmEvent(url, digest, nil)
+}
+
+// lastPublishEvent returns the latest event recording the outcome
+// of an attempt to publish digest at url, or any digest if empty.
+func (s *MemStore) lastPublishEvent(url *charm.URL, digest string) (*CharmEvent, error) {
+	return s.charmEvent(url.WithRevision(-1), digest, publishOutcomeKinds)
+}
+
+// charmEvent returns the latest event logged for url and digest,
+// or any digest if empty, with one of the given kinds, or any kind
+// if none.
+func (s *MemStore) charmEvent(url *charm.URL, digest string, kinds []CharmEventKind) (*CharmEvent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var found *CharmEvent
+	for _, event := range s.events {
+		if digest != "" && event.Digest != digest || !hasURL(event.URLs, url) {
+			continue
+		}
+		if len(kinds) > 0 && !hasEventKind(kinds, event.Kind) {
+			continue
+		}
+		if found == nil || !eventBefore(event, found) {
+			found = event
+		}
+	}
+	if found == nil {
+		return nil, ErrNotFound
+	}
+	event := *found
+	return &event, nil
+}
+
+// hasURL reports whether urls holds url.
+func hasURL(urls []*charm.URL, url *charm.URL) bool {
+	for _, u := range urls {
+		if *u == *url {
+			return true
+		}
+	}
+	return false
+}
+
+// hasEventKind reports whether kinds holds kind.
+func hasEventKind(kinds []CharmEventKind, kind CharmEventKind) bool {
+	for _, k := range kinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// eventBefore reports whether e1 was logged before e2.
+func eventBefore(e1, e2 *CharmEvent) bool {
+	if !e1.Time.Equal(e2.Time) {
+		return e1.Time.Before(e2.Time)
+	}
+	return e1.Id < e2.Id
+}
+
+// Events implements StoreReader.Events.
+func (s *MemStore) Events(req *EventsRequest) ([]*CharmEvent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var after *CharmEvent
+	if req.AfterId != "" {
+		for _, event := range s.events {
+			if event.Id == req.AfterId {
+				after = event
+			}
+		}
+		if after == nil {
+			return nil, ErrNotFound
+		}
+	}
+	kinds := make(map[CharmEventKind]bool)
+	for _, kind := range req.Kinds {
+		kinds[kind] = true
+	}
+	var result []*CharmEvent
+	for _, event := range s.events {
+		if after != nil && event.Seq <= after.Seq ||
+			!req.Since.IsZero() && event.Time.Before(req.Since) ||
+			len(kinds) > 0 && !kinds[event.Kind] ||
+			req.Actor != "" && event.Actor != req.Actor {
+			continue
+		}
+		e := *event
+		result = append(result, &e)
+	}
+	if req.Limit > 0 && len(result) > req.Limit {
+		result = result[:req.Limit]
+	}
+	return result, nil
+}
+
+// ChannelRevision implements StoreReader.ChannelRevision.
+// MemStore doesn't support channels, so ErrNotFound
+// is always returned.
+func (s *MemStore) ChannelRevision(url *charm.URL, channel Channel) (int, error) {
+	return 0, ErrNotFound
+}
+
+// BundleInfo implements StoreReader.BundleInfo.
+// MemStore doesn't support bundles, so ErrNotFound
+// is always returned.
+func (s *MemStore) BundleInfo(url *charm.URL) (*BundleInfo, error) {
+	return nil, ErrNotFound
+}
+
+// OpenBundle implements StoreReader.OpenBundle.
+// MemStore doesn't support bundles, so ErrNotFound
+// is always returned.
+func (s *MemStore) OpenBundle(url *charm.URL) (*BundleInfo, io.ReadCloser, error) {
+	return nil, nil, ErrNotFound
+}
+
+// InterfaceCharms implements StoreReader.InterfaceCharms.
+func (s *MemStore) InterfaceCharms(iface string, role charm.RelationRole, series string) ([]*charm.URL, error) {
+	if _, err := roleField(role); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	seen := make(map[charm.URL]bool)
+	var result []*charm.URL
+	for _, c := range s.charms {
+		for _, url := range c.urls {
+			if seen[*url] || series != "" && url.Series != series {
+				continue
+			}
+			seen[*url] = true
+			meta := s.latest(url, -1).info.meta
+			relations := meta.Provides
+			if role == charm.RoleRequirer {
+				relations = meta.Requires
+			}
+			for _, name := range interfaceNames(relations) {
+				if name == iface {
+					result = append(result, url)
+					break
+				}
+			}
+		}
+	}
+	sort.Sort(byURLString(result))
+	return result, nil
+}
+
+// RelatedCharms implements StoreReader.RelatedCharms.
+func (s *MemStore) RelatedCharms(url *charm.URL) ([]RelatedCharm, error) {
+	return relatedCharms(s, url)
+}
+
+// IncCounter implements StoreReader.IncCounter.
+func (s *MemStore) IncCounter(key []string) error {
+	if len(key) == 0 {
+		return fmt.Errorf("store: empty statistics key")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.incCounter(key, time.Now())
+	return nil
+}
+
+// incCounter increases by one the counter for key at time t.
+// It must be called with s.mu held.
+func (s *MemStore) incCounter(key []string, t time.Time) {
+	t = t.UTC()
+	// Round to the start of the minute, as done by Store.
+	t = t.Add(-time.Duration(t.Second()) * time.Second)
+	s.counters[memCounter{strings.Join(key, memKeySep), timeToStamp(t)}]++
+}
+
+// IncUniqueCounter implements StoreReader.IncUniqueCounter.
+func (s *MemStore) IncUniqueCounter(key []string, client string, window time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	added, err := s.seen.add(key, client, window, now)
+	if added {
+		s.incCounter(key, now)
+	}
+	return err
+}
+
+// Counters implements StoreReader.Counters.
+func (s *MemStore) Counters(req *CounterRequest) ([]Counter, error) {
+	if len(req.Key) == 0 {
+		return nil, fmt.Errorf("store: empty statistics key")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sums := make(map[string]*Counter)
+	for mc, count := range s.counters {
+		key := strings.Split(mc.key, memKeySep)
+		if !hasKeyPrefix(key, req.Key) ||
+			req.Prefix && len(key) == len(req.Key) ||
+			!req.Prefix && len(key) != len(req.Key) ||
+			!req.Start.IsZero() && mc.stamp < timeToStamp(req.Start) ||
+			!req.Stop.IsZero() && mc.stamp > timeToStamp(req.Stop) {
+			continue
+		}
+		counter := Counter{Key: req.Key, Prefix: req.Prefix}
+		if req.List && req.Prefix {
+			counter.Key = key[:len(req.Key)+1]
+			counter.Prefix = len(key) > len(req.Key)+1
+		}
+		switch req.By {
+		case ByDay:
+			counter.Time = time.Unix(counterEpoch+int64(mc.stamp)/86400*86400, 0).UTC()
+		case ByWeek:
+			// The +1 puts it at the end of the period.
+			counter.Time = time.Unix(counterEpoch+(int64(mc.stamp)/604800+1)*604800, 0).UTC()
+		}
+		id := fmt.Sprintf("%q %v %d", counter.Key, counter.Prefix, counter.Time.Unix())
+		if sum, ok := sums[id]; ok {
+			sum.Count += count
+			continue
+		}
+		counter.Count = count
+		sums[id] = &counter
+	}
+	var counters []Counter
+	for _, counter := range sums {
+		counters = append(counters, *counter)
+	}
+	if !req.List && len(counters) == 0 {
+		counters = []Counter{{Key: req.Key, Prefix: req.Prefix, Count: 0}}
+	} else if len(counters) > 1 {
+		sort.Sort(sortableCounters(counters))
+	}
+	return counters, nil
+}
+
+// hasKeyPrefix reports whether key starts with the tokens in prefix.
+func hasKeyPrefix(key, prefix []string) bool {
+	if len(key) < len(prefix) {
+		return false
+	}
+	for i := range prefix {
+		if key[i] != prefix[i] {
+			return false
+		}
+	}
+	return true
+}
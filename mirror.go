@@ -0,0 +1,332 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/juju/charm"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+
+	"github.com/juju/charmstore/csclient"
+)
+
+// remoteTimeout holds the maximum time spent in each
+// request to a remote store.
+var remoteTimeout = 5 * time.Minute
+
+// mirrorPageSize holds the number of events requested
+// from the remote /changes API at a time.
+var mirrorPageSize = 100
+
+// MirrorSelection specifies the charms replicated from a remote store.
+type MirrorSelection struct {
+	// Users holds the namespaces of the charms replicated.
+	// The empty string selects the charms with no user.
+	// If empty, charms from all namespaces are replicated.
+	Users []string
+
+	// Series holds the series of the charms replicated.
+	// If empty, charms from all series are replicated.
+	Series []string
+
+	// URLs holds charm URLs, with no revision, which are
+	// replicated regardless of Users and Series. If only URLs
+	// are specified, no other charms are replicated.
+	URLs []*charm.URL
+}
+
+// match reports whether curl is selected.
+func (sel *MirrorSelection) match(curl *charm.URL) bool {
+	for _, u := range sel.URLs {
+		if u.String() == curl.String() {
+			return true
+		}
+	}
+	if len(sel.URLs) > 0 && len(sel.Users) == 0 && len(sel.Series) == 0 {
+		return false
+	}
+	return matchAny(sel.Users, curl.User) && matchAny(sel.Series, curl.Series)
+}
+
+// matchAny reports whether s is in list or list is empty.
+func matchAny(list []string, s string) bool {
+	if len(list) == 0 {
+		return true
+	}
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// MirrorReport summarizes the outcome of a mirroring run. Each list
+// holds the charm URLs, with revision, in the respective situation.
+type MirrorReport struct {
+	// Mirrored holds the charms replicated locally.
+	Mirrored []string `json:"mirrored"`
+
+	// Redundant holds the charms already present locally.
+	Redundant []string `json:"redundant"`
+
+	// Skipped holds the charms no longer available remotely.
+	Skipped []string `json:"skipped"`
+}
+
+// String returns a one line summary of the report.
+func (r *MirrorReport) String() string {
+	return fmt.Sprintf("%d mirrored, %d redundant, %d skipped",
+		len(r.Mirrored), len(r.Redundant), len(r.Skipped))
+}
+
+// A Mirror replicates charms from a remote store into a local one.
+type Mirror struct {
+	store  *Store
+	remote *csclient.Client
+	sel    *MirrorSelection
+}
+
+// NewMirror returns a Mirror replicating onto store the charms selected
+// by sel, which may be nil to select all charms, from the store serving
+// its API at remoteURL.
+func NewMirror(store *Store, remoteURL string, sel *MirrorSelection) *Mirror {
+	if sel == nil {
+		sel = &MirrorSelection{}
+	}
+	return &Mirror{
+		store:  store,
+		remote: newRemoteClient(remoteURL),
+		sel:    sel,
+	}
+}
+
+// mirrorDoc represents the document stored in MongoDB recording
+// the progress of mirroring a remote store.
+type mirrorDoc struct {
+	Remote string `bson:"_id"`
+	After  string
+	Time   time.Time
+}
+
+// Run replicates the selected charms published in the remote store
+// since the last run. The revisions, digests and SHA256 hashes of the
+// charms are preserved, and the downloaded archives are verified
+// against the hashes reported by the remote store. Charms deleted
+// remotely before being replicated are skipped. The progress is
+// recorded in the local store after each replicated charm, so a
+// failed run is resumed from the charm that failed.
+func (m *Mirror) Run() (*MirrorReport, error) {
+	report := &MirrorReport{}
+	after, err := m.store.mirrorCursor(m.remote.URL())
+	if err != nil {
+		return nil, err
+	}
+	for {
+		entries, err := m.changes(after)
+		if err != nil {
+			return report, err
+		}
+		for _, entry := range entries {
+			if err := m.mirrorEntry(entry, report); err != nil {
+				return report, err
+			}
+			after = entry.Id
+			if err := m.store.setMirrorCursor(m.remote.URL(), after); err != nil {
+				return report, err
+			}
+		}
+		if len(entries) < mirrorPageSize {
+			return report, nil
+		}
+	}
+}
+
+// newRemoteClient returns a client of the store serving its API at
+// remoteURL. Its requests are not counted in the statistics of the
+// remote store.
+func newRemoteClient(remoteURL string) *csclient.Client {
+	return csclient.New(csclient.Params{
+		URL:          remoteURL,
+		HTTPClient:   &http.Client{Timeout: remoteTimeout},
+		DisableStats: true,
+	})
+}
+
+// changes returns the events about published charms logged
+// in the remote store after the one with the given id.
+func (m *Mirror) changes(after string) ([]csclient.ChangeEntry, error) {
+	return m.remote.Changes(&csclient.ChangesRequest{
+		After: after,
+		Kinds: []string{EventPublished.String()},
+		Limit: mirrorPageSize,
+	})
+}
+
+// mirrorEntry replicates the charm published in the remote
+// store as described by entry, if it's selected.
+func (m *Mirror) mirrorEntry(entry csclient.ChangeEntry, report *MirrorReport) error {
+	var urls []*charm.URL
+	for _, u := range entry.URLs {
+		curl, err := charm.ParseURL(u)
+		if err != nil {
+			return fmt.Errorf("invalid charm URL in remote event %s: %v", entry.Id, err)
+		}
+		if m.sel.match(curl) {
+			urls = append(urls, curl)
+		}
+	}
+	if len(urls) == 0 {
+		return nil
+	}
+	curl := urls[0].WithRevision(entry.Revision)
+	info, err := m.remote.CharmInfo(curl.String())
+	if err == csclient.ErrNotFound {
+		logger.Infof("charm %s not found in remote store; skipping", curl)
+		report.Skipped = append(report.Skipped, curl.String())
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Revision != curl.Revision {
+		return fmt.Errorf("remote store returned revision %d for charm %s", info.Revision, curl)
+	}
+	lock, err := m.store.LockUpdates(urls)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	pub, err := m.store.charmPublisherAt(urls, info.Digest, info.Revision)
+	if err == ErrRedundantUpdate {
+		report.Redundant = append(report.Redundant, curl.String())
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	// The downloaded archive is verified against the SHA256 hash
+	// the remote store reports along with it.
+	dinfo, data, err := m.remote.Download(curl.String())
+	if err == csclient.ErrNotFound {
+		logger.Infof("charm %s not found in remote store; skipping", curl)
+		report.Skipped = append(report.Skipped, curl.String())
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if dinfo.Digest != info.Digest {
+		return fmt.Errorf("cannot mirror charm %s: remote digest changed from %q to %q", curl, info.Digest, dinfo.Digest)
+	}
+	bundle, err := charm.ReadBundleBytes(data)
+	if err != nil {
+		return fmt.Errorf("cannot mirror charm %s: %v", curl, err)
+	}
+	missing := pub.urls
+	if err := pub.Publish(&mirroredCharm{bundle, data}); err != nil {
+		return fmt.Errorf("cannot mirror charm %s: %v", curl, err)
+	}
+	err = m.store.LogCharmEvent(&CharmEvent{
+		Kind:     EventPublished,
+		Revision: info.Revision,
+		Digest:   info.Digest,
+		URLs:     missing,
+		Warnings: pub.Warnings(),
+		Actor:    "mirror",
+		Reason:   "mirrored from " + m.remote.URL(),
+	})
+	if err != nil {
+		return err
+	}
+	report.Mirrored = append(report.Mirrored, curl.String())
+	return nil
+}
+
+// mirroredCharm is a CharmDir for a charm archive
+// downloaded from a remote store.
+type mirroredCharm struct {
+	*charm.Bundle
+	data []byte
+}
+
+// SetRevision implements CharmDir.SetRevision. The archive
+// is stored unchanged, so the revision in it is preserved.
+func (c *mirroredCharm) SetRevision(revision int) {}
+
+// BundleTo implements CharmDir.BundleTo by writing the archive as is.
+func (c *mirroredCharm) BundleTo(w io.Writer) error {
+	_, err := w.Write(c.data)
+	return err
+}
+
+// charmPublisherAt is like CharmPublisher, but the charm is published
+// at the given revision rather than the next one, and only at the
+// urls which lack it. An error is returned if any of the urls already
+// has the revision with a different digest.
+func (s *Store) charmPublisherAt(urls []*charm.URL, digest string, revision int) (*CharmPublisher, error) {
+	if err := mustLackRevision("charmPublisherAt", urls...); err != nil {
+		return nil, err
+	}
+	session := s.session.Copy()
+	defer session.Close()
+
+	var missing []*charm.URL
+	for _, curl := range urls {
+		var doc charmDoc
+		err := session.Charms().Find(bson.D{{"urls", curl.String()}, {"revision", revision}}).One(&doc)
+		if err == mgo.ErrNotFound {
+			missing = append(missing, curl)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if doc.Digest != digest {
+			return nil, fmt.Errorf("charm %s already has a different digest %q", curl.WithRevision(revision), doc.Digest)
+		}
+	}
+	if len(missing) == 0 {
+		return nil, ErrRedundantUpdate
+	}
+	w := &charmWriter{
+		store:    s,
+		urls:     missing,
+		revision: revision,
+		digest:   digest,
+	}
+	return &CharmPublisher{revision: revision, urls: missing, w: w, policy: LintLenient}, nil
+}
+
+// mirrorCursor returns the id of the last event processed when
+// mirroring the remote store, or the empty string if none was.
+func (s *Store) mirrorCursor(remote string) (string, error) {
+	session := s.session.Copy()
+	defer session.Close()
+
+	var doc mirrorDoc
+	err := session.Mirrors().FindId(remote).One(&doc)
+	if err == mgo.ErrNotFound {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return doc.After, nil
+}
+
+// setMirrorCursor records after as the id of the last event
+// processed when mirroring the remote store.
+func (s *Store) setMirrorCursor(remote, after string) error {
+	session := s.session.Copy()
+	defer session.Close()
+
+	_, err := session.Mirrors().UpsertId(remote, &mirrorDoc{remote, after, time.Now()})
+	return err
+}
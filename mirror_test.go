@@ -0,0 +1,207 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/juju/charm"
+	charmtesting "github.com/juju/charm/testing"
+	gitjujutesting "github.com/juju/testing"
+	gc "launchpad.net/gocheck"
+
+	"github.com/juju/charmstore"
+)
+
+// openRemoteStore returns a store held in a separate database,
+// and an HTTP server serving its API.
+func (s *StoreSuite) openRemoteStore(c *gc.C) (*charmstore.Store, *httptest.Server) {
+	remote, err := charmstore.OpenDB(gitjujutesting.MgoServer.Addr(), "juju-remote")
+	c.Assert(err, gc.IsNil)
+	server, err := charmstore.NewServer(remote)
+	c.Assert(err, gc.IsNil)
+	return remote, httptest.NewServer(server)
+}
+
+// publishDummy publishes the dummy charm with the given digest
+// at urls in store, as the charm loader would.
+func publishDummy(c *gc.C, store *charmstore.Store, digest string, urls ...string) {
+	curls := make([]*charm.URL, len(urls))
+	for i, url := range urls {
+		curls[i] = charm.MustParseURL(url)
+	}
+	pub, err := store.CharmPublisher(curls, digest)
+	c.Assert(err, gc.IsNil)
+	err = pub.Publish(charmtesting.Charms.ClonedDir(c.MkDir(), "dummy"))
+	c.Assert(err, gc.IsNil)
+	err = store.LogCharmEvent(&charmstore.CharmEvent{
+		Kind:     charmstore.EventPublished,
+		Revision: pub.Revision(),
+		Digest:   digest,
+		URLs:     curls,
+	})
+	c.Assert(err, gc.IsNil)
+}
+
+func (s *StoreSuite) TestMirror(c *gc.C) {
+	defer func(old int) { *charmstore.MirrorPageSize = old }(*charmstore.MirrorPageSize)
+	*charmstore.MirrorPageSize = 2
+
+	remote, server := s.openRemoteStore(c)
+	defer remote.Close()
+	defer server.Close()
+
+	publishDummy(c, remote, "digest-0", "cs:~joe/precise/dummy", "cs:precise/dummy")
+	publishDummy(c, remote, "digest-1", "cs:~joe/precise/dummy", "cs:precise/dummy")
+	publishDummy(c, remote, "digest-2", "cs:~bob/trusty/dummy")
+
+	sel := &charmstore.MirrorSelection{Users: []string{"joe"}}
+	mirror := charmstore.NewMirror(s.store, server.URL, sel)
+	report, err := mirror.Run()
+	c.Assert(err, gc.IsNil)
+	c.Assert(report.Mirrored, gc.DeepEquals, []string{"cs:~joe/precise/dummy-0", "cs:~joe/precise/dummy-1"})
+	c.Assert(report.String(), gc.Equals, "2 mirrored, 0 redundant, 0 skipped")
+
+	for rev := 0; rev < 2; rev++ {
+		curl := charm.MustParseURL("cs:~joe/precise/dummy").WithRevision(rev)
+		remoteInfo, err := remote.CharmInfo(curl)
+		c.Assert(err, gc.IsNil)
+		info, err := s.store.CharmInfo(curl)
+		c.Assert(err, gc.IsNil)
+		c.Assert(info.Revision(), gc.Equals, rev)
+		c.Assert(info.Digest(), gc.Equals, remoteInfo.Digest())
+		c.Assert(info.BundleSha256(), gc.Equals, remoteInfo.BundleSha256())
+		c.Assert(info.Meta().Name, gc.Equals, "dummy")
+	}
+	_, err = s.store.CharmInfo(charm.MustParseURL("cs:precise/dummy"))
+	c.Assert(err, gc.Equals, charmstore.ErrNotFound)
+	_, err = s.store.CharmInfo(charm.MustParseURL("cs:~bob/trusty/dummy"))
+	c.Assert(err, gc.Equals, charmstore.ErrNotFound)
+
+	event, err := s.store.CharmEvent(charm.MustParseURL("cs:~joe/precise/dummy"), "digest-1")
+	c.Assert(err, gc.IsNil)
+	c.Assert(event.Kind, gc.Equals, charmstore.EventPublished)
+	c.Assert(event.Revision, gc.Equals, 1)
+	c.Assert(event.Actor, gc.Equals, "mirror")
+
+	// Later runs only consider the charms published since.
+	report, err = mirror.Run()
+	c.Assert(err, gc.IsNil)
+	c.Assert(report.String(), gc.Equals, "0 mirrored, 0 redundant, 0 skipped")
+
+	publishDummy(c, remote, "digest-3", "cs:~joe/precise/dummy")
+	report, err = mirror.Run()
+	c.Assert(err, gc.IsNil)
+	c.Assert(report.Mirrored, gc.DeepEquals, []string{"cs:~joe/precise/dummy-2"})
+}
+
+func (s *StoreSuite) TestMirrorExplicitURLs(c *gc.C) {
+	remote, server := s.openRemoteStore(c)
+	defer remote.Close()
+	defer server.Close()
+
+	publishDummy(c, remote, "digest-0", "cs:precise/dummy")
+	publishDummy(c, remote, "digest-1", "cs:precise/other")
+
+	// The charm is already present locally at the same revision.
+	publishDummy(c, s.store, "digest-0", "cs:precise/dummy")
+
+	sel := &charmstore.MirrorSelection{URLs: []*charm.URL{
+		charm.MustParseURL("cs:precise/dummy"),
+		charm.MustParseURL("cs:precise/missing"),
+	}}
+	report, err := charmstore.NewMirror(s.store, server.URL, sel).Run()
+	c.Assert(err, gc.IsNil)
+	c.Assert(report.Redundant, gc.DeepEquals, []string{"cs:precise/dummy-0"})
+	c.Assert(report.String(), gc.Equals, "0 mirrored, 1 redundant, 0 skipped")
+}
+
+func (s *StoreSuite) TestMirrorRevisionConflict(c *gc.C) {
+	remote, server := s.openRemoteStore(c)
+	defer remote.Close()
+	defer server.Close()
+
+	publishDummy(c, remote, "remote-digest", "cs:precise/dummy")
+	publishDummy(c, s.store, "local-digest", "cs:precise/dummy")
+
+	_, err := charmstore.NewMirror(s.store, server.URL, nil).Run()
+	c.Assert(err, gc.ErrorMatches, `charm cs:precise/dummy-0 already has a different digest "local-digest"`)
+}
+
+func (s *StoreSuite) TestMirrorSkipsDeletedCharms(c *gc.C) {
+	remote, server := s.openRemoteStore(c)
+	defer remote.Close()
+	defer server.Close()
+
+	publishDummy(c, remote, "digest-0", "cs:precise/dummy")
+	publishDummy(c, remote, "digest-1", "cs:precise/dummy")
+	_, err := remote.DeleteCharm(charm.MustParseURL("cs:precise/dummy-0"), charmstore.Origin{})
+	c.Assert(err, gc.IsNil)
+
+	report, err := charmstore.NewMirror(s.store, server.URL, nil).Run()
+	c.Assert(err, gc.IsNil)
+	c.Assert(report.Mirrored, gc.DeepEquals, []string{"cs:precise/dummy-1"})
+	c.Assert(report.Skipped, gc.DeepEquals, []string{"cs:precise/dummy-0"})
+}
+
+func (s *StoreSuite) TestMirrorVerifiesSha256(c *gc.C) {
+	remote, err := charmstore.OpenDB(gitjujutesting.MgoServer.Addr(), "juju-remote")
+	c.Assert(err, gc.IsNil)
+	defer remote.Close()
+
+	publishDummy(c, remote, "digest-0", "cs:precise/dummy")
+	publishDummy(c, remote, "digest-1", "cs:precise/dummy")
+
+	handler, err := charmstore.NewServer(remote)
+	c.Assert(err, gc.IsNil)
+	corrupt := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if corrupt && strings.HasPrefix(r.URL.Path, "/charm/") && strings.HasSuffix(r.URL.Path, "-1") {
+			w.Write([]byte("corrupt archive"))
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	mirror := charmstore.NewMirror(s.store, server.URL, nil)
+	report, err := mirror.Run()
+	c.Assert(err, gc.ErrorMatches, `cannot download charm cs:precise/dummy-1: archive has SHA256 [0-9a-f]+, expected [0-9a-f]+`)
+	c.Assert(report.Mirrored, gc.DeepEquals, []string{"cs:precise/dummy-0"})
+	_, err = s.store.CharmInfo(charm.MustParseURL("cs:precise/dummy-1"))
+	c.Assert(err, gc.Equals, charmstore.ErrNotFound)
+
+	// The next run resumes from the charm that failed.
+	corrupt = false
+	report, err = mirror.Run()
+	c.Assert(err, gc.IsNil)
+	c.Assert(report.Mirrored, gc.DeepEquals, []string{"cs:precise/dummy-1"})
+}
+
+func (s *TrivialSuite) TestMirrorSelectionMatch(c *gc.C) {
+	tests := []struct {
+		sel   charmstore.MirrorSelection
+		url   string
+		match bool
+	}{
+		{charmstore.MirrorSelection{}, "cs:~joe/precise/foo", true},
+		{charmstore.MirrorSelection{Users: []string{"joe"}}, "cs:~joe/precise/foo", true},
+		{charmstore.MirrorSelection{Users: []string{"joe"}}, "cs:precise/foo", false},
+		{charmstore.MirrorSelection{Users: []string{""}}, "cs:precise/foo", true},
+		{charmstore.MirrorSelection{Series: []string{"trusty"}}, "cs:~joe/precise/foo", false},
+		{charmstore.MirrorSelection{Users: []string{"joe"}, Series: []string{"precise"}}, "cs:~joe/precise/foo", true},
+		{charmstore.MirrorSelection{URLs: []*charm.URL{charm.MustParseURL("cs:precise/foo")}}, "cs:precise/foo", true},
+		{charmstore.MirrorSelection{URLs: []*charm.URL{charm.MustParseURL("cs:precise/foo")}}, "cs:precise/bar", false},
+		{charmstore.MirrorSelection{
+			Series: []string{"trusty"},
+			URLs:   []*charm.URL{charm.MustParseURL("cs:precise/foo")},
+		}, "cs:trusty/bar", true},
+	}
+	for i, t := range tests {
+		c.Logf("test %d: %s", i, t.url)
+		c.Assert(t.sel.Match(charm.MustParseURL(t.url)), gc.Equals, t.match)
+	}
+}
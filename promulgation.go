@@ -0,0 +1,234 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/juju/charm"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+// promulgationDoc represents the document stored in MongoDB recording
+// the user namespace backing an unqualified charm name.
+type promulgationDoc struct {
+	Name string
+	User string
+	Time time.Time
+}
+
+// Promulgate makes the charms at ref, which must be in a user namespace,
+// also available at the corresponding unqualified URLs, so that
+// cs:~user/trusty/foo can be retrieved as cs:trusty/foo. A name can be
+// backed by a single user namespace at a time: promulgating a charm
+// replaces any previous promulgation of the same name. If a signing
+// key is set, the charm revisions are signed for the unqualified URLs.
+func (s *Store) Promulgate(ref charm.Reference, origin Origin) error {
+	if ref.User == "" {
+		return fmt.Errorf("cannot promulgate charm %s: not in a user namespace", ref)
+	}
+	if ref.Revision != -1 {
+		return fmt.Errorf("Promulgate: got charm reference with revision: %s", ref)
+	}
+	urls, err := s.promulgationURLs(ref)
+	if err != nil {
+		return err
+	}
+	session := s.session.Copy()
+	defer session.Close()
+
+	previous, err := s.PromulgatedUser(ref.Name)
+	if err != nil && err != ErrNotFound {
+		return err
+	}
+
+	logger.Infof("promulgating charm %s", ref)
+	doc := promulgationDoc{
+		Name: ref.Name,
+		User: ref.User,
+		Time: time.Now(),
+	}
+	if _, err := session.Promulgations().Upsert(bson.D{{"name", ref.Name}}, &doc); err != nil {
+		return err
+	}
+	if previous != "" && previous != ref.User {
+		// The charms backing the name until now are
+		// no longer verifiable at the unqualified URLs.
+		pref := ref
+		pref.User = previous
+		purls, err := s.promulgationURLs(pref)
+		if err != nil && err != ErrNotFound {
+			return err
+		}
+		if err := unsignPromulgated(session, purls); err != nil {
+			return err
+		}
+	}
+	if err := s.signPromulgated(session, urls); err != nil {
+		return err
+	}
+	return s.LogCharmEvent(&CharmEvent{
+		Kind:   EventPromulgated,
+		URLs:   urls,
+		Time:   doc.Time,
+		Actor:  origin.Actor,
+		Reason: origin.Reason,
+	})
+}
+
+// Unpromulgate removes the promulgation of the charms at ref, so that
+// the corresponding unqualified URLs are no longer resolved through
+// the user namespace. ErrNotFound is returned if ref is not the
+// currently promulgated charm for its name.
+func (s *Store) Unpromulgate(ref charm.Reference, origin Origin) error {
+	if ref.Revision != -1 {
+		return fmt.Errorf("Unpromulgate: got charm reference with revision: %s", ref)
+	}
+	session := s.session.Copy()
+	defer session.Close()
+
+	logger.Infof("unpromulgating charm %s", ref)
+	err := session.Promulgations().Remove(bson.D{{"name", ref.Name}, {"user", ref.User}})
+	if err == mgo.ErrNotFound {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	urls, err := s.promulgationURLs(ref)
+	if err == ErrNotFound {
+		// The charm was removed from the store after
+		// being promulgated: there is nothing to log.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := unsignPromulgated(session, urls); err != nil {
+		return err
+	}
+	return s.LogCharmEvent(&CharmEvent{
+		Kind:   EventUnpromulgated,
+		URLs:   urls,
+		Actor:  origin.Actor,
+		Reason: origin.Reason,
+	})
+}
+
+// PromulgatedUser returns the user namespace backing the
+// unqualified charm name, or ErrNotFound if the name
+// is not promulgated.
+func (s *Store) PromulgatedUser(name string) (string, error) {
+	session := s.session.Copy()
+	defer session.Close()
+
+	var doc promulgationDoc
+	err := session.Promulgations().Find(bson.D{{"name", name}}).One(&doc)
+	if err == mgo.ErrNotFound {
+		return "", ErrNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	return doc.User, nil
+}
+
+// promulgationURLs returns the URLs affected by the promulgation of
+// ref: both the user and the unqualified URLs for each series the
+// charm is available in. ErrNotFound is returned if the charm
+// is not in the store.
+func (s *Store) promulgationURLs(ref charm.Reference) ([]*charm.URL, error) {
+	series, err := s.Series(ref)
+	if err != nil {
+		return nil, err
+	}
+	if len(series) == 0 {
+		return nil, ErrNotFound
+	}
+	official := ref
+	official.User = ""
+	var urls []*charm.URL
+	for _, series := range series {
+		urls = append(urls,
+			&charm.URL{Reference: ref, Series: series},
+			&charm.URL{Reference: official, Series: series},
+		)
+	}
+	return urls, nil
+}
+
+// promulgatedURL returns the user URL backing url if url is
+// unqualified and its name is promulgated. Otherwise it returns nil.
+func (s *Store) promulgatedURL(url *charm.URL) (*charm.URL, error) {
+	if url.User != "" || url.Schema != "cs" {
+		return nil, nil
+	}
+	user, err := s.PromulgatedUser(url.Name)
+	if err == ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	purl := *url
+	purl.User = user
+	return &purl, nil
+}
+
+// signPromulgated adds to the signed charm revisions at the user URLs
+// in urls, as returned by promulgationURLs, their signatures for the
+// following unqualified URLs, unless they have them already. Nothing
+// is done if no signing key is set.
+func (s *Store) signPromulgated(session *storeSession, urls []*charm.URL) error {
+	if !s.signing() {
+		return nil
+	}
+	charms := session.Charms()
+	for i := 0; i < len(urls); i += 2 {
+		url, official := urls[i], urls[i+1]
+		var cdocs []charmDoc
+		// Revisions published before the signing key was
+		// set are left unsigned.
+		query := bson.D{
+			{"urls", url.String()},
+			{"signatures.url", bson.D{
+				{"$in", []string{url.String()}},
+				{"$nin", []string{official.String()}},
+			}},
+		}
+		if err := charms.Find(query).All(&cdocs); err != nil {
+			return err
+		}
+		for _, cdoc := range cdocs {
+			sigs := s.signCharm([]*charm.URL{official}, cdoc.Revision, cdoc.Sha256)
+			err := charms.Update(
+				bson.D{{"urls", url.String()}, {"revision", cdoc.Revision}},
+				bson.D{{"$push", bson.D{{"signatures", sigs[0]}}}},
+			)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// unsignPromulgated removes from the charm revisions at the user URLs
+// in urls, as returned by promulgationURLs, their signatures for the
+// following unqualified URLs.
+func unsignPromulgated(session *storeSession, urls []*charm.URL) error {
+	for i := 0; i < len(urls); i += 2 {
+		url, official := urls[i], urls[i+1]
+		_, err := session.Charms().UpdateAll(
+			bson.D{{"urls", url.String()}},
+			bson.D{{"$pull", bson.D{{"signatures", bson.D{{"url", official.String()}}}}}},
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
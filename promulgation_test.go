@@ -0,0 +1,110 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore_test
+
+import (
+	"io/ioutil"
+
+	"github.com/juju/charm"
+	gc "launchpad.net/gocheck"
+
+	"github.com/juju/charmstore"
+)
+
+func mustParseReference(c *gc.C, url string) charm.Reference {
+	ref, series, err := charm.ParseReference(url)
+	c.Assert(err, gc.IsNil)
+	c.Assert(series, gc.Equals, "")
+	return ref
+}
+
+func (s *StoreSuite) TestPromulgate(c *gc.C) {
+	s.publishMeta(c, "cs:~joe/trusty/mysql", "joe-0", relationMeta("mysql", nil, nil))
+	s.publishMeta(c, "cs:~joe/precise/mysql", "joe-0", relationMeta("mysql", nil, nil))
+	s.publishMeta(c, "cs:~bob/trusty/mysql", "bob-0", relationMeta("mysql", nil, nil))
+	s.publishMeta(c, "cs:~bob/trusty/mysql", "bob-1", relationMeta("mysql", nil, nil))
+	curl := charm.MustParseURL("cs:trusty/mysql")
+	ref := mustParseReference(c, "cs:mysql")
+
+	_, err := s.store.CharmInfo(curl)
+	c.Assert(err, gc.Equals, charmstore.ErrNotFound)
+	_, err = s.store.PromulgatedUser("mysql")
+	c.Assert(err, gc.Equals, charmstore.ErrNotFound)
+
+	err = s.store.Promulgate(mustParseReference(c, "cs:~joe/mysql"), charmstore.Origin{})
+	c.Assert(err, gc.IsNil)
+	user, err := s.store.PromulgatedUser("mysql")
+	c.Assert(err, gc.IsNil)
+	c.Assert(user, gc.Equals, "joe")
+
+	info, err := s.store.CharmInfo(curl)
+	c.Assert(err, gc.IsNil)
+	c.Assert(info.Digest(), gc.Equals, "joe-0")
+	info, rc, err := s.store.OpenCharm(curl.WithRevision(0))
+	c.Assert(err, gc.IsNil)
+	data, err := ioutil.ReadAll(rc)
+	c.Check(err, gc.IsNil)
+	rc.Close()
+	c.Assert(info.Digest(), gc.Equals, "joe-0")
+	c.Assert(string(data), gc.Equals, "charm-revision-0")
+	series, err := s.store.Series(ref)
+	c.Assert(err, gc.IsNil)
+	c.Assert(series, gc.DeepEquals, []string{"trusty", "precise"})
+
+	event, err := s.store.CharmEvent(curl, "")
+	c.Assert(err, gc.IsNil)
+	c.Assert(event.Kind, gc.Equals, charmstore.EventPromulgated)
+	c.Assert(urlStrings(event.URLs), gc.DeepEquals, []string{
+		"cs:~joe/trusty/mysql", "cs:trusty/mysql",
+		"cs:~joe/precise/mysql", "cs:precise/mysql",
+	})
+
+	// Promulgating another user's charm replaces the previous one.
+	err = s.store.Promulgate(mustParseReference(c, "cs:~bob/mysql"), charmstore.Origin{})
+	c.Assert(err, gc.IsNil)
+	info, err = s.store.CharmInfo(curl)
+	c.Assert(err, gc.IsNil)
+	c.Assert(info.Digest(), gc.Equals, "bob-1")
+	series, err = s.store.Series(ref)
+	c.Assert(err, gc.IsNil)
+	c.Assert(series, gc.DeepEquals, []string{"trusty"})
+
+	// Only the currently promulgated charm can be unpromulgated.
+	err = s.store.Unpromulgate(mustParseReference(c, "cs:~joe/mysql"), charmstore.Origin{})
+	c.Assert(err, gc.Equals, charmstore.ErrNotFound)
+	err = s.store.Unpromulgate(mustParseReference(c, "cs:~bob/mysql"), charmstore.Origin{})
+	c.Assert(err, gc.IsNil)
+	_, err = s.store.CharmInfo(curl)
+	c.Assert(err, gc.Equals, charmstore.ErrNotFound)
+	event, err = s.store.CharmEvent(curl, "")
+	c.Assert(err, gc.IsNil)
+	c.Assert(event.Kind, gc.Equals, charmstore.EventUnpromulgated)
+}
+
+func (s *StoreSuite) TestPromulgatePrefersUserCharm(c *gc.C) {
+	s.publishMeta(c, "cs:trusty/mysql", "official-0", relationMeta("mysql", nil, nil))
+	s.publishMeta(c, "cs:precise/mysql", "official-0", relationMeta("mysql", nil, nil))
+	s.publishMeta(c, "cs:~joe/trusty/mysql", "joe-0", relationMeta("mysql", nil, nil))
+	err := s.store.Promulgate(mustParseReference(c, "cs:~joe/mysql"), charmstore.Origin{})
+	c.Assert(err, gc.IsNil)
+
+	info, err := s.store.CharmInfo(charm.MustParseURL("cs:trusty/mysql"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(info.Digest(), gc.Equals, "joe-0")
+
+	// Series not available in the user namespace are still
+	// resolved to the unqualified charms.
+	info, err = s.store.CharmInfo(charm.MustParseURL("cs:precise/mysql"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(info.Digest(), gc.Equals, "official-0")
+}
+
+func (s *StoreSuite) TestPromulgateErrors(c *gc.C) {
+	err := s.store.Promulgate(mustParseReference(c, "cs:mysql"), charmstore.Origin{})
+	c.Assert(err, gc.ErrorMatches, "cannot promulgate charm cs:mysql: not in a user namespace")
+	err = s.store.Promulgate(mustParseReference(c, "cs:~joe/mysql"), charmstore.Origin{})
+	c.Assert(err, gc.Equals, charmstore.ErrNotFound)
+	err = s.store.Unpromulgate(mustParseReference(c, "cs:~joe/mysql"), charmstore.Origin{})
+	c.Assert(err, gc.Equals, charmstore.ErrNotFound)
+}
@@ -0,0 +1,292 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimit holds the limit on the rate of requests of a class
+// accepted from each client, enforced with a token bucket: each
+// request takes a token from a bucket holding up to Burst tokens,
+// which is refilled at Rate tokens per second.
+type RateLimit struct {
+	// Rate holds the number of requests per second accepted on
+	// average. A zero rate means no limit.
+	Rate float64 `yaml:"rate"`
+
+	// Burst holds the number of requests accepted in a row once
+	// the bucket is full. It defaults to the rate, rounded up.
+	Burst int `yaml:"burst"`
+
+	// Uncounted specifies that requests over the limit are served
+	// but excluded from the statistics, as if made with stats=0,
+	// instead of being rejected.
+	Uncounted bool `yaml:"uncounted"`
+}
+
+// RateLimits holds the limits on the rate of requests accepted by
+// the server from each client IP address, for each class of requests.
+type RateLimits struct {
+	// Download limits the requests for charm and bundle archives.
+	Download RateLimit `yaml:"download"`
+
+	// Stats limits the requests to the /stats/counter/ API.
+	Stats RateLimit `yaml:"stats"`
+
+	// API limits all other requests.
+	API RateLimit `yaml:"api"`
+
+	// Allow holds the addresses, or CIDR networks such as
+	// 10.0.0.0/8, of the clients whose requests are not limited.
+	Allow []string `yaml:"allow"`
+
+	// TrustedProxies holds the addresses, or CIDR networks, of the
+	// proxies trusted to report the address of the clients they
+	// forward requests for in the X-Forwarded-For header.
+	TrustedProxies []string `yaml:"trusted-proxies"`
+}
+
+// requestClass identifies a class of requests limited together.
+type requestClass int
+
+const (
+	apiRequest requestClass = iota
+	downloadRequest
+	statsRequest
+	numRequestClasses
+)
+
+// classifyRequest returns the class of the request r.
+func classifyRequest(r *http.Request) requestClass {
+	switch path := r.URL.Path; {
+	case strings.HasPrefix(path, "/charm/"), strings.HasPrefix(path, "/bundle/"):
+		return downloadRequest
+	case strings.HasPrefix(path, "/stats/counter/"):
+		return statsRequest
+	}
+	return apiRequest
+}
+
+// rateLimitNow returns the current time, as seen by rate limiters.
+var rateLimitNow = time.Now
+
+// rateLimitPurgeInterval holds the interval between purges of the
+// buckets of the clients that haven't made requests recently.
+const rateLimitPurgeInterval = time.Minute
+
+// RateLimiter limits the rate of requests accepted from each client.
+// It is safe to use concurrently.
+type RateLimiter struct {
+	limits         [numRequestClasses]RateLimit
+	allow          []*net.IPNet
+	trustedProxies []*net.IPNet
+
+	mu        sync.Mutex
+	buckets   map[bucketKey]*tokenBucket
+	lastPurge time.Time
+}
+
+// bucketKey identifies the token bucket of a client
+// for a class of requests.
+type bucketKey struct {
+	class  requestClass
+	client string
+}
+
+// tokenBucket holds the tokens available to a client
+// at the time of its last request.
+type tokenBucket struct {
+	tokens float64
+	time   time.Time
+}
+
+// NewRateLimiter returns a rate limiter enforcing the given limits.
+func NewRateLimiter(limits *RateLimits) (*RateLimiter, error) {
+	l := &RateLimiter{
+		buckets:   make(map[bucketKey]*tokenBucket),
+		lastPurge: rateLimitNow(),
+	}
+	for class, limit := range map[requestClass]RateLimit{
+		apiRequest:      limits.API,
+		downloadRequest: limits.Download,
+		statsRequest:    limits.Stats,
+	} {
+		if limit.Rate < 0 || limit.Burst < 0 {
+			return nil, fmt.Errorf("negative rate limit %v/%d", limit.Rate, limit.Burst)
+		}
+		if limit.Rate > 0 && limit.Burst == 0 {
+			limit.Burst = int(math.Ceil(limit.Rate))
+		}
+		l.limits[class] = limit
+	}
+	var err error
+	if l.allow, err = parseNetworks(limits.Allow); err != nil {
+		return nil, err
+	}
+	if l.trustedProxies, err = parseNetworks(limits.TrustedProxies); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// parseNetworks parses addresses and CIDR networks.
+func parseNetworks(addrs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, addr := range addrs {
+		if !strings.Contains(addr, "/") {
+			ip := net.ParseIP(addr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", addr)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q", addr)
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets, nil
+}
+
+// containsIP reports whether ip is in any of nets.
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, ipnet := range nets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the client making the request r,
+// or nil if it is unknown. The address reported by trusted proxies
+// is used for the requests they forward.
+func (l *RateLimiter) clientIP(r *http.Request) net.IP {
+	return clientIP(r, l.trustedProxies)
+}
+
+// clientIP returns the address of the client making the request r, or
+// nil if it is unknown. The address reported in the X-Forwarded-For
+// header is used for the requests forwarded by the given proxies.
+func clientIP(r *http.Request, trustedProxies []*net.IPNet) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !containsIP(trustedProxies, ip) {
+		return ip
+	}
+	// Each proxy appends the address of the host it received the
+	// request from, so the last untrusted address is the client's.
+	forwarded := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		fip := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if fip == nil {
+			break
+		}
+		ip = fip
+		if !containsIP(trustedProxies, ip) {
+			break
+		}
+	}
+	return ip
+}
+
+// limit reports whether the request r exceeds its rate limit, along
+// with the limit and the time to wait before the client can make a
+// request of the same class again.
+func (l *RateLimiter) limit(r *http.Request) (bool, RateLimit, time.Duration) {
+	class := classifyRequest(r)
+	limit := l.limits[class]
+	if limit.Rate == 0 {
+		return false, limit, 0
+	}
+	ip := l.clientIP(r)
+	if ip != nil && containsIP(l.allow, ip) {
+		return false, limit, 0
+	}
+	// Clients whose address can't be parsed are told
+	// apart by their raw address rather than sharing
+	// a single bucket.
+	client := r.RemoteAddr
+	if ip != nil {
+		client = ip.String()
+	}
+	now := rateLimitNow()
+	key := bucketKey{class, client}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.lastPurge) >= rateLimitPurgeInterval {
+		l.purge(now)
+	}
+	b := l.buckets[key]
+	if b == nil {
+		b = &tokenBucket{tokens: float64(limit.Burst), time: now}
+		l.buckets[key] = b
+	}
+	b.refill(limit, now)
+	if b.tokens >= 1 {
+		b.tokens--
+		return false, limit, 0
+	}
+	wait := time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second))
+	return true, limit, wait
+}
+
+// refill adds the tokens earned since the last request of the client.
+func (b *tokenBucket) refill(limit RateLimit, now time.Time) {
+	if elapsed := now.Sub(b.time); elapsed > 0 {
+		b.tokens = math.Min(b.tokens+elapsed.Seconds()*limit.Rate, float64(limit.Burst))
+	}
+	b.time = now
+}
+
+// purge removes the buckets that are full again, which
+// are equivalent to the buckets of new clients.
+// It must be called with l.mu held.
+func (l *RateLimiter) purge(now time.Time) {
+	for key, b := range l.buckets {
+		limit := l.limits[key.class]
+		b.refill(limit, now)
+		if b.tokens >= float64(limit.Burst) {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastPurge = now
+}
+
+// Limit enforces the rate limit of the request r. It replies with
+// a 429 Too Many Requests error and returns false if the request
+// must be rejected. Requests over a limit that leaves them uncounted
+// are marked with stats=0 and accepted.
+func (l *RateLimiter) Limit(w http.ResponseWriter, r *http.Request) bool {
+	exceeded, limit, wait := l.limit(r)
+	if !exceeded {
+		return true
+	}
+	if limit.Uncounted {
+		r.ParseForm()
+		r.Form.Set("stats", "0")
+		return true
+	}
+	logger.Debugf("rate limit exceeded by %s for %s", r.RemoteAddr, r.URL.Path)
+	w.Header().Set("Retry-After", fmt.Sprint(int(math.Ceil(wait.Seconds()))))
+	http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+	return false
+}
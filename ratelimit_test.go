@@ -0,0 +1,220 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/juju/charm"
+	gc "launchpad.net/gocheck"
+
+	"github.com/juju/charmstore"
+)
+
+// fakeRateLimitClock freezes the time seen by rate limiters. It returns
+// a function advancing the time and a function restoring the clock.
+func fakeRateLimitClock() (advance func(time.Duration), restore func()) {
+	now := time.Date(2014, 5, 1, 12, 0, 0, 0, time.UTC)
+	old := *charmstore.RateLimitNow
+	*charmstore.RateLimitNow = func() time.Time { return now }
+	return func(d time.Duration) { now = now.Add(d) }, func() { *charmstore.RateLimitNow = old }
+}
+
+// prepareRateLimitedServer returns a server enforcing the given rate
+// limits, serving a charm published in a MemStore.
+func prepareRateLimitedServer(c *gc.C, limits *charmstore.RateLimits) (*charmstore.Server, *charmstore.MemStore) {
+	store := charmstore.NewMemStore()
+	pub, err := store.CharmPublisher([]*charm.URL{charm.MustParseURL("cs:precise/wordpress")}, "some-digest")
+	c.Assert(err, gc.IsNil)
+	err = pub.Publish(&FakeCharmDir{})
+	c.Assert(err, gc.IsNil)
+
+	server, err := charmstore.NewServer(store)
+	c.Assert(err, gc.IsNil)
+	limiter, err := charmstore.NewRateLimiter(limits)
+	c.Assert(err, gc.IsNil)
+	server.SetRateLimiter(limiter)
+	return server, store
+}
+
+// serveFrom serves a GET request for path made from the
+// given remote address, with the given X-Forwarded-For header.
+func serveFrom(c *gc.C, server *charmstore.Server, path, remoteAddr, forwardedFor string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest("GET", path, nil)
+	c.Assert(err, gc.IsNil)
+	req.RemoteAddr = remoteAddr
+	if forwardedFor != "" {
+		req.Header.Set("X-Forwarded-For", forwardedFor)
+	}
+	rec := httptest.NewRecorder()
+	server.ServeHTTP(rec, req)
+	return rec
+}
+
+func (s *TrivialSuite) TestRateLimits(c *gc.C) {
+	advance, restore := fakeRateLimitClock()
+	defer restore()
+	server, _ := prepareRateLimitedServer(c, &charmstore.RateLimits{
+		Download: charmstore.RateLimit{Rate: 1, Burst: 2},
+		Stats:    charmstore.RateLimit{Rate: 0.25},
+	})
+	const download = "/charm/precise/wordpress?stats=0"
+	const stats = "/stats/counter/charm-bundle:*"
+
+	// The burst of requests is accepted, then the
+	// client has to wait for the bucket to refill.
+	for i := 0; i < 2; i++ {
+		rec := serveFrom(c, server, download, "1.2.3.4:1234", "")
+		c.Assert(rec.Code, gc.Equals, http.StatusOK)
+	}
+	rec := serveFrom(c, server, download, "1.2.3.4:1234", "")
+	c.Assert(rec.Code, gc.Equals, http.StatusTooManyRequests)
+	c.Assert(rec.Header().Get("Retry-After"), gc.Equals, "1")
+	c.Assert(rec.Body.String(), gc.Equals, "rate limit exceeded\n")
+
+	// Other clients and classes of requests are limited separately,
+	// and requests of classes without limits are always accepted.
+	rec = serveFrom(c, server, download, "1.2.3.5:1234", "")
+	c.Assert(rec.Code, gc.Equals, http.StatusOK)
+	rec = serveFrom(c, server, stats, "1.2.3.4:1234", "")
+	c.Assert(rec.Code, gc.Equals, http.StatusOK)
+	for i := 0; i < 10; i++ {
+		rec = serveFrom(c, server, "/charm-info?charms=cs:precise/wordpress&stats=0", "1.2.3.4:1234", "")
+		c.Assert(rec.Code, gc.Equals, http.StatusOK)
+	}
+
+	// The burst defaults to the rate rounded up.
+	rec = serveFrom(c, server, stats, "1.2.3.4:1234", "")
+	c.Assert(rec.Code, gc.Equals, http.StatusTooManyRequests)
+	c.Assert(rec.Header().Get("Retry-After"), gc.Equals, "4")
+
+	advance(1500 * time.Millisecond)
+	rec = serveFrom(c, server, download, "1.2.3.4:1234", "")
+	c.Assert(rec.Code, gc.Equals, http.StatusOK)
+	rec = serveFrom(c, server, download, "1.2.3.4:1234", "")
+	c.Assert(rec.Code, gc.Equals, http.StatusTooManyRequests)
+	rec = serveFrom(c, server, stats, "1.2.3.4:1234", "")
+	c.Assert(rec.Header().Get("Retry-After"), gc.Equals, "3")
+
+	// The buckets of idle clients are purged, which doesn't
+	// change the requests accepted from them.
+	advance(time.Hour)
+	for i := 0; i < 2; i++ {
+		rec := serveFrom(c, server, download, "1.2.3.4:1234", "")
+		c.Assert(rec.Code, gc.Equals, http.StatusOK)
+	}
+	rec = serveFrom(c, server, download, "1.2.3.4:1234", "")
+	c.Assert(rec.Code, gc.Equals, http.StatusTooManyRequests)
+}
+
+func (s *TrivialSuite) TestRateLimitUnparsedAddress(c *gc.C) {
+	_, restore := fakeRateLimitClock()
+	defer restore()
+	server, _ := prepareRateLimitedServer(c, &charmstore.RateLimits{
+		Download: charmstore.RateLimit{Rate: 1, Burst: 1},
+	})
+	const download = "/charm/precise/wordpress?stats=0"
+
+	// Clients whose address can't be parsed
+	// don't share their rate limit.
+	rec := serveFrom(c, server, download, "@unix-a", "")
+	c.Assert(rec.Code, gc.Equals, http.StatusOK)
+	rec = serveFrom(c, server, download, "@unix-a", "")
+	c.Assert(rec.Code, gc.Equals, http.StatusTooManyRequests)
+	rec = serveFrom(c, server, download, "@unix-b", "")
+	c.Assert(rec.Code, gc.Equals, http.StatusOK)
+}
+
+func (s *TrivialSuite) TestRateLimitAllowAndProxies(c *gc.C) {
+	_, restore := fakeRateLimitClock()
+	defer restore()
+	server, _ := prepareRateLimitedServer(c, &charmstore.RateLimits{
+		API:            charmstore.RateLimit{Rate: 1},
+		Allow:          []string{"10.0.0.0/8", "2001:db8::1"},
+		TrustedProxies: []string{"127.0.0.1", "192.168.0.0/16"},
+	})
+	tests := []struct {
+		about        string
+		remoteAddr   string
+		forwardedFor string
+		limited      bool
+	}{{
+		about:      "allowed IPv4 network",
+		remoteAddr: "10.1.2.3:1234",
+	}, {
+		about:      "allowed IPv6 address",
+		remoteAddr: "[2001:db8::1]:1234",
+	}, {
+		about:      "other IPv6 address",
+		remoteAddr: "[2001:db8::2]:1234",
+		limited:    true,
+	}, {
+		about:        "allowed client behind trusted proxies",
+		remoteAddr:   "127.0.0.1:1234",
+		forwardedFor: "1.2.3.4, 10.1.2.3, 192.168.1.1",
+	}, {
+		about:        "client behind trusted proxy",
+		remoteAddr:   "127.0.0.1:1234",
+		forwardedFor: "1.2.3.4",
+		limited:      true,
+	}, {
+		about:        "forwarded address from an untrusted host",
+		remoteAddr:   "1.2.3.5:1234",
+		forwardedFor: "10.1.2.3",
+		limited:      true,
+	}}
+	for i, test := range tests {
+		c.Logf("test %d: %s", i, test.about)
+		for j := 0; j < 3; j++ {
+			rec := serveFrom(c, server, "/charm-info?stats=0", test.remoteAddr, test.forwardedFor)
+			if j > 0 && test.limited {
+				c.Assert(rec.Code, gc.Equals, http.StatusTooManyRequests)
+			} else {
+				c.Assert(rec.Code, gc.Equals, http.StatusOK)
+			}
+		}
+	}
+}
+
+func (s *TrivialSuite) TestRateLimitUncounted(c *gc.C) {
+	_, restore := fakeRateLimitClock()
+	defer restore()
+	server, store := prepareRateLimitedServer(c, &charmstore.RateLimits{
+		Download: charmstore.RateLimit{Rate: 1, Uncounted: true},
+	})
+
+	// Requests over the limit are served without being counted.
+	for i := 0; i < 3; i++ {
+		rec := serveFrom(c, server, "/charm/precise/wordpress", "1.2.3.4:1234", "")
+		c.Assert(rec.Code, gc.Equals, http.StatusOK)
+		c.Assert(rec.Body.String(), gc.Equals, "charm-revision-0")
+	}
+	checkMemCounter(c, store, []string{"charm-bundle", "precise", "wordpress"}, 1)
+}
+
+func (s *TrivialSuite) TestNewRateLimiterErrors(c *gc.C) {
+	tests := []struct {
+		limits charmstore.RateLimits
+		err    string
+	}{{
+		limits: charmstore.RateLimits{Stats: charmstore.RateLimit{Rate: -1}},
+		err:    `negative rate limit -1/0`,
+	}, {
+		limits: charmstore.RateLimits{API: charmstore.RateLimit{Rate: 1, Burst: -2}},
+		err:    `negative rate limit 1/-2`,
+	}, {
+		limits: charmstore.RateLimits{Allow: []string{"10.0.0.0/33"}},
+		err:    `invalid network "10.0.0.0/33"`,
+	}, {
+		limits: charmstore.RateLimits{TrustedProxies: []string{"localhost"}},
+		err:    `invalid address "localhost"`,
+	}}
+	for i, test := range tests {
+		c.Logf("test %d", i)
+		_, err := charmstore.NewRateLimiter(&test.limits)
+		c.Assert(err, gc.ErrorMatches, test.err)
+	}
+}
@@ -4,7 +4,10 @@
 package charmstore
 
 import (
+	"crypto/ed25519"
+	"encoding/base64"
 	"encoding/json"
+	"encoding/xml"
 	"fmt"
 	"io"
 	"net/http"
@@ -13,6 +16,9 @@ import (
 	"time"
 
 	"github.com/juju/charm"
+	"labix.org/v2/mgo/bson"
+
+	"github.com/juju/charmstore/csclient"
 )
 
 const DefaultSeries = "precise"
@@ -20,12 +26,17 @@ const DefaultSeries = "precise"
 // Server is an http.Handler that serves the HTTP API of juju
 // so that juju clients can retrieve published charms.
 type Server struct {
-	store *Store
-	mux   *http.ServeMux
+	store          StoreReader
+	mux            *http.ServeMux
+	defaultChannel Channel
+	publicKey      ed25519.PublicKey
+	rateLimiter    *RateLimiter
+	uniqueWindow   time.Duration
 }
 
-// NewServer returns a new *Server using store.
-func NewServer(store *Store) (*Server, error) {
+// NewServer returns a new *Server using store, which is usually
+// a *Store, or a *StaticStore to serve a static charm directory.
+func NewServer(store StoreReader) (*Server, error) {
 	s := &Server{
 		store: store,
 		mux:   http.NewServeMux(),
@@ -39,9 +50,27 @@ func NewServer(store *Store) (*Server, error) {
 	s.mux.HandleFunc("/charm/", func(w http.ResponseWriter, r *http.Request) {
 		s.serveCharm(w, r)
 	})
+	s.mux.HandleFunc("/bundle-info", func(w http.ResponseWriter, r *http.Request) {
+		s.serveBundleInfo(w, r)
+	})
+	s.mux.HandleFunc("/bundle/", func(w http.ResponseWriter, r *http.Request) {
+		s.serveBundle(w, r)
+	})
+	s.mux.HandleFunc("/charm-interface", func(w http.ResponseWriter, r *http.Request) {
+		s.serveInterface(w, r)
+	})
+	s.mux.HandleFunc("/charm-related", func(w http.ResponseWriter, r *http.Request) {
+		s.serveRelated(w, r)
+	})
+	s.mux.HandleFunc("/changes", func(w http.ResponseWriter, r *http.Request) {
+		s.serveChanges(w, r)
+	})
 	s.mux.HandleFunc("/stats/counter/", func(w http.ResponseWriter, r *http.Request) {
 		s.serveStats(w, r)
 	})
+	s.mux.HandleFunc("/signing-key", func(w http.ResponseWriter, r *http.Request) {
+		s.serveSigningKey(w, r)
+	})
 
 	// This is just a validation key to allow blitz.io to run
 	// performance tests against the site.
@@ -51,9 +80,33 @@ func NewServer(store *Store) (*Server, error) {
 	return s, nil
 }
 
+// SetDefaultChannel sets the channel used to resolve charm URLs without
+// a revision when the request doesn't specify one. By default, and for
+// URLs with no revision released in the channel, such URLs resolve to
+// the latest revision.
+func (s *Server) SetDefaultChannel(channel Channel) {
+	s.defaultChannel = channel
+}
+
+// SetPublicKey sets the public key served by the /signing-key API,
+// which clients verify the signatures of charms against. It should
+// match the key the store signs charms with.
+func (s *Server) SetPublicKey(key ed25519.PublicKey) {
+	s.publicKey = key
+}
+
+// SetRateLimiter sets the rate limiter enforcing the limits on the
+// requests accepted from each client. By default there are no limits.
+func (s *Server) SetRateLimiter(l *RateLimiter) {
+	s.rateLimiter = l
+}
+
 // ServeHTTP serves an http request.
 // This method turns *Server into an http.Handler.
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.rateLimiter != nil && !s.rateLimiter.Limit(w, r) {
+		return
+	}
 	if r.URL.Path == "/" {
 		http.Redirect(w, r, "https://juju.ubuntu.com", http.StatusSeeOther)
 		return
@@ -93,20 +146,67 @@ func (s *Server) resolveURL(url string) (*charm.URL, error) {
 	return &charm.URL{Reference: ref, Series: series}, nil
 }
 
+// resolveBundleURL parses the given bundle URL. Bundle URLs
+// without a series are assumed to be in BundleSeries.
+func resolveBundleURL(url string) (*charm.URL, error) {
+	ref, series, err := charm.ParseReference(url)
+	if err != nil {
+		return nil, err
+	}
+	if series == "" {
+		series = BundleSeries
+	}
+	return &charm.URL{Reference: ref, Series: series}, nil
+}
+
+// channelURL returns curl with its revision set to the one released
+// in the channel requested by r, or in the server default channel.
+// URLs with a revision and URLs requested in the edge channel
+// are returned unchanged, as are URLs with no revision released
+// in the default channel, so that charms which were never released
+// remain available at their latest revision.
+func (s *Server) channelURL(curl *charm.URL, r *http.Request) (*charm.URL, error) {
+	if curl.Revision != -1 {
+		return curl, nil
+	}
+	channel := s.defaultChannel
+	requested := r.Form.Get("channel")
+	if requested != "" {
+		var err error
+		if channel, err = ParseChannel(requested); err != nil {
+			return nil, err
+		}
+	}
+	if channel == "" || channel == EdgeChannel {
+		return curl, nil
+	}
+	rev, err := s.store.ChannelRevision(curl, channel)
+	if err == ErrNotFound && requested == "" {
+		return curl, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return curl.WithRevision(rev), nil
+}
+
 func (s *Server) serveInfo(w http.ResponseWriter, r *http.Request) {
 	if r.URL.Path != "/charm-info" {
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
 	r.ParseForm()
-	response := map[string]*charm.InfoResponse{}
+	response := map[string]*csclient.InfoResponse{}
 	for _, url := range r.Form["charms"] {
-		c := &charm.InfoResponse{}
+		c := &csclient.InfoResponse{}
 		response[url] = c
 		curl, err := s.resolveURL(url)
 		var info *CharmInfo
 		if err == nil {
-			info, err = s.store.CharmInfo(curl)
+			var rurl *charm.URL
+			if rurl, err = s.channelURL(curl, r); err == nil {
+				info, err = s.store.CharmInfo(rurl)
+			}
 		}
 		var skey []string
 		if err == nil {
@@ -115,6 +215,9 @@ func (s *Server) serveInfo(w http.ResponseWriter, r *http.Request) {
 			c.Sha256 = info.BundleSha256()
 			c.Revision = info.Revision()
 			c.Digest = info.Digest()
+			if sig := info.Signature(curl); sig != nil {
+				c.Signature = base64.StdEncoding.EncodeToString(sig)
+			}
 		} else {
 			if err == ErrNotFound && curl != nil {
 				skey = charmStatsKey(curl, "charm-missing")
@@ -143,7 +246,7 @@ func (s *Server) serveEvent(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	r.ParseForm()
-	response := map[string]*charm.EventResponse{}
+	response := map[string]*csclient.EventResponse{}
 	for _, url := range r.Form["charms"] {
 		shortURL := url
 		digest := ""
@@ -151,7 +254,7 @@ func (s *Server) serveEvent(w http.ResponseWriter, r *http.Request) {
 			digest = url[i+1:]
 			shortURL = url[:i]
 		}
-		c := &charm.EventResponse{}
+		c := &csclient.EventResponse{}
 		// By default, shortURL is used as the key in the response data.
 		// This makes it impossible to return more than one event per charm.
 		// If the query parameter "long_keys=1" is set, use the parameter
@@ -175,6 +278,8 @@ func (s *Server) serveEvent(w http.ResponseWriter, r *http.Request) {
 			c.Errors = event.Errors
 			c.Warnings = event.Warnings
 			c.Time = event.Time.UTC().Format(time.RFC3339)
+			c.Actor = event.Actor
+			c.Reason = event.Reason
 		} else {
 			c.Errors = append(c.Errors, err.Error())
 		}
@@ -203,7 +308,18 @@ func (s *Server) serveCharm(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
-	info, rc, err := s.store.OpenCharm(curl)
+	r.ParseForm()
+	rurl, err := s.channelURL(curl, r)
+	if err == ErrNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	info, rc, err := s.store.OpenCharm(rurl)
 	if err == ErrNotFound {
 		w.WriteHeader(http.StatusNotFound)
 		return
@@ -214,18 +330,408 @@ func (s *Server) serveCharm(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	if statsEnabled(r) {
-		go s.store.IncCounter(charmStatsKey(curl, "charm-bundle"))
+		s.incCounters(r, charmStatsKey(curl, "charm-bundle"))
 	}
 	defer rc.Close()
 	w.Header().Set("Connection", "close") // No keep-alive for now.
 	w.Header().Set("Content-Type", "application/octet-stream")
 	w.Header().Set("Content-Length", strconv.FormatInt(info.BundleSize(), 10))
+	if sig := info.Signature(curl); sig != nil {
+		w.Header().Set("X-Charm-URL", curl.WithRevision(info.Revision()).String())
+		w.Header().Set("X-Charm-Signature", base64.StdEncoding.EncodeToString(sig))
+	}
 	_, err = io.Copy(w, rc)
 	if err != nil {
 		logger.Errorf("failed to stream charm %q: %v", curl, err)
 	}
 }
 
+func (s *Server) serveSigningKey(w http.ResponseWriter, r *http.Request) {
+	if s.publicKey == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	data, err := json.Marshal(&csclient.SigningKeyResponse{
+		Algorithm: csclient.SignatureAlgorithm,
+		PublicKey: base64.StdEncoding.EncodeToString(s.publicKey),
+	})
+	if err == nil {
+		w.Header().Set("Content-Type", "application/json")
+		_, err = w.Write(data)
+	}
+	if err != nil {
+		logger.Errorf("cannot write content: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+// InterfaceResponse holds the charms implementing an interface,
+// as returned by the /charm-interface API.
+type InterfaceResponse struct {
+	Provides []string `json:"provides,omitempty"`
+	Requires []string `json:"requires,omitempty"`
+}
+
+func (s *Server) serveInterface(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/charm-interface" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	r.ParseForm()
+	iface := r.Form.Get("interface")
+	if iface == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Missing 'interface' value"))
+		return
+	}
+	var roles []charm.RelationRole
+	switch v := r.Form.Get("role"); v {
+	case "":
+		roles = []charm.RelationRole{charm.RoleProvider, charm.RoleRequirer}
+	case "provides":
+		roles = []charm.RelationRole{charm.RoleProvider}
+	case "requires":
+		roles = []charm.RelationRole{charm.RoleRequirer}
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("Invalid 'role' value: %q", v)))
+		return
+	}
+	response := &InterfaceResponse{}
+	for _, role := range roles {
+		urls, err := s.store.InterfaceCharms(iface, role, r.Form.Get("series"))
+		if err != nil {
+			logger.Errorf("cannot query charms for interface %q: %v", iface, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		strs := make([]string, len(urls))
+		for i, url := range urls {
+			strs[i] = url.String()
+		}
+		if role == charm.RoleProvider {
+			response.Provides = strs
+		} else {
+			response.Requires = strs
+		}
+	}
+	sendJSON(w, response)
+}
+
+// RelatedResponse holds the charms that can be related to a charm,
+// as returned by the /charm-related API.
+type RelatedResponse struct {
+	CanonicalURL string         `json:"canonical-url,omitempty"`
+	Related      []RelatedEntry `json:"related,omitempty"`
+	Errors       []string       `json:"errors,omitempty"`
+}
+
+// RelatedEntry describes a single related charm in a RelatedResponse.
+type RelatedEntry struct {
+	Relation  string `json:"relation"`
+	Interface string `json:"interface"`
+	Role      string `json:"role"`
+	URL       string `json:"url"`
+}
+
+func (s *Server) serveRelated(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/charm-related" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	r.ParseForm()
+	response := map[string]*RelatedResponse{}
+	for _, url := range r.Form["charms"] {
+		c := &RelatedResponse{}
+		response[url] = c
+		curl, err := s.resolveURL(url)
+		var related []RelatedCharm
+		if err == nil {
+			related, err = s.store.RelatedCharms(curl)
+		}
+		if err != nil {
+			c.Errors = append(c.Errors, err.Error())
+			continue
+		}
+		c.CanonicalURL = curl.String()
+		for _, rc := range related {
+			c.Related = append(c.Related, RelatedEntry{
+				Relation:  rc.Relation,
+				Interface: rc.Interface,
+				Role:      string(rc.Role),
+				URL:       rc.URL.String(),
+			})
+		}
+	}
+	sendJSON(w, response)
+}
+
+const (
+	// defaultChangesLimit holds the number of events returned
+	// by the /changes API when no limit is specified.
+	defaultChangesLimit = 100
+
+	// maxChangesLimit holds the maximum number of events
+	// returned by a single call to the /changes API.
+	maxChangesLimit = 1000
+)
+
+func (s *Server) serveChanges(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/changes" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	r.ParseForm()
+	req := EventsRequest{Limit: defaultChangesLimit}
+	if v := r.Form.Get("since"); v != "" {
+		var err error
+		req.Since, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(fmt.Sprintf("Invalid 'since' value: %q", v)))
+			return
+		}
+	}
+	if v := r.Form.Get("after"); v != "" {
+		if !bson.IsObjectIdHex(v) {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(fmt.Sprintf("Invalid 'after' value: %q", v)))
+			return
+		}
+		req.AfterId = bson.ObjectIdHex(v)
+	}
+	for _, v := range r.Form["kind"] {
+		kind, err := ParseCharmEventKind(v)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(fmt.Sprintf("Invalid 'kind' value: %q", v)))
+			return
+		}
+		req.Kinds = append(req.Kinds, kind)
+	}
+	req.Actor = r.Form.Get("actor")
+	if v := r.Form.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxChangesLimit {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(fmt.Sprintf("Invalid 'limit' value: %q", v)))
+			return
+		}
+		req.Limit = limit
+	}
+	var format func(http.ResponseWriter, []*CharmEvent)
+	switch v := r.Form.Get("format"); v {
+	case "", "json":
+		format = sendChangesJSON
+	case "atom":
+		format = sendChangesAtom
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("Invalid 'format' value: %q", v)))
+		return
+	}
+	events, err := s.store.Events(&req)
+	if err == ErrNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(fmt.Sprintf("Unknown 'after' event: %q", r.Form.Get("after"))))
+		return
+	}
+	if err != nil {
+		logger.Errorf("cannot query charm events: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	format(w, events)
+}
+
+// eventURLStrings returns the URLs of event as strings.
+func eventURLStrings(event *CharmEvent) []string {
+	strs := make([]string, len(event.URLs))
+	for i, url := range event.URLs {
+		strs[i] = url.String()
+	}
+	return strs
+}
+
+// newChangeEntry returns the entry describing event in the /changes
+// API. The same format is used for the notifications sent to webhooks.
+func newChangeEntry(event *CharmEvent) csclient.ChangeEntry {
+	return csclient.ChangeEntry{
+		Id:       event.Id.Hex(),
+		Kind:     event.Kind.String(),
+		URLs:     eventURLStrings(event),
+		Revision: event.Revision,
+		Digest:   event.Digest,
+		Errors:   event.Errors,
+		Warnings: event.Warnings,
+		Time:     event.Time.UTC().Format(time.RFC3339),
+		Actor:    event.Actor,
+		Reason:   event.Reason,
+		Channel:  string(event.Channel),
+	}
+}
+
+func sendChangesJSON(w http.ResponseWriter, events []*CharmEvent) {
+	response := make([]csclient.ChangeEntry, len(events))
+	for i, event := range events {
+		response[i] = newChangeEntry(event)
+	}
+	sendJSON(w, response)
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Id      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Author  atomAuthor  `xml:"author"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomEntry struct {
+	Id      string `xml:"id"`
+	Title   string `xml:"title"`
+	Updated string `xml:"updated"`
+	Content string `xml:"content"`
+}
+
+func sendChangesAtom(w http.ResponseWriter, events []*CharmEvent) {
+	feed := atomFeed{
+		Id:      "urn:juju-charmstore:changes",
+		Title:   "Charm store changes",
+		Updated: time.Now().UTC().Format(time.RFC3339),
+		Author:  atomAuthor{Name: "Juju charm store"},
+	}
+	if len(events) > 0 {
+		feed.Updated = events[len(events)-1].Time.UTC().Format(time.RFC3339)
+	}
+	for _, event := range events {
+		urls := eventURLStrings(event)
+		content := []string{"URLs: " + strings.Join(urls, " ")}
+		if event.Digest != "" {
+			content = append(content, "Digest: "+event.Digest)
+		}
+		if event.Channel != "" {
+			content = append(content, "Channel: "+string(event.Channel))
+		}
+		if event.Actor != "" {
+			content = append(content, "Actor: "+event.Actor)
+		}
+		if event.Reason != "" {
+			content = append(content, "Reason: "+event.Reason)
+		}
+		for _, e := range event.Errors {
+			content = append(content, "Error: "+e)
+		}
+		for _, w := range event.Warnings {
+			content = append(content, "Warning: "+w)
+		}
+		title := event.Kind.String()
+		if len(event.URLs) > 0 {
+			title = fmt.Sprintf("%s %s", event.URLs[0].WithRevision(event.Revision), title)
+		}
+		feed.Entries = append(feed.Entries, atomEntry{
+			Id:      "urn:juju-charmstore:event:" + event.Id.Hex(),
+			Title:   title,
+			Updated: event.Time.UTC().Format(time.RFC3339),
+			Content: strings.Join(content, "\n"),
+		})
+	}
+	data, err := xml.Marshal(&feed)
+	if err == nil {
+		w.Header().Set("Content-Type", "application/atom+xml")
+		_, err = w.Write(append([]byte(xml.Header), data...))
+	}
+	if err != nil {
+		logger.Errorf("cannot write content: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+// sendJSON writes the JSON encoding of v as the response.
+func sendJSON(w http.ResponseWriter, v interface{}) {
+	data, err := json.Marshal(v)
+	if err == nil {
+		w.Header().Set("Content-Type", "application/json")
+		_, err = w.Write(data)
+	}
+	if err != nil {
+		logger.Errorf("cannot write content: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+func (s *Server) serveBundleInfo(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/bundle-info" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	r.ParseForm()
+	response := map[string]*charm.InfoResponse{}
+	for _, url := range r.Form["bundles"] {
+		c := &charm.InfoResponse{}
+		response[url] = c
+		burl, err := resolveBundleURL(url)
+		var info *BundleInfo
+		if err == nil {
+			info, err = s.store.BundleInfo(burl)
+		}
+		var skey []string
+		if err == nil {
+			skey = charmStatsKey(burl, "bundle-info")
+			c.CanonicalURL = burl.String()
+			c.Sha256 = info.ArchiveSha256()
+			c.Revision = info.Revision()
+			c.Digest = info.Digest()
+		} else {
+			if err == ErrNotFound {
+				skey = charmStatsKey(burl, "bundle-missing")
+			}
+			c.Errors = append(c.Errors, err.Error())
+		}
+		if skey != nil && statsEnabled(r) {
+			go s.store.IncCounter(skey)
+		}
+	}
+	sendJSON(w, response)
+}
+
+func (s *Server) serveBundle(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.URL.Path, "/bundle/") {
+		panic("serveBundle: bad url")
+	}
+	burl, err := resolveBundleURL("cs:" + r.URL.Path[len("/bundle/"):])
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	info, rc, err := s.store.OpenBundle(burl)
+	if err == ErrNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		logger.Errorf("cannot open bundle %q: %v", burl, err)
+		return
+	}
+	if statsEnabled(r) {
+		s.incCounters(r, charmStatsKey(burl, "bundle-archive"))
+	}
+	defer rc.Close()
+	w.Header().Set("Connection", "close") // No keep-alive for now.
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Length", strconv.FormatInt(info.ArchiveSize(), 10))
+	_, err = io.Copy(w, rc)
+	if err != nil {
+		logger.Errorf("failed to stream bundle %q: %v", burl, err)
+	}
+}
+
 func (s *Server) serveStats(w http.ResponseWriter, r *http.Request) {
 	// TODO: Adopt a smarter mux that simplifies this logic.
 	const dir = "/stats/counter/"
@@ -0,0 +1,195 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"sync"
+
+	"github.com/juju/charm"
+
+	"github.com/juju/charmstore/csclient"
+)
+
+// charmSignature holds the signature of a charm revision
+// for one of the URLs it was published at.
+type charmSignature struct {
+	URL       *charm.URL
+	Signature []byte
+}
+
+// signer holds the key a Backend signs the charms it publishes with.
+type signer struct {
+	mu  sync.RWMutex
+	key ed25519.PrivateKey
+}
+
+// SetSigningKey sets the key the store signs the charms it publishes
+// with. Charms are not signed if key is nil, which is the default.
+func (s *signer) SetSigningKey(key ed25519.PrivateKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.key = key
+}
+
+// signing reports whether a signing key is set.
+func (s *signer) signing() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.key != nil
+}
+
+// signCharm returns the signatures of the charm revision published at
+// urls with the given SHA256 hash, or nil if no signing key is set.
+// The message signed for each URL is csclient.SignatureMessage.
+func (s *signer) signCharm(urls []*charm.URL, revision int, sha256 string) []charmSignature {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.key == nil {
+		return nil
+	}
+	sigs := make([]charmSignature, len(urls))
+	for i, url := range urls {
+		msg := csclient.SignatureMessage(url.WithRevision(revision), sha256)
+		sigs[i] = charmSignature{url, ed25519.Sign(s.key, msg)}
+	}
+	return sigs
+}
+
+// Signature returns the signature of the charm revision for url,
+// which may hold a revision, or nil if it was not signed when
+// published at url.
+func (ci *CharmInfo) Signature(url *charm.URL) []byte {
+	url = url.WithRevision(-1)
+	for _, sig := range ci.signatures {
+		if *sig.URL.WithRevision(-1) == *url {
+			return sig.Signature
+		}
+	}
+	return nil
+}
+
+// signatureURLs returns the URLs a charm published at urls is signed
+// for: urls, and the unqualified URLs backed by the ones which are
+// promulgated, so that the charm can be verified when retrieved at
+// either.
+func (s *Store) signatureURLs(urls []*charm.URL) ([]*charm.URL, error) {
+	if !s.signing() {
+		return urls, nil
+	}
+	sigURLs := append([]*charm.URL(nil), urls...)
+	for _, url := range urls {
+		if url.User == "" {
+			continue
+		}
+		user, err := s.PromulgatedUser(url.Name)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if user == url.User {
+			official := *url
+			official.User = ""
+			sigURLs = append(sigURLs, &official)
+		}
+	}
+	return sigURLs, nil
+}
+
+// LoadSigningKey configures the store to sign the charms it publishes
+// with the key held in the file at conf.SigningKey, if set.
+func (s *Store) LoadSigningKey(conf *Config) error {
+	if conf.SigningKey == "" {
+		return nil
+	}
+	key, err := ReadSigningKey(conf.SigningKey)
+	if err != nil {
+		return err
+	}
+	s.SetSigningKey(key)
+	return nil
+}
+
+// ReadSigningKey reads the Ed25519 private key held in PKCS #8,
+// PEM form in the file at path, as generated by:
+//
+//	openssl genpkey -algorithm ed25519
+func ReadSigningKey(path string) (ed25519.PrivateKey, error) {
+	der, err := readPEM(path, "PRIVATE KEY")
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse signing key %s: %v", path, err)
+	}
+	edKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("signing key %s is not an Ed25519 key", path)
+	}
+	return edKey, nil
+}
+
+// ReadPublicKey reads the Ed25519 public key held in PKIX, PEM form
+// in the file at path, as generated from a private key by:
+//
+//	openssl pkey -pubout
+func ReadPublicKey(path string) (ed25519.PublicKey, error) {
+	der, err := readPEM(path, "PUBLIC KEY")
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse public key %s: %v", path, err)
+	}
+	edKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("public key %s is not an Ed25519 key", path)
+	}
+	return edKey, nil
+}
+
+// ConfigPublicKey returns the public key served by charmd
+// as configured in conf. The public key is read from the file at
+// conf.PublicKey if set, or derived from the signing key otherwise.
+// It returns nil if neither is set.
+func ConfigPublicKey(conf *Config) (ed25519.PublicKey, error) {
+	if conf.PublicKey != "" {
+		return ReadPublicKey(conf.PublicKey)
+	}
+	if conf.SigningKey != "" {
+		key, err := ReadSigningKey(conf.SigningKey)
+		if err != nil {
+			return nil, err
+		}
+		return key.Public().(ed25519.PublicKey), nil
+	}
+	return nil, nil
+}
+
+// readPEM returns the contents of the first PEM block
+// of the given type in the file at path.
+func readPEM(path, blockType string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("no %s found in %s", blockType, path)
+		}
+		if block.Type == blockType {
+			return block.Bytes, nil
+		}
+	}
+}
@@ -0,0 +1,237 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+
+	"github.com/juju/charm"
+	gc "launchpad.net/gocheck"
+
+	"github.com/juju/charmstore"
+	"github.com/juju/charmstore/csclient"
+)
+
+func (s *StoreSuite) TestServerSignatures(c *gc.C) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	c.Assert(err, gc.IsNil)
+	s.store.SetSigningKey(priv)
+	server, curl := s.prepareServer(c)
+
+	// The signature is returned by /charm-info, for URLs
+	// with or without a series or revision.
+	for _, u := range []string{curl.String(), "cs:wordpress", "cs:precise/wordpress-0"} {
+		req, err := http.NewRequest("GET", "/charm-info", nil)
+		c.Assert(err, gc.IsNil)
+		req.Form = url.Values{"charms": {u}, "stats": {"0"}}
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, req)
+		var infos map[string]*csclient.InfoResponse
+		err = json.NewDecoder(rec.Body).Decode(&infos)
+		c.Assert(err, gc.IsNil)
+		info := infos[u]
+		c.Assert(info.Signature, gc.Not(gc.Equals), "", gc.Commentf("URL: %s", u))
+		err = csclient.VerifyInfo(pub, info)
+		c.Assert(err, gc.IsNil, gc.Commentf("URL: %s", u))
+
+		// The signature doesn't verify for another revision or hash.
+		info.Revision = 1
+		err = csclient.VerifyInfo(pub, info)
+		c.Assert(err, gc.ErrorMatches, `invalid signature for charm cs:precise/wordpress-1`)
+		info.Revision = 0
+		info.Sha256 = strings.Repeat("0", 64)
+		err = csclient.VerifyInfo(pub, info)
+		c.Assert(err, gc.ErrorMatches, `invalid signature for charm cs:precise/wordpress-0`)
+	}
+
+	// The signature of the downloaded revision is returned by /charm/.
+	req, err := http.NewRequest("GET", "/charm/precise/wordpress", nil)
+	c.Assert(err, gc.IsNil)
+	req.Form = url.Values{"stats": {"0"}}
+	rec := httptest.NewRecorder()
+	server.ServeHTTP(rec, req)
+	c.Assert(rec.Code, gc.Equals, http.StatusOK)
+	c.Assert(rec.Header().Get("X-Charm-URL"), gc.Equals, "cs:precise/wordpress-0")
+	hash := sha256.Sum256(rec.Body.Bytes())
+	err = csclient.VerifySignature(pub, curl.WithRevision(0), hex.EncodeToString(hash[:]), rec.Header().Get("X-Charm-Signature"))
+	c.Assert(err, gc.IsNil)
+
+	// Charms published without a signing key are not signed.
+	s.store.SetSigningKey(nil)
+	unsigned := charm.MustParseURL("cs:precise/mysql")
+	publisher, err := s.store.CharmPublisher([]*charm.URL{unsigned}, "other-digest")
+	c.Assert(err, gc.IsNil)
+	err = publisher.Publish(&FakeCharmDir{})
+	c.Assert(err, gc.IsNil)
+	req, err = http.NewRequest("GET", "/charm-info", nil)
+	c.Assert(err, gc.IsNil)
+	req.Form = url.Values{"charms": {unsigned.String()}, "stats": {"0"}}
+	rec = httptest.NewRecorder()
+	server.ServeHTTP(rec, req)
+	var infos map[string]*csclient.InfoResponse
+	err = json.NewDecoder(rec.Body).Decode(&infos)
+	c.Assert(err, gc.IsNil)
+	c.Assert(infos[unsigned.String()].Signature, gc.Equals, "")
+	err = csclient.VerifyInfo(pub, infos[unsigned.String()])
+	c.Assert(err, gc.ErrorMatches, `charm cs:precise/mysql-0 is not signed`)
+
+	req, err = http.NewRequest("GET", "/charm/precise/mysql", nil)
+	c.Assert(err, gc.IsNil)
+	req.Form = url.Values{"stats": {"0"}}
+	rec = httptest.NewRecorder()
+	server.ServeHTTP(rec, req)
+	c.Assert(rec.Code, gc.Equals, http.StatusOK)
+	c.Assert(rec.Header().Get("X-Charm-Signature"), gc.Equals, "")
+}
+
+func (s *StoreSuite) TestPromulgatedSignatures(c *gc.C) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	c.Assert(err, gc.IsNil)
+	s.store.SetSigningKey(priv)
+	handler, err := charmstore.NewServer(s.store)
+	c.Assert(err, gc.IsNil)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	client := csclient.New(csclient.Params{
+		URL:          server.URL,
+		DisableStats: true,
+		PublicKey:    pub,
+	})
+	meta := relationMeta("mysql", nil, nil)
+
+	// Revisions published before and after the promulgation
+	// are signed for the unqualified URL.
+	s.publishMeta(c, "cs:~joe/trusty/mysql", "joe-0", meta)
+	err = s.store.Promulgate(mustParseReference(c, "cs:~joe/mysql"), charmstore.Origin{})
+	c.Assert(err, gc.IsNil)
+	info, _, err := client.Download("cs:trusty/mysql")
+	c.Assert(err, gc.IsNil)
+	c.Assert(info.Digest, gc.Equals, "joe-0")
+	s.publishMeta(c, "cs:~joe/trusty/mysql", "joe-1", meta)
+	info, _, err = client.Download("cs:trusty/mysql")
+	c.Assert(err, gc.IsNil)
+	c.Assert(info.Digest, gc.Equals, "joe-1")
+	info, _, err = client.Download("cs:trusty/mysql-0")
+	c.Assert(err, gc.IsNil)
+	c.Assert(info.Digest, gc.Equals, "joe-0")
+
+	// The signatures are removed when another
+	// user namespace backs the name.
+	s.publishMeta(c, "cs:~bob/trusty/mysql", "bob-0", meta)
+	err = s.store.Promulgate(mustParseReference(c, "cs:~bob/mysql"), charmstore.Origin{})
+	c.Assert(err, gc.IsNil)
+	info, _, err = client.Download("cs:trusty/mysql")
+	c.Assert(err, gc.IsNil)
+	c.Assert(info.Digest, gc.Equals, "bob-0")
+	joe, err := s.store.CharmInfo(charm.MustParseURL("cs:~joe/trusty/mysql"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(joe.Signature(charm.MustParseURL("cs:trusty/mysql")), gc.IsNil)
+	c.Assert(joe.Signature(charm.MustParseURL("cs:~joe/trusty/mysql")), gc.NotNil)
+
+	// And when the name is unpromulgated.
+	err = s.store.Unpromulgate(mustParseReference(c, "cs:~bob/mysql"), charmstore.Origin{})
+	c.Assert(err, gc.IsNil)
+	bob, err := s.store.CharmInfo(charm.MustParseURL("cs:~bob/trusty/mysql"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(bob.Signature(charm.MustParseURL("cs:trusty/mysql")), gc.IsNil)
+	c.Assert(bob.Signature(charm.MustParseURL("cs:~bob/trusty/mysql")), gc.NotNil)
+}
+
+func (s *StoreSuite) TestServerSigningKey(c *gc.C) {
+	server, _ := s.prepareServer(c)
+	req, err := http.NewRequest("GET", "/signing-key", nil)
+	c.Assert(err, gc.IsNil)
+	rec := httptest.NewRecorder()
+	server.ServeHTTP(rec, req)
+	c.Assert(rec.Code, gc.Equals, http.StatusNotFound)
+
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	c.Assert(err, gc.IsNil)
+	server.SetPublicKey(pub)
+	rec = httptest.NewRecorder()
+	server.ServeHTTP(rec, req)
+	c.Assert(rec.Code, gc.Equals, http.StatusOK)
+	c.Assert(rec.Header().Get("Content-Type"), gc.Equals, "application/json")
+	var response csclient.SigningKeyResponse
+	err = json.NewDecoder(rec.Body).Decode(&response)
+	c.Assert(err, gc.IsNil)
+	c.Assert(response, gc.Equals, csclient.SigningKeyResponse{
+		Algorithm: "ed25519",
+		PublicKey: base64.StdEncoding.EncodeToString(pub),
+	})
+}
+
+// writePEM writes the DER data as a PEM block of
+// the given type to a new file and returns its path.
+func writePEM(c *gc.C, blockType string, der []byte) string {
+	path := filepath.Join(c.MkDir(), "key.pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	err := ioutil.WriteFile(path, data, 0600)
+	c.Assert(err, gc.IsNil)
+	return path
+}
+
+func (s *TrivialSuite) TestReadSigningKeys(c *gc.C) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	c.Assert(err, gc.IsNil)
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	c.Assert(err, gc.IsNil)
+	privPath := writePEM(c, "PRIVATE KEY", der)
+	der, err = x509.MarshalPKIXPublicKey(pub)
+	c.Assert(err, gc.IsNil)
+	pubPath := writePEM(c, "PUBLIC KEY", der)
+
+	key, err := charmstore.ReadSigningKey(privPath)
+	c.Assert(err, gc.IsNil)
+	c.Assert(key, gc.DeepEquals, priv)
+	pubKey, err := charmstore.ReadPublicKey(pubPath)
+	c.Assert(err, gc.IsNil)
+	c.Assert(pubKey, gc.DeepEquals, pub)
+
+	// The public key served by charmd is derived from the
+	// signing key unless configured explicitly.
+	pubKey, err = charmstore.ConfigPublicKey(&charmstore.Config{})
+	c.Assert(err, gc.IsNil)
+	c.Assert(pubKey, gc.IsNil)
+	pubKey, err = charmstore.ConfigPublicKey(&charmstore.Config{SigningKey: privPath})
+	c.Assert(err, gc.IsNil)
+	c.Assert(pubKey, gc.DeepEquals, pub)
+	otherPub, _, err := ed25519.GenerateKey(rand.Reader)
+	c.Assert(err, gc.IsNil)
+	der, err = x509.MarshalPKIXPublicKey(otherPub)
+	c.Assert(err, gc.IsNil)
+	otherPath := writePEM(c, "PUBLIC KEY", der)
+	pubKey, err = charmstore.ConfigPublicKey(&charmstore.Config{SigningKey: privPath, PublicKey: otherPath})
+	c.Assert(err, gc.IsNil)
+	c.Assert(pubKey, gc.DeepEquals, otherPub)
+
+	_, err = charmstore.ReadSigningKey(pubPath)
+	c.Assert(err, gc.ErrorMatches, "no PRIVATE KEY found in .*")
+	_, err = charmstore.ReadPublicKey(privPath)
+	c.Assert(err, gc.ErrorMatches, "no PUBLIC KEY found in .*")
+	_, err = charmstore.ReadSigningKey(writePEM(c, "PRIVATE KEY", []byte("bad")))
+	c.Assert(err, gc.ErrorMatches, "cannot parse signing key .*")
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, gc.IsNil)
+	der, err = x509.MarshalPKCS8PrivateKey(ecKey)
+	c.Assert(err, gc.IsNil)
+	_, err = charmstore.ReadSigningKey(writePEM(c, "PRIVATE KEY", der))
+	c.Assert(err, gc.ErrorMatches, "signing key .* is not an Ed25519 key")
+}
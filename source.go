@@ -0,0 +1,378 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/juju/charm"
+)
+
+// A Source provides charms to be published in the store, such as the
+// branches of the /charms distribution in Launchpad.
+type Source interface {
+	// Name returns the name identifying the source, under which
+	// the synchronizations with it are recorded in the store.
+	Name() string
+
+	// Candidates returns the charms available from the source.
+	// Sources able to tell when their charms changed may return only
+	// the ones changed since the given time, unless it's zero.
+	Candidates(since time.Time) ([]*Candidate, error)
+
+	// Publish publishes the charm for candidate in store. Operations
+	// taking longer than timeout, if not zero, are aborted.
+	// ErrRedundantUpdate is returned if the candidate is already
+	// published.
+	Publish(store *Store, candidate *Candidate, timeout time.Duration) error
+}
+
+// A Candidate is a charm available from a Source.
+type Candidate struct {
+	// SourceURL holds the location of the charm in the source,
+	// such as a Bazaar branch URL.
+	SourceURL string
+
+	// URLs holds the charm URLs to publish the charm at.
+	URLs []*charm.URL
+
+	// Digest uniquely identifies the charm content,
+	// such as the Bazaar revision id of the branch tip.
+	Digest string
+
+	// resolveDigest, if not nil, returns the digest of a candidate
+	// whose Digest is empty because determining it takes time, as
+	// done concurrently with the publishing of other candidates.
+	// Operations still running at the deadline, if not zero, are
+	// aborted.
+	resolveDigest func(deadline time.Time) (string, error)
+
+	// Skip holds whether the candidate is not a charm to be published.
+	Skip bool
+
+	// Err holds why the candidate cannot be published, if it can't.
+	Err error
+}
+
+type PublishBranchError struct {
+	URL string
+	Err error
+}
+
+type PublishBranchErrors []PublishBranchError
+
+func (errs PublishBranchErrors) Error() string {
+	return fmt.Sprintf("%d branch(es) failed to be published", len(errs))
+}
+
+func (errs PublishBranchErrors) Len() int           { return len(errs) }
+func (errs PublishBranchErrors) Less(i, j int) bool { return errs[i].URL < errs[j].URL }
+func (errs PublishBranchErrors) Swap(i, j int)      { errs[i], errs[j] = errs[j], errs[i] }
+
+// PublishOptions holds options for publishing the charms
+// from a source.
+type PublishOptions struct {
+	// Parallelism holds the maximum number of branches
+	// published concurrently. If zero, one branch is
+	// published at a time.
+	Parallelism int
+
+	// Timeout holds the maximum time spent retrieving each
+	// branch. The Bazaar commands still running after that
+	// are killed. If zero, there is no timeout.
+	Timeout time.Duration
+
+	// Full specifies that all the branches in the source are
+	// considered, rather than only the ones changed since
+	// the last synchronization.
+	Full bool
+
+	// DryRun specifies that the branches that would be published
+	// are reported without publishing them or recording the
+	// synchronization in the store.
+	DryRun bool
+}
+
+// syncMargin holds how long before the last synchronization branches
+// are looked for changes, so that changes happening during the last
+// synchronization or affected by clock skew aren't missed.
+const syncMargin = time.Hour
+
+// PublishReport summarizes the outcome of publishing the charms
+// from a source. Each list holds the source URLs of the branches
+// in the respective situation.
+type PublishReport struct {
+	// DryRun holds whether the branches were not actually published.
+	DryRun bool `json:"dry-run"`
+
+	// Published holds the branches published successfully,
+	// or that would be published in a dry run.
+	Published []string `json:"published"`
+
+	// Redundant holds the branches whose tip was already published.
+	Redundant []string `json:"redundant"`
+
+	// Failed holds the branches that failed to be published.
+	Failed []string `json:"failed"`
+
+	// Skipped holds the branches that were not considered for
+	// publishing, either because they are not charms or because
+	// publishing is deferred after a transient failure.
+	Skipped []string `json:"skipped"`
+
+	// URLs holds the charm URLs each of the published branches
+	// is published at.
+	URLs map[string][]string `json:"urls,omitempty"`
+}
+
+// String returns a one line summary of the report.
+func (r *PublishReport) String() string {
+	return fmt.Sprintf("%d published, %d redundant, %d failed, %d skipped",
+		len(r.Published), len(r.Redundant), len(r.Failed), len(r.Skipped))
+}
+
+// PublishSource publishes onto store the charms available from src.
+// Branches are published concurrently according to opts, which
+// may be nil to use the defaults. The returned report holds the
+// outcome of publishing each branch.
+// Unless opts.Full is set, only the branches changed since the last
+// synchronization recorded in store are considered, along with the
+// branches whose tip failed to be published before. Tips which failed
+// permanently are skipped until retrying them is requested.
+// Errors found while processing one or more branches are
+// all returned as a PublishBranchErrors value.
+func PublishSource(store *Store, src Source, opts *PublishOptions) (*PublishReport, error) {
+	if opts == nil {
+		opts = &PublishOptions{}
+	}
+	start := time.Now()
+	var since time.Time
+	if !opts.Full {
+		last, err := store.LastSync(src.Name())
+		if err != nil {
+			return nil, err
+		}
+		if !last.IsZero() {
+			since = last.Add(-syncMargin)
+		}
+	}
+	candidates, err := src.Candidates(since)
+	if err != nil {
+		return nil, err
+	}
+	pending, err := store.pendingSyncBranches(src.Name())
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	for _, c := range candidates {
+		seen[c.SourceURL] = true
+	}
+	for _, doc := range pending {
+		if seen[doc.URL] {
+			continue
+		}
+		c := &Candidate{
+			SourceURL: doc.URL,
+			Digest:    doc.Digest,
+		}
+		for _, url := range doc.URLs {
+			curl, err := charm.ParseURL(url)
+			if err != nil {
+				return nil, err
+			}
+			c.URLs = append(c.URLs, curl)
+		}
+		candidates = append(candidates, c)
+	}
+
+	p := &sourcePublisher{
+		store:   store,
+		src:     src,
+		timeout: opts.Timeout,
+		full:    opts.Full,
+		dryRun:  opts.DryRun,
+		report:  &PublishReport{DryRun: opts.DryRun},
+	}
+
+	// Candidates from the same branch are published in order by the
+	// same worker, as they would otherwise fight for the update locks.
+	var jobs [][]*Candidate
+	branchJobs := make(map[string]int)
+	for _, c := range candidates {
+		if c.Skip {
+			p.skipped(c.SourceURL)
+			continue
+		}
+		i, ok := branchJobs[c.SourceURL]
+		if !ok {
+			i = len(jobs)
+			branchJobs[c.SourceURL] = i
+			jobs = append(jobs, nil)
+		}
+		jobs[i] = append(jobs[i], c)
+	}
+
+	parallelism := opts.Parallelism
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	jobc := make(chan []*Candidate)
+	var wg sync.WaitGroup
+	for i := 0; i < parallelism; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobc {
+				for _, c := range job {
+					p.publish(c)
+				}
+			}
+		}()
+	}
+	for _, job := range jobs {
+		jobc <- job
+	}
+	close(jobc)
+	wg.Wait()
+
+	// Branches which failed to be published are recorded as pending,
+	// so the synchronization time can move forward regardless.
+	if !opts.DryRun {
+		if err := store.SetLastSync(src.Name(), start); err != nil {
+			return p.report, err
+		}
+	}
+	if p.errs != nil {
+		sort.Sort(p.errs)
+		return p.report, p.errs
+	}
+	return p.report, nil
+}
+
+// sourcePublisher holds the state shared by the workers
+// publishing the charms from a source.
+type sourcePublisher struct {
+	store   *Store
+	src     Source
+	timeout time.Duration
+	full    bool
+	dryRun  bool
+
+	mu     sync.Mutex
+	report *PublishReport
+	errs   PublishBranchErrors
+}
+
+// publish publishes the charm for c.
+func (p *sourcePublisher) publish(c *Candidate) {
+	logger.Infof("%s\n", c.SourceURL)
+	if c.Err != nil {
+		p.failed(c.SourceURL, c.Err)
+		return
+	}
+	if c.Digest == "" && c.resolveDigest != nil {
+		var deadline time.Time
+		if p.timeout > 0 {
+			deadline = time.Now().Add(p.timeout)
+		}
+		digest, err := c.resolveDigest(deadline)
+		if err != nil {
+			p.failed(c.SourceURL, err)
+			return
+		}
+		c.Digest = digest
+	}
+	last, err := p.store.syncBranch(c.SourceURL)
+	if err != nil {
+		p.failed(c.SourceURL, err)
+		return
+	}
+	if !p.full && last != nil && last.Digest == c.Digest && last.Failed {
+		failed, err := p.store.publishFailed(c.URLs, c.Digest)
+		if err != nil {
+			p.failed(c.SourceURL, err)
+			return
+		}
+		if failed {
+			// Failed permanently in a previous synchronization,
+			// and retrying wasn't requested since.
+			p.skipped(c.SourceURL)
+			return
+		}
+	}
+	if !p.full && last != nil && last.Digest == c.Digest && !last.Pending {
+		// Seen already in a previous synchronization.
+		p.mu.Lock()
+		p.report.Redundant = append(p.report.Redundant, c.SourceURL)
+		p.mu.Unlock()
+		return
+	}
+	curls := make([]string, len(c.URLs))
+	for i, url := range c.URLs {
+		curls[i] = url.String()
+	}
+
+	if p.dryRun {
+		// Only check whether the candidate is published already,
+		// or publishing it is deferred or failed before.
+		_, err = p.store.CharmPublisher(c.URLs, c.Digest)
+		if err == nil {
+			_, err = publishAttempts(p.store, c.URLs, c.Digest)
+		}
+	} else {
+		err = p.src.Publish(p.store, c, p.timeout)
+		doc := &syncBranchDoc{
+			URL:     c.SourceURL,
+			Source:  p.src.Name(),
+			URLs:    curls,
+			Digest:  c.Digest,
+			Pending: err != nil && err != ErrRedundantUpdate,
+		}
+		if doc.Pending && err != ErrPublishDeferred {
+			failed, ferr := p.store.publishFailed(c.URLs, c.Digest)
+			if ferr != nil {
+				logger.Errorf("cannot check whether publishing branch %s failed: %v", c.SourceURL, ferr)
+			}
+			doc.Failed = failed
+		}
+		if err := p.store.setSyncBranch(doc); err != nil {
+			logger.Errorf("cannot record branch %s as seen: %v", c.SourceURL, err)
+		}
+	}
+	p.mu.Lock()
+	switch err {
+	case nil:
+		p.report.Published = append(p.report.Published, c.SourceURL)
+		if p.report.URLs == nil {
+			p.report.URLs = make(map[string][]string)
+		}
+		p.report.URLs[c.SourceURL] = curls
+	case ErrRedundantUpdate:
+		p.report.Redundant = append(p.report.Redundant, c.SourceURL)
+	case ErrPublishDeferred:
+		p.report.Skipped = append(p.report.Skipped, c.SourceURL)
+	}
+	p.mu.Unlock()
+	if err != nil && err != ErrRedundantUpdate && err != ErrPublishDeferred {
+		p.failed(c.SourceURL, err)
+	}
+}
+
+func (p *sourcePublisher) skipped(surl string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.report.Skipped = append(p.report.Skipped, surl)
+}
+
+func (p *sourcePublisher) failed(surl string, err error) {
+	logger.Errorf("%v", err)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.report.Failed = append(p.report.Failed, surl)
+	p.errs = append(p.errs, PublishBranchError{surl, err})
+}
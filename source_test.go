@@ -0,0 +1,198 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/juju/charm"
+	charmtesting "github.com/juju/charm/testing"
+	gc "launchpad.net/gocheck"
+
+	"github.com/juju/charmstore"
+)
+
+func (s *StoreSuite) TestDirSource(c *gc.C) {
+	root := c.MkDir()
+	for _, dir := range []string{"precise", "~joe/trusty", ".hidden"} {
+		err := os.MkdirAll(filepath.Join(root, dir), 0755)
+		c.Assert(err, gc.IsNil)
+	}
+	precisePath := charmtesting.Charms.ClonedDirPath(filepath.Join(root, "precise"), "dummy")
+	trustyPath := charmtesting.Charms.ClonedDirPath(filepath.Join(root, "~joe", "trusty"), "dummy")
+	charmtesting.Charms.ClonedDirPath(filepath.Join(root, ".hidden"), "dummy")
+
+	src := charmstore.NewDirSource(root)
+	c.Assert(src.Name(), gc.Equals, "dir:"+root)
+	candidates, err := src.Candidates(time.Time{})
+	c.Assert(err, gc.IsNil)
+	c.Assert(candidates, gc.HasLen, 2)
+	c.Assert(candidates[0].SourceURL, gc.Equals, trustyPath)
+	c.Assert(candidates[0].URLs, gc.DeepEquals, []*charm.URL{charm.MustParseURL("cs:~joe/trusty/dummy")})
+	c.Assert(candidates[1].SourceURL, gc.Equals, precisePath)
+	c.Assert(candidates[1].URLs, gc.DeepEquals, []*charm.URL{charm.MustParseURL("cs:precise/dummy")})
+	for _, candidate := range candidates {
+		c.Assert(candidate.Err, gc.IsNil)
+		c.Assert(candidate.Digest, gc.Matches, "[0-9a-f]{64}")
+	}
+
+	report, err := charmstore.PublishSource(s.store, src, nil)
+	c.Assert(err, gc.IsNil)
+	c.Assert(report.String(), gc.Equals, "2 published, 0 redundant, 0 failed, 0 skipped")
+	info, err := s.store.CharmInfo(charm.MustParseURL("cs:precise/dummy"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(info.Digest(), gc.Equals, candidates[1].Digest)
+
+	// Changing the charm content publishes a new revision.
+	err = ioutil.WriteFile(filepath.Join(precisePath, "README"), []byte("Changed."), 0644)
+	c.Assert(err, gc.IsNil)
+	report, err = charmstore.PublishSource(s.store, src, nil)
+	c.Assert(err, gc.IsNil)
+	c.Assert(report.Published, gc.DeepEquals, []string{precisePath})
+	c.Assert(report.Redundant, gc.DeepEquals, []string{trustyPath})
+	info, err = s.store.CharmInfo(charm.MustParseURL("cs:precise/dummy"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(info.Revision(), gc.Equals, 1)
+}
+
+func (s *StoreSuite) TestDirSourceErrors(c *gc.C) {
+	root := c.MkDir()
+	err := os.MkdirAll(filepath.Join(root, "precise", "Bad_Name"), 0755)
+	c.Assert(err, gc.IsNil)
+	err = os.MkdirAll(filepath.Join(root, "precise", "empty"), 0755)
+	c.Assert(err, gc.IsNil)
+
+	report, err := charmstore.PublishSource(s.store, charmstore.NewDirSource(root), nil)
+	c.Assert(err, gc.ErrorMatches, `2 branch\(es\) failed to be published`)
+	errs := err.(charmstore.PublishBranchErrors)
+	c.Assert(errs[0].URL, gc.Equals, filepath.Join(root, "precise", "Bad_Name"))
+	c.Assert(errs[1].URL, gc.Equals, filepath.Join(root, "precise", "empty"))
+	c.Assert(errs[1].Err, gc.ErrorMatches, ".*/metadata.yaml: no such file or directory")
+	c.Assert(report.Failed, gc.HasLen, 2)
+
+	_, err = charmstore.NewDirSource(filepath.Join(root, "missing")).Candidates(time.Time{})
+	c.Assert(err, gc.NotNil)
+}
+
+func (s *StoreSuite) TestDirSourcePermanentFailure(c *gc.C) {
+	root := c.MkDir()
+	err := os.MkdirAll(filepath.Join(root, "precise"), 0755)
+	c.Assert(err, gc.IsNil)
+	path := charmtesting.Charms.ClonedDirPath(filepath.Join(root, "precise"), "dummy")
+	err = os.MkdirAll(filepath.Join(path, "hooks"), 0755)
+	c.Assert(err, gc.IsNil)
+	err = ioutil.WriteFile(filepath.Join(path, "hooks", "start"), []byte("#!/bin/sh\n"), 0644)
+	c.Assert(err, gc.IsNil)
+	s.store.SetLintPolicy("", charmstore.LintStrict)
+
+	src := charmstore.NewDirSource(root)
+	report, err := charmstore.PublishSource(s.store, src, nil)
+	c.Assert(err, gc.ErrorMatches, `1 branch\(es\) failed to be published`)
+	c.Assert(report.Failed, gc.DeepEquals, []string{path})
+
+	// The failed branch isn't attempted again while it's unchanged.
+	report, err = charmstore.PublishSource(s.store, src, nil)
+	c.Assert(err, gc.IsNil)
+	c.Assert(report.String(), gc.Equals, "0 published, 0 redundant, 0 failed, 1 skipped")
+
+	// It's attempted again when retrying is requested.
+	err = s.store.RetryPublish(charm.MustParseURL("cs:precise/dummy"), charmstore.Origin{})
+	c.Assert(err, gc.IsNil)
+	report, err = charmstore.PublishSource(s.store, src, nil)
+	c.Assert(err, gc.ErrorMatches, `1 branch\(es\) failed to be published`)
+	report, err = charmstore.PublishSource(s.store, src, nil)
+	c.Assert(err, gc.IsNil)
+	c.Assert(report.Skipped, gc.DeepEquals, []string{path})
+
+	// And when the branch changes.
+	err = os.Chmod(filepath.Join(path, "hooks", "start"), 0755)
+	c.Assert(err, gc.IsNil)
+	err = ioutil.WriteFile(filepath.Join(path, "README"), []byte("Fixed."), 0644)
+	c.Assert(err, gc.IsNil)
+	report, err = charmstore.PublishSource(s.store, src, nil)
+	c.Assert(err, gc.IsNil)
+	c.Assert(report.Published, gc.DeepEquals, []string{path})
+}
+
+func (s *StoreSuite) TestDirSourceDryRunDeferred(c *gc.C) {
+	root := c.MkDir()
+	err := os.MkdirAll(filepath.Join(root, "precise"), 0755)
+	c.Assert(err, gc.IsNil)
+	path := charmtesting.Charms.ClonedDirPath(filepath.Join(root, "precise"), "dummy")
+	src := charmstore.NewDirSource(root)
+	candidates, err := src.Candidates(time.Time{})
+	c.Assert(err, gc.IsNil)
+	err = s.store.LogCharmEvent(&charmstore.CharmEvent{
+		Kind:       charmstore.EventPublishError,
+		Digest:     candidates[0].Digest,
+		URLs:       candidates[0].URLs,
+		Errors:     []string{"Connection reset"},
+		Transient:  true,
+		Attempts:   1,
+		RetryAfter: time.Now().Add(time.Hour),
+	})
+	c.Assert(err, gc.IsNil)
+
+	// Branches within their retry delay are reported as skipped,
+	// as they are by a real run.
+	opts := &charmstore.PublishOptions{DryRun: true}
+	report, err := charmstore.PublishSource(s.store, src, opts)
+	c.Assert(err, gc.IsNil)
+	c.Assert(report.Skipped, gc.DeepEquals, []string{path})
+	c.Assert(report.Published, gc.HasLen, 0)
+	opts.DryRun = false
+	report, err = charmstore.PublishSource(s.store, src, opts)
+	c.Assert(err, gc.IsNil)
+	c.Assert(report.Skipped, gc.DeepEquals, []string{path})
+}
+
+func (s *StoreSuite) TestManifestSource(c *gc.C) {
+	branch := s.dummyBranch(c, "")
+	path := filepath.Join(c.MkDir(), "manifest.yaml")
+	manifest := fmt.Sprintf(`
+charms:
+  - branch: %s
+    urls: [cs:~joe/precise/dummy, cs:precise/dummy]
+  - branch: %s
+    urls: [cs:precise/other-0]
+  - branch: /non-existent
+  - branch: %s
+    urls: [cs:precise/missing]
+`, branch.path(), branch.path()+"/other", branch.path()+"/missing")
+	err := ioutil.WriteFile(path, []byte(manifest), 0644)
+	c.Assert(err, gc.IsNil)
+
+	src := charmstore.NewManifestSource(path)
+	c.Assert(src.Name(), gc.Equals, "manifest:"+path)
+	candidates, err := src.Candidates(time.Time{})
+	c.Assert(err, gc.IsNil)
+	c.Assert(candidates, gc.HasLen, 4)
+	c.Assert(candidates[0].Err, gc.IsNil)
+	c.Assert(candidates[1].Err, gc.ErrorMatches, "manifest: got charm URL with revision: cs:precise/other-0")
+	c.Assert(candidates[2].Err, gc.ErrorMatches, "no charm URLs for branch /non-existent")
+	c.Assert(candidates[3].Err, gc.IsNil)
+
+	// The tips of the branches are looked up when publishing them.
+	report, err := charmstore.PublishSource(s.store, src, &charmstore.PublishOptions{
+		Parallelism: 2,
+		Timeout:     time.Minute,
+	})
+	c.Assert(err, gc.ErrorMatches, `3 branch\(es\) failed to be published`)
+	c.Assert(report.Published, gc.DeepEquals, []string{branch.path()})
+	c.Assert(report.Failed, gc.HasLen, 3)
+	for _, url := range []string{"cs:~joe/precise/dummy-0", "cs:precise/dummy-0"} {
+		info, err := s.store.CharmInfo(charm.MustParseURL(url))
+		c.Assert(err, gc.IsNil)
+		c.Assert(info.Digest(), gc.Equals, branch.digest())
+	}
+
+	err = ioutil.WriteFile(path, []byte("charms: {"), 0644)
+	c.Assert(err, gc.IsNil)
+	_, err = src.Candidates(time.Time{})
+	c.Assert(err, gc.ErrorMatches, "cannot parse manifest .*")
+}
@@ -0,0 +1,372 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/juju/charm"
+)
+
+// StoreReader holds the store operations used by Server
+// to serve the store API.
+type StoreReader interface {
+	Series(ref charm.Reference) ([]string, error)
+	CharmInfo(url *charm.URL) (*CharmInfo, error)
+	OpenCharm(url *charm.URL) (*CharmInfo, io.ReadCloser, error)
+	CharmEvent(url *charm.URL, digest string) (*CharmEvent, error)
+	Events(req *EventsRequest) ([]*CharmEvent, error)
+	ChannelRevision(url *charm.URL, channel Channel) (int, error)
+	BundleInfo(url *charm.URL) (*BundleInfo, error)
+	OpenBundle(url *charm.URL) (*BundleInfo, io.ReadCloser, error)
+	InterfaceCharms(iface string, role charm.RelationRole, series string) ([]*charm.URL, error)
+	RelatedCharms(url *charm.URL) ([]RelatedCharm, error)
+	IncCounter(key []string) error
+	IncUniqueCounter(key []string, client string, window time.Duration) error
+	Counters(req *CounterRequest) ([]Counter, error)
+}
+
+// Statically ensure that *Store and *StaticStore are StoreReaders.
+var (
+	_ StoreReader = (*Store)(nil)
+	_ StoreReader = (*StaticStore)(nil)
+)
+
+// ErrStaticUnsupported is returned by the StaticStore operations
+// that rely on information not held in static charm directories.
+var ErrStaticUnsupported = errors.New("operation not supported by static store")
+
+// StaticStore is a read-only StoreReader serving the charms in
+// a static charm directory, as written by WriteSubset, without
+// access to MongoDB.
+type StaticStore struct {
+	dir    string
+	charms map[string][]*staticEntry
+
+	statsMu   sync.Mutex
+	statsFile *os.File
+	seen      seenClients
+}
+
+// staticEntry holds a charm revision served by a StaticStore.
+type staticEntry struct {
+	url   *charm.URL
+	info  *CharmInfo
+	path  string
+	event *CharmEvent
+}
+
+// staticStatsRecord is written to the statistics file of
+// a StaticStore for each counter increment.
+type staticStatsRecord struct {
+	Time time.Time `json:"time"`
+	Key  []string  `json:"key"`
+}
+
+// OpenStatic returns a StaticStore serving the charms in the static
+// charm directory at dir. The archives are verified against their
+// SHA256 hashes in the directory index. If statsPath is not empty,
+// the statistics counter increments are appended to the file at
+// statsPath, one JSON record per line. Otherwise they are discarded.
+func OpenStatic(dir, statsPath string) (*StaticStore, error) {
+	if _, err := os.Stat(filepath.Join(dir, staticIndexFile)); err != nil {
+		return nil, fmt.Errorf("cannot open static charm directory: %v", err)
+	}
+	index, err := readStaticIndex(dir)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open static charm directory: %v", err)
+	}
+	s := &StaticStore{
+		dir:    dir,
+		charms: make(map[string][]*staticEntry),
+	}
+	for _, c := range index.Charms {
+		entry, err := s.loadEntry(c)
+		if err != nil {
+			return nil, fmt.Errorf("cannot open static charm directory: %v", err)
+		}
+		key := entry.url.String()
+		s.charms[key] = append(s.charms[key], entry)
+	}
+	for _, entries := range s.charms {
+		sort.Sort(staticEntriesByRevision(entries))
+	}
+	if statsPath != "" {
+		s.statsFile, err = os.OpenFile(statsPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// loadEntry returns the entry for serving the charm described by c.
+func (s *StaticStore) loadEntry(c *staticCharm) (*staticEntry, error) {
+	curl, err := charm.ParseURL(c.URL)
+	if err != nil {
+		return nil, err
+	}
+	if err := mustLackRevision("OpenStatic", curl); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(s.dir, c.path())
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifySha256(data, c.Sha256); err != nil {
+		return nil, fmt.Errorf("%s: %v", c.path(), err)
+	}
+	bundle, err := charm.ReadBundleBytes(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", c.path(), err)
+	}
+	entry := &staticEntry{
+		url: curl,
+		info: &CharmInfo{
+			revision: c.Revision,
+			digest:   c.Digest,
+			sha256:   c.Sha256,
+			size:     int64(len(data)),
+			meta:     bundle.Meta(),
+			config:   bundle.Config(),
+			actions:  bundle.Actions(),
+		},
+		path: path,
+	}
+	if c.Event != nil {
+		kind, err := ParseCharmEventKind(c.Event.Kind)
+		if err != nil {
+			return nil, err
+		}
+		t, err := time.Parse(time.RFC3339, c.Event.Time)
+		if err != nil {
+			return nil, err
+		}
+		entry.event = &CharmEvent{
+			Kind:     kind,
+			Digest:   c.Event.Digest,
+			Revision: c.Event.Revision,
+			URLs:     []*charm.URL{curl},
+			Errors:   c.Event.Errors,
+			Warnings: c.Event.Warnings,
+			Time:     t,
+			Actor:    c.Event.Actor,
+			Reason:   c.Event.Reason,
+		}
+	}
+	return entry, nil
+}
+
+type staticEntriesByRevision []*staticEntry
+
+func (s staticEntriesByRevision) Len() int           { return len(s) }
+func (s staticEntriesByRevision) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s staticEntriesByRevision) Less(i, j int) bool { return s[i].info.revision < s[j].info.revision }
+
+// Close closes the statistics file of the store, if any.
+func (s *StaticStore) Close() {
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+	if s.statsFile != nil {
+		s.statsFile.Close()
+		s.statsFile = nil
+	}
+}
+
+// entry returns the entry for the charm at url, which
+// is the latest revision if url has no revision.
+func (s *StaticStore) entry(url *charm.URL) (*staticEntry, error) {
+	entries := s.charms[url.WithRevision(-1).String()]
+	if len(entries) == 0 {
+		return nil, ErrNotFound
+	}
+	if url.Revision == -1 {
+		return entries[len(entries)-1], nil
+	}
+	for _, entry := range entries {
+		if entry.info.revision == url.Revision {
+			return entry, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// Series implements StoreReader.Series.
+func (s *StaticStore) Series(ref charm.Reference) ([]string, error) {
+	var result []string
+	for _, entries := range s.charms {
+		if entries[0].url.Reference == ref {
+			result = append(result, entries[0].url.Series)
+		}
+	}
+	sort.Sort(byPreferredSeries(result))
+	return result, nil
+}
+
+// CharmInfo implements StoreReader.CharmInfo.
+func (s *StaticStore) CharmInfo(url *charm.URL) (*CharmInfo, error) {
+	entry, err := s.entry(url)
+	if err != nil {
+		return nil, err
+	}
+	return entry.info, nil
+}
+
+// OpenCharm implements StoreReader.OpenCharm.
+func (s *StaticStore) OpenCharm(url *charm.URL) (*CharmInfo, io.ReadCloser, error) {
+	entry, err := s.entry(url)
+	if err != nil {
+		return nil, nil, err
+	}
+	f, err := os.Open(entry.path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return entry.info, f, nil
+}
+
+// CharmEvent implements StoreReader.CharmEvent.
+// Only the events of the charm revisions in
+// the static charm directory are available.
+func (s *StaticStore) CharmEvent(url *charm.URL, digest string) (*CharmEvent, error) {
+	if err := mustLackRevision("CharmEvent", url); err != nil {
+		return nil, err
+	}
+	entries := s.charms[url.String()]
+	for i := len(entries) - 1; i >= 0; i-- {
+		event := entries[i].event
+		if event != nil && (digest == "" || event.Digest == digest) {
+			return event, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// Events implements StoreReader.Events.
+// ErrStaticUnsupported is always returned.
+func (s *StaticStore) Events(req *EventsRequest) ([]*CharmEvent, error) {
+	return nil, ErrStaticUnsupported
+}
+
+// ChannelRevision implements StoreReader.ChannelRevision.
+// Static charm directories have no channel releases,
+// so ErrNotFound is always returned.
+func (s *StaticStore) ChannelRevision(url *charm.URL, channel Channel) (int, error) {
+	return 0, ErrNotFound
+}
+
+// BundleInfo implements StoreReader.BundleInfo.
+// Static charm directories have no bundles,
+// so ErrNotFound is always returned.
+func (s *StaticStore) BundleInfo(url *charm.URL) (*BundleInfo, error) {
+	return nil, ErrNotFound
+}
+
+// OpenBundle implements StoreReader.OpenBundle.
+// Static charm directories have no bundles,
+// so ErrNotFound is always returned.
+func (s *StaticStore) OpenBundle(url *charm.URL) (*BundleInfo, io.ReadCloser, error) {
+	return nil, nil, ErrNotFound
+}
+
+// InterfaceCharms implements StoreReader.InterfaceCharms.
+func (s *StaticStore) InterfaceCharms(iface string, role charm.RelationRole, series string) ([]*charm.URL, error) {
+	if _, err := roleField(role); err != nil {
+		return nil, err
+	}
+	var result []*charm.URL
+	for _, entries := range s.charms {
+		latest := entries[len(entries)-1]
+		if series != "" && latest.url.Series != series {
+			continue
+		}
+		relations := latest.info.meta.Provides
+		if role == charm.RoleRequirer {
+			relations = latest.info.meta.Requires
+		}
+		for _, name := range interfaceNames(relations) {
+			if name == iface {
+				result = append(result, latest.url)
+				break
+			}
+		}
+	}
+	sort.Sort(byURLString(result))
+	return result, nil
+}
+
+// RelatedCharms implements StoreReader.RelatedCharms.
+func (s *StaticStore) RelatedCharms(url *charm.URL) ([]RelatedCharm, error) {
+	return relatedCharms(s, url)
+}
+
+// IncCounter implements StoreReader.IncCounter by recording
+// the increment in the statistics file, if any.
+func (s *StaticStore) IncCounter(key []string) error {
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+	return s.recordCounter(key)
+}
+
+// IncUniqueCounter implements StoreReader.IncUniqueCounter by
+// recording the increment in the statistics file, if any, unless
+// already recorded for client since charmd started in the current
+// window.
+func (s *StaticStore) IncUniqueCounter(key []string, client string, window time.Duration) error {
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+	if s.statsFile == nil {
+		return nil
+	}
+	if s.seen == nil {
+		s.seen = make(seenClients)
+	}
+	if added, err := s.seen.add(key, client, window, time.Now()); !added {
+		return err
+	}
+	return s.recordCounter(key)
+}
+
+// recordCounter records an increment of the counter for key
+// in the statistics file, if any. It must be called with
+// s.statsMu held.
+func (s *StaticStore) recordCounter(key []string) error {
+	if s.statsFile == nil {
+		return nil
+	}
+	data, err := json.Marshal(&staticStatsRecord{time.Now().UTC(), key})
+	if err != nil {
+		return err
+	}
+	_, err = s.statsFile.Write(append(data, '\n'))
+	return err
+}
+
+// Counters implements StoreReader.Counters.
+// ErrStaticUnsupported is always returned.
+func (s *StaticStore) Counters(req *CounterRequest) ([]Counter, error) {
+	return nil, ErrStaticUnsupported
+}
+
+// verifySha256 returns an error if the SHA256 hash
+// of data isn't the expected one.
+func verifySha256(data []byte, expected string) error {
+	hash := sha256.Sum256(data)
+	if sum := hex.EncodeToString(hash[:]); sum != expected {
+		return fmt.Errorf("archive has SHA256 %s, expected %s", sum, expected)
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore_test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	charmtesting "github.com/juju/charm/testing"
+	gc "launchpad.net/gocheck"
+
+	"github.com/juju/charmstore"
+)
+
+func (s *StoreSuite) TestStaticServerMatchesStore(c *gc.C) {
+	publishDummy(c, s.store, "digest-0", "cs:precise/dummy")
+	publishDummy(c, s.store, "digest-1", "cs:precise/dummy")
+	publishDummy(c, s.store, "digest-2", "cs:trusty/dummy")
+	handler, err := charmstore.NewServer(s.store)
+	c.Assert(err, gc.IsNil)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	dir := c.MkDir()
+	urls := []string{"cs:precise/dummy-0", "cs:precise/dummy", "cs:trusty/dummy"}
+	_, err = charmstore.WriteSubset(server.URL, dir, urls, nil)
+	c.Assert(err, gc.IsNil)
+
+	statsPath := filepath.Join(c.MkDir(), "stats.log")
+	static, err := charmstore.OpenStatic(dir, statsPath)
+	c.Assert(err, gc.IsNil)
+	defer static.Close()
+	staticHandler, err := charmstore.NewServer(static)
+	c.Assert(err, gc.IsNil)
+
+	for i, path := range []string{
+		"/charm-info?charms=cs:precise/dummy",
+		"/charm-info?charms=cs:precise/dummy-0",
+		"/charm-info?charms=cs:dummy",
+		"/charm-info?charms=cs:trusty/dummy&charms=cs:precise/missing",
+		"/charm-event?charms=cs:precise/dummy",
+		"/charm-event?charms=cs:precise/dummy@digest-0",
+		"/charm-event?charms=cs:precise/missing",
+		"/charm/precise/dummy",
+		"/charm/precise/dummy-0",
+		"/charm/trusty/dummy-0",
+		"/charm/precise/missing",
+	} {
+		c.Logf("test %d: %s", i, path)
+		req, err := http.NewRequest("GET", path, nil)
+		c.Assert(err, gc.IsNil)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		req, err = http.NewRequest("GET", path, nil)
+		c.Assert(err, gc.IsNil)
+		staticRec := httptest.NewRecorder()
+		staticHandler.ServeHTTP(staticRec, req)
+
+		c.Assert(staticRec.Code, gc.Equals, rec.Code)
+		c.Assert(staticRec.Body.String(), gc.Equals, rec.Body.String())
+		c.Assert(staticRec.Header().Get("Content-Type"), gc.Equals, rec.Header().Get("Content-Type"))
+	}
+
+	// Counters are incremented in the background.
+	var data []byte
+	for retry := 0; retry < 10; retry++ {
+		time.Sleep(1e8)
+		data, err = ioutil.ReadFile(statsPath)
+		c.Assert(err, gc.IsNil)
+		if strings.Contains(string(data), `"charm-bundle"`) {
+			break
+		}
+	}
+	c.Assert(string(data), gc.Matches, `(?s).*"key":\["charm-bundle","precise","dummy"\].*`)
+}
+
+// writeStaticDir writes a static charm directory holding
+// the dummy charm at cs:precise/dummy-3, and returns its path.
+func writeStaticDir(c *gc.C) string {
+	dir := c.MkDir()
+	data, err := ioutil.ReadFile(charmtesting.Charms.BundlePath(c.MkDir(), "dummy"))
+	c.Assert(err, gc.IsNil)
+	hash := sha256.Sum256(data)
+	sum := hex.EncodeToString(hash[:])
+	err = os.Mkdir(filepath.Join(dir, "charms"), 0755)
+	c.Assert(err, gc.IsNil)
+	err = ioutil.WriteFile(filepath.Join(dir, "charms", sum), data, 0644)
+	c.Assert(err, gc.IsNil)
+	index := fmt.Sprintf(`{
+		"format": 1,
+		"charms": [{
+			"url": "cs:precise/dummy",
+			"revision": 3,
+			"digest": "some-digest",
+			"sha256": %q,
+			"size": %d,
+			"event": {"kind": "published", "revision": 3, "digest": "some-digest", "time": "2014-06-01T10:00:00Z"}
+		}]
+	}`, sum, len(data))
+	err = ioutil.WriteFile(filepath.Join(dir, "index.json"), []byte(index), 0644)
+	c.Assert(err, gc.IsNil)
+	return dir
+}
+
+func (s *TrivialSuite) TestStaticServer(c *gc.C) {
+	static, err := charmstore.OpenStatic(writeStaticDir(c), "")
+	c.Assert(err, gc.IsNil)
+	defer static.Close()
+	server, err := charmstore.NewServer(static)
+	c.Assert(err, gc.IsNil)
+
+	req, err := http.NewRequest("GET", "/charm-info?charms=cs:dummy", nil)
+	c.Assert(err, gc.IsNil)
+	rec := httptest.NewRecorder()
+	server.ServeHTTP(rec, req)
+	var info map[string]map[string]interface{}
+	err = json.Unmarshal(rec.Body.Bytes(), &info)
+	c.Assert(err, gc.IsNil)
+	c.Assert(info["cs:dummy"]["canonical-url"], gc.Equals, "cs:precise/dummy")
+	c.Assert(info["cs:dummy"]["revision"], gc.Equals, float64(3))
+	c.Assert(info["cs:dummy"]["digest"], gc.Equals, "some-digest")
+
+	req, err = http.NewRequest("GET", "/charm-event?charms=cs:precise/dummy", nil)
+	c.Assert(err, gc.IsNil)
+	rec = httptest.NewRecorder()
+	server.ServeHTTP(rec, req)
+	c.Assert(rec.Body.String(), gc.Matches, `.*"kind":"published".*"time":"2014-06-01T10:00:00Z".*`)
+
+	req, err = http.NewRequest("GET", "/changes", nil)
+	c.Assert(err, gc.IsNil)
+	rec = httptest.NewRecorder()
+	server.ServeHTTP(rec, req)
+	c.Assert(rec.Code, gc.Equals, http.StatusInternalServerError)
+}
+
+func (s *TrivialSuite) TestOpenStaticErrors(c *gc.C) {
+	_, err := charmstore.OpenStatic(c.MkDir(), "")
+	c.Assert(err, gc.ErrorMatches, "cannot open static charm directory: .*index.json: no such file or directory")
+
+	dir := writeStaticDir(c)
+	paths, err := filepath.Glob(filepath.Join(dir, "charms", "*"))
+	c.Assert(err, gc.IsNil)
+	err = ioutil.WriteFile(paths[0], []byte("corrupt"), 0644)
+	c.Assert(err, gc.IsNil)
+	_, err = charmstore.OpenStatic(dir, "")
+	c.Assert(err, gc.ErrorMatches, "cannot open static charm directory: charms/[0-9a-f]+: archive has SHA256 [0-9a-f]+, expected [0-9a-f]+")
+
+	err = ioutil.WriteFile(filepath.Join(dir, "index.json"), []byte(`{"format": 2}`), 0644)
+	c.Assert(err, gc.IsNil)
+	_, err = charmstore.OpenStatic(dir, "")
+	c.Assert(err, gc.ErrorMatches, "cannot open static charm directory: unsupported static charm directory format 2")
+}
@@ -31,15 +31,34 @@ var logger = loggo.GetLogger("juju.store")
 //
 //     juju.events        - Log of events relating to the lifecycle of charms
 //     juju.charms        - Information about the stored charms
-//     juju.charmfs.*     - GridFS with the charm files
+//     juju.bundles       - Information about the stored bundles
+//     juju.charmfs.*     - GridFS with the charm and bundle files
 //     juju.locks         - Has unique keys with url of updating charms
+//     juju.channels      - Revisions released in each channel for charm URLs
+//     juju.promulgations - User namespaces backing unqualified charm names
+//     juju.webhooks      - Subscriptions to charm events
+//     juju.deliveries    - Webhook notifications pending delivery
+//     juju.deadletters   - Webhook notifications that could not be delivered
+//     juju.sync.sources  - Time of the last synchronization with charm sources
+//     juju.sync.branches - Last charm seen for each synchronized branch
+//     juju.mirrors       - Progress of mirroring remote stores
 //     juju.stat.counters - Counters for statistics
 //     juju.stat.tokens   - Tokens used in statistics counter keys
+//     juju.stat.seen     - Clients already counted by unique counters
 
 var (
 	ErrUpdateConflict  = errors.New("charm update in progress")
 	ErrRedundantUpdate = errors.New("charm is up-to-date")
 
+	// ErrPublishDeferred is returned when publishing is not
+	// attempted because a previous attempt failed with a
+	// transient error too recently.
+	ErrPublishDeferred = errors.New("charm publishing deferred after transient failure")
+
+	// errEmptyArchive is returned when publishing an archive
+	// to which no data was written.
+	errEmptyArchive = errors.New("cannot publish empty archive")
+
 	// Note that this error message is part of the API, since it's sent
 	// both in charm-info and charm-event responses as errors indicating
 	// that the given charm or charm event wasn't found.
@@ -53,6 +72,7 @@ const (
 // Store holds a connection to a charm store.
 type Store struct {
 	session *storeSession
+	hooks   *webhookDispatcher
 
 	// Cache for statistics key words (two generations).
 	cacheMu       sync.RWMutex
@@ -60,12 +80,25 @@ type Store struct {
 	statsIdOld    map[string]int
 	statsTokenNew map[int]string
 	statsTokenOld map[int]string
+
+	lintPolicies
+
+	signer
+
+	limitsMu sync.RWMutex
+	limits   StorageLimits
 }
 
 // Open creates a new session with the store. It connects to the MongoDB
 // server at the given address (as expected by the Mongo function in the
 // labix.org/v2/mgo package).
 func Open(mongoAddr string) (store *Store, err error) {
+	return OpenDB(mongoAddr, "juju")
+}
+
+// OpenDB is like Open, but the store data is held in the
+// MongoDB database with the given name rather than "juju".
+func OpenDB(mongoAddr, dbName string) (store *Store, err error) {
 	logger.Infof("store opened, connecting to: %s", mongoAddr)
 	store = &Store{}
 	session, err := mgo.Dial(mongoAddr)
@@ -74,16 +107,27 @@ func Open(mongoAddr string) (store *Store, err error) {
 		return nil, err
 	}
 
-	store = &Store{session: &storeSession{session}}
+	store = &Store{
+		session: &storeSession{session, dbName},
+		hooks:   newWebhookDispatcher(),
+	}
 
 	// Ignore error. It'll always fail after created.
 	// TODO Check the error once mgo hands it to us.
-	_ = store.session.DB("juju").Run(bson.D{{"create", "stat.counters"}, {"autoIndexId", false}}, nil)
+	_ = store.session.db().Run(bson.D{{"create", "stat.counters"}, {"autoIndexId", false}}, nil)
 
 	if err := store.ensureIndexes(); err != nil {
 		session.Close()
 		return nil, err
 	}
+	if err := store.sequenceEvents(); err != nil {
+		session.Close()
+		return nil, err
+	}
+	if err := store.addInterfaceNames(); err != nil {
+		session.Close()
+		return nil, err
+	}
 
 	// Put the used socket back in the pool.
 	session.Refresh()
@@ -101,12 +145,45 @@ func (s *Store) ensureIndexes() error {
 	}, {
 		session.StatTokens(),
 		mgo.Index{Key: []string{"t"}, Unique: true},
+	}, {
+		session.StatSeen(),
+		mgo.Index{Key: []string{"expires"}, ExpireAfter: time.Second},
 	}, {
 		session.Charms(),
 		mgo.Index{Key: []string{"urls", "revision"}, Unique: true},
 	}, {
 		session.Events(),
 		mgo.Index{Key: []string{"urls", "digest"}},
+	}, {
+		session.Events(),
+		mgo.Index{Key: []string{"time", "_id"}},
+	}, {
+		session.Events(),
+		mgo.Index{Key: []string{"seq"}, Unique: true, Sparse: true},
+	}, {
+		session.Charms(),
+		mgo.Index{Key: []string{"provides"}},
+	}, {
+		session.Charms(),
+		mgo.Index{Key: []string{"requires"}},
+	}, {
+		session.Bundles(),
+		mgo.Index{Key: []string{"urls", "revision"}, Unique: true},
+	}, {
+		session.Channels(),
+		mgo.Index{Key: []string{"url", "channel"}, Unique: true},
+	}, {
+		session.Promulgations(),
+		mgo.Index{Key: []string{"name"}, Unique: true},
+	}, {
+		session.Webhooks(),
+		mgo.Index{Key: []string{"scope"}},
+	}, {
+		session.WebhookDeliveries(),
+		mgo.Index{Key: []string{"nextattempt"}},
+	}, {
+		session.SyncBranches(),
+		mgo.Index{Key: []string{"source", "pending"}},
 	}}
 	for _, idx := range indexes {
 		err := idx.c.EnsureIndex(idx.i)
@@ -118,8 +195,11 @@ func (s *Store) ensureIndexes() error {
 	return nil
 }
 
-// Close terminates the connection with the store.
+// Close terminates the connection with the store, after waiting for
+// the webhook notifications being delivered. Notifications that
+// failed are left to be retried by DeliverWebhooks.
 func (s *Store) Close() {
+	s.hooks.close()
 	s.session.Close()
 }
 
@@ -249,14 +329,53 @@ func (s *Store) IncCounter(key []string) error {
 		return err
 	}
 
-	t := time.Now().UTC()
+	return incCounter(session, skey, time.Now())
+}
+
+// incCounter increases by one the counter associated with
+// the statistics identifier skey at time t.
+func incCounter(session *storeSession, skey string, t time.Time) error {
+	t = t.UTC()
 	// Round to the start of the minute so we get one document per minute at most.
 	t = t.Add(-time.Duration(t.Second()) * time.Second)
 	counters := session.StatCounters()
-	_, err = counters.Upsert(bson.D{{"k", skey}, {"t", timeToStamp(t)}}, bson.D{{"$inc", bson.D{{"c", 1}}}})
+	_, err := counters.Upsert(bson.D{{"k", skey}, {"t", timeToStamp(t)}}, bson.D{{"$inc", bson.D{{"c", 1}}}})
 	return err
 }
 
+// IncUniqueCounter increases by one the counter associated with the
+// composed key, unless it was already increased for the same client
+// during the current window of time. Windows are aligned so that
+// windows of 24 hours are UTC days. The client is usually a fingerprint
+// of the client making the request being counted.
+func (s *Store) IncUniqueCounter(key []string, client string, window time.Duration) error {
+	if window <= 0 {
+		return fmt.Errorf("store: invalid unique counter window %v", window)
+	}
+	session := s.session.Copy()
+	defer session.Close()
+
+	skey, err := s.statsKey(session, key, true)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	start := now.UTC().Truncate(window)
+	// The documents of past windows are removed by MongoDB
+	// once they expire, thanks to the TTL index on expires.
+	err = session.StatSeen().Insert(bson.D{
+		{"_id", fmt.Sprintf("%s %s %d", skey, client, start.Unix())},
+		{"expires", start.Add(window)},
+	})
+	if mgo.IsDup(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return incCounter(session, skey, now)
+}
+
 // CounterRequest represents a request to aggregate counter values.
 type CounterRequest struct {
 	// Key and Prefix determine the counter keys to match.
@@ -504,7 +623,10 @@ func (s sortableCounters) Less(i, j int) bool {
 // A CharmPublisher is responsible for importing a charm dir onto the store.
 type CharmPublisher struct {
 	revision int
-	w        *charmWriter
+	urls     []*charm.URL
+	w        charmSink
+	policy   LintPolicy
+	warnings []string
 }
 
 // Revision returns the revision that will be assigned to the published charm.
@@ -512,6 +634,12 @@ func (p *CharmPublisher) Revision() int {
 	return p.revision
 }
 
+// Warnings returns the problems found when linting the published
+// charm which didn't prevent it from being published.
+func (p *CharmPublisher) Warnings() []string {
+	return p.warnings
+}
+
 // CharmDir matches the part of the interface of *charm.Dir that is necessary
 // to publish a charm. Using this interface rather than *charm.Dir directly
 // makes testing some aspects of the store possible.
@@ -526,8 +654,25 @@ type CharmDir interface {
 // Statically ensure that *charm.Dir is indeed a CharmDir.
 var _ CharmDir = (*charm.Dir)(nil)
 
+// charmSink stores the archive of a charm being published.
+type charmSink interface {
+	io.Writer
+
+	// written returns the number of bytes written so far.
+	written() int64
+
+	// abort discards the written archive.
+	abort()
+
+	// finishCharm makes the written archive available
+	// in the store as the archive of ch.
+	finishCharm(ch CharmDir) error
+}
+
 // Publish bundles charm and writes it to the store. The written charm
 // bundle will have its revision set to the result of Revision.
+// The charm is linted before being written, and a *LintError is
+// returned if lint errors are found under the strict lint policy.
 // Publish must be called only once for a CharmPublisher.
 func (p *CharmPublisher) Publish(charm CharmDir) error {
 	w := p.w
@@ -535,16 +680,19 @@ func (p *CharmPublisher) Publish(charm CharmDir) error {
 		panic("CharmPublisher already published a charm")
 	}
 	p.w = nil
-	w.charm = charm
+	problems, warnings := lintCharm(charm)
+	if len(problems) > 0 && p.policy == LintStrict {
+		return &LintError{problems}
+	}
 	// TODO: Refactor to BundleTo(w, revision)
 	charm.SetRevision(p.revision)
 	err := charm.BundleTo(w)
-	if err == nil {
-		err = w.finish()
-	} else {
+	if err != nil {
 		w.abort()
+		return err
 	}
-	return err
+	p.warnings = append(problems, warnings...)
+	return w.finishCharm(charm)
 }
 
 // CharmPublisher returns a new CharmPublisher for importing a charm that
@@ -561,93 +709,168 @@ func (s *Store) CharmPublisher(urls []*charm.URL, digest string) (p *CharmPublis
 	session := s.session.Copy()
 	defer session.Close()
 
+	revision, err := nextRevision(session.Charms(), urls, digest)
+	if err != nil {
+		return nil, err
+	}
+	logger.Infof("preparing writer to add charms with revision %d.", revision)
+	w := &charmWriter{
+		store:    s,
+		urls:     urls,
+		revision: revision,
+		digest:   digest,
+	}
+	return &CharmPublisher{revision: revision, urls: urls, w: w, policy: s.lintPolicy(urls)}, nil
+}
+
+// nextRevision returns the revision to be assigned to a new entry in
+// coll that will be made available at all of the provided urls with
+// the given digest. ErrRedundantUpdate is returned if all of the urls
+// are already associated to that digest.
+func nextRevision(coll *mgo.Collection, urls []*charm.URL, digest string) (int, error) {
 	maxRev := -1
 	newKey := false
-	charms := session.Charms()
-	doc := charmDoc{}
+	doc := struct {
+		Revision int
+		Digest   string
+	}{}
 	for i := range urls {
 		urlStr := urls[i].String()
-		err = charms.Find(bson.D{{"urls", urlStr}}).Sort("-revision").One(&doc)
+		err := coll.Find(bson.D{{"urls", urlStr}}).Sort("-revision").One(&doc)
 		if err == mgo.ErrNotFound {
 			logger.Infof("charm %s not yet in the store.", urls[i])
 			newKey = true
 			continue
 		}
+		if err != nil {
+			logger.Errorf("unknown error looking for charm %s: %s", urlStr, err)
+			return 0, err
+		}
 		if doc.Digest != digest {
 			logger.Infof("charm %s is out of date with revision key %q.", urlStr, digest)
 			newKey = true
 		}
-		if err != nil {
-			logger.Errorf("unknown error looking for charm %s: %s", urlStr, err)
-			return
-		}
 		if doc.Revision > maxRev {
 			maxRev = doc.Revision
 		}
 	}
 	if !newKey {
 		logger.Infof("all charms have revision key %q. Nothing to update.", digest)
-		err = ErrRedundantUpdate
-		return
+		return 0, ErrRedundantUpdate
 	}
-	revision := maxRev + 1
-	logger.Infof("preparing writer to add charms with revision %d.", revision)
-	w := &charmWriter{
-		store:    s,
-		urls:     urls,
-		revision: revision,
-		digest:   digest,
-	}
-	return &CharmPublisher{revision, w}, nil
+	return maxRev + 1, nil
 }
 
 // charmWriter is an io.Writer that writes charm bundles to the charms GridFS.
+// It is also used to write bundle archives, in which case bundle is set
+// rather than charm.
 type charmWriter struct {
 	store    *Store
 	session  *storeSession
 	file     *mgo.GridFile
 	sha256   hash.Hash
 	charm    CharmDir
+	bundle   BundleDir
 	urls     []*charm.URL
 	revision int
 	digest   string
+	size     int64
+
+	// maxSize holds the size the archive must not exceed given
+	// the storage limits of the store, or zero if there is none.
+	// limitErr holds the error reported when it's exceeded.
+	maxSize  int64
+	limitErr *StorageLimitError
+
+	// err holds the error which made the writing fail,
+	// returned by all later calls.
+	err error
 }
 
 // Write creates an entry in the charms GridFS when first called,
-// and streams all written data into it.
+// and streams all written data into it. The writing fails with a
+// *StorageLimitError when the data exceeds the storage limits.
 func (w *charmWriter) Write(data []byte) (n int, err error) {
+	if w.err != nil {
+		return 0, w.err
+	}
 	if w.file == nil {
 		w.session = w.store.session.Copy()
+		w.maxSize, w.limitErr, err = archiveLimit(w.store.storageLimits(), w.urls, func(user string) (int64, error) {
+			return namespaceUsage(w.session, user)
+		})
+		if err != nil {
+			logger.Errorf("failed to get storage limits for %v: %v", w.urls, err)
+			w.session.Close()
+			return 0, err
+		}
 		w.file, err = w.session.CharmFS().Create("")
 		if err != nil {
 			logger.Errorf("failed to create GridFS file: %v", err)
+			w.session.Close()
 			return 0, err
 		}
 		w.sha256 = sha256.New()
 		logger.Infof("creating GridFS file with id %q...", w.file.Id().(bson.ObjectId).Hex())
 	}
+	if w.maxSize != 0 && w.size+int64(len(data)) > w.maxSize {
+		logger.Errorf("cannot publish %v: %v", w.urls, w.limitErr)
+		w.err = w.limitErr
+		return 0, w.err
+	}
 	_, err = w.sha256.Write(data)
 	if err != nil {
 		panic("hash.Hash should never error")
 	}
-	return w.file.Write(data)
+	n, err = w.file.Write(data)
+	w.size += int64(n)
+	return n, err
+}
+
+// written returns the number of bytes written so far.
+func (w *charmWriter) written() int64 {
+	return w.size
 }
 
-// abort cancels the charm writing.
+// finishCharm completes the writing of the archive of ch.
+func (w *charmWriter) finishCharm(ch CharmDir) error {
+	w.charm = ch
+	return w.finish()
+}
+
+// abort cancels the charm writing, removing
+// the data written to the GridFS file.
 func (w *charmWriter) abort() {
 	if w.file != nil {
 		// Ignore error. Already aborting due to a preceding bad situation
 		// elsewhere. This error is not important right now.
+		w.file.Abort()
 		_ = w.file.Close()
 		w.session.Close()
+		w.file = nil
 	}
 }
 
 // finish completes the charm writing process and inserts the final metadata.
 // After it completes the charm will be available for consumption.
 func (w *charmWriter) finish() error {
+	if w.err != nil {
+		// The error may have been swallowed by the code
+		// writing the archive.
+		w.abort()
+		return w.err
+	}
 	if w.file == nil {
-		return nil
+		return errEmptyArchive
+	}
+	var sigURLs []*charm.URL
+	if w.bundle == nil {
+		var err error
+		if sigURLs, err = w.store.signatureURLs(w.urls); err != nil {
+			logger.Errorf("cannot get signature URLs for %v: %v", w.urls, err)
+			w.abort()
+			return err
+		}
 	}
 	defer w.session.Close()
 	id := w.file.Id()
@@ -657,8 +880,12 @@ func (w *charmWriter) finish() error {
 		logger.Errorf("failed to close GridFS file: %v", err)
 		return err
 	}
-	charms := w.session.Charms()
 	sha256 := hex.EncodeToString(w.sha256.Sum(nil))
+	if w.bundle != nil {
+		return w.insertBundle(id.(bson.ObjectId), size, sha256)
+	}
+	charms := w.session.Charms()
+	meta := w.charm.Meta()
 	charm := charmDoc{
 		w.urls,
 		w.revision,
@@ -666,9 +893,12 @@ func (w *charmWriter) finish() error {
 		sha256,
 		size,
 		id.(bson.ObjectId),
-		w.charm.Meta(),
+		meta,
 		w.charm.Config(),
 		w.charm.Actions(),
+		interfaceNames(meta.Provides),
+		interfaceNames(meta.Requires),
+		w.store.signCharm(sigURLs, w.revision, sha256),
 	}
 	if err = charms.Insert(&charm); err != nil {
 		err = maybeConflict(err)
@@ -687,6 +917,10 @@ type CharmInfo struct {
 	meta     *charm.Meta
 	config   *charm.Config
 	actions  *charm.Actions
+
+	// signatures holds the signatures of the charm
+	// revision for the URLs it was published at.
+	signatures []charmSignature
 }
 
 // Statically ensure CharmInfo is a charm.Charm.
@@ -748,11 +982,38 @@ func (s byPreferredSeries) Less(i, j int) bool {
 }
 
 // Series returns all the series available for a charm reference, in descending
-// order of preference. LTS releases preferred over non-LTS
+// order of preference. LTS releases preferred over non-LTS. The series of
+// the user charm backing a promulgated unqualified reference are included.
 func (s *Store) Series(ref charm.Reference) ([]string, error) {
 	session := s.session.Copy()
 	defer session.Close()
 
+	// Unique set of series
+	seriesSet := make(map[string]bool)
+	if err := addSeries(session, ref, seriesSet); err != nil {
+		return nil, err
+	}
+	purl, err := s.promulgatedURL(&charm.URL{Reference: ref})
+	if err != nil {
+		return nil, err
+	}
+	if purl != nil {
+		if err := addSeries(session, purl.Reference, seriesSet); err != nil {
+			return nil, err
+		}
+	}
+
+	// Collect into a slice
+	var result []string
+	for series := range seriesSet {
+		result = append(result, series)
+	}
+	sort.Sort(byPreferredSeries(result))
+	return result, nil
+}
+
+// addSeries adds the series of the charms stored for ref to seriesSet.
+func addSeries(session *storeSession, ref charm.Reference, seriesSet map[string]bool) error {
 	patternURL := &charm.URL{Reference: ref, Series: "[a-z][^/]+"}
 	patternURL = patternURL.WithRevision(-1)
 
@@ -763,11 +1024,8 @@ func (s *Store) Series(ref charm.Reference) ([]string, error) {
 	var cdocs []charmDoc
 	err := q.All(&cdocs)
 	if err != nil {
-		return nil, err
+		return err
 	}
-
-	// Unique set of series
-	seriesSet := make(map[string]bool)
 	for _, cdoc := range cdocs {
 		for _, url := range cdoc.URLs {
 			if ref == url.Reference {
@@ -775,14 +1033,7 @@ func (s *Store) Series(ref charm.Reference) ([]string, error) {
 			}
 		}
 	}
-
-	// Collect into a slice
-	var result []string
-	for series := range seriesSet {
-		result = append(result, series)
-	}
-	sort.Sort(byPreferredSeries(result))
-	return result, nil
+	return nil
 }
 
 // getRevisions returns at most the last n revisions for charm at url,
@@ -812,23 +1063,30 @@ func (s *Store) getRevisions(url *charm.URL, n int) ([]*CharmInfo, error) {
 		return nil, ErrNotFound
 	}
 	var infos []*CharmInfo
-	for _, cdoc := range cdocs {
-		infos = append(infos, &CharmInfo{
-			cdoc.Revision,
-			cdoc.Digest,
-			cdoc.Sha256,
-			cdoc.Size,
-			cdoc.FileId,
-			cdoc.Meta,
-			cdoc.Config,
-			cdoc.Actions,
-		})
+	for i := range cdocs {
+		infos = append(infos, cdocs[i].info())
 	}
 	return infos, nil
 }
 
 // CharmInfo retrieves the CharmInfo value for the charm at url.
+// Unqualified URLs with a promulgated name are resolved to the
+// backing user charm, if available.
 func (s *Store) CharmInfo(url *charm.URL) (*CharmInfo, error) {
+	purl, err := s.promulgatedURL(url)
+	if err != nil {
+		return nil, err
+	}
+	if purl != nil {
+		if info, err := s.charmInfo(purl); err != ErrNotFound {
+			return info, err
+		}
+	}
+	return s.charmInfo(url)
+}
+
+// charmInfo retrieves the CharmInfo value for the charm stored at url.
+func (s *Store) charmInfo(url *charm.URL) (*CharmInfo, error) {
 	infos, err := s.getRevisions(url, 1)
 	if err != nil {
 		logger.Errorf("failed to find charm %s: %v", url, err)
@@ -859,8 +1117,9 @@ func (s *Store) OpenCharm(url *charm.URL) (info *CharmInfo, rc io.ReadCloser, er
 }
 
 // DeleteCharm deletes the charms matching url. If no revision is specified,
-// all revisions of the charm are deleted.
-func (s *Store) DeleteCharm(url *charm.URL) ([]*CharmInfo, error) {
+// all revisions of the charm are deleted. Each deleted revision is
+// recorded as an EventDeleted event, with the given origin.
+func (s *Store) DeleteCharm(url *charm.URL, origin Origin) ([]*CharmInfo, error) {
 	logger.Debugf("deleting charm %s", url)
 	infos, err := s.getRevisions(url, 0)
 	if err != nil {
@@ -879,14 +1138,43 @@ func (s *Store) DeleteCharm(url *charm.URL) ([]*CharmInfo, error) {
 			logger.Errorf("failed to delete metadata for charm %s: %v", url, err)
 			return deleted, err
 		}
-		err = session.CharmFS().RemoveId(info.fileId)
+		err = removeUnusedArchive(session, info.fileId)
 		if err != nil {
 			logger.Errorf("failed to delete GridFS file for charm %s: %v", url, err)
 			return deleted, err
 		}
 		deleted = append(deleted, info)
+		err = s.LogCharmEvent(&CharmEvent{
+			Kind:     EventDeleted,
+			Digest:   info.Digest(),
+			Revision: info.Revision(),
+			URLs:     []*charm.URL{url.WithRevision(-1)},
+			Actor:    origin.Actor,
+			Reason:   origin.Reason,
+		})
+		if err != nil {
+			logger.Errorf("failed to log deletion of charm %s: %v", url, err)
+			return deleted, err
+		}
+	}
+	return deleted, nil
+}
+
+// removeUnusedArchive removes the archive stored in the GridFS file
+// with the given id, unless other charms or bundles use it, as charms
+// imported with the same content do.
+func removeUnusedArchive(session *storeSession, fileId bson.ObjectId) error {
+	for _, coll := range archiveCollections(session) {
+		n, err := coll.Find(bson.D{{"fileid", fileId}}).Count()
+		if err != nil || n > 0 {
+			return err
+		}
 	}
-	return deleted, err
+	err := session.CharmFS().RemoveId(fileId)
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	return err
 }
 
 type reader struct {
@@ -917,6 +1205,31 @@ type charmDoc struct {
 	Meta     *charm.Meta
 	Config   *charm.Config
 	Actions  *charm.Actions
+
+	// Provides and Requires hold the interface names of the
+	// charm relations, so that charms may be looked up by
+	// the interfaces they implement.
+	Provides []string `bson:",omitempty"`
+	Requires []string `bson:",omitempty"`
+
+	// Signatures holds the signatures of the charm revision for
+	// each of its URLs, if a signing key was set when publishing.
+	Signatures []charmSignature `bson:",omitempty"`
+}
+
+// info returns the CharmInfo describing the charm in cdoc.
+func (cdoc *charmDoc) info() *CharmInfo {
+	return &CharmInfo{
+		cdoc.Revision,
+		cdoc.Digest,
+		cdoc.Sha256,
+		cdoc.Size,
+		cdoc.FileId,
+		cdoc.Meta,
+		cdoc.Config,
+		cdoc.Actions,
+		cdoc.Signatures,
+	}
 }
 
 // LockUpdates acquires a server-side lock for updating a single charm
@@ -933,7 +1246,7 @@ func (s *Store) LockUpdates(urls []*charm.URL) (l *UpdateLock, err error) {
 		keys[i] = urls[i].String()
 	}
 	sort.Strings(keys)
-	l = &UpdateLock{keys, session.Locks(), bson.Now()}
+	l = &UpdateLock{keys: keys, locks: session.Locks(), time: bson.Now()}
 	if err = l.tryLock(); err != nil {
 		session.Close()
 		return nil, err
@@ -946,12 +1259,20 @@ type UpdateLock struct {
 	keys  []string
 	locks *mgo.Collection
 	time  time.Time
+
+	// mem holds the in-memory store the lock was acquired
+	// in, if it wasn't acquired in MongoDB.
+	mem *MemStore
 }
 
 // Unlock removes the previously acquired server-side lock that prevents
 // other processes from attempting to update a set of charm URLs.
 func (l *UpdateLock) Unlock() {
 	logger.Debugf("unlocking charms for future updates: %v", l.keys)
+	if l.mem != nil {
+		l.mem.unlock(l.keys, l.time)
+		return
+	}
 	defer l.locks.Database.Session.Close()
 	for i := len(l.keys) - 1; i >= 0; i-- {
 		// Using time below ensures only the proper lock is removed.
@@ -1014,42 +1335,106 @@ func maybeConflict(err error) error {
 // storeSession wraps a mgo.Session ands adds a few convenience methods.
 type storeSession struct {
 	*mgo.Session
+	dbName string
 }
 
 // Copy copies the storeSession and its underlying mgo session.
 func (s *storeSession) Copy() *storeSession {
-	return &storeSession{s.Session.Copy()}
+	return &storeSession{s.Session.Copy(), s.dbName}
+}
+
+// db returns the database holding the store data.
+func (s *storeSession) db() *mgo.Database {
+	return s.DB(s.dbName)
 }
 
 // Charms returns the mongo collection where charms are stored.
 func (s *storeSession) Charms() *mgo.Collection {
-	return s.DB("juju").C("charms")
+	return s.db().C("charms")
 }
 
-// CharmFS returns a mgo.GridFS to read and write charms.
+// Bundles returns the mongo collection where bundles are stored.
+func (s *storeSession) Bundles() *mgo.Collection {
+	return s.db().C("bundles")
+}
+
+// CharmFS returns a mgo.GridFS to read and write charms and bundles.
 func (s *storeSession) CharmFS() *mgo.GridFS {
-	return s.DB("juju").GridFS("charmfs")
+	return s.db().GridFS("charmfs")
 }
 
 // Events returns the mongo collection where charm events are stored.
 func (s *storeSession) Events() *mgo.Collection {
-	return s.DB("juju").C("events")
+	return s.db().C("events")
 }
 
 // Locks returns the mongo collection where charm locks are stored.
 func (s *storeSession) Locks() *mgo.Collection {
-	return s.DB("juju").C("locks")
+	return s.db().C("locks")
+}
+
+// Channels returns the mongo collection where the revisions released
+// in each channel are stored.
+func (s *storeSession) Channels() *mgo.Collection {
+	return s.db().C("channels")
+}
+
+// Promulgations returns the mongo collection where the user
+// namespaces backing unqualified charm names are stored.
+func (s *storeSession) Promulgations() *mgo.Collection {
+	return s.db().C("promulgations")
+}
+
+// Webhooks returns the mongo collection where webhooks are stored.
+func (s *storeSession) Webhooks() *mgo.Collection {
+	return s.db().C("webhooks")
+}
+
+// WebhookDeliveries returns the mongo collection where the webhook
+// notifications pending delivery are stored.
+func (s *storeSession) WebhookDeliveries() *mgo.Collection {
+	return s.db().C("deliveries")
+}
+
+// WebhookDeadLetters returns the mongo collection where the webhook
+// notifications that couldn't be delivered are stored.
+func (s *storeSession) WebhookDeadLetters() *mgo.Collection {
+	return s.db().C("deadletters")
+}
+
+// SyncSources returns the mongo collection where the time of the
+// last synchronization with each source of charms is stored.
+func (s *storeSession) SyncSources() *mgo.Collection {
+	return s.db().C("sync.sources")
+}
+
+// SyncBranches returns the mongo collection where the last revision
+// seen for each synchronized branch is stored.
+func (s *storeSession) SyncBranches() *mgo.Collection {
+	return s.db().C("sync.branches")
+}
+
+// Mirrors returns the mongo collection where the progress
+// of mirroring remote stores is recorded.
+func (s *storeSession) Mirrors() *mgo.Collection {
+	return s.db().C("mirrors")
 }
 
 // StatTokens returns the mongo collection for storing key tokens
 // for statistics collection.
 func (s *storeSession) StatTokens() *mgo.Collection {
-	return s.DB("juju").C("stat.tokens")
+	return s.db().C("stat.tokens")
 }
 
 // StatCounters returns the mongo collection for counter values.
 func (s *storeSession) StatCounters() *mgo.Collection {
-	return s.DB("juju").C("stat.counters")
+	return s.db().C("stat.counters")
+}
+
+// StatSeen returns the mongo collection where the clients
+// already counted by unique counters are recorded.
+func (s *storeSession) StatSeen() *mgo.Collection {
+	return s.db().C("stat.seen")
 }
 
 type CharmEventKind int
@@ -1057,6 +1442,14 @@ type CharmEventKind int
 const (
 	EventPublished CharmEventKind = iota + 1
 	EventPublishError
+	EventPromulgated
+	EventUnpromulgated
+	EventDeleted
+	EventRestored
+	EventReleased
+	EventVerifyError
+	EventACLChanged
+	EventRetryRequested
 
 	EventKindCount
 )
@@ -1067,12 +1460,31 @@ func (k CharmEventKind) String() string {
 		return "published"
 	case EventPublishError:
 		return "publish-error"
-	}
-	panic(fmt.Errorf("unknown charm event kind %d", k))
+	case EventPromulgated:
+		return "promulgated"
+	case EventUnpromulgated:
+		return "unpromulgated"
+	case EventDeleted:
+		return "deleted"
+	case EventRestored:
+		return "restored"
+	case EventReleased:
+		return "released"
+	case EventVerifyError:
+		return "verify-error"
+	case EventACLChanged:
+		return "acl-changed"
+	case EventRetryRequested:
+		return "retry-requested"
+	}
+	// Events logged by newer versions of the store
+	// may have kinds unknown to this version.
+	return "unknown"
 }
 
 // CharmEvent is a record for an event relating to one or more charm URLs.
 type CharmEvent struct {
+	Id       bson.ObjectId `bson:"_id,omitempty"`
 	Kind     CharmEventKind
 	Digest   string
 	Revision int
@@ -1080,6 +1492,35 @@ type CharmEvent struct {
 	Errors   []string `bson:",omitempty"`
 	Warnings []string `bson:",omitempty"`
 	Time     time.Time
+
+	// Actor and Reason record who made the change
+	// and why, when known.
+	Actor  string `bson:",omitempty"`
+	Reason string `bson:",omitempty"`
+
+	// Channel holds the channel a revision was released
+	// to, for EventReleased events.
+	Channel Channel `bson:",omitempty"`
+
+	// Transient reports whether the failure recorded by an
+	// EventPublishError event may go away by trying again.
+	// Attempts holds the number of consecutive failed attempts
+	// to publish the digest, and RetryAfter the time after which
+	// publishing is attempted again for transient failures.
+	Transient  bool      `bson:",omitempty"`
+	Attempts   int       `bson:",omitempty"`
+	RetryAfter time.Time `bson:",omitempty"`
+
+	// Seq holds the sequence number of the event, which is
+	// assigned by the store in the order events are logged.
+	Seq int64 `bson:",omitempty"`
+}
+
+// Origin describes who makes a change to the store and why.
+// It is recorded in the events logged for the change.
+type Origin struct {
+	Actor  string
+	Reason string
 }
 
 // LogCharmEvent records an event related to one or more charm URLs.
@@ -1090,14 +1531,28 @@ func (s *Store) LogCharmEvent(event *CharmEvent) (err error) {
 	}
 	session := s.session.Copy()
 	defer session.Close()
-	if event.Kind == 0 || event.Digest == "" || len(event.URLs) == 0 {
-		return fmt.Errorf("LogCharmEvent: need valid Kind, Digest and URLs")
+	if event.Kind == 0 || len(event.URLs) == 0 {
+		return fmt.Errorf("LogCharmEvent: need valid Kind and URLs")
+	}
+	if event.Digest == "" && (event.Kind == EventPublished || event.Kind == EventPublishError) {
+		return fmt.Errorf("LogCharmEvent: need valid Digest for %s events", event.Kind)
+	}
+	if event.Id == "" {
+		event.Id = bson.NewObjectId()
 	}
 	if event.Time.IsZero() {
 		event.Time = time.Now()
 	}
-	events := session.Events()
-	return events.Insert(event)
+	err = insertEvent(session.Events(), func(seq int64) error {
+		event.Seq = seq
+		return session.Events().Insert(event)
+	})
+	if err != nil {
+		event.Seq = 0
+		return err
+	}
+	s.notifyWebhooks(event)
+	return nil
 }
 
 // CharmEvent returns the most recent event associated with url
@@ -1111,18 +1566,26 @@ func (s *Store) CharmEvent(url *charm.URL, digest string) (*CharmEvent, error) {
 	if err := mustLackRevision("CharmEvent", url); err != nil {
 		return nil, err
 	}
+	return s.charmEvent(url, digest, nil)
+}
+
+// charmEvent returns the latest event for url and digest, as
+// CharmEvent does, only considering events of the given kinds
+// if any are provided.
+func (s *Store) charmEvent(url *charm.URL, digest string, kinds []CharmEventKind) (*CharmEvent, error) {
 	session := s.session.Copy()
 	defer session.Close()
 
 	events := session.Events()
 	event := &CharmEvent{Digest: digest}
-	var query *mgo.Query
-	if digest == "" {
-		query = events.Find(bson.D{{"urls", url}})
-	} else {
-		query = events.Find(bson.D{{"urls", url}, {"digest", digest}})
+	query := bson.D{{"urls", url}}
+	if digest != "" {
+		query = append(query, bson.DocElem{"digest", digest})
+	}
+	if len(kinds) > 0 {
+		query = append(query, bson.DocElem{"kind", bson.D{{"$in", kinds}}})
 	}
-	err := query.Sort("-time").One(&event)
+	err := events.Find(query).Sort("-time", "-_id").One(&event)
 	if err == mgo.ErrNotFound {
 		return nil, ErrNotFound
 	}
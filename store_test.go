@@ -80,9 +80,14 @@ func (s *StoreSuite) TearDownTest(c *gc.C) {
 type FakeCharmDir struct {
 	revision interface{} // so we can tell if it's not set.
 	error    string
+	meta     *charm.Meta
+	config   *charm.Config
 }
 
 func (d *FakeCharmDir) Meta() *charm.Meta {
+	if d.meta != nil {
+		return d.meta
+	}
 	return &charm.Meta{
 		Name:        "fakecharm",
 		Summary:     "Fake charm for testing purposes.",
@@ -94,6 +99,9 @@ func (d *FakeCharmDir) Meta() *charm.Meta {
 }
 
 func (d *FakeCharmDir) Config() *charm.Config {
+	if d.config != nil {
+		return d.config
+	}
 	return &charm.Config{make(map[string]charm.Option)}
 }
 
@@ -109,10 +117,16 @@ func (d *FakeCharmDir) BundleTo(w io.Writer) error {
 	if d.error == "beforeWrite" {
 		return fmt.Errorf(d.error)
 	}
+	if d.error == "noWrite" {
+		return nil
+	}
 	_, err := w.Write([]byte(fmt.Sprintf("charm-revision-%v", d.revision)))
 	if d.error == "afterWrite" {
 		return fmt.Errorf(d.error)
 	}
+	if d.error == "ignoreWriteError" {
+		return nil
+	}
 	return err
 }
 
@@ -183,7 +197,7 @@ func (s *StoreSuite) TestDeleteCharm(c *gc.C) {
 
 	// Delete an arbitrary middle revision
 	url1 := url.WithRevision(1)
-	infos, err := s.store.DeleteCharm(url1)
+	infos, err := s.store.DeleteCharm(url1, charmstore.Origin{})
 	c.Assert(err, gc.IsNil)
 	c.Assert(len(infos), gc.Equals, 1)
 
@@ -196,7 +210,7 @@ func (s *StoreSuite) TestDeleteCharm(c *gc.C) {
 
 	// Delete all revisions
 	expectedRevs := map[int]bool{0: true, 2: true, 3: true}
-	infos, err = s.store.DeleteCharm(url)
+	infos, err = s.store.DeleteCharm(url, charmstore.Origin{})
 	c.Assert(err, gc.IsNil)
 	c.Assert(len(infos), gc.Equals, 3)
 	for _, deleted := range infos {
@@ -1011,5 +1025,8 @@ func (s *TrivialSuite) TestEventString(c *gc.C) {
 		// This guarantees the switch in String is properly
 		// updated with new event kinds.
 		c.Assert(kind.String(), gc.Matches, "[a-z-]+")
+		c.Assert(kind.String(), gc.Not(gc.Equals), "unknown")
 	}
+	// Kinds logged by newer versions of the store don't cause a panic.
+	c.Assert(charmstore.EventKindCount.String(), gc.Equals, "unknown")
 }
@@ -0,0 +1,254 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/juju/charm"
+
+	"github.com/juju/charmstore/csclient"
+)
+
+// A static charm directory holds a subset of the charms in a store,
+// so that they can be served without access to the store. It has the
+// following layout:
+//
+//	index.json        - Information about each of the charms
+//	charms/<sha256>   - Charm archives, named after their SHA256
+//
+// The index holds the information returned by the /charm-info
+// and /charm-event APIs for each of the charms.
+
+// staticIndexFormat holds the version of the static charm directory format.
+const staticIndexFormat = 1
+
+const staticIndexFile = "index.json"
+
+const staticCharmsDir = "charms"
+
+// staticIndex is the content of the index.json
+// file of a static charm directory.
+type staticIndex struct {
+	Format  int            `json:"format"`
+	Updated time.Time      `json:"updated"`
+	Charms  []*staticCharm `json:"charms"`
+}
+
+// staticCharm holds the information about a charm
+// revision in a static charm directory.
+type staticCharm struct {
+	URL      string                  `json:"url"`
+	Revision int                     `json:"revision"`
+	Digest   string                  `json:"digest"`
+	Sha256   string                  `json:"sha256"`
+	Size     int64                   `json:"size"`
+	Event    *csclient.EventResponse `json:"event,omitempty"`
+}
+
+// path returns the path of the archive of c
+// relative to the static charm directory.
+func (c *staticCharm) path() string {
+	return filepath.Join(staticCharmsDir, c.Sha256)
+}
+
+// readStaticIndex returns the index of the static charm directory
+// at dir, or an empty index if the directory doesn't have one.
+func readStaticIndex(dir string) (*staticIndex, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, staticIndexFile))
+	if os.IsNotExist(err) {
+		return &staticIndex{Format: staticIndexFormat}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var index staticIndex
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, fmt.Errorf("cannot parse %s: %v", staticIndexFile, err)
+	}
+	if index.Format != staticIndexFormat {
+		return nil, fmt.Errorf("unsupported static charm directory format %d", index.Format)
+	}
+	return &index, nil
+}
+
+// write writes index as the index of the static charm directory at dir.
+func (index *staticIndex) write(dir string) error {
+	sort.Sort(staticCharms(index.Charms))
+	index.Updated = time.Now().UTC()
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, staticIndexFile)
+	if err := ioutil.WriteFile(path+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+type staticCharms []*staticCharm
+
+func (cs staticCharms) Len() int      { return len(cs) }
+func (cs staticCharms) Swap(i, j int) { cs[i], cs[j] = cs[j], cs[i] }
+func (cs staticCharms) Less(i, j int) bool {
+	if cs[i].URL != cs[j].URL {
+		return cs[i].URL < cs[j].URL
+	}
+	return cs[i].Revision < cs[j].Revision
+}
+
+// SubsetOptions holds options for writing a static charm directory.
+type SubsetOptions struct {
+	// Series holds the series charm URLs with no series are
+	// resolved in. If empty, such URLs are resolved in the
+	// preferred series of the charm, as done by the remote store.
+	Series []string
+}
+
+// SubsetReport holds the charm URLs, with revision, added to
+// a static charm directory or found in it already.
+type SubsetReport struct {
+	Added    []string
+	Existing []string
+}
+
+// String returns a one line summary of the report.
+func (r *SubsetReport) String() string {
+	return fmt.Sprintf("%d added, %d existing", len(r.Added), len(r.Existing))
+}
+
+// WriteSubset writes to the static charm directory at dir the charms
+// at the given URLs in the store serving its API at remoteURL, so that
+// they can be served without access to the store (see OpenStatic).
+// URLs without a revision select the latest revision of the charm, and
+// URLs without a series are resolved according to opts, which may be
+// nil to use the defaults. Charms already in the directory are kept.
+// The archives are verified against the SHA256 hashes reported by the
+// remote store.
+func WriteSubset(remoteURL, dir string, urls []string, opts *SubsetOptions) (*SubsetReport, error) {
+	if opts == nil {
+		opts = &SubsetOptions{}
+	}
+	var resolved []string
+	for _, url := range urls {
+		ref, series, err := charm.ParseReference(url)
+		if err != nil {
+			return nil, err
+		}
+		if series != "" || len(opts.Series) == 0 {
+			resolved = append(resolved, url)
+			continue
+		}
+		for _, series := range opts.Series {
+			resolved = append(resolved, (&charm.URL{Reference: ref, Series: series}).String())
+		}
+	}
+	if err := os.MkdirAll(filepath.Join(dir, staticCharmsDir), 0755); err != nil {
+		return nil, err
+	}
+	index, err := readStaticIndex(dir)
+	if err != nil {
+		return nil, err
+	}
+	remote := newRemoteClient(remoteURL)
+	report := &SubsetReport{}
+	for _, url := range resolved {
+		c, added, err := addStaticCharm(remote, dir, index, url)
+		if err != nil {
+			return nil, err
+		}
+		curl := c.URL + fmt.Sprintf("-%d", c.Revision)
+		if added {
+			report.Added = append(report.Added, curl)
+		} else {
+			report.Existing = append(report.Existing, curl)
+		}
+	}
+	if err := index.write(dir); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// addStaticCharm adds to index the charm at url in the remote store,
+// writing its archive into dir, unless it's in the index already.
+// The added or existing charm is returned.
+func addStaticCharm(remote *csclient.Client, dir string, index *staticIndex, url string) (*staticCharm, bool, error) {
+	info, err := remote.CharmInfo(url)
+	if err == csclient.ErrNotFound {
+		return nil, false, fmt.Errorf("charm %s not found in remote store", url)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	curl, err := charm.ParseURL(info.CanonicalURL)
+	if err != nil {
+		return nil, false, err
+	}
+	curl = curl.WithRevision(-1)
+	for _, c := range index.Charms {
+		if c.URL != curl.String() || c.Revision != info.Revision {
+			continue
+		}
+		if c.Sha256 != info.Sha256 {
+			return nil, false, fmt.Errorf("charm %s-%d in directory has SHA256 %s, remote store has %s", c.URL, c.Revision, c.Sha256, info.Sha256)
+		}
+		return c, false, nil
+	}
+	// The downloaded archive is verified against the SHA256
+	// hash the remote store reports along with it.
+	info, data, err := remote.Download(curl.WithRevision(info.Revision).String())
+	if err != nil {
+		return nil, false, err
+	}
+	if _, err := charm.ReadBundleBytes(data); err != nil {
+		return nil, false, fmt.Errorf("cannot read charm %s: %v", url, err)
+	}
+	c := &staticCharm{
+		URL:      curl.String(),
+		Revision: info.Revision,
+		Digest:   info.Digest,
+		Sha256:   info.Sha256,
+		Size:     int64(len(data)),
+	}
+	c.Event, err = remoteEvent(remote, curl, info.Digest)
+	if err != nil && err != csclient.ErrNotFound {
+		return nil, false, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, c.path()), data, 0644); err != nil {
+		return nil, false, err
+	}
+	index.Charms = append(index.Charms, c)
+	return c, true, nil
+}
+
+// remoteEvent returns the event logged by the remote store when
+// the charm at curl, which must lack a revision, was published with
+// the given digest. csclient.ErrNotFound is returned if there's none.
+func remoteEvent(remote *csclient.Client, curl *charm.URL, digest string) (*csclient.EventResponse, error) {
+	key := curl.String() + "@" + digest
+	events, err := remote.Event(key)
+	if err != nil {
+		return nil, err
+	}
+	event := events[key]
+	if event == nil {
+		return nil, fmt.Errorf("no event for charm %s in remote store response", key)
+	}
+	if event.Kind == "" && len(event.Errors) > 0 {
+		if event.Errors[0] == csclient.ErrNotFound.Error() {
+			return nil, csclient.ErrNotFound
+		}
+		return nil, fmt.Errorf("cannot get event for charm %s: %s", key, strings.Join(event.Errors, "; "))
+	}
+	return event, nil
+}
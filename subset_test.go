@@ -0,0 +1,74 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore_test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"path/filepath"
+
+	gc "launchpad.net/gocheck"
+
+	"github.com/juju/charmstore"
+	"github.com/juju/charmstore/csclient"
+)
+
+func (s *StoreSuite) TestWriteSubset(c *gc.C) {
+	publishDummy(c, s.store, "digest-0", "cs:precise/dummy")
+	publishDummy(c, s.store, "digest-1", "cs:precise/dummy")
+	publishDummy(c, s.store, "digest-2", "cs:trusty/dummy")
+	handler, err := charmstore.NewServer(s.store)
+	c.Assert(err, gc.IsNil)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	dir := c.MkDir()
+	urls := []string{"cs:precise/dummy", "cs:precise/dummy-0", "cs:dummy"}
+	opts := &charmstore.SubsetOptions{Series: []string{"trusty"}}
+	report, err := charmstore.WriteSubset(server.URL, dir, urls, opts)
+	c.Assert(err, gc.IsNil)
+	c.Assert(report.Added, gc.DeepEquals, []string{"cs:precise/dummy-1", "cs:precise/dummy-0", "cs:trusty/dummy-0"})
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "index.json"))
+	c.Assert(err, gc.IsNil)
+	var index struct {
+		Charms []struct {
+			URL      string
+			Revision int
+			Digest   string
+			Sha256   string
+			Event    *csclient.EventResponse
+		}
+	}
+	err = json.Unmarshal(data, &index)
+	c.Assert(err, gc.IsNil)
+	c.Assert(index.Charms, gc.HasLen, 3)
+	for _, ic := range index.Charms {
+		info, archive := readCharm(c, s.store, fmt.Sprintf("%s-%d", ic.URL, ic.Revision))
+		c.Assert(ic.Digest, gc.Equals, info.Digest())
+		c.Assert(ic.Sha256, gc.Equals, info.BundleSha256())
+		c.Assert(ic.Event.Kind, gc.Equals, "published")
+		c.Assert(ic.Event.Revision, gc.Equals, ic.Revision)
+
+		data, err := ioutil.ReadFile(filepath.Join(dir, "charms", ic.Sha256))
+		c.Assert(err, gc.IsNil)
+		c.Assert(data, gc.DeepEquals, archive)
+		sum := sha256.Sum256(data)
+		c.Assert(hex.EncodeToString(sum[:]), gc.Equals, ic.Sha256)
+	}
+
+	// Charms in the directory are kept and not downloaded again.
+	publishDummy(c, s.store, "digest-3", "cs:precise/dummy")
+	report, err = charmstore.WriteSubset(server.URL, dir, []string{"cs:precise/dummy", "cs:trusty/dummy"}, nil)
+	c.Assert(err, gc.IsNil)
+	c.Assert(report.String(), gc.Equals, "1 added, 1 existing")
+	c.Assert(report.Added, gc.DeepEquals, []string{"cs:precise/dummy-2"})
+
+	_, err = charmstore.WriteSubset(server.URL, dir, []string{"cs:precise/missing"}, nil)
+	c.Assert(err, gc.ErrorMatches, "charm cs:precise/missing not found in remote store")
+}
@@ -0,0 +1,116 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore
+
+import (
+	"time"
+
+	"github.com/juju/charm"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+// syncSourceDoc represents the document stored in MongoDB recording
+// the last successful synchronization with a source of charms.
+type syncSourceDoc struct {
+	Source string `bson:"_id"`
+	Time   time.Time
+}
+
+// syncBranchDoc represents the document stored in MongoDB recording
+// the last candidate seen for a branch of a source when synchronizing.
+// Pending is set when publishing the candidate didn't succeed, so that
+// it's attempted again on later synchronizations even if the branch
+// doesn't change. Failed is set along with Pending when publishing
+// failed permanently, so that the candidate is only attempted again
+// once its branch changes or publishing it is retried on request.
+type syncBranchDoc struct {
+	URL     string `bson:"_id"`
+	Source  string
+	URLs    []string
+	Digest  string
+	Pending bool
+	Failed  bool `bson:",omitempty"`
+	Time    time.Time
+}
+
+// LastSync returns the time of the last successful synchronization
+// with source, as recorded by SetLastSync. The zero time is returned
+// if source was never synchronized.
+func (s *Store) LastSync(source string) (time.Time, error) {
+	session := s.session.Copy()
+	defer session.Close()
+
+	var doc syncSourceDoc
+	err := session.SyncSources().FindId(source).One(&doc)
+	if err == mgo.ErrNotFound {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	return doc.Time, nil
+}
+
+// SetLastSync records t as the time of the last successful
+// synchronization with source.
+func (s *Store) SetLastSync(source string, t time.Time) error {
+	session := s.session.Copy()
+	defer session.Close()
+
+	_, err := session.SyncSources().UpsertId(source, &syncSourceDoc{source, t})
+	return err
+}
+
+// syncBranch returns the last tip seen for the branch at burl,
+// or nil if the branch was never seen.
+func (s *Store) syncBranch(burl string) (*syncBranchDoc, error) {
+	session := s.session.Copy()
+	defer session.Close()
+
+	var doc syncBranchDoc
+	err := session.SyncBranches().FindId(burl).One(&doc)
+	if err == mgo.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &doc, nil
+}
+
+// setSyncBranch records doc as the last tip seen for its branch.
+func (s *Store) setSyncBranch(doc *syncBranchDoc) error {
+	session := s.session.Copy()
+	defer session.Close()
+
+	doc.Time = time.Now()
+	_, err := session.SyncBranches().UpsertId(doc.URL, doc)
+	return err
+}
+
+// pendingSyncBranches returns the branches of source whose last
+// seen candidate wasn't successfully published.
+func (s *Store) pendingSyncBranches(source string) ([]syncBranchDoc, error) {
+	session := s.session.Copy()
+	defer session.Close()
+
+	var docs []syncBranchDoc
+	err := session.SyncBranches().Find(bson.D{{"source", source}, {"pending", true}}).Sort("_id").All(&docs)
+	return docs, err
+}
+
+// publishFailed reports whether the last attempt to publish digest
+// at urls failed permanently, and retrying it wasn't requested since.
+func (s *Store) publishFailed(urls []*charm.URL, digest string) (bool, error) {
+	event, err := s.lastPublishEvent(urls[0], digest)
+	if err == ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	permanent := event.Kind == EventPublishError && !event.Transient
+	return permanent || event.Kind == EventVerifyError, nil
+}
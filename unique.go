@@ -0,0 +1,86 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// seenClients records the clients already counted by unique counters
+// held in memory, as done by Store in juju.stat.seen. It maps the
+// identifiers of the windows clients were counted in to their end.
+type seenClients map[string]time.Time
+
+// add records that client is counted for key at time now, and reports
+// whether it wasn't already counted during the current window.
+func (seen seenClients) add(key []string, client string, window time.Duration, now time.Time) (bool, error) {
+	if len(key) == 0 {
+		return false, fmt.Errorf("store: empty statistics key")
+	}
+	if window <= 0 {
+		return false, fmt.Errorf("store: invalid unique counter window %v", window)
+	}
+	now = now.UTC()
+	for id, expires := range seen {
+		if !now.Before(expires) {
+			delete(seen, id)
+		}
+	}
+	start := now.Truncate(window)
+	id := fmt.Sprintf("%q %s %d", key, client, start.Unix())
+	if _, ok := seen[id]; ok {
+		return false, nil
+	}
+	seen[id] = start.Add(window)
+	return true, nil
+}
+
+// uniqueStatsKey returns the key of the unique counter
+// recorded next to the counter with the given key.
+func uniqueStatsKey(key []string) []string {
+	ukey := append([]string(nil), key...)
+	ukey[0] += "-unique"
+	return ukey
+}
+
+// SetUniqueStatsWindow sets the window of time during which the
+// downloads of a charm or bundle by the same client are counted
+// once by the unique counters "charm-bundle-unique" and
+// "bundle-archive-unique", in addition to the raw counters. Clients
+// are identified by their address and user agent. Unique counters
+// are disabled if window is zero, which is the default.
+func (s *Server) SetUniqueStatsWindow(window time.Duration) {
+	s.uniqueWindow = window
+}
+
+// incCounters increases the counter for key in the background, and the
+// unique counter next to it if enabled, for the client making request r.
+func (s *Server) incCounters(r *http.Request, key []string) {
+	go s.store.IncCounter(key)
+	if s.uniqueWindow > 0 {
+		go s.store.IncUniqueCounter(uniqueStatsKey(key), clientFingerprint(s.clientIP(r), r), s.uniqueWindow)
+	}
+}
+
+// clientIP returns the address of the client making the request r, as
+// seen by the rate limiter if any, or nil if it is unknown.
+func (s *Server) clientIP(r *http.Request) net.IP {
+	if s.rateLimiter != nil {
+		return s.rateLimiter.clientIP(r)
+	}
+	return clientIP(r, nil)
+}
+
+// clientFingerprint returns a hash identifying the client at the given
+// address making the request r, which doesn't reveal the address.
+func clientFingerprint(ip net.IP, r *http.Request) string {
+	hash := sha256.Sum256([]byte(strings.Join([]string{ip.String(), r.UserAgent()}, "\n")))
+	return hex.EncodeToString(hash[:16])
+}
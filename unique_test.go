@@ -0,0 +1,72 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/juju/charm"
+	gc "launchpad.net/gocheck"
+
+	"github.com/juju/charmstore"
+)
+
+// checkMemCounter checks that the counter for key in store reaches
+// the expected value, waiting for the counters increased in the
+// background by the server.
+func checkMemCounter(c *gc.C, store *charmstore.MemStore, key []string, expected int64) {
+	var count int64
+	for retry := 0; retry < 10; retry++ {
+		time.Sleep(1e8)
+		counters, err := store.Counters(&charmstore.CounterRequest{Key: key})
+		c.Assert(err, gc.IsNil)
+		if count = counters[0].Count; count > expected || retry >= 2 && count == expected {
+			break
+		}
+	}
+	c.Assert(count, gc.Equals, expected, gc.Commentf("counter %q", key))
+}
+
+func (s *TrivialSuite) TestUniqueStats(c *gc.C) {
+	store := charmstore.NewMemStore()
+	pub, err := store.CharmPublisher([]*charm.URL{charm.MustParseURL("cs:precise/wordpress")}, "some-digest")
+	c.Assert(err, gc.IsNil)
+	err = pub.Publish(&FakeCharmDir{})
+	c.Assert(err, gc.IsNil)
+	server, err := charmstore.NewServer(store)
+	c.Assert(err, gc.IsNil)
+	server.SetUniqueStatsWindow(24 * time.Hour)
+
+	// Clients are identified by their address and user agent.
+	for _, client := range []struct {
+		remoteAddr string
+		userAgent  string
+	}{
+		{"1.2.3.4:1234", "Go 1.1 package http"},
+		{"1.2.3.4:5678", "Go 1.1 package http"},
+		{"1.2.3.4:1234", "curl/7.35.0"},
+		{"1.2.3.5:1234", "Go 1.1 package http"},
+		{"1.2.3.4:1234", "Go 1.1 package http"},
+	} {
+		req, err := http.NewRequest("GET", "/charm/precise/wordpress", nil)
+		c.Assert(err, gc.IsNil)
+		req.RemoteAddr = client.remoteAddr
+		req.Header.Set("User-Agent", client.userAgent)
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, req)
+		c.Assert(rec.Code, gc.Equals, http.StatusOK)
+	}
+	checkMemCounter(c, store, []string{"charm-bundle", "precise", "wordpress"}, 5)
+	checkMemCounter(c, store, []string{"charm-bundle-unique", "precise", "wordpress"}, 3)
+
+	// Unique counters are queried like the raw ones.
+	req, err := http.NewRequest("GET", "/stats/counter/charm-bundle-unique:*", nil)
+	c.Assert(err, gc.IsNil)
+	rec := httptest.NewRecorder()
+	server.ServeHTTP(rec, req)
+	c.Assert(rec.Code, gc.Equals, http.StatusOK)
+	c.Assert(rec.Body.String(), gc.Equals, "3")
+}
@@ -0,0 +1,167 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/juju/charm"
+)
+
+// URLMapping holds the rules mapping the unique names of the branches
+// in a charm source, such as ~joe/charms/precise/foo/trunk, to the
+// charm URLs the branches are published at.
+type URLMapping struct {
+	// Suffixes holds the branch name suffixes accepted for publishing.
+	// The branches with other names are skipped. If empty, only
+	// trunk branches ("/trunk") are accepted.
+	Suffixes []string `yaml:"suffixes"`
+
+	// Exclude holds regular expressions matching branch names
+	// that are skipped.
+	Exclude []string `yaml:"exclude"`
+
+	// Rules holds the rules mapping branch names to charm URLs.
+	// The first matching rule applies. If empty, the rule mapping
+	// ~<user>/charms/<series>/<name>/trunk to cs:~<user>/<series>/<name>
+	// is used.
+	Rules []URLRule `yaml:"rules"`
+
+	once     sync.Once
+	err      error
+	exclude  []*regexp.Regexp
+	patterns []*regexp.Regexp
+}
+
+// URLRule holds a rule mapping branch names to charm URLs.
+type URLRule struct {
+	// Pattern holds a regular expression matching the branch names
+	// the rule applies to.
+	Pattern string `yaml:"pattern"`
+
+	// URLs holds templates of the charm URLs branches are published
+	// at, in which $name or ${name} is replaced by the text matched
+	// by the respective named group in the pattern.
+	URLs []string `yaml:"urls"`
+}
+
+// defaultURLRule holds the rule used by a URLMapping with no rules.
+// Branch names may have a prefix preceding the ~<user> part, which is
+// useful for testing with branches in the local filesystem.
+var defaultURLRule = URLRule{
+	Pattern: `(?:^|/)~(?P<user>[^/]+)/charms/(?P<series>[^/]+)/(?P<name>[^/]+)/trunk$`,
+	URLs:    []string{"cs:~$user/$series/$name"},
+}
+
+// DefaultURLMapping holds the mapping used when none is configured.
+var DefaultURLMapping = &URLMapping{}
+
+// BranchMapping holds the result of mapping a branch name.
+type BranchMapping struct {
+	// BranchURL holds the URL of the branch.
+	BranchURL string
+
+	// URLs holds the charm URLs the branch is published at.
+	URLs []*charm.URL
+
+	// Skipped holds why the branch is skipped, if it is.
+	Skipped string
+}
+
+// Validate returns an error if the mapping rules are invalid.
+func (m *URLMapping) Validate() error {
+	m.once.Do(m.compile)
+	return m.err
+}
+
+func (m *URLMapping) compile() {
+	for _, expr := range m.Exclude {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			m.err = fmt.Errorf("invalid exclusion pattern: %v", err)
+			return
+		}
+		m.exclude = append(m.exclude, re)
+	}
+	for _, rule := range m.rules() {
+		re, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			m.err = fmt.Errorf("invalid rule pattern: %v", err)
+			return
+		}
+		if len(rule.URLs) == 0 {
+			m.err = fmt.Errorf("rule with pattern %q has no URLs", rule.Pattern)
+			return
+		}
+		m.patterns = append(m.patterns, re)
+	}
+}
+
+func (m *URLMapping) rules() []URLRule {
+	if len(m.Rules) == 0 {
+		return []URLRule{defaultURLRule}
+	}
+	return m.Rules
+}
+
+func (m *URLMapping) suffixes() []string {
+	if len(m.Suffixes) == 0 {
+		return []string{"/trunk"}
+	}
+	return m.Suffixes
+}
+
+// Map maps the branch with the given unique name according to the
+// rules. Names with a URL scheme are used as branch URLs unchanged,
+// while other names are taken to be Launchpad branch names.
+// An error is returned if no rule applies to an accepted branch name.
+func (m *URLMapping) Map(name string) (*BranchMapping, error) {
+	if err := m.Validate(); err != nil {
+		return nil, err
+	}
+	bm := &BranchMapping{BranchURL: name}
+	if !strings.Contains(name, ":") {
+		bm.BranchURL = "lp:" + name
+	}
+	accepted := false
+	for _, suffix := range m.suffixes() {
+		if strings.HasSuffix(name, suffix) {
+			accepted = true
+			break
+		}
+	}
+	if !accepted {
+		bm.Skipped = "branch name suffix not accepted"
+		return bm, nil
+	}
+	for _, re := range m.exclude {
+		if re.MatchString(name) {
+			bm.Skipped = fmt.Sprintf("branch name excluded by pattern %q", re)
+			return bm, nil
+		}
+	}
+	for i, rule := range m.rules() {
+		re := m.patterns[i]
+		match := re.FindStringSubmatchIndex(name)
+		if match == nil {
+			continue
+		}
+		for _, template := range rule.URLs {
+			url := string(re.ExpandString(nil, template, name, match))
+			curl, err := charm.ParseURL(url)
+			if err != nil {
+				return nil, fmt.Errorf("cannot map branch name %s: %v", name, err)
+			}
+			if err := mustLackRevision("URLMapping", curl); err != nil {
+				return nil, err
+			}
+			bm.URLs = append(bm.URLs, curl)
+		}
+		return bm, nil
+	}
+	return nil, fmt.Errorf("unwanted branch name: %s", name)
+}
@@ -0,0 +1,86 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore_test
+
+import (
+	"github.com/juju/charm"
+	gc "launchpad.net/gocheck"
+
+	"github.com/juju/charmstore"
+)
+
+var urlMappingTests = []struct {
+	about   string
+	mapping *charmstore.URLMapping
+	name    string
+	burl    string
+	urls    []string
+	skipped string
+	err     string
+}{{
+	about:   "default mapping",
+	mapping: charmstore.DefaultURLMapping,
+	name:    "~joe/charms/precise/foo/trunk",
+	burl:    "lp:~joe/charms/precise/foo/trunk",
+	urls:    []string{"cs:~joe/precise/foo"},
+}, {
+	about:   "default mapping with a branch URL",
+	mapping: charmstore.DefaultURLMapping,
+	name:    "file:///tmp/branches/~joe/charms/precise/foo/trunk",
+	burl:    "file:///tmp/branches/~joe/charms/precise/foo/trunk",
+	urls:    []string{"cs:~joe/precise/foo"},
+}, {
+	about:   "default mapping, not a trunk",
+	mapping: charmstore.DefaultURLMapping,
+	name:    "~joe/charms/precise/foo/devel",
+	burl:    "lp:~joe/charms/precise/foo/devel",
+	skipped: "branch name suffix not accepted",
+}, {
+	about:   "default mapping, not a charm",
+	mapping: charmstore.DefaultURLMapping,
+	name:    "~joe/juju/trunk",
+	err:     "unwanted branch name: ~joe/juju/trunk",
+}, {
+	about: "invalid charm URL",
+	mapping: &charmstore.URLMapping{Rules: []charmstore.URLRule{{
+		Pattern: "^~(?P<user>[^/]+)/(?P<name>.+)/trunk$",
+		URLs:    []string{"cs:~$user/precise/$name"},
+	}}},
+	name: "~joe/Foo_Bar/trunk",
+	err:  "cannot map branch name ~joe/Foo_Bar/trunk: .*",
+}, {
+	about: "charm URL with revision",
+	mapping: &charmstore.URLMapping{Rules: []charmstore.URLRule{{
+		Pattern: "^~(?P<user>[^/]+)/(?P<name>[^/]+)/trunk$",
+		URLs:    []string{"cs:~$user/precise/$name-1"},
+	}}},
+	name: "~joe/foo/trunk",
+	err:  "URLMapping: got charm URL with revision: cs:~joe/precise/foo-1",
+}, {
+	about: "rule without URLs",
+	mapping: &charmstore.URLMapping{Rules: []charmstore.URLRule{{
+		Pattern: "^~(?P<user>[^/]+)/(?P<name>[^/]+)/trunk$",
+	}}},
+	name: "~joe/foo/trunk",
+	err:  `rule with pattern "\^~\(\?P<user>\[\^/\]\+\)/\(\?P<name>\[\^/\]\+\)/trunk\$" has no URLs`,
+}}
+
+func (s *TrivialSuite) TestURLMapping(c *gc.C) {
+	for i, test := range urlMappingTests {
+		c.Logf("test %d: %s", i, test.about)
+		bm, err := test.mapping.Map(test.name)
+		if test.err != "" {
+			c.Assert(err, gc.ErrorMatches, test.err)
+			continue
+		}
+		c.Assert(err, gc.IsNil)
+		c.Assert(bm.BranchURL, gc.Equals, test.burl)
+		c.Assert(bm.Skipped, gc.Equals, test.skipped)
+		var urls []*charm.URL
+		for _, url := range test.urls {
+			urls = append(urls, charm.MustParseURL(url))
+		}
+		c.Assert(bm.URLs, gc.DeepEquals, urls)
+	}
+}
@@ -0,0 +1,444 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juju/charm"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+
+	"github.com/juju/charmstore/csclient"
+)
+
+// WebhookSignatureHeader holds the HTTP header used to send the
+// hex-encoded HMAC-SHA256 signature of webhook payloads, computed
+// with the webhook secret, in the form "sha256=<signature>".
+const WebhookSignatureHeader = "X-Charmstore-Signature"
+
+// WebhookEventHeader holds the HTTP header used to send
+// the kind of the event notified to webhooks.
+const WebhookEventHeader = "X-Charmstore-Event"
+
+// webhookBackoff holds the delays between successive
+// attempts to deliver a webhook notification. Notifications
+// are retried by Store.DeliverWebhooks.
+var webhookBackoff = []time.Duration{
+	10 * time.Second,
+	time.Minute,
+	10 * time.Minute,
+	time.Hour,
+}
+
+// webhookTimeout holds the time allowed to each delivery attempt.
+const webhookTimeout = 30 * time.Second
+
+// webhookLease holds the time after which a notification being
+// delivered is considered abandoned, and may be delivered again.
+const webhookLease = 2 * webhookTimeout
+
+// Webhook represents a subscription to the charm events in the store.
+type Webhook struct {
+	Id bson.ObjectId `bson:"_id"`
+
+	// URL holds the address the notifications are posted to.
+	URL string
+
+	// Secret, if not empty, is used to sign the notifications.
+	Secret string
+
+	// Scope restricts the events notified to the webhook. It is
+	// empty for all events, holds "~user" for the events about
+	// charms in a user namespace, or a charm URL without revision
+	// for the events about that charm.
+	Scope string
+
+	Time time.Time
+}
+
+// WebhookDeadLetter records a notification that could not be
+// delivered to a webhook.
+type WebhookDeadLetter struct {
+	Id       bson.ObjectId `bson:"_id"`
+	HookId   bson.ObjectId
+	URL      string
+	Kind     string
+	Payload  string
+	Attempts int
+	Error    string
+	Time     time.Time
+}
+
+// webhookScope returns the normalized form of the given webhook scope.
+func webhookScope(scope string) (string, error) {
+	if scope == "" {
+		return "", nil
+	}
+	if strings.HasPrefix(scope, "~") {
+		if len(scope) == 1 || strings.Contains(scope, "/") {
+			return "", fmt.Errorf("invalid webhook scope %q", scope)
+		}
+		return scope, nil
+	}
+	curl, err := charm.ParseURL(scope)
+	if err != nil {
+		return "", fmt.Errorf("invalid webhook scope %q: %v", scope, err)
+	}
+	if curl.Revision != -1 {
+		return "", fmt.Errorf("invalid webhook scope %q: charm URL with revision", scope)
+	}
+	return curl.String(), nil
+}
+
+// AddWebhook subscribes the given HTTP URL to the charm events
+// within scope (see Webhook.Scope), and returns the new webhook.
+func (s *Store) AddWebhook(hookURL, secret, scope string) (*Webhook, error) {
+	u, err := url.Parse(hookURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid webhook URL %q: %v", hookURL, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid webhook URL %q: not an HTTP URL", hookURL)
+	}
+	scope, err = webhookScope(scope)
+	if err != nil {
+		return nil, err
+	}
+	session := s.session.Copy()
+	defer session.Close()
+
+	hook := &Webhook{
+		Id:     bson.NewObjectId(),
+		URL:    hookURL,
+		Secret: secret,
+		Scope:  scope,
+		Time:   time.Now(),
+	}
+	logger.Infof("adding webhook %s for %q", hook.URL, hook.Scope)
+	if err := session.Webhooks().Insert(hook); err != nil {
+		return nil, err
+	}
+	return hook, nil
+}
+
+// Webhooks returns all the webhooks, in the order they were added.
+func (s *Store) Webhooks() ([]*Webhook, error) {
+	session := s.session.Copy()
+	defer session.Close()
+
+	var hooks []*Webhook
+	if err := session.Webhooks().Find(nil).Sort("time", "_id").All(&hooks); err != nil {
+		return nil, err
+	}
+	return hooks, nil
+}
+
+// RemoveWebhook removes the webhook with the given id.
+func (s *Store) RemoveWebhook(id bson.ObjectId) error {
+	session := s.session.Copy()
+	defer session.Close()
+
+	logger.Infof("removing webhook %s", id.Hex())
+	err := session.Webhooks().RemoveId(id)
+	if err == mgo.ErrNotFound {
+		return ErrNotFound
+	}
+	return err
+}
+
+// TestWebhook sends a test notification to the webhook with the given
+// id, and returns any error encountered. The notification isn't
+// retried nor recorded as a dead letter on failure.
+func (s *Store) TestWebhook(id bson.ObjectId) error {
+	session := s.session.Copy()
+	defer session.Close()
+
+	var hook Webhook
+	err := session.Webhooks().FindId(id).One(&hook)
+	if err == mgo.ErrNotFound {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	payload, err := json.Marshal(csclient.ChangeEntry{
+		Kind: "test",
+		URLs: []string{},
+		Time: time.Now().UTC().Format(time.RFC3339),
+	})
+	if err != nil {
+		return err
+	}
+	return s.hooks.post(&hook, "test", payload)
+}
+
+// WebhookDeadLetters returns the notifications that could not be
+// delivered, in the order they were given up on.
+func (s *Store) WebhookDeadLetters() ([]*WebhookDeadLetter, error) {
+	session := s.session.Copy()
+	defer session.Close()
+
+	var letters []*WebhookDeadLetter
+	if err := session.WebhookDeadLetters().Find(nil).Sort("time", "_id").All(&letters); err != nil {
+		return nil, err
+	}
+	return letters, nil
+}
+
+// matchingWebhooks returns the webhooks subscribed to event.
+func (s *Store) matchingWebhooks(event *CharmEvent) ([]*Webhook, error) {
+	session := s.session.Copy()
+	defer session.Close()
+
+	scopes := []string{""}
+	for _, url := range event.URLs {
+		scopes = append(scopes, url.WithRevision(-1).String())
+		if url.User != "" {
+			scopes = append(scopes, "~"+url.User)
+		}
+	}
+	var hooks []*Webhook
+	err := session.Webhooks().Find(bson.D{{"scope", bson.D{{"$in", scopes}}}}).All(&hooks)
+	if err != nil {
+		return nil, err
+	}
+	return hooks, nil
+}
+
+// webhookDelivery records a notification pending delivery to a webhook.
+type webhookDelivery struct {
+	Id       bson.ObjectId `bson:"_id"`
+	HookId   bson.ObjectId
+	Kind     string
+	Payload  string
+	Attempts int
+	Error    string `bson:",omitempty"`
+
+	// NextAttempt holds the time after which delivering the
+	// notification is attempted again.
+	NextAttempt time.Time
+}
+
+// notifyWebhooks notifies event to the webhooks subscribed to it in
+// the background, so that logging events doesn't wait for MongoDB.
+func (s *Store) notifyWebhooks(event *CharmEvent) {
+	e := *event
+	s.hooks.start(func() {
+		s.recordNotifications(&e)
+	})
+}
+
+// recordNotifications records the notification of event to the
+// webhooks subscribed to it, and starts delivering it.
+func (s *Store) recordNotifications(event *CharmEvent) {
+	hooks, err := s.matchingWebhooks(event)
+	if err != nil {
+		logger.Errorf("cannot find webhooks for charm event %s: %v", event.Id.Hex(), err)
+		return
+	}
+	if len(hooks) == 0 {
+		return
+	}
+	payload, err := json.Marshal(newChangeEntry(event))
+	if err != nil {
+		logger.Errorf("cannot marshal charm event %s: %v", event.Id.Hex(), err)
+		return
+	}
+	session := s.session.Copy()
+	defer session.Close()
+
+	for _, hook := range hooks {
+		hook := hook
+		// The delivery is recorded before being attempted, so that
+		// it is retried by DeliverWebhooks if this process stops
+		// before the notification is delivered.
+		d := &webhookDelivery{
+			Id:          bson.NewObjectId(),
+			HookId:      hook.Id,
+			Kind:        event.Kind.String(),
+			Payload:     string(payload),
+			NextAttempt: time.Now().Add(webhookLease),
+		}
+		if err := session.WebhookDeliveries().Insert(d); err != nil {
+			logger.Errorf("cannot record notification to webhook %s: %v", hook.URL, err)
+			continue
+		}
+		s.hooks.start(func() {
+			err := s.hooks.post(hook, d.Kind, []byte(d.Payload))
+			session := s.session.Copy()
+			defer session.Close()
+			s.recordDelivery(session, hook, d, err)
+		})
+	}
+}
+
+// DeliverWebhooks attempts to deliver the webhook notifications
+// due to be retried, and returns the number of notifications
+// delivered. Notifications that fail again are retried later with
+// increasing delays, until they are recorded as dead letters. Each
+// notification is claimed by a single caller at a time, so that
+// several processes can deliver notifications concurrently.
+func (s *Store) DeliverWebhooks() (int, error) {
+	session := s.session.Copy()
+	defer session.Close()
+
+	deliveries := session.WebhookDeliveries()
+	delivered := 0
+	for {
+		now := time.Now()
+		var d webhookDelivery
+		_, err := deliveries.Find(bson.D{{"nextattempt", bson.D{{"$lte", now}}}}).Sort("nextattempt").Apply(mgo.Change{
+			Update:    bson.D{{"$set", bson.D{{"nextattempt", now.Add(webhookLease)}}}},
+			ReturnNew: true,
+		}, &d)
+		if err == mgo.ErrNotFound {
+			return delivered, nil
+		}
+		if err != nil {
+			return delivered, err
+		}
+		var hook Webhook
+		err = session.Webhooks().FindId(d.HookId).One(&hook)
+		if err == mgo.ErrNotFound {
+			// The webhook was removed since the notification was sent.
+			if err := deliveries.RemoveId(d.Id); err != nil && err != mgo.ErrNotFound {
+				return delivered, err
+			}
+			continue
+		}
+		if err != nil {
+			return delivered, err
+		}
+		err = s.hooks.post(&hook, d.Kind, []byte(d.Payload))
+		if err == nil {
+			delivered++
+		}
+		s.recordDelivery(session, &hook, &d, err)
+	}
+}
+
+// recordDelivery records the outcome of an attempt to deliver the
+// notification d to hook, which failed if err is not nil. Failed
+// notifications are scheduled to be retried, or recorded as dead
+// letters once all the attempts failed.
+func (s *Store) recordDelivery(session *storeSession, hook *Webhook, d *webhookDelivery, err error) {
+	deliveries := session.WebhookDeliveries()
+	if err == nil {
+		if err := deliveries.RemoveId(d.Id); err != nil && err != mgo.ErrNotFound {
+			logger.Errorf("cannot remove delivered notification to webhook %s: %v", hook.URL, err)
+		}
+		return
+	}
+	d.Attempts++
+	d.Error = err.Error()
+	logger.Warningf("cannot deliver %s notification to webhook %s (attempt %d): %v", d.Kind, hook.URL, d.Attempts, err)
+	if d.Attempts <= len(webhookBackoff) {
+		d.NextAttempt = time.Now().Add(webhookBackoff[d.Attempts-1])
+		err := deliveries.UpdateId(d.Id, bson.D{{"$set", bson.D{
+			{"attempts", d.Attempts},
+			{"error", d.Error},
+			{"nextattempt", d.NextAttempt},
+		}}})
+		if err != nil {
+			logger.Errorf("cannot record failed notification to webhook %s: %v", hook.URL, err)
+		}
+		return
+	}
+	letter := &WebhookDeadLetter{
+		Id:       bson.NewObjectId(),
+		HookId:   hook.Id,
+		URL:      hook.URL,
+		Kind:     d.Kind,
+		Payload:  d.Payload,
+		Attempts: d.Attempts,
+		Error:    d.Error,
+		Time:     time.Now(),
+	}
+	if err := session.WebhookDeadLetters().Insert(letter); err != nil {
+		logger.Errorf("cannot record undelivered notification to webhook %s: %v", hook.URL, err)
+		return
+	}
+	if err := deliveries.RemoveId(d.Id); err != nil && err != mgo.ErrNotFound {
+		logger.Errorf("cannot remove undelivered notification to webhook %s: %v", hook.URL, err)
+	}
+}
+
+// webhookDispatcher keeps track of the webhook
+// notifications being delivered in the background.
+type webhookDispatcher struct {
+	client *http.Client
+	wg     sync.WaitGroup
+
+	mu     sync.Mutex
+	closed bool
+}
+
+func newWebhookDispatcher() *webhookDispatcher {
+	return &webhookDispatcher{
+		client: &http.Client{Timeout: webhookTimeout},
+	}
+}
+
+// start runs f in the background, unless the dispatcher is closed.
+func (d *webhookDispatcher) start(f func()) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return
+	}
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		f()
+	}()
+}
+
+// close waits for the deliveries in progress to complete.
+func (d *webhookDispatcher) close() {
+	d.mu.Lock()
+	d.closed = true
+	d.mu.Unlock()
+	d.wg.Wait()
+}
+
+// post makes a single attempt to deliver payload to hook.
+func (d *webhookDispatcher) post(hook *Webhook, kind string, payload []byte) error {
+	req, err := http.NewRequest("POST", hook.URL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookEventHeader, kind)
+	if hook.Secret != "" {
+		req.Header.Set(WebhookSignatureHeader, "sha256="+WebhookSignature(hook.Secret, payload))
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned status %q", resp.Status)
+	}
+	return nil
+}
+
+// WebhookSignature returns the hex-encoded HMAC-SHA256
+// signature of payload computed with secret.
+func WebhookSignature(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,290 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/juju/charm"
+	gitjujutesting "github.com/juju/testing"
+	gc "launchpad.net/gocheck"
+
+	"github.com/juju/charmstore"
+)
+
+// webhookRequest holds a request received by a webhook server.
+type webhookRequest struct {
+	path    string
+	header  http.Header
+	payload []byte
+}
+
+// startWebhookServer starts an HTTP server sending the requests it
+// receives on the returned channel and replying with the given status.
+func startWebhookServer(c *gc.C, status int) (*httptest.Server, <-chan webhookRequest) {
+	requests := make(chan webhookRequest, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, err := ioutil.ReadAll(r.Body)
+		c.Check(err, gc.IsNil)
+		requests <- webhookRequest{r.URL.Path, r.Header, data}
+		w.WriteHeader(status)
+	}))
+	return server, requests
+}
+
+func receiveWebhookRequest(c *gc.C, requests <-chan webhookRequest) webhookRequest {
+	select {
+	case req := <-requests:
+		return req
+	case <-time.After(5 * time.Second):
+		c.Fatalf("timed out waiting for webhook notification")
+	}
+	panic("unreachable")
+}
+
+func (s *StoreSuite) TestAddWebhook(c *gc.C) {
+	hook1, err := s.store.AddWebhook("http://example.com/hook1", "", "")
+	c.Assert(err, gc.IsNil)
+	hook2, err := s.store.AddWebhook("https://example.com/hook2", "secret", "~joe")
+	c.Assert(err, gc.IsNil)
+	hook3, err := s.store.AddWebhook("http://example.com/hook3", "", "cs:trusty/mysql")
+	c.Assert(err, gc.IsNil)
+
+	hooks, err := s.store.Webhooks()
+	c.Assert(err, gc.IsNil)
+	c.Assert(hooks, gc.HasLen, 3)
+	c.Assert(hooks[0].Id, gc.Equals, hook1.Id)
+	c.Assert(hooks[1].Id, gc.Equals, hook2.Id)
+	c.Assert(hooks[1].Secret, gc.Equals, "secret")
+	c.Assert(hooks[1].Scope, gc.Equals, "~joe")
+	c.Assert(hooks[2].Id, gc.Equals, hook3.Id)
+	c.Assert(hooks[2].URL, gc.Equals, "http://example.com/hook3")
+	c.Assert(hooks[2].Scope, gc.Equals, "cs:trusty/mysql")
+
+	err = s.store.RemoveWebhook(hook2.Id)
+	c.Assert(err, gc.IsNil)
+	err = s.store.RemoveWebhook(hook2.Id)
+	c.Assert(err, gc.Equals, charmstore.ErrNotFound)
+	hooks, err = s.store.Webhooks()
+	c.Assert(err, gc.IsNil)
+	c.Assert(hooks, gc.HasLen, 2)
+}
+
+func (s *StoreSuite) TestAddWebhookErrors(c *gc.C) {
+	tests := []struct {
+		url, scope, err string
+	}{
+		{"ftp://example.com", "", `invalid webhook URL "ftp://example.com": not an HTTP URL`},
+		{"/hook", "", `invalid webhook URL "/hook": not an HTTP URL`},
+		{"http://example.com", "~", `invalid webhook scope "~"`},
+		{"http://example.com", "~joe/mysql", `invalid webhook scope "~joe/mysql"`},
+		{"http://example.com", "cs:trusty/mysql-1", `invalid webhook scope "cs:trusty/mysql-1": charm URL with revision`},
+	}
+	for i, test := range tests {
+		c.Logf("test %d: %q %q", i, test.url, test.scope)
+		_, err := s.store.AddWebhook(test.url, "", test.scope)
+		c.Assert(err, gc.ErrorMatches, test.err)
+	}
+}
+
+func (s *StoreSuite) TestWebhookDelivery(c *gc.C) {
+	server, requests := startWebhookServer(c, http.StatusOK)
+	defer server.Close()
+	_, err := s.store.AddWebhook(server.URL+"/all", "secret", "")
+	c.Assert(err, gc.IsNil)
+	_, err = s.store.AddWebhook(server.URL+"/joe", "", "~joe")
+	c.Assert(err, gc.IsNil)
+	_, err = s.store.AddWebhook(server.URL+"/mysql", "", "cs:trusty/mysql")
+	c.Assert(err, gc.IsNil)
+
+	event := &charmstore.CharmEvent{
+		Kind:     charmstore.EventPublished,
+		Digest:   "some-digest",
+		Revision: 3,
+		URLs:     []*charm.URL{charm.MustParseURL("cs:trusty/wordpress")},
+		Time:     time.Unix(1e9, 0),
+	}
+	err = s.store.LogCharmEvent(event)
+	c.Assert(err, gc.IsNil)
+
+	req := receiveWebhookRequest(c, requests)
+	c.Assert(req.path, gc.Equals, "/all")
+	c.Assert(req.header.Get("Content-Type"), gc.Equals, "application/json")
+	c.Assert(req.header.Get(charmstore.WebhookEventHeader), gc.Equals, "published")
+	c.Assert(req.header.Get(charmstore.WebhookSignatureHeader), gc.Equals,
+		"sha256="+charmstore.WebhookSignature("secret", req.payload))
+	var payload map[string]interface{}
+	err = json.Unmarshal(req.payload, &payload)
+	c.Assert(err, gc.IsNil)
+	c.Assert(payload, gc.DeepEquals, map[string]interface{}{
+		"id":       event.Id.Hex(),
+		"kind":     "published",
+		"urls":     []interface{}{"cs:trusty/wordpress"},
+		"revision": float64(3),
+		"digest":   "some-digest",
+		"time":     "2001-09-09T01:46:40Z",
+	})
+
+	// Scoped webhooks are only notified about their charms.
+	err = s.store.LogCharmEvent(&charmstore.CharmEvent{
+		Kind:   charmstore.EventPublished,
+		Digest: "some-digest",
+		URLs:   []*charm.URL{charm.MustParseURL("cs:~joe/trusty/mysql")},
+	})
+	c.Assert(err, gc.IsNil)
+	paths := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		req := receiveWebhookRequest(c, requests)
+		paths[req.path] = true
+		c.Assert(req.header.Get(charmstore.WebhookSignatureHeader), gc.Equals, map[string]string{
+			"/all": "sha256=" + charmstore.WebhookSignature("secret", req.payload),
+		}[req.path])
+	}
+	c.Assert(paths, gc.DeepEquals, map[string]bool{"/all": true, "/joe": true})
+
+	err = s.store.LogCharmEvent(&charmstore.CharmEvent{
+		Kind:   charmstore.EventPublishError,
+		Digest: "some-digest",
+		URLs:   []*charm.URL{charm.MustParseURL("cs:trusty/mysql")},
+	})
+	c.Assert(err, gc.IsNil)
+	paths = map[string]bool{}
+	for i := 0; i < 2; i++ {
+		req := receiveWebhookRequest(c, requests)
+		paths[req.path] = true
+		c.Assert(req.header.Get(charmstore.WebhookEventHeader), gc.Equals, "publish-error")
+	}
+	c.Assert(paths, gc.DeepEquals, map[string]bool{"/all": true, "/mysql": true})
+
+	// Waiting for the deliveries ensures there are no unexpected ones.
+	s.store.Close()
+	s.store = nil
+	c.Assert(requests, gc.HasLen, 0)
+}
+
+func (s *StoreSuite) TestWebhookDeadLetter(c *gc.C) {
+	defer func(backoff []time.Duration) {
+		*charmstore.WebhookBackoff = backoff
+	}(*charmstore.WebhookBackoff)
+	*charmstore.WebhookBackoff = []time.Duration{time.Millisecond, time.Millisecond}
+
+	server, requests := startWebhookServer(c, http.StatusInternalServerError)
+	defer server.Close()
+	hook, err := s.store.AddWebhook(server.URL, "", "")
+	c.Assert(err, gc.IsNil)
+	event := &charmstore.CharmEvent{
+		Kind:   charmstore.EventPublished,
+		Digest: "some-digest",
+		URLs:   []*charm.URL{charm.MustParseURL("cs:trusty/wordpress")},
+	}
+	err = s.store.LogCharmEvent(event)
+	c.Assert(err, gc.IsNil)
+	receiveWebhookRequest(c, requests)
+
+	// Closing the store waits for the first attempt to complete, and
+	// leaves the notification to be retried by another process.
+	s.store.Close()
+	s.store, err = charmstore.Open(gitjujutesting.MgoServer.Addr())
+	c.Assert(err, gc.IsNil)
+	letters, err := s.store.WebhookDeadLetters()
+	c.Assert(err, gc.IsNil)
+	c.Assert(letters, gc.HasLen, 0)
+
+	for i := 0; i < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+		delivered, err := s.store.DeliverWebhooks()
+		c.Assert(err, gc.IsNil)
+		c.Assert(delivered, gc.Equals, 0)
+		receiveWebhookRequest(c, requests)
+	}
+	delivered, err := s.store.DeliverWebhooks()
+	c.Assert(err, gc.IsNil)
+	c.Assert(delivered, gc.Equals, 0)
+	c.Assert(requests, gc.HasLen, 0)
+	letters, err = s.store.WebhookDeadLetters()
+	c.Assert(err, gc.IsNil)
+	c.Assert(letters, gc.HasLen, 1)
+	c.Assert(letters[0].HookId, gc.Equals, hook.Id)
+	c.Assert(letters[0].URL, gc.Equals, server.URL)
+	c.Assert(letters[0].Kind, gc.Equals, "published")
+	c.Assert(letters[0].Attempts, gc.Equals, 3)
+	c.Assert(letters[0].Error, gc.Equals, `webhook returned status "500 Internal Server Error"`)
+	var payload map[string]interface{}
+	err = json.Unmarshal([]byte(letters[0].Payload), &payload)
+	c.Assert(err, gc.IsNil)
+	c.Assert(payload["id"], gc.Equals, event.Id.Hex())
+}
+
+func (s *StoreSuite) TestDeliverWebhooks(c *gc.C) {
+	defer func(backoff []time.Duration) {
+		*charmstore.WebhookBackoff = backoff
+	}(*charmstore.WebhookBackoff)
+	*charmstore.WebhookBackoff = []time.Duration{time.Millisecond}
+
+	// The webhook fails to handle the first notification only.
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests++; requests == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+	_, err := s.store.AddWebhook(server.URL, "", "")
+	c.Assert(err, gc.IsNil)
+	err = s.store.LogCharmEvent(&charmstore.CharmEvent{
+		Kind:   charmstore.EventPublished,
+		Digest: "some-digest",
+		URLs:   []*charm.URL{charm.MustParseURL("cs:trusty/wordpress")},
+	})
+	c.Assert(err, gc.IsNil)
+	s.store.Close()
+	c.Assert(requests, gc.Equals, 1)
+
+	s.store, err = charmstore.Open(gitjujutesting.MgoServer.Addr())
+	c.Assert(err, gc.IsNil)
+	time.Sleep(10 * time.Millisecond)
+	delivered, err := s.store.DeliverWebhooks()
+	c.Assert(err, gc.IsNil)
+	c.Assert(delivered, gc.Equals, 1)
+	c.Assert(requests, gc.Equals, 2)
+
+	// Delivered notifications are not sent again.
+	delivered, err = s.store.DeliverWebhooks()
+	c.Assert(err, gc.IsNil)
+	c.Assert(delivered, gc.Equals, 0)
+	c.Assert(requests, gc.Equals, 2)
+	letters, err := s.store.WebhookDeadLetters()
+	c.Assert(err, gc.IsNil)
+	c.Assert(letters, gc.HasLen, 0)
+}
+
+func (s *StoreSuite) TestTestWebhook(c *gc.C) {
+	server, requests := startWebhookServer(c, http.StatusOK)
+	defer server.Close()
+	hook, err := s.store.AddWebhook(server.URL, "secret", "~joe")
+	c.Assert(err, gc.IsNil)
+
+	err = s.store.TestWebhook(hook.Id)
+	c.Assert(err, gc.IsNil)
+	c.Assert(requests, gc.HasLen, 1)
+	req := <-requests
+	c.Assert(req.header.Get(charmstore.WebhookEventHeader), gc.Equals, "test")
+	c.Assert(req.header.Get(charmstore.WebhookSignatureHeader), gc.Equals,
+		"sha256="+charmstore.WebhookSignature("secret", req.payload))
+
+	err = s.store.RemoveWebhook(hook.Id)
+	c.Assert(err, gc.IsNil)
+	err = s.store.TestWebhook(hook.Id)
+	c.Assert(err, gc.Equals, charmstore.ErrNotFound)
+}
+
+func (s *TrivialSuite) TestWebhookSignature(c *gc.C) {
+	// Signature computed with: echo -n payload | openssl dgst -sha256 -hmac secret
+	c.Assert(charmstore.WebhookSignature("secret", []byte("payload")), gc.Equals,
+		"b82fcb791acec57859b989b430a826488ce2e479fdf92326bd0a2e8375a42ba4")
+}